@@ -9,19 +9,36 @@ import (
 	"ebooker/logging"
 	"ebooker/oauth1"
 
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/rpc"
+	"os"
 	"strings"
+	"time"
 )
 
+const API_KEY_ENV = "EBOOKER_API_KEY"
+
 func main() {
 
-	var port, userlist, sched, token, botName, keyFile string
+	var host, port, apiKey, userlist, sched, token, botName, account, keyFile string
+	var format, since, until, outFile string
+	var mastodon, visibility, contentWarning string
+	var webhook, webhookTemplate, signatureHeader string
+	var webhookHeaders headerList
 	var numTweets, prefixLen int
-	var reps, generate, newBot, cancel, del, list bool
+	var reps, generate, newBot, cancel, del, list, pause, resume, setSched, getSched, refreshStatus bool
+	var exportTweets, exportPosts, ping bool
+	flag.StringVar(&host, "host", "127.0.0.1", "Address of the server.")
 	flag.StringVar(&port, "port", "8998", "Port to server location.")
+	flag.StringVar(&apiKey, "apikey", os.Getenv(API_KEY_ENV), "API key the server gave you (with -newkey). "+API_KEY_ENV+" sets the default.")
 	flag.StringVar(&userlist, "users", "SrPablo,__MICHAELJ0RDAN", "Comma-seperated list of users to read from (no spaces)")
 	flag.IntVar(&numTweets, "numTweets", 15, "Number of tweets to generate.")
 	flag.IntVar(&prefixLen, "prefixLen", 2, "Length of generation prefix. Smaller = more random, Larger = more accurate.")
@@ -29,21 +46,54 @@ func main() {
 
 	flag.BoolVar(&generate, "generate", true, "Generate tweets and print them to stdout. Overrides \"newbot\".")
 	flag.BoolVar(&newBot, "newBot", false, "Creates a new bot to run on the server. Must set \"generate\" to false.")
-	flag.StringVar(&botName, "botName", "SrPablo_ebooks", "The name for your new bot.")
-	flag.StringVar(&sched, "sched", "0 11,19 * * *", "cron-formatted string for how often the new bot will tweet. NOT IMPLEMENTED.")
-	flag.StringVar(&token, "token", "", "Comma-separated pair of token & token secret. If not provided, we require you to complete a Twitter PIN-based authentication")
+	flag.StringVar(&botName, "botName", "SrPablo_ebooks", "The name for your new bot. Must be unique on the server.")
+	flag.StringVar(&account, "account", "", "The Twitter account your new bot tweets as. Defaults to botName.")
+	flag.StringVar(&sched, "sched", "0 11,19 * * *", "cron-formatted string for how often the new bot will tweet.")
+	flag.StringVar(&token, "token", "", "Comma-separated pair of token & token secret (or, for Mastodon and webhooks, just the access token or secret). If not provided, we require you to complete a Twitter PIN-based authentication")
+	flag.StringVar(&mastodon, "mastodon", "", "URL of the Mastodon instance the new bot posts to, instead of Twitter. Requires token.")
+	flag.StringVar(&visibility, "visibility", "public", "Visibility of the new Mastodon bot's posts: public, unlisted, private or direct.")
+	flag.StringVar(&contentWarning, "cw", "", "Content warning for the new Mastodon bot's posts.")
+	flag.StringVar(&webhook, "webhook", "", "URL the new bot POSTs its posts to as JSON, instead of tweeting. Requires token, the secret posts are signed with.")
+	flag.StringVar(&webhookTemplate, "template", "slack", "Body of the new webhook bot's posts: slack, discord, or a Go template given .Text and .Time.")
+	flag.Var(&webhookHeaders, "header", "\"Name: value\" header for the new webhook bot to send. May be repeated.")
+	flag.StringVar(&signatureHeader, "signatureHeader", "X-Ebooker-Signature", "Header the new webhook bot sends its posts' HMAC-SHA256 signature in.")
 	flag.StringVar(&keyFile, "keyfile", "keys.txt", "File containing the application keys assigned to you by Twitter.")
 
 	flag.BoolVar(&cancel, "cancelBot", false, "Must be used with botName -- sets the named bot to no longer tweet.")
 	flag.BoolVar(&del, "deleteBot", false, "Must be used with botName -- removes the bot entirely from the server.")
+	flag.BoolVar(&pause, "pauseBot", false, "Must be used with botName -- the named bot skips its tweets until resumed.")
+	flag.BoolVar(&resume, "resumeBot", false, "Must be used with botName -- sets a paused or cancelled bot tweeting again.")
+	flag.BoolVar(&setSched, "setSchedule", false, "Must be used with botName and sched -- changes when the named bot tweets.")
+	flag.BoolVar(&getSched, "getSchedule", false, "Must be used with botName -- prints when the named bot tweets, and whether it's running.")
+	flag.BoolVar(&ping, "ping", false, "Checks the server is up (and takes the API key), printing \"ok\" if it is.")
 	flag.BoolVar(&list, "listBots", false, "Prints a list of all the bots on this server")
+	flag.BoolVar(&refreshStatus, "refreshStatus", false, "Prints when the server last checked each bot source for new tweets.")
+	flag.BoolVar(&exportTweets, "exportTweets", false, "Must be used with users -- exports the tweets the server has stored for them.")
+	flag.BoolVar(&exportPosts, "exportPosts", false, "Must be used with botName -- exports what the named bot has posted.")
+	flag.StringVar(&format, "format", "jsonl", "Format to export in: jsonl or csv.")
+	flag.StringVar(&since, "since", "", "Only export what was tweeted on or after this date (2006-01-02, or RFC 3339).")
+	flag.StringVar(&until, "until", "", "Only export what was tweeted before this date (2006-01-02, or RFC 3339).")
+	flag.StringVar(&outFile, "out", "", "File to export to. Defaults to stdout.")
 	flag.Parse()
 
-	client, err := rpc.DialHTTP("tcp", "127.0.0.1:"+port)
-	defer client.Close()
+	client, err := dialEbooker(net.JoinHostPort(host, port), apiKey)
 	if err != nil {
 		log.Fatal("dialing:", err)
 	}
+	defer client.Close()
+
+	if ping {
+		var pong string
+		if err := client.Call("Ebooker.Ping", "", &pong); err != nil {
+			log.Fatal("ping error:", err)
+		}
+		fmt.Println(pong)
+		return
+	}
+
+	if account == "" {
+		account = botName
+	}
 
 	var authArgs defs.AuthParams
 	if token == "" {
@@ -52,11 +102,11 @@ func main() {
 		oauth := oauth1.CreateOAuth1(&lm, applicationKey, applicationSecret)
 		requestToken := oauth.ObtainRequestToken()
 		tokenObj := oauth.ObtainAccessToken(requestToken)
-		lm.StatusWrite("Your access token is %v\n", tokenObj)
-		authArgs = defs.AuthParams{botName, tokenObj.OAuthToken, tokenObj.OAuthTokenSecret}
+		fmt.Printf("Your access token is %s,%s\n", tokenObj.OAuthToken, tokenObj.OAuthTokenSecret)
+		authArgs = defs.AuthParams{account, tokenObj.OAuthToken, tokenObj.OAuthTokenSecret}
 	} else {
-		components := strings.Split(token, ",")
-		authArgs = defs.AuthParams{botName, components[0], components[1]}
+		components := strings.SplitN(token+",", ",", 3)
+		authArgs = defs.AuthParams{account, components[0], components[1]}
 	}
 
 	genArgs := defs.GenParams{strings.Split(userlist, ","), numTweets, reps, prefixLen, authArgs}
@@ -75,7 +125,15 @@ func main() {
 		var resp string
 		schedArgs := defs.Schedule{sched}
 
-		args := defs.NewBotParams{genArgs, authArgs, schedArgs}
+		var publishArgs defs.PublisherParams
+		if mastodon != "" {
+			publishArgs = defs.PublisherParams{"mastodon", mastodon, visibility, contentWarning, defs.WebhookParams{}}
+		} else if webhook != "" {
+			publishArgs = defs.PublisherParams{"webhook", "", "", "",
+				defs.WebhookParams{webhook, webhookTemplate, webhookHeaders, signatureHeader}}
+		}
+
+		args := defs.NewBotParams{botName, genArgs, authArgs, schedArgs, publishArgs}
 		err = client.Call("Ebooker.NewBot", &args, &resp)
 		if err != nil {
 			log.Fatal("new bot error:", err)
@@ -102,14 +160,119 @@ func main() {
 			log.Fatal("deleteBot error:", err)
 		}
 		fmt.Println(msg)
+	} else if !generate && pause {
+		var msg string
+		err := client.Call("Ebooker.PauseBot", botName, &msg)
+		if err != nil {
+			log.Fatal("pauseBot error:", err)
+		}
+		fmt.Println(msg)
+	} else if !generate && resume {
+		var msg string
+		err := client.Call("Ebooker.ResumeBot", botName, &msg)
+		if err != nil {
+			log.Fatal("resumeBot error:", err)
+		}
+		fmt.Println(msg)
+	} else if !generate && setSched {
+		var msg string
+		err := client.Call("Ebooker.SetBotSchedule", &defs.BotSchedule{botName, defs.Schedule{sched}}, &msg)
+		if err != nil {
+			log.Fatal("setSchedule error:", err)
+		}
+		fmt.Println(msg)
+	} else if !generate && getSched {
+		var status defs.BotStatus
+		err := client.Call("Ebooker.GetBotSchedule", botName, &status)
+		if err != nil {
+			log.Fatal("getSchedule error:", err)
+		}
+		fmt.Printf("%s is %s, tweeting on \"%s\".\n", status.Name, status.State, status.Cron)
+		if !status.Next.IsZero() {
+			fmt.Printf("Next tweet at %v\n", status.Next)
+		}
+	} else if !generate && refreshStatus {
+		var sources []defs.SourceStatus
+		err := client.Call("Ebooker.RefreshStatus", "", &sources)
+		if err != nil {
+			log.Fatal("refreshStatus error:", err)
+		}
+		for _, source := range sources {
+			fmt.Printf("%s: %d tweets, %d new at %v, used by %d models\n", source.User, source.Total,
+				source.LastFetched, source.LastRefresh, source.Models)
+		}
+	} else if !generate && (exportTweets || exportPosts) {
+		args := defs.ExportParams{Format: format, Since: parseDate(since), Until: parseDate(until)}
+		if exportPosts {
+			args.Bot = botName
+		} else {
+			args.Sources = strings.Split(userlist, ",")
+		}
+		var exported string
+		err := client.Call("Ebooker.Export", &args, &exported)
+		if err != nil {
+			log.Fatal("export error:", err)
+		}
+		if outFile == "" {
+			fmt.Print(exported)
+		} else if err := ioutil.WriteFile(outFile, []byte(exported), 0644); err != nil {
+			log.Fatal("export error:", err)
+		}
+	}
+}
+
+// Connects to the server's net/rpc like rpc.DialHTTP, but with our API key.
+func dialEbooker(address, apiKey string) (*rpc.Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\r\nAuthorization: Bearer "+apiKey+"\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		err = errors.New(resp.Status + ": " + strings.TrimSpace(string(message)))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Dates for -since and -until, either just the day or a full RFC 3339 time.
+func parseDate(date string) time.Time {
+	if date == "" {
+		return time.Time{}
 	}
+	parsed, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		parsed, err = time.Parse(time.RFC3339, date)
+	}
+	if err != nil {
+		log.Fatal("bad date \"" + date + "\": use 2006-01-02, or RFC 3339.")
+	}
+	return parsed
+}
+
+// Collects each -header given.
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(header string) error {
+	*h = append(*h, header)
+	return nil
 }
 
 func newBot(genParams *defs.GenParams, client *rpc.Client) {
 	sched := defs.Schedule{"30 12,18 * * *"}
 	auth := defs.AuthParams{"SrPablo_ebooks", "", ""}
 
-	args := defs.NewBotParams{*genParams, auth, sched}
+	args := defs.NewBotParams{"", *genParams, auth, sched, defs.PublisherParams{}}
 	var resp string
 	client.Call("Ebooker.NewBot", &args, &resp)
 
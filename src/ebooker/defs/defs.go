@@ -1,34 +1,93 @@
 /*
-Shared definitions that facilitate RPC with the server and any client.
+Shared definitions that facilitate RPC with the server and any client. The
+JSON names are the REST API's.
 */
 package defs
 
+import "time"
+
 type Tweets []string
 
 // Parameters needed to Generate Tweets.
 type GenParams struct {
-	Users     []string // The Twitter users whose Timeline will form our corpus.
-	NumTweets int      // The number of tweets to generate.
-	Reps      bool     // Whether all variations of text (e.g. "ITS/it's/It's") are treated as equivalent
-	PrefixLen int      // Length of generation prefix. Smaller = more random, Larger = more accurate.
-	Auth AuthParams    // Twitter 1.1 API requires user_timeline be Authorized ;_;
+	Users     []string   `json:"users"`     // The Twitter users (or "mastodon:@user@instance" accounts, "feed:URL" feeds, or "file:name" imports) whose posts form our corpus.
+	NumTweets int        `json:"numTweets"` // The number of tweets to generate.
+	Reps      bool       `json:"reps"`      // Whether all variations of text (e.g. "ITS/it's/It's") are treated as equivalent
+	PrefixLen int        `json:"prefixLen"` // Length of generation prefix. Smaller = more random, Larger = more accurate.
+	Auth      AuthParams `json:"auth"`      // Twitter 1.1 API requires user_timeline be Authorized ;_;
 }
 
 // Parameters needed to get a new bot up and running.
 type NewBotParams struct {
-	Gen   GenParams  // Gen parameters so we know what styles of tweets to generate.
-	Auth  AuthParams // Auth parameters so we have tweeting privileges.
-	Sched Schedule   // How often the bot should tweet.
+	Name    string          `json:"name"`    // The bot's name, unique on the server. Defaults to Auth.User.
+	Gen     GenParams       `json:"gen"`     // Gen parameters so we know what styles of tweets to generate.
+	Auth    AuthParams      `json:"auth"`    // Auth parameters so we have tweeting privileges.
+	Sched   Schedule        `json:"sched"`   // How often the bot should tweet.
+	Publish PublisherParams `json:"publish"` // Where it posts; Twitter, unless told otherwise.
+}
+
+// Where a bot posts, if not Twitter. For Mastodon, the bot's Auth.Token is
+// its access token, and Auth.User any name for the account ("@bot@instance"
+// is a good one) we can keep that token under. Webhooks are the same, with
+// the secret their posts are signed with as the token.
+type PublisherParams struct {
+	Kind           string        `json:"kind"`           // "twitter" (the default), "mastodon" or "webhook".
+	Instance       string        `json:"instance"`       // The Mastodon instance's URL, e.g. https://mastodon.social
+	Visibility     string        `json:"visibility"`     // public (the default), unlisted, private or direct.
+	ContentWarning string        `json:"contentWarning"` // Shown in place of each post until it's opened.
+	Webhook        WebhookParams `json:"webhook"`        // Where and how webhook bots post.
+}
+
+// How a webhook bot posts: a JSON body made from Template, POSTed to URL.
+type WebhookParams struct {
+	URL             string   `json:"url"`             // Where to POST.
+	Template        string   `json:"template"`        // "slack" (the default) or "discord", or a text/template of the body, given .Text and .Time.
+	Headers         []string `json:"headers"`         // Extra headers, as "Name: value".
+	SignatureHeader string   `json:"signatureHeader"` // Carries the body's HMAC-SHA256, as sha256=hex. Defaults to X-Ebooker-Signature.
 }
 
 // Parameters needed to Authenticate.
 type AuthParams struct {
-	User        string // The Username who is represented by this token.
-	Token       string // Their publicly-known token value
-	TokenSecret string // Their privately-held token secret
+	User        string `json:"user"`        // The Username who is represented by this token.
+	Token       string `json:"token"`       // Their publicly-known token value
+	TokenSecret string `json:"tokenSecret"` // Their privately-held token secret
 }
 
 // Parameters needed to Schedule Tweeting.
 type Schedule struct {
-	Cron string // schedule as a set of cron-formatted strings
+	Cron string `json:"cron"` // schedule as a set of cron-formatted strings
+}
+
+// A bot's schedule and what it's up to, as reported by GetBotSchedule.
+type BotStatus struct {
+	Name    string    `json:"name"`
+	State   string    `json:"state"`   // "running", "paused" or "stopped"
+	Cron    string    `json:"cron"`    // the bot's schedule
+	Next    time.Time `json:"next"`    // when it'll next tweet; zero unless it's running
+	Sources []string  `json:"sources"` // what it learns from
+}
+
+// Parameters needed to change a bot's schedule.
+type BotSchedule struct {
+	Name  string   `json:"name"`  // The bot to reschedule.
+	Sched Schedule `json:"sched"` // Its new schedule.
+}
+
+// How the server's keeping up with a source, as reported by RefreshStatus.
+type SourceStatus struct {
+	User        string    `json:"user"`        // The source (a Twitter user, usually) whose tweets these are.
+	LastRefresh time.Time `json:"lastRefresh"` // When we last looked for new tweets.
+	LastFetched int       `json:"lastFetched"` // How many new ones we found then.
+	Total       int       `json:"total"`       // How many we have altogether.
+	Models      int       `json:"models"`      // How many models learn from them; bots share models.
+}
+
+// Parameters for exporting what the server has stored: either the tweets of
+// Sources, or what Bot has posted.
+type ExportParams struct {
+	Sources []string  `json:"sources"` // Sources whose tweets to export.
+	Bot     string    `json:"bot"`     // Or, the bot whose posts to export.
+	Format  string    `json:"format"`  // "jsonl" (the default) or "csv".
+	Since   time.Time `json:"since"`   // Only what was tweeted at or after Since, unless it's zero,
+	Until   time.Time `json:"until"`   // and before Until, unless it's zero.
 }
@@ -1,64 +1,379 @@
 /*
 Functions for logging, error reporting, debugging... virtually everything that
-prints. Like the Android logger, we distinguish between Debug messages,
-Status messages, and making it easy to add any other kinds as necessary (e.g.
-Android, IIRC, has "Info" messages). Each can be turned on or off as desired.
+prints. Messages have a level (Debug, Info, Warn or Error), come from a
+component (the bots, the refresher, the RPC service...), and can carry fields:
+key-value pairs like bot=SrPablo_ebooks or source=laurelita that say what
+they're about, without having to be fished out of the text.
 
-This also allows us to abstract away the output channel. Currently we only
-write to stdout, but we could write to a file, a buffer, many at the same
-time, etc.
+Each component's level can be set on its own, so the refresher can be chatty
+while everything else only says what matters:
+
+	info,refresher=debug
+
+Messages go to as many sinks as we give the LogMaster: stdout, say, and a
+RotatingFile. Each sink writes either text, for people:
+
+	2013/06/01 11:00:00 (S) - [bots] Sending a tweet. bot=SrPablo_ebooks
+
+or JSON, one object a line, for machines:
+
+	{"time":"2013-06-01T11:00:00Z","level":"info","component":"bots","msg":"Sending a tweet.","bot":"SrPablo_ebooks"}
+
+StatusWrite and DebugWrite are what everything used before there were levels,
+and still work: they're Info and Debug, formatted like Printf. Info's tag in
+text is still (S), for Status.
+
+Anything registered with Redact (OAuth tokens, mostly) is masked before it's
+written, so credentials don't end up in anyone's terminal scrollback.
+
+The zero LogMaster writes nothing, which suits tests.
 */
 package logging
 
 import (
-	"log"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
 )
 
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// How levels are tagged in text. Info was once Status.
+var levelTags = []string{"(D)", "(S)", "(W)", "(E)"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return INFO, errors.New("No such log level \"" + name + "\". Try " + strings.Join(levelNames, ", ") + ".")
+}
+
+// How a sink encodes messages.
+type Format int
+
+const (
+	TEXT Format = iota
+	JSON
+)
+
+var formatNames = []string{"text", "json"}
+
+func ParseFormat(name string) (Format, error) {
+	for i, formatName := range formatNames {
+		if strings.EqualFold(name, formatName) {
+			return Format(i), nil
+		}
+	}
+	return TEXT, errors.New("No such log format \"" + name + "\". Try text or json.")
+}
+
+// A key-value pair a message is about.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
 // LogMaster is the struct containing all the logging methods, and contains all
 // the information we'll need to simply "Do the right thing," per its
 // configuration, when we ask to write Debug messages, Status messages, etc.
+//
+// LogMasters made from one another (by Component or With) share their sinks,
+// levels and secrets.
 type LogMaster struct {
-	logger *log.Logger
-	silent bool
-	debug  bool
+	core      *core
+	secrets   *redactor
+	component string
+	fields    []Field
 }
 
-// Creates a new LogMaster.
+// What LogMasters made from one another share.
+type core struct {
+	lock       sync.RWMutex
+	sinks      []sink
+	level      Level            // for components without one of their own
+	components map[string]Level // by component
+}
+
+type sink struct {
+	w          io.Writer
+	format     Format
+	timestamps bool // in text; JSON always has them
+}
+
+// Creates a new LogMaster, writing text to stdout (unless silent) at the Info
+// level, or Debug if debug is set.
 func GetLogMaster(silent, debug, timestamps bool) LogMaster {
-	var flags int
-	if timestamps {
-		flags = log.LstdFlags
-	} else {
-		flags = 0
+	level := INFO
+	if debug {
+		level = DEBUG
+	}
+	l := LogMaster{core: &core{level: level, components: make(map[string]Level)}, secrets: newRedactor()}
+	if !silent {
+		l.AddSink(os.Stdout, TEXT, timestamps)
 	}
+	return l
+}
 
-	return LogMaster{log.New(os.Stdout, "", flags), silent, debug}
+// Has messages written to w as well, encoded in format.
+func (l LogMaster) AddSink(w io.Writer, format Format, timestamps bool) {
+	if l.core == nil {
+		return
+	}
+	l.core.lock.Lock()
+	defer l.core.lock.Unlock()
+	l.core.sinks = append(l.core.sinks, sink{w, format, timestamps})
 }
 
-// Writes a new Status message to all the output writers we've given the
-// LogMaster.
+// Sets the levels from a spec like "info,refresher=debug,bots=warn": a level
+// for every component without its own (Info, if it's left out), then
+// components' own.
+func (l LogMaster) SetLevels(spec string) error {
+	if l.core == nil {
+		return nil
+	}
+	level := INFO
+	components := make(map[string]Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, levelName, found := strings.Cut(part, "=")
+		if !found {
+			levelName = component
+		}
+		parsed, err := ParseLevel(strings.TrimSpace(levelName))
+		if err != nil {
+			return err
+		}
+		if found {
+			components[strings.TrimSpace(component)] = parsed
+		} else {
+			level = parsed
+		}
+	}
+
+	l.core.lock.Lock()
+	defer l.core.lock.Unlock()
+	l.core.level = level
+	l.core.components = components
+	return nil
+}
+
+// A LogMaster for the named part of the program, whose level can be set on
+// its own.
+func (l LogMaster) Component(name string) *LogMaster {
+	l.component = name
+	return &l
+}
+
+// A LogMaster that adds the fields to everything it writes.
+func (l LogMaster) With(fields ...Field) *LogMaster {
+	l.fields = append(append([]Field(nil), l.fields...), fields...)
+	return &l
+}
+
+// Whether messages at level would be written.
+func (l LogMaster) Enabled(level Level) bool {
+	if l.core == nil {
+		return false
+	}
+	l.core.lock.RLock()
+	defer l.core.lock.RUnlock()
+	if len(l.core.sinks) == 0 {
+		return false
+	}
+	threshold, exists := l.core.components[l.component]
+	if !exists {
+		threshold = l.core.level
+	}
+	return level >= threshold
+}
+
+// Registers values that must never appear in output, such as access tokens.
+// Only register what the server holds, not whatever clients send: each one
+// costs every line logged. Values under MIN_SECRET_LEN are ignored.
+func (l LogMaster) Redact(secrets ...string) {
+	if l.secrets != nil {
+		l.secrets.add(secrets...)
+	}
+}
+
+// Stops masking values registered with Redact, once we no longer hold them.
+func (l LogMaster) Forget(secrets ...string) {
+	if l.secrets != nil {
+		l.secrets.remove(secrets...)
+	}
+}
+
+func (l LogMaster) Debug(message string, fields ...Field) {
+	l.write(DEBUG, message, fields)
+}
+
+func (l LogMaster) Info(message string, fields ...Field) {
+	l.write(INFO, message, fields)
+}
+
+func (l LogMaster) Warn(message string, fields ...Field) {
+	l.write(WARN, message, fields)
+}
+
+func (l LogMaster) Error(message string, fields ...Field) {
+	l.write(ERROR, message, fields)
+}
+
+// Writes a new Status (Info) message to all the output writers we've given
+// the LogMaster.
 func (l LogMaster) StatusWrite(format string, a ...interface{}) {
-	l.writeToAll(addTag("(S)", format), a...)
+	if l.Enabled(INFO) {
+		l.write(INFO, fmt.Sprintf(format, a...), nil)
+	}
 }
 
 // Writes a new Debug message to all the output writers we've given the
 // LogMaster.
 func (l LogMaster) DebugWrite(format string, a ...interface{}) {
-	if l.debug {
-		l.writeToAll(addTag("(D)", format), a...)
+	if l.Enabled(DEBUG) {
+		l.write(DEBUG, fmt.Sprintf(format, a...), nil)
 	}
 }
 
 // Writes the message to all the output Writers we've given the LogMaster.
-func (l LogMaster) writeToAll(format string, a ...interface{}) {
-	if !l.silent {
-		l.logger.Printf(format, a...)
+func (l LogMaster) write(level Level, message string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	now := time.Now()
+	message = l.secrets.scrub(strings.TrimRight(message, "\r\n"))
+	all := append(append([]Field(nil), l.fields...), fields...)
+	for i, field := range all {
+		all[i].Value = l.scrubValue(field.Value)
 	}
+
+	// One message at a time, so lines don't get mixed up.
+	l.core.lock.Lock()
+	defer l.core.lock.Unlock()
+	for _, s := range l.core.sinks {
+		var line []byte
+		if s.format == JSON {
+			line = encodeJSON(now, level, l.component, message, all)
+		} else {
+			line = encodeText(now, s.timestamps, level, l.component, message, all)
+		}
+		s.w.Write(line)
+	}
+}
+
+// Strings (and errors, and anything else that prints) get the same
+// treatment as messages; numbers and the like can't hold secrets.
+func (l LogMaster) scrubValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, int, int64, uint64, float64, time.Duration, time.Time:
+		return v
+	case string:
+		return l.secrets.scrub(v)
+	case error:
+		return l.secrets.scrub(v.Error())
+	}
+	return l.secrets.scrub(fmt.Sprint(value))
+}
+
+// 2013/06/01 11:00:00 (S) - [bots] Sending a tweet. bot=SrPablo_ebooks
+func encodeText(now time.Time, timestamps bool, level Level, component, message string, fields []Field) []byte {
+	var buf bytes.Buffer
+	if timestamps {
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	}
+	buf.WriteString(levelTags[level] + " - ")
+	if component != "" {
+		buf.WriteString("[" + component + "] ")
+	}
+	buf.WriteString(message)
+	for _, field := range fields {
+		buf.WriteString(" " + field.Key + "=" + textValue(field.Value))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
 }
 
-// Helper function to allow messages to "tag" themselves by type.
-func addTag(tag, format string) string {
-	return strings.Join([]string{tag, format}, " - ")
+// Values are quoted if they'd otherwise be hard to tell apart from the rest
+// of the line.
+func textValue(value interface{}) string {
+	text := fmt.Sprint(value)
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return strconv.Quote(text)
+	}
+	return text
+}
+
+// {"time":"2013-06-01T11:00:00Z","level":"info","component":"bots","msg":"Sending a tweet.","bot":"SrPablo_ebooks"}
+//
+// Fields come after the standard keys, in the order they were given; a field
+// sharing a standard key's name gets a "field." in front of it.
+func encodeJSON(now time.Time, level Level, component, message string, fields []Field) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, now.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	if component != "" {
+		buf.WriteString(`,"component":`)
+		writeJSON(&buf, component)
+	}
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, message)
+	for _, field := range fields {
+		key := field.Key
+		if isStandardKey(key) {
+			key = "field." + key
+		}
+		buf.WriteByte(',')
+		writeJSON(&buf, key)
+		buf.WriteByte(':')
+		if duration, isDuration := field.Value.(time.Duration); isDuration {
+			writeJSON(&buf, duration.Seconds())
+		} else {
+			writeJSON(&buf, field.Value)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+var standardKeys = []string{"component", "level", "msg", "time"} // sorted
+
+func isStandardKey(key string) bool {
+	i := sort.SearchStrings(standardKeys, key)
+	return i < len(standardKeys) && standardKeys[i] == key
+}
+
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
 }
@@ -0,0 +1,123 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type LoggerSuite struct{}
+
+var _ = gocheck.Suite(&LoggerSuite{})
+
+func (s LoggerSuite) TestLevels(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := GetLogMaster(true, false, false)
+	l.AddSink(&buf, TEXT, false)
+
+	l.Debug("Not written.")
+	l.DebugWrite("Nor %s.\n", "this")
+	l.Info("Written.")
+	l.StatusWrite("So is %s.\n", "this")
+	l.Warn("Careful.")
+	l.Error("Oops.")
+	c.Assert(buf.String(), gocheck.Equals, "(S) - Written.\n(S) - So is this.\n(W) - Careful.\n(E) - Oops.\n")
+
+	level, err := ParseLevel("WARN")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(level, gocheck.Equals, WARN)
+	_, err = ParseLevel("loud")
+	c.Assert(err, gocheck.ErrorMatches, "No such log level \"loud\".*")
+}
+
+func (s LoggerSuite) TestComponentLevels(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := GetLogMaster(true, false, false)
+	l.AddSink(&buf, TEXT, false)
+	c.Assert(l.SetLevels("warn, refresher=debug"), gocheck.IsNil)
+
+	bots := l.Component("bots")
+	refresher := l.Component("refresher")
+	bots.Info("Not written.")
+	bots.Warn("Written.")
+	refresher.Debug("Chatty.")
+	l.Info("Not written either.")
+	c.Assert(buf.String(), gocheck.Equals, "(W) - [bots] Written.\n(D) - [refresher] Chatty.\n")
+
+	// Leaving the default level out means Info.
+	buf.Reset()
+	c.Assert(l.SetLevels("bots=error"), gocheck.IsNil)
+	bots.Warn("Not written.")
+	l.Info("Written.")
+	c.Assert(buf.String(), gocheck.Equals, "(S) - Written.\n")
+
+	c.Assert(l.SetLevels("info,bots=shouty"), gocheck.NotNil)
+	c.Assert(l.Enabled(INFO), gocheck.Equals, true)
+}
+
+func (s LoggerSuite) TestTextFields(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := GetLogMaster(true, false, false)
+	l.AddSink(&buf, TEXT, false)
+
+	bot := l.Component("bots").With(Field{"bot", "SrPablo_ebooks"})
+	bot.Info("Sending a tweet.", Field{"text", "hello world"}, Field{"after", time.Hour})
+	bot.Error("Couldn't post.", Field{"error", errors.New("over capacity")}, Field{"empty", ""})
+	// With doesn't change the LogMaster it's called on.
+	l.Info("Plain.")
+	c.Assert(buf.String(), gocheck.Equals, "(S) - [bots] Sending a tweet. bot=SrPablo_ebooks text=\"hello world\" after=1h0m0s\n"+
+		"(E) - [bots] Couldn't post. bot=SrPablo_ebooks error=\"over capacity\" empty=\"\"\n"+
+		"(S) - Plain.\n")
+}
+
+func (s LoggerSuite) TestJSON(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := GetLogMaster(true, false, false)
+	l.AddSink(&buf, JSON, false)
+	l.Redact("LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE")
+
+	l.Component("rpc").With(Field{"method", "NewBot"}).Info("Call failed.\n", Field{"duration", 1500 * time.Millisecond},
+		Field{"error", errors.New("bad token LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE")}, Field{"msg", "shadowed"}, Field{"count", 3})
+	l.Debug("Not written.")
+
+	line := buf.String()
+	c.Assert(strings.Count(line, "\n"), gocheck.Equals, 1)
+	c.Assert(line, gocheck.Matches, `\{"time":"[^"]+","level":"info","component":"rpc","msg":"Call failed.","method":"NewBot",.*\n`)
+	var decoded map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(line), &decoded), gocheck.IsNil)
+	when, err := time.Parse(time.RFC3339Nano, decoded["time"].(string))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(time.Since(when) < time.Minute, gocheck.Equals, true)
+	c.Assert(decoded["duration"], gocheck.Equals, 1.5)
+	c.Assert(decoded["error"], gocheck.Equals, "bad token [REDACTED]")
+	c.Assert(decoded["msg"], gocheck.Equals, "Call failed.")
+	c.Assert(decoded["field.msg"], gocheck.Equals, "shadowed")
+	c.Assert(decoded["count"], gocheck.Equals, float64(3))
+
+	format, err := ParseFormat("JSON")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(format, gocheck.Equals, JSON)
+	_, err = ParseFormat("xml")
+	c.Assert(err, gocheck.NotNil)
+}
+
+// Every sink gets every message, in its own format.
+func (s LoggerSuite) TestSinks(c *gocheck.C) {
+	var text, encoded bytes.Buffer
+	l := GetLogMaster(true, false, true)
+	l.AddSink(&text, TEXT, true)
+	l.AddSink(&encoded, JSON, false)
+	l.Warn("Both.")
+	c.Assert(text.String(), gocheck.Matches, `\d{4}/\d\d/\d\d \d\d:\d\d:\d\d \(W\) - Both.\n`)
+	c.Assert(encoded.String(), gocheck.Matches, `\{"time":"[^"]+","level":"warn","msg":"Both."\}\n`)
+
+	// The zero LogMaster goes nowhere, quietly.
+	var quiet LogMaster
+	quiet.AddSink(&text, TEXT, false)
+	quiet.Error("Nobody hears this.")
+	c.Assert(quiet.Component("bots").Enabled(ERROR), gocheck.Equals, false)
+	c.Assert(strings.Contains(text.String(), "Nobody"), gocheck.Equals, false)
+}
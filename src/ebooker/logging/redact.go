@@ -0,0 +1,87 @@
+package logging
+
+/*
+Keeps credentials out of the logs. The secrets the server holds are registered
+with a LogMaster as they're loaded or stored, and forgotten once nothing uses
+them; anything that looks like an OAuth parameter in a header or form body is
+masked regardless.
+*/
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const REDACTED = "[REDACTED]"
+
+// Anything shorter isn't a credential, and masking it would garble the logs.
+const MIN_SECRET_LEN = 8
+
+var oauthParamPattern = regexp.MustCompile("(oauth_(?:token|token_secret|signature|verifier)=\"?)[^\"&,\\s]+")
+
+type redactor struct {
+	lock    sync.RWMutex
+	secrets map[string]bool
+	ordered []string // the secrets, longest first, so no secret's left half-masked
+}
+
+func newRedactor() *redactor {
+	return &redactor{secrets: make(map[string]bool)}
+}
+
+func (r *redactor) add(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= MIN_SECRET_LEN {
+			r.secrets[secret] = true
+		}
+	}
+	r.order()
+}
+
+func (r *redactor) remove(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, secret := range secrets {
+		delete(r.secrets, secret)
+	}
+	r.order()
+}
+
+// Lists the secrets longest first. The lock must be held.
+func (r *redactor) order() {
+	r.ordered = r.ordered[:0]
+	for secret := range r.secrets {
+		r.ordered = append(r.ordered, secret)
+	}
+	sort.Sort(byLength(r.ordered))
+}
+
+// Masks every registered secret in the message, and any OAuth parameters.
+func (r *redactor) scrub(message string) string {
+	message = oauthParamPattern.ReplaceAllString(message, "${1}"+REDACTED)
+	if r == nil {
+		return message
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, secret := range r.ordered {
+		message = strings.Replace(message, secret, REDACTED, -1)
+	}
+	return message
+}
+
+type byLength []string
+
+func (s byLength) Len() int      { return len(s) }
+func (s byLength) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool {
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"launchpad.net/gocheck"
+	"strings"
+	"testing"
+)
+
+// hook up gocheck into the gotest runner.
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
+type RedactSuite struct{}
+
+var _ = gocheck.Suite(&RedactSuite{})
+
+func makeBufferedLogMaster(buf *bytes.Buffer) LogMaster {
+	l := GetLogMaster(true, true, false)
+	l.AddSink(buf, TEXT, false)
+	return l
+}
+
+func (s RedactSuite) TestRegisteredSecrets(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := makeBufferedLogMaster(&buf)
+
+	l.Redact("LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE", "")
+	l.StatusWrite("Token secret is %s\n", "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE")
+	l.DebugWrite("%v\n", []string{"LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE", "harmless"})
+
+	out := buf.String()
+	c.Assert(strings.Contains(out, "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE"), gocheck.Equals, false)
+	c.Assert(out, gocheck.Equals, "(S) - Token secret is [REDACTED]\n(D) - [[REDACTED] harmless]\n")
+}
+
+// Even tokens we were never told about are masked when they show up as OAuth
+// parameters, e.g. in a dumped Authorization header.
+func (s RedactSuite) TestOAuthParameters(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := makeBufferedLogMaster(&buf)
+
+	l.DebugWrite("%s\n", "Authorization: OAuth oauth_consumer_key=\"xvz1evFS4wEEPTGEFPHBog\", oauth_token=\"370773112-GmHx\", oauth_signature=\"tnnArxj06cW%3D\"")
+	l.DebugWrite("oauth_token=NPcudxy0yU5T&oauth_token_secret=veNRnAWe6inF&oauth_callback_confirmed=true\n")
+
+	c.Assert(buf.String(), gocheck.Equals,
+		"(D) - Authorization: OAuth oauth_consumer_key=\"xvz1evFS4wEEPTGEFPHBog\", oauth_token=\"[REDACTED]\", oauth_signature=\"[REDACTED]\"\n"+
+			"(D) - oauth_token=[REDACTED]&oauth_token_secret=[REDACTED]&oauth_callback_confirmed=true\n")
+}
+
+// The zero LogMaster, used all over the tests, still redacts what it can.
+func (s RedactSuite) TestZeroLogMaster(c *gocheck.C) {
+	var l LogMaster
+	l.Redact("secret")
+	c.Assert(l.secrets.scrub("oauth_token=abc"), gocheck.Equals, "oauth_token=[REDACTED]")
+}
+
+// Short values aren't masked, or logging "e" would garble everything after.
+// Overlapping secrets are masked whole, and forgotten ones aren't masked.
+func (s RedactSuite) TestWhatsMasked(c *gocheck.C) {
+	var buf bytes.Buffer
+	l := makeBufferedLogMaster(&buf)
+
+	l.Redact("e", "secret", "abcdefgh", "abcdefghijkl", "forgotten-token")
+	l.Forget("forgotten-token")
+	l.StatusWrite("The secret here is abcdefghijkl, then abcdefgh, then forgotten-token.\n")
+
+	c.Assert(buf.String(), gocheck.Equals, "(S) - The secret here is [REDACTED], then [REDACTED], then forgotten-token.\n")
+}
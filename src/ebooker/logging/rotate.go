@@ -0,0 +1,128 @@
+package logging
+
+/*
+A log file that doesn't grow forever. Once writing to it would take it past
+its size limit, it's renamed to name.1 (name.1 to name.2, and so on, the
+oldest falling off the end) and a fresh one started. If the renaming fails,
+we carry on appending to the file we had, and try again on the next write.
+*/
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int // how many old files we keep
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Opens (or creates) the file at path for appending, keeping it under
+// maxBytes and backups old ones.
+func OpenRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	if maxBytes <= 0 || backups < 0 {
+		return nil, errors.New("Log files need a size limit, and can't keep fewer than no backups.")
+	}
+	rf := &RotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// Writes p, rotating first if it won't fit. A single write bigger than the
+// limit gets a file to itself. If we couldn't rotate, p is still written, and
+// we return why not.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	var rotateErr error
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if rotateErr = rf.rotate(); rf.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// Moves the file out of the way and opens a fresh one. Whatever goes wrong,
+// we open rf.path again before returning: a fresh file if the renames worked,
+// and the one we had if they didn't. rf.file is only left nil if even that
+// fails.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	rf.file = nil
+	if err == nil {
+		err = rf.shift()
+	}
+	if openErr := rf.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Renames the file and its backups along by one, or removes it if we keep no
+// backups.
+func (rf *RotatingFile) shift() error {
+	if rf.backups == 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	for i := rf.backups - 1; i > 0; i-- {
+		err := os.Rename(rf.backup(i), rf.backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(rf.path, rf.backup(1))
+}
+
+func (rf *RotatingFile) backup(n int) string {
+	return rf.path + "." + strconv.Itoa(n)
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+type RotateSuite struct{}
+
+var _ = gocheck.Suite(&RotateSuite{})
+
+func readLog(c *gocheck.C, path string) string {
+	contents, err := ioutil.ReadFile(path)
+	c.Assert(err, gocheck.IsNil)
+	return string(contents)
+}
+
+func (s RotateSuite) TestRotation(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "ebooker.log")
+	ioutil.WriteFile(path, []byte("old\n"), 0640)
+	rf, err := OpenRotatingFile(path, 10, 2)
+	c.Assert(err, gocheck.IsNil)
+	defer rf.Close()
+
+	// Appends to what was there, until the next write won't fit.
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "a line too long for any file\n"} {
+		_, err := rf.Write([]byte(line))
+		c.Assert(err, gocheck.IsNil)
+	}
+	c.Assert(readLog(c, path), gocheck.Equals, "a line too long for any file\n")
+	c.Assert(readLog(c, path+".1"), gocheck.Equals, "four\n")
+	c.Assert(readLog(c, path+".2"), gocheck.Equals, "two\nthree\n")
+
+	// The oldest falls off the end.
+	rf.Write([]byte("five\n"))
+	c.Assert(readLog(c, path), gocheck.Equals, "five\n")
+	c.Assert(readLog(c, path+".1"), gocheck.Equals, "a line too long for any file\n")
+	c.Assert(readLog(c, path+".2"), gocheck.Equals, "four\n")
+	_, err = os.Stat(path + ".3")
+	c.Assert(os.IsNotExist(err), gocheck.Equals, true)
+
+	c.Assert(rf.Close(), gocheck.IsNil)
+	_, err = rf.Write([]byte("six\n"))
+	c.Assert(err, gocheck.NotNil)
+}
+
+// If we can't rename the file out of the way, we keep writing to it, and
+// rotate once we can.
+func (s RotateSuite) TestRotationFails(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "ebooker.log")
+	rf, err := OpenRotatingFile(path, 10, 1)
+	c.Assert(err, gocheck.IsNil)
+	defer rf.Close()
+
+	// A file can't be renamed over a directory.
+	c.Assert(os.Mkdir(path+".1", 0750), gocheck.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(path+".1", "in the way"), nil, 0640), gocheck.IsNil)
+	_, err = rf.Write([]byte("one\n"))
+	c.Assert(err, gocheck.IsNil)
+	n, err := rf.Write([]byte("two, three\n"))
+	c.Assert(err, gocheck.NotNil)
+	c.Assert(n, gocheck.Equals, 11)
+	rf.Write([]byte("four\n"))
+	c.Assert(readLog(c, path), gocheck.Equals, "one\ntwo, three\nfour\n")
+
+	c.Assert(os.RemoveAll(path+".1"), gocheck.IsNil)
+	_, err = rf.Write([]byte("five\n"))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(readLog(c, path), gocheck.Equals, "five\n")
+	c.Assert(readLog(c, path+".1"), gocheck.Equals, "one\ntwo, three\nfour\n")
+}
+
+func (s RotateSuite) TestNoBackups(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "ebooker.log")
+	rf, err := OpenRotatingFile(path, 8, 0)
+	c.Assert(err, gocheck.IsNil)
+	defer rf.Close()
+	rf.Write([]byte("first\n"))
+	rf.Write([]byte("second\n"))
+	c.Assert(readLog(c, path), gocheck.Equals, "second\n")
+	_, err = os.Stat(path + ".1")
+	c.Assert(os.IsNotExist(err), gocheck.Equals, true)
+
+	_, err = OpenRotatingFile(path, 0, 1)
+	c.Assert(err, gocheck.NotNil)
+}
+
+// Logging to a file, as the server does.
+func (s RotateSuite) TestAsSink(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "ebooker.log")
+	rf, err := OpenRotatingFile(path, 1<<20, 1)
+	c.Assert(err, gocheck.IsNil)
+	defer rf.Close()
+	l := GetLogMaster(true, false, false)
+	l.AddSink(rf, TEXT, false)
+	l.Component("bots").Info("To the file.")
+	c.Assert(readLog(c, path), gocheck.Equals, "(S) - [bots] To the file.\n")
+}
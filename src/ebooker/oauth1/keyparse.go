@@ -21,7 +21,7 @@ const (
 func ParseFromFile(filename string) (string, string) {
 	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("Non-nil error opening file: ", err)
+		fmt.Println("Non-nil error opening file: ", err)
 	}
 	reader := bufio.NewReader(file)
 
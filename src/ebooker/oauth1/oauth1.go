@@ -11,6 +11,10 @@ Twitter Developer pages:
 https://dev.twitter.com/docs/auth/authorizing-request      - Authorizing a request
 https://dev.twitter.com/docs/auth/creating-signature       - Creating a signature
 https://dev.twitter.com/docs/auth/pin-based-authorization  - PIN based auth
+
+It has since grown to cover the rest of RFC 5849 (repeated parameters, and the
+PLAINTEXT and RSA-SHA1 signature methods; see signature.go), so it works for
+OAuth1 APIs other than Twitter's too.
 */
 
 package oauth1
@@ -19,16 +23,13 @@ import (
 	"ebooker/logging"
 
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/base64"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
-	"os"
+	"net/http/httputil"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -40,15 +41,23 @@ const (
 	OAUTH_CALLBACK         = "oauth_callback"
 	OAUTH_CONSUMER_KEY     = "oauth_consumer_key"
 	OAUTH_NONCE            = "oauth_nonce"
+	OAUTH_SIGNATURE        = "oauth_signature"
 	OAUTH_SIGNATURE_METHOD = "oauth_signature_method"
 	OAUTH_TIMESTAMP        = "oauth_timestamp"
+	OAUTH_TOKEN            = "oauth_token"
 	OAUTH_VERIFIER         = "oauth_verifier"
 	OAUTH_VERSION          = "oauth_version"
+	REALM                  = "realm"
+
+	// Twitter endpoints, relative to the base URL.
+	TWITTER_BASE_URL   = "https://api.twitter.com"
+	AUTHENTICATE_PATH  = "/oauth/authenticate"
+	ACCESS_TOKEN_PATH  = "/oauth/access_token"
+	REQUEST_TOKEN_PATH = "/oauth/request_token"
 
-	// Twitter URLS
-	AUTHENTICATE_URL  = "https://api.twitter.com/oauth/authenticate"
-	ACCESS_TOKEN_URL  = "https://api.twitter.com/oauth/access_token"
-	REQUEST_TOKEN_URL = "https://api.twitter.com/oauth/request_token"
+	// How long we'll wait on Twitter by default, from connecting through
+	// reading the whole response.
+	DEFAULT_TIMEOUT = 30 * time.Second
 
 	// Other 'naked' values
 	OUT_OF_BAND = "oob"
@@ -59,6 +68,10 @@ type OAuth1 struct {
 
 	applicationKey    string
 	applicationSecret string
+
+	client  *http.Client
+	baseURL string
+	method  SignatureMethod
 }
 
 type Token struct {
@@ -66,8 +79,29 @@ type Token struct {
 	OAuthTokenSecret string
 }
 
+// Creates an OAuth1 that talks to Twitter, giving up on requests after
+// DEFAULT_TIMEOUT.
 func CreateOAuth1(l *logging.LogMaster, key, secret string) OAuth1 {
-	return OAuth1{l, key, secret}
+	return CreateOAuth1WithClient(l, key, secret, &http.Client{Timeout: DEFAULT_TIMEOUT}, TWITTER_BASE_URL)
+}
+
+// Creates an OAuth1 that sends its requests with client, to endpoints under
+// baseURL (e.g. "https://api.twitter.com", or a fake Twitter in tests).
+func CreateOAuth1WithClient(l *logging.LogMaster, key, secret string, client *http.Client, baseURL string) OAuth1 {
+	l.Redact(secret)
+	return OAuth1{l, key, secret, client, strings.TrimRight(baseURL, "/"), HMAC_SHA1}
+}
+
+// Changes how requests are signed. Twitter only takes HMAC_SHA1, the default,
+// but other OAuth1 APIs may want PLAINTEXT or RSA-SHA1.
+func (o *OAuth1) SetSignatureMethod(method SignatureMethod) {
+	o.method = method
+}
+
+// Resolves an endpoint path, e.g. "/1.1/statuses/update.json", against the
+// base URL.
+func (o OAuth1) URL(path string) string {
+	return o.baseURL + path
 }
 
 // Return a Token based on the application's credentials.
@@ -75,25 +109,40 @@ func (o OAuth1) MakeToken() *Token {
 	return &Token{o.applicationKey, o.applicationSecret}
 }
 
-// Gives us a request token to begin an OAuth exchange with Twitter.
+// Gives us a request token to begin an OAuth exchange with Twitter, for the
+// PIN-based flow.
 func (o OAuth1) ObtainRequestToken() *Token {
+	return o.ObtainRequestTokenWithCallback(OUT_OF_BAND)
+}
+
+// Gives us a request token to begin an OAuth exchange with Twitter. Once the
+// user signs in, Twitter redirects them to callback with the token and a
+// verifier appended as query parameters.
+func (o OAuth1) ObtainRequestTokenWithCallback(callback string) *Token {
 	o.logger.DebugWrite("Making a POST request for a request token...\n")
-	url := REQUEST_TOKEN_URL
+	endpoint := o.URL(REQUEST_TOKEN_PATH)
 	method := "POST"
-	urlParams := map[string]string{}
-	bodyParams := map[string]string{}
-	authParams := map[string]string{OAUTH_CALLBACK: OUT_OF_BAND}
-	req := o.CreateAuthorizedRequest(url, method, urlParams, bodyParams, authParams, nil)
+	urlParams := url.Values{}
+	bodyParams := url.Values{}
+	authParams := url.Values{OAUTH_CALLBACK: {callback}}
+	req := o.CreateAuthorizedRequest(endpoint, method, urlParams, bodyParams, authParams, nil)
 	resp := o.ExecuteRequest(req)
 
 	return o.parseTokenResponse(resp)
 }
 
-// Given a request token, we get an Access token for the user account.
+// The page where the user signs in to Twitter to authorize the request token.
+func (o OAuth1) AuthenticationURL(requestToken *Token) string {
+	tokenUrl := fmt.Sprintf("oauth_token=%s", percentEncode(requestToken.OAuthToken))
+	return strings.Join([]string{o.URL(AUTHENTICATE_PATH), tokenUrl}, "?")
+}
+
+// Given a request token, we get an Access token for the user account. This is
+// the PIN-based flow, for when there's someone at a terminal: we print the
+// sign-in URL and read the PIN Twitter gives them from stdin.
 func (o OAuth1) ObtainAccessToken(requestToken *Token) *Token {
 
-	tokenUrl := fmt.Sprintf("oauth_token=%s", requestToken.OAuthToken)
-	userFacingUrl := strings.Join([]string{AUTHENTICATE_URL, tokenUrl}, "?")
+	userFacingUrl := o.AuthenticationURL(requestToken)
 
 	fmt.Printf("Please sign in to Twitter at the following URL: %s\n", userFacingUrl)
 	fmt.Printf("After successful Sign-in, Twitter will provide you a PIN number.\n")
@@ -102,83 +151,106 @@ func (o OAuth1) ObtainAccessToken(requestToken *Token) *Token {
 	var pin int
 	fmt.Scanf("%d", &pin)
 
+	token, _ := o.ExchangeVerifier(requestToken, strconv.Itoa(pin))
+	return token
+}
+
+// Trades an authorized request token and its verifier (the PIN, or the
+// oauth_verifier Twitter hands the callback) for an access token. Also returns
+// the screen name of the account the token belongs to.
+func (o OAuth1) ExchangeVerifier(requestToken *Token, verifier string) (*Token, string) {
 	o.logger.DebugWrite("Making a POST request for an Access token...\n")
-	url := ACCESS_TOKEN_URL
+	endpoint := o.URL(ACCESS_TOKEN_PATH)
 	method := "POST"
-	urlParams := map[string]string{}
-	bodyParams := map[string]string{OAUTH_VERIFIER: strconv.Itoa(pin)}
-	authParams := map[string]string{}
-	req := o.CreateAuthorizedRequest(url, method, urlParams, bodyParams, authParams, requestToken)
+	urlParams := url.Values{}
+	bodyParams := url.Values{OAUTH_VERIFIER: {verifier}}
+	authParams := url.Values{}
+	req := o.CreateAuthorizedRequest(endpoint, method, urlParams, bodyParams, authParams, requestToken)
 	resp := o.ExecuteRequest(req)
 
-	return o.parseTokenResponse(resp)
+	paramMap := o.readTokenResponse(resp)
+	return o.tokenFromParams(paramMap), paramMap["screen_name"]
 }
 
 // Handles most of the functionality in a way that's (reasonably) easy to call.
-// Makes a POST request to the URL provided, handling the various places you can
+// Makes a request to the URL provided, handling the various places you can
 // can put parameters (in the URL, e.g. twitter.com/authorize?token_id=900981,
 // in the body e.g. status="Sup%20Son", or in the "Authorization:" part of the
-// Header).
+// Header). Any parameter may be given more than once.
 //
 // Understandable why we have it, and God bless crypto, but what a bloody mess.
-func (o OAuth1) CreateAuthorizedRequest(url, method string,
-	urlParams, bodyParams, authParams map[string]string,
+func (o OAuth1) CreateAuthorizedRequest(endpoint, method string,
+	urlParams, bodyParams, authParams url.Values,
 	token *Token) *http.Request {
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	authParamMap := map[string]string{
-		OAUTH_NONCE:            createNonce(),
-		OAUTH_CONSUMER_KEY:     o.applicationKey,
-		OAUTH_TIMESTAMP:        timestamp,
-		OAUTH_SIGNATURE_METHOD: "HMAC-SHA1",
-		OAUTH_VERSION:          "1.0"}
+	allAuthParams := url.Values{
+		OAUTH_NONCE:            {createNonce()},
+		OAUTH_CONSUMER_KEY:     {o.applicationKey},
+		OAUTH_TIMESTAMP:        {timestamp},
+		OAUTH_SIGNATURE_METHOD: {o.method.Name()},
+		OAUTH_VERSION:          {"1.0"}}
 
 	for k, v := range authParams {
-		authParamMap[k] = v
+		allAuthParams[k] = v
 	}
 
-	return o.authorizedRequestWithParams(url, method, urlParams, bodyParams, authParamMap, token)
+	return o.authorizedRequestWithParams(endpoint, method, urlParams, bodyParams, allAuthParams, token)
 }
 
 // We seperate this function from the one above for testing.
 func (o OAuth1) authorizedRequestWithParams(urlRaw, method string,
-	urlParams, bodyParams, authParams map[string]string,
+	urlParams, bodyParams, authParams url.Values,
 	token *Token) *http.Request {
 
-	urlParamString := makeParamStringFromMap(urlParams)
-	bodyString := makeParamStringFromMap(bodyParams)
-
-	urlWithParams := strings.Join([]string{urlRaw, urlParamString}, "?")
+	urlWithParams := urlRaw
+	if len(urlParams) > 0 {
+		separator := "?"
+		if strings.Contains(urlRaw, "?") {
+			separator = "&"
+		}
+		urlWithParams = urlRaw + separator + encodeParams(urlParams)
+	}
 
-	req, err := http.NewRequest(method, urlWithParams, strings.NewReader(bodyString))
+	req, err := http.NewRequest(method, urlWithParams, strings.NewReader(encodeParams(bodyParams)))
 
 	if err != nil {
 		o.logger.StatusWrite("Error creating request object for %v\n", method)
 		o.logger.DebugWrite("%v request to url: %v. Error: %v\n", method, urlRaw, err)
-		o.logger.DebugWrite("Request is:\n")
-		req.Write(os.Stdout)
 	}
 
 	if token != nil {
-		authParams["oauth_token"] = token.OAuthToken
+		authParams.Set(OAUTH_TOKEN, token.OAuthToken)
 	}
 
 	signature := o.createSignature(urlParams, bodyParams, authParams, urlRaw, method, token)
-	authParams["oauth_signature"] = signature
+	authParams.Set(OAUTH_SIGNATURE, signature)
 	o.finishHeader(req, authParams)
 
 	return req
 }
 
-func makeParamStringFromMap(mp map[string]string) string {
+// Percent-encodes parameters for a query string or form body. Keys are sorted,
+// so the same parameters always encode the same way.
+func encodeParams(params url.Values) string {
 	var total []string
-	for k, v := range mp {
-		param := strings.Join([]string{percentEncode(k), percentEncode(v)}, "=")
-		total = append(total, param)
+	for _, k := range sortedKeys(params) {
+		for _, v := range params[k] {
+			total = append(total, percentEncode(k)+"="+percentEncode(v))
+		}
 	}
 	return strings.Join(total, "&")
 }
 
+func sortedKeys(params url.Values) []string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // Parses strings passed back from POST request_token, they look like
 // (all concatenated):
 //
@@ -186,23 +258,38 @@ func makeParamStringFromMap(mp map[string]string) string {
 // oauth_token_secret=veNRnAWe6inFuo8o2u8SLLZLjolYDmDP7SzL0YfYI&
 // oauth_callback_confirmed=true
 func (o OAuth1) parseTokenResponse(resp *http.Response) *Token {
+	return o.tokenFromParams(o.readTokenResponse(resp))
+}
+
+func (o OAuth1) readTokenResponse(resp *http.Response) map[string]string {
+	if resp == nil {
+		return map[string]string{}
+	}
 	tokenBytes, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
 		o.logger.StatusWrite("Error reading from response body %v\n", err)
 	}
-	tokenData := string(tokenBytes)
-	return o.parseTokenData(tokenData)
+	return parseTokenParams(string(tokenBytes))
 }
 
 func (o OAuth1) parseTokenData(tokenData string) *Token {
+	return o.tokenFromParams(parseTokenParams(tokenData))
+}
+
+func parseTokenParams(tokenData string) map[string]string {
 	params := strings.Split(string(tokenData), "&")
 	paramMap := map[string]string{}
 	for _, param := range params {
-		kvPair := strings.Split(param, "=")
-		paramMap[kvPair[0]] = kvPair[1]
+		kvPair := strings.SplitN(param, "=", 2)
+		if len(kvPair) == 2 {
+			paramMap[kvPair[0]] = kvPair[1]
+		}
 	}
+	return paramMap
+}
 
+func (o OAuth1) tokenFromParams(paramMap map[string]string) *Token {
 	if confirmed, exists := paramMap["oauth_callback_confirmed"]; exists {
 		if confirmed != "true" {
 			o.logger.StatusWrite("oauth_callback_confirmed not true for response.\n")
@@ -227,66 +314,37 @@ func createNonce() string {
 	return string(rslt)
 }
 
-// Create the request signature. This is done according to the instructions on
-// the API pages linked above.
-func (o *OAuth1) createSignature(urlParams, bodyParams, authParams map[string]string, url, method string, token *Token) string {
+// Create the request signature, with whichever SignatureMethod we're using.
+func (o *OAuth1) createSignature(urlParams, bodyParams, authParams url.Values, url, method string, token *Token) string {
 
 	signatureBaseString := o.makeSignatureBaseString(urlParams, bodyParams, authParams, url, method)
-	signingKey := o.makeSigningKey(token)
-
-	hmacSha1 := hmac.New(sha1.New, []byte(signingKey))
-	io.WriteString(hmacSha1, signatureBaseString)
-
-	return base64.StdEncoding.EncodeToString(hmacSha1.Sum(nil))
-}
-
-func (o *OAuth1) makeSignatureBaseString(urlParams, bodyParams, authParams map[string]string, url, method string) string {
-
-	allMaps := []map[string]string{urlParams, bodyParams, authParams}
-	allParams := map[string]string{}
-	for _, mp := range allMaps {
-		for k, v := range mp {
-			allParams[k] = v
-		}
-	}
-
-	// Percent encode the parameters
-	encoded := map[string]string{}
-	for k, v := range allParams {
-		encoded[percentEncode(k)] = percentEncode(v)
-	}
-
-	// sort the parameters
-	var keys []string
-	for k, _ := range encoded {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	// create parameter string
-	for i, key := range keys {
-		keys[i] = strings.Join([]string{key, encoded[key]}, "=")
-
+	signature, err := o.method.Sign(signatureBaseString, o.makeSigningKey(token))
+	if err != nil {
+		o.logger.StatusWrite("Couldn't sign the request with %s: %v\n", o.method.Name(), err)
 	}
-	parameterString := percentEncode(strings.Join(keys, "&"))
-	encodedUrl := percentEncode(url)
+	return signature
+}
 
-	return strings.Join([]string{method, encodedUrl, parameterString}, "&")
+func (o *OAuth1) makeSignatureBaseString(urlParams, bodyParams, authParams url.Values, url, method string) string {
+	return signatureBaseString(method, url, urlParams, bodyParams, authParams)
 }
 
 func (o *OAuth1) makeSigningKey(token *Token) string {
-	appKey := percentEncode(o.applicationSecret)
-	consumerKey := ""
+	tokenSecret := ""
 	if token != nil {
-		consumerKey = percentEncode(token.OAuthTokenSecret)
+		tokenSecret = token.OAuthTokenSecret
 	}
-	return strings.Join([]string{appKey, consumerKey}, "&")
+	return signingKey(o.applicationSecret, tokenSecret)
 }
 
-func (o *OAuth1) finishHeader(req *http.Request, authParams map[string]string) {
+// Writes the Authorization header. Parameters are in sorted order, so a given
+// request always produces the same header.
+func (o *OAuth1) finishHeader(req *http.Request, authParams url.Values) {
 	var paramstrings []string
-	for k, v := range authParams {
-		paramstrings = append(paramstrings, fmt.Sprintf("%s=\"%s\"", percentEncode(k), percentEncode(v)))
+	for _, k := range sortedKeys(authParams) {
+		for _, v := range authParams[k] {
+			paramstrings = append(paramstrings, fmt.Sprintf("%s=\"%s\"", percentEncode(k), percentEncode(v)))
+		}
 	}
 	authString := strings.Join(paramstrings, ", ")
 	authorizationString := strings.Join([]string{"OAuth", authString}, " ")
@@ -297,17 +355,21 @@ func (o *OAuth1) finishHeader(req *http.Request, authParams map[string]string) {
 	req.Header.Add("Accept", "*/*")
 }
 
+// Sends the request with our http.Client. The response is nil if the request
+// couldn't be made at all (e.g. it timed out).
+//
+// Requests and responses are dumped through the LogMaster rather than straight
+// to stdout, so the credentials in them are redacted like everything else.
 func (o OAuth1) ExecuteRequest(req *http.Request) *http.Response {
-	client := &http.Client{}
-//	req.Write(os.Stdout)
-	resp, err := client.Do(req)
+	resp, err := o.client.Do(req)
 	if err != nil || resp == nil {
-		o.logger.StatusWrite("Error executing POST request: %v\n", err)
-		req.Write(os.Stdout)
+		o.logger.StatusWrite("Error executing %s request: %v\n", req.Method, err)
+		dump, _ := httputil.DumpRequestOut(req, false)
+		o.logger.DebugWrite("Request:\n%s\n", dump)
 	} else if resp.StatusCode != http.StatusOK {
 		o.logger.StatusWrite("Twitter returned non-200 status: %v\n", resp.Status)
-		o.logger.DebugWrite("Response:\n")
-		resp.Write(os.Stdout)
+		dump, _ := httputil.DumpResponse(resp, true)
+		o.logger.DebugWrite("Response:\n%s\n", dump)
 	}
 
 	return resp
@@ -5,10 +5,19 @@ import (
 
 	"ebooker/logging"
 
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"regexp"
+	"strings"
+	"testing"
+	"time"
 )
 
+// hook up gocheck into the gotest runner.
+func Test(t *testing.T) { gocheck.TestingT(t) }
+
 type OAuthSuite struct{}
 
 var _ = gocheck.Suite(&OAuthSuite{})
@@ -19,28 +28,28 @@ var _ = gocheck.Suite(&OAuthSuite{})
 // https://dev.twitter.com/docs/auth/creating-signature
 func (oa OAuthSuite) TestTwitterSignatureExample(c *gocheck.C) {
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "xvz1evFS4wEEPTGEFPHBog", "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw"}
+	o := CreateOAuth1(&logger, "xvz1evFS4wEEPTGEFPHBog", "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw")
 
-	url := "https://api.twitter.com/1/statuses/update.json"
+	endpoint := "https://api.twitter.com/1/statuses/update.json"
 	method := "POST"
-	urlParams := map[string]string{"include_entities": "true"}
-	bodyParams := map[string]string{"status": "Hello Ladies + Gentlemen, a signed OAuth request!"}
-	authParams := map[string]string{
-		"oauth_consumer_key":     "xvz1evFS4wEEPTGEFPHBog",
-		"oauth_nonce":            "kYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg",
-		"oauth_signature_method": "HMAC-SHA1",
-		"oauth_timestamp":        "1318622958",
-		"oauth_token":            "370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb",
-		"oauth_version":          "1.0"}
+	urlParams := url.Values{"include_entities": {"true"}}
+	bodyParams := url.Values{"status": {"Hello Ladies + Gentlemen, a signed OAuth request!"}}
+	authParams := url.Values{
+		"oauth_consumer_key":     {"xvz1evFS4wEEPTGEFPHBog"},
+		"oauth_nonce":            {"kYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"1318622958"},
+		"oauth_token":            {"370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb"},
+		"oauth_version":          {"1.0"}}
 
 	token := Token{"370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb", "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE"}
 
 	// check signature base string
 	baseStringExpected := "POST&https%3A%2F%2Fapi.twitter.com%2F1%2Fstatuses%2Fupdate.json&include_entities%3Dtrue%26oauth_consumer_key%3Dxvz1evFS4wEEPTGEFPHBog%26oauth_nonce%3DkYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1318622958%26oauth_token%3D370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb%26oauth_version%3D1.0%26status%3DHello%2520Ladies%2520%252B%2520Gentlemen%252C%2520a%2520signed%2520OAuth%2520request%2521"
-	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, url, method), gocheck.Equals, baseStringExpected)
+	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, endpoint, method), gocheck.Equals, baseStringExpected)
 
 	// check signature
-	req := o.authorizedRequestWithParams(url, method, urlParams, bodyParams, authParams, &token)
+	req := o.authorizedRequestWithParams(endpoint, method, urlParams, bodyParams, authParams, &token)
 	authstring := req.Header.Get("Authorization")
 	regex, _ := regexp.Compile("oauth_signature=\"([^\"]+)\"")
 	signature := regex.FindStringSubmatch(authstring)[1]
@@ -51,27 +60,27 @@ func (oa OAuthSuite) TestTwitterSignatureExample(c *gocheck.C) {
 func (oa OAuthSuite) TestAuthOnUpdate(c *gocheck.C) {
 
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "MxIkjx9eCC3j1JC8kTig", "IgOkwoh5m7AS4LplszxcPaF881vjvZYZNCAvvUz1x0"}
+	o := CreateOAuth1(&logger, "MxIkjx9eCC3j1JC8kTig", "IgOkwoh5m7AS4LplszxcPaF881vjvZYZNCAvvUz1x0")
 
-	url := "https://api.twitter.com/1.1/statuses/update.json"
+	endpoint := "https://api.twitter.com/1.1/statuses/update.json"
 	method := "POST"
-	urlParams := map[string]string{}
-	bodyParams := map[string]string{"status": "IMMATWEET"}
-	authParams := map[string]string{
-		"oauth_consumer_key":     "MxIkjx9eCC3j1JC8kTig",
-		"oauth_nonce":            "1bd818f5d8e62ceb172aad5bae030fd3",
-		"oauth_signature_method": "HMAC-SHA1",
-		"oauth_token":            "27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt",
-		"oauth_timestamp":        "1349163796",
-		"oauth_version":          "1.0"}
+	urlParams := url.Values{}
+	bodyParams := url.Values{"status": {"IMMATWEET"}}
+	authParams := url.Values{
+		"oauth_consumer_key":     {"MxIkjx9eCC3j1JC8kTig"},
+		"oauth_nonce":            {"1bd818f5d8e62ceb172aad5bae030fd3"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_token":            {"27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt"},
+		"oauth_timestamp":        {"1349163796"},
+		"oauth_version":          {"1.0"}}
 
 	token := Token{"27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt", "R2ieHCPMIECQnDhXMLOh3zL0w2CC484gFKVdBq6E"}
 
 	baseStringExpected := "POST&https%3A%2F%2Fapi.twitter.com%2F1.1%2Fstatuses%2Fupdate.json&oauth_consumer_key%3DMxIkjx9eCC3j1JC8kTig%26oauth_nonce%3D1bd818f5d8e62ceb172aad5bae030fd3%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1349163796%26oauth_token%3D27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt%26oauth_version%3D1.0%26status%3DIMMATWEET"
-	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, url, method), gocheck.Equals, baseStringExpected)
+	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, endpoint, method), gocheck.Equals, baseStringExpected)
 
 	// check signature
-	req := o.authorizedRequestWithParams(url, method, urlParams, bodyParams, authParams, &token)
+	req := o.authorizedRequestWithParams(endpoint, method, urlParams, bodyParams, authParams, &token)
 	authstring := req.Header.Get("Authorization")
 	regex, _ := regexp.Compile("oauth_signature=\"([^\"]+)\"")
 	signature := regex.FindStringSubmatch(authstring)[1]
@@ -85,74 +94,74 @@ func (oa OAuthSuite) TestAuthOnUpdate(c *gocheck.C) {
 // when requesting a request token, before you get an "oauth_token" value.
 func (oa OAuthSuite) TestSecondTwitterExample(c *gocheck.C) {
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "cChZNFj6T5R0TigYB9yd1w", "L8qq9PZyRg6ieKGEKhZolGC0vJWLw8iEJ88DRdyOg"}
+	o := CreateOAuth1(&logger, "cChZNFj6T5R0TigYB9yd1w", "L8qq9PZyRg6ieKGEKhZolGC0vJWLw8iEJ88DRdyOg")
 
-	url := "https://api.twitter.com/oauth/request_token"
+	endpoint := "https://api.twitter.com/oauth/request_token"
 	method := "POST"
-	urlParams := map[string]string{}
-	bodyParams := map[string]string{}
-	authParams := map[string]string{
-		"oauth_callback":         "http://localhost/sign-in-with-twitter/",
-		"oauth_consumer_key":     "cChZNFj6T5R0TigYB9yd1w",
-		"oauth_nonce":            "ea9ec8429b68d6b77cd5600adbbb0456",
-		"oauth_signature_method": "HMAC-SHA1",
-		"oauth_timestamp":        "1318467427",
-		"oauth_version":          "1.0"}
-
-	req := o.authorizedRequestWithParams(url, method, urlParams, bodyParams, authParams, nil)
+	urlParams := url.Values{}
+	bodyParams := url.Values{}
+	authParams := url.Values{
+		"oauth_callback":         {"http://localhost/sign-in-with-twitter/"},
+		"oauth_consumer_key":     {"cChZNFj6T5R0TigYB9yd1w"},
+		"oauth_nonce":            {"ea9ec8429b68d6b77cd5600adbbb0456"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"1318467427"},
+		"oauth_version":          {"1.0"}}
+
+	req := o.authorizedRequestWithParams(endpoint, method, urlParams, bodyParams, authParams, nil)
 
 	checkSignature(req, "F1Li3tvehgcraF8DMJ7OyxO4w9Y%3D", c)
 }
 
 func (oa OAuthSuite) TestStatusUpdateWithoutEncoding(c *gocheck.C) {
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "MxIkjx9eCC3j1JC8kTig", "IgOkwoh5m7AS4LplszxcPaF881vjvZYZNCAvvUz1x0"}
+	o := CreateOAuth1(&logger, "MxIkjx9eCC3j1JC8kTig", "IgOkwoh5m7AS4LplszxcPaF881vjvZYZNCAvvUz1x0")
 
-	url := "https://api.twitter.com/1.1/statuses/update.json"
+	endpoint := "https://api.twitter.com/1.1/statuses/update.json"
 	method := "POST"
-	urlParams := map[string]string{}
-	bodyParams := map[string]string{"status": "IMMATWEET"}
-	authParams := map[string]string{
-		"oauth_consumer_key":     "MxIkjx9eCC3j1JC8kTig",
-		"oauth_nonce":            "ef1efdb1c6b03c70ae2800543caae04d",
-		"oauth_signature_method": "HMAC-SHA1",
-		"oauth_token":            "27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt",
-		"oauth_timestamp":        "1349229371",
-		"oauth_version":          "1.0"}
+	urlParams := url.Values{}
+	bodyParams := url.Values{"status": {"IMMATWEET"}}
+	authParams := url.Values{
+		"oauth_consumer_key":     {"MxIkjx9eCC3j1JC8kTig"},
+		"oauth_nonce":            {"ef1efdb1c6b03c70ae2800543caae04d"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_token":            {"27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt"},
+		"oauth_timestamp":        {"1349229371"},
+		"oauth_version":          {"1.0"}}
 
 	token := Token{"27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt", "R2ieHCPMIECQnDhXMLOh3zL0w2CC484gFKVdBq6E"}
 
 	baseStringExpected := "POST&https%3A%2F%2Fapi.twitter.com%2F1.1%2Fstatuses%2Fupdate.json&oauth_consumer_key%3DMxIkjx9eCC3j1JC8kTig%26oauth_nonce%3Def1efdb1c6b03c70ae2800543caae04d%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1349229371%26oauth_token%3D27082544-JW0JZKi69R6OloylRBbs85By30kvZ7IfoGmGoiFvt%26oauth_version%3D1.0%26status%3DIMMATWEET"
 
-	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, url, method), gocheck.Equals, baseStringExpected)
+	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, endpoint, method), gocheck.Equals, baseStringExpected)
 
-	req := o.authorizedRequestWithParams(url, method, urlParams, bodyParams, authParams, &token)
+	req := o.authorizedRequestWithParams(endpoint, method, urlParams, bodyParams, authParams, &token)
 	checkSignature(req, "P6IKBc5LPV7Cz%2F%2FXnjpQuCisgek%3D", c)
 }
 
 func (oa OAuthSuite) TestGetTimelineWithAuthorization(c *gocheck.C) {
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "MxIkjx9eCC3j1JC8kTig", "IgOkwoh5m7AS4LplszxcPaF881vjvZYZNCAvvUz1x0"}
+	o := CreateOAuth1(&logger, "MxIkjx9eCC3j1JC8kTig", "IgOkwoh5m7AS4LplszxcPaF881vjvZYZNCAvvUz1x0")
 
-	url := "https://api.twitter.com/1.1/statuses/user_timeline.json"
+	endpoint := "https://api.twitter.com/1.1/statuses/user_timeline.json"
 	method := "GET"
-	urlParams := map[string]string{"screen_name": "theletterjeff"}
-	bodyParams := map[string]string{}
-	authParams := map[string]string{
-		"oauth_consumer_key":     "MxIkjx9eCC3j1JC8kTig",
-		"oauth_nonce":            "e0420a453875a19723a3873c9d6af3f0",
-		"oauth_signature_method": "HMAC-SHA1",
-		"oauth_token":            "27082544-QJA8iu2G4s7xG9OBRFKLlPntzJakmxidUgrlYtlIy",
-		"oauth_timestamp":        "1349331540",
-		"oauth_version":          "1.0"}
+	urlParams := url.Values{"screen_name": {"theletterjeff"}}
+	bodyParams := url.Values{}
+	authParams := url.Values{
+		"oauth_consumer_key":     {"MxIkjx9eCC3j1JC8kTig"},
+		"oauth_nonce":            {"e0420a453875a19723a3873c9d6af3f0"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_token":            {"27082544-QJA8iu2G4s7xG9OBRFKLlPntzJakmxidUgrlYtlIy"},
+		"oauth_timestamp":        {"1349331540"},
+		"oauth_version":          {"1.0"}}
 
 	token := Token{"27082544-QJA8iu2G4s7xG9OBRFKLlPntzJakmxidUgrlYtlIy", "yuNeA8Z2DPLu8wwU7zYlsxIGIEyMqqxzaczCafdtvYY"}
 
 	baseStringExpected := "GET&https%3A%2F%2Fapi.twitter.com%2F1.1%2Fstatuses%2Fuser_timeline.json&oauth_consumer_key%3DMxIkjx9eCC3j1JC8kTig%26oauth_nonce%3De0420a453875a19723a3873c9d6af3f0%26oauth_signature_method%3DHMAC-SHA1%26oauth_timestamp%3D1349331540%26oauth_token%3D27082544-QJA8iu2G4s7xG9OBRFKLlPntzJakmxidUgrlYtlIy%26oauth_version%3D1.0%26screen_name%3Dtheletterjeff"
 
-	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, url, method), gocheck.Equals, baseStringExpected)
+	c.Assert(o.makeSignatureBaseString(urlParams, bodyParams, authParams, endpoint, method), gocheck.Equals, baseStringExpected)
 
-	req := o.authorizedRequestWithParams(url, method, urlParams, bodyParams, authParams, &token)
+	req := o.authorizedRequestWithParams(endpoint, method, urlParams, bodyParams, authParams, &token)
 	checkSignature(req, "J8pKvAeHfse6dhv8Z06epOEOArQ%3D", c)
 }
 
@@ -165,7 +174,7 @@ func checkSignature(req *http.Request, expected string, c *gocheck.C) {
 
 func (oa OAuthSuite) TestMakingSigningKey(c *gocheck.C) {
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "xvz1evFS4wEEPTGEFPHBog", "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw"}
+	o := CreateOAuth1(&logger, "xvz1evFS4wEEPTGEFPHBog", "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw")
 
 	token := Token{"370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb", "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE"}
 
@@ -178,7 +187,7 @@ func (oa OAuthSuite) TestMakingSigningKey(c *gocheck.C) {
 
 func (oa OAuthSuite) TestTokenStringParsing(c *gocheck.C) {
 	logger := logging.GetLogMaster(false, true, false)
-	o := OAuth1{&logger, "xvz1evFS4wEEPTGEFPHBog", "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw"}
+	o := CreateOAuth1(&logger, "xvz1evFS4wEEPTGEFPHBog", "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw")
 
 	testcase := "oauth_token=NPcudxy0yU5T3tBzho7iCotZ3cnetKwcTIRlX0iwRl0&oauth_token_secret=veNRnAWe6inFuo8o2u8SLLZLjolYDmDP7SzL0YfYI&oauth_callback_confirmed=true"
 	token := o.parseTokenData(testcase)
@@ -202,3 +211,53 @@ func (o OAuthSuite) TestPercentEncode(c *gocheck.C) {
 		c.Assert(percentEncode(k), gocheck.Equals, v)
 	}
 }
+
+// A fake Twitter for the token endpoints. It checks that requests are signed
+// with the token it expects at each leg, then hands out the next one.
+func makeTokenServer(c *gocheck.C) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(REQUEST_TOKEN_PATH, func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		c.Check(strings.Contains(auth, "oauth_callback=\"http%3A%2F%2Febooker.example%2Foauth%2Fcallback\""), gocheck.Equals, true)
+		c.Check(strings.Contains(auth, "oauth_token="), gocheck.Equals, false)
+		fmt.Fprint(w, "oauth_token=requesttoken&oauth_token_secret=requestsecret&oauth_callback_confirmed=true")
+	})
+	mux.HandleFunc(ACCESS_TOKEN_PATH, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(strings.Contains(r.Header.Get("Authorization"), "oauth_token=\"requesttoken\""), gocheck.Equals, true)
+		c.Check(r.FormValue(OAUTH_VERIFIER), gocheck.Equals, "verifier")
+		fmt.Fprint(w, "oauth_token=accesstoken&oauth_token_secret=accesssecret&user_id=27082544&screen_name=SrPablo")
+	})
+	return httptest.NewServer(mux)
+}
+
+func (oa OAuthSuite) TestTokenExchange(c *gocheck.C) {
+	server := makeTokenServer(c)
+	defer server.Close()
+
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1WithClient(&logger, "key", "secret", server.Client(), server.URL+"/")
+
+	requestToken := o.ObtainRequestTokenWithCallback("http://ebooker.example/oauth/callback")
+	c.Assert(*requestToken, gocheck.Equals, Token{"requesttoken", "requestsecret"})
+	c.Assert(o.AuthenticationURL(requestToken), gocheck.Equals, server.URL+"/oauth/authenticate?oauth_token=requesttoken")
+
+	accessToken, screenName := o.ExchangeVerifier(requestToken, "verifier")
+	c.Assert(*accessToken, gocheck.Equals, Token{"accesstoken", "accesssecret"})
+	c.Assert(screenName, gocheck.Equals, "SrPablo")
+}
+
+// A Twitter that never answers shouldn't hang us.
+func (oa OAuthSuite) TestTimeout(c *gocheck.C) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1WithClient(&logger, "key", "secret", &http.Client{Timeout: 50 * time.Millisecond}, server.URL)
+
+	requestToken := o.ObtainRequestToken()
+	c.Assert(*requestToken, gocheck.Equals, Token{"", ""})
+}
@@ -0,0 +1,173 @@
+package oauth1
+
+/*
+Signing, per RFC 5849 section 3.4:
+
+http://tools.ietf.org/html/rfc5849#section-3.4
+
+Every method signs the same "signature base string": the request method, the
+request URL normalized (lowercase scheme and host, no default port, no query)
+and every parameter from the query, the form body and the Authorization header,
+encoded and sorted. Parameters can repeat, and all their values are signed.
+
+Twitter only takes HMAC-SHA1. PLAINTEXT (only sensible over TLS) and RSA-SHA1
+are here so the package can talk to other OAuth1 APIs.
+*/
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A SignatureMethod signs signature base strings for requests.
+type SignatureMethod interface {
+	// The value we send as oauth_signature_method.
+	Name() string
+
+	// Signs the base string. signingKey is the percent-encoded consumer secret
+	// and token secret, joined with "&".
+	Sign(baseString, signingKey string) (string, error)
+}
+
+var (
+	HMAC_SHA1 SignatureMethod = hmacSha1{}
+	PLAINTEXT SignatureMethod = plaintext{}
+)
+
+type hmacSha1 struct{}
+
+func (hmacSha1) Name() string { return "HMAC-SHA1" }
+
+func (hmacSha1) Sign(baseString, signingKey string) (string, error) {
+	hmacSha1 := hmac.New(sha1.New, []byte(signingKey))
+	io.WriteString(hmacSha1, baseString)
+	return base64.StdEncoding.EncodeToString(hmacSha1.Sum(nil)), nil
+}
+
+// PLAINTEXT "signs" by sending the signing key itself.
+type plaintext struct{}
+
+func (plaintext) Name() string { return "PLAINTEXT" }
+
+func (plaintext) Sign(baseString, signingKey string) (string, error) {
+	return signingKey, nil
+}
+
+// RSA-SHA1 ignores the secrets entirely: the consumer proves itself with a
+// private key, whose public half the server was given at registration.
+type rsaSha1 struct {
+	key *rsa.PrivateKey
+}
+
+func NewRSASHA1(key *rsa.PrivateKey) SignatureMethod {
+	return rsaSha1{key}
+}
+
+func (rsaSha1) Name() string { return "RSA-SHA1" }
+
+func (r rsaSha1) Sign(baseString, signingKey string) (string, error) {
+	hashed := sha1.Sum([]byte(baseString))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, r.key, crypto.SHA1, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// Reads an RSA private key from PEM, in either PKCS #1 or PKCS #8 form.
+func ParseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("PEM data is not an RSA private key")
+	}
+	return key, nil
+}
+
+func signingKey(consumerSecret, tokenSecret string) string {
+	return percentEncode(consumerSecret) + "&" + percentEncode(tokenSecret)
+}
+
+type encodedParam struct {
+	key, value string
+}
+
+type encodedParams []encodedParam
+
+// Sorted by key, then value, as the RFC asks.
+func (p encodedParams) Len() int      { return len(p) }
+func (p encodedParams) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p encodedParams) Less(i, j int) bool {
+	if p[i].key != p[j].key {
+		return p[i].key < p[j].key
+	}
+	return p[i].value < p[j].value
+}
+
+// Builds the signature base string. Any query already on rawURL is signed
+// along with urlParams. realm and oauth_signature are never signed.
+func signatureBaseString(method, rawURL string, urlParams, bodyParams, authParams url.Values) string {
+	baseURL := rawURL
+	var queryParams url.Values
+	if parsed, err := url.Parse(rawURL); err == nil {
+		baseURL = normalizeURL(parsed)
+		queryParams = parsed.Query()
+	}
+
+	var params encodedParams
+	for _, values := range []url.Values{queryParams, urlParams, bodyParams, authParams} {
+		for k, vs := range values {
+			if k == REALM || k == OAUTH_SIGNATURE {
+				continue
+			}
+			for _, v := range vs {
+				params = append(params, encodedParam{percentEncode(k), percentEncode(v)})
+			}
+		}
+	}
+	sort.Sort(params)
+
+	pairs := make([]string, len(params))
+	for i, param := range params {
+		pairs[i] = param.key + "=" + param.value
+	}
+	parameterString := percentEncode(strings.Join(pairs, "&"))
+
+	return strings.Join([]string{strings.ToUpper(method), percentEncode(baseURL), parameterString}, "&")
+}
+
+// The base string URI: scheme and host lowercased, default ports dropped, and
+// no query or fragment.
+func normalizeURL(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return scheme + "://" + host + path
+}
@@ -0,0 +1,171 @@
+package oauth1
+
+import (
+	"ebooker/logging"
+
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+type SignatureSuite struct{}
+
+var _ = gocheck.Suite(&SignatureSuite{})
+
+// The example from RFC 5849 section 3.4.1.1: repeated keys, parameters in the
+// query, body and header, an empty value, and a realm that isn't signed.
+func (s SignatureSuite) TestRFC5849BaseString(c *gocheck.C) {
+	rawURL := "http://example.com/request?b5=%3D%253D&a3=a&c%40=&a2=r%20b"
+	bodyParams, _ := url.ParseQuery("c2&a3=2+q")
+	authParams := url.Values{
+		"realm":                  {"Example"},
+		"oauth_consumer_key":     {"9djdj82h48djs9d2"},
+		"oauth_token":            {"kkk9d7dh3k39sjv7"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"137131201"},
+		"oauth_nonce":            {"7d8f3e4a"},
+		"oauth_signature":        {"bYT5CMsGcbgUdFHObYMEfcx6bsw%3D"}}
+
+	expected := "POST&http%3A%2F%2Fexample.com%2Frequest&a2%3Dr%2520b%26a3%3D2%2520q" +
+		"%26a3%3Da%26b5%3D%253D%25253D%26c%2540%3D%26c2%3D%26oauth_consumer_key%3D9dj" +
+		"dj82h48djs9d2%26oauth_nonce%3D7d8f3e4a%26oauth_signature_method%3DHMAC-SHA1" +
+		"%26oauth_timestamp%3D137131201%26oauth_token%3Dkkk9d7dh3k39sjv7"
+	c.Assert(signatureBaseString("POST", rawURL, url.Values{}, bodyParams, authParams), gocheck.Equals, expected)
+}
+
+// RFC 5849 section 3.4.1.2.
+func (s SignatureSuite) TestNormalizeURL(c *gocheck.C) {
+	testCases := map[string]string{
+		"HTTP://EXAMPLE.COM:80/r%20v/X?id=123":      "http://example.com/r%20v/X",
+		"https://www.example.net:8080/?q=1":         "https://www.example.net:8080/",
+		"https://api.twitter.com:443/1.1/statuses/": "https://api.twitter.com/1.1/statuses/",
+		"http://example.com":                        "http://example.com/"}
+
+	for raw, expected := range testCases {
+		parsed, err := url.Parse(raw)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(normalizeURL(parsed), gocheck.Equals, expected)
+	}
+}
+
+// The photo-sharing walkthrough of RFC 5849 section 1.2. The signature
+// printed in the RFC itself is wrong; this is the corrected one from its
+// errata.
+func (s SignatureSuite) TestRFC5849HMACSHA1(c *gocheck.C) {
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1(&logger, "dpf43f3p2l4k3l03", "kd94hf93k423kf44")
+
+	urlParams := url.Values{"file": {"vacation.jpg"}, "size": {"original"}}
+	authParams := url.Values{
+		"realm":                  {"Photos"},
+		"oauth_consumer_key":     {"dpf43f3p2l4k3l03"},
+		"oauth_signature_method": {"HMAC-SHA1"},
+		"oauth_timestamp":        {"137131202"},
+		"oauth_nonce":            {"chapoH"}}
+	token := Token{"nnch734d00sl2jdk", "pfkkdhi9sl3r4s00"}
+
+	req := o.authorizedRequestWithParams("http://photos.example.net/photos", "GET", urlParams, url.Values{}, authParams, &token)
+	checkSignature(req, percentEncode("MdpQcU8iPSUjWoN/UDMsK2sui9I="), c)
+	c.Assert(req.URL.String(), gocheck.Equals, "http://photos.example.net/photos?file=vacation.jpg&size=original")
+}
+
+// PLAINTEXT, for the temporary and token credential requests of RFC 5849
+// section 1.2.
+func (s SignatureSuite) TestRFC5849Plaintext(c *gocheck.C) {
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1(&logger, "dpf43f3p2l4k3l03", "kd94hf93k423kf44")
+	o.SetSignatureMethod(PLAINTEXT)
+
+	authParams := url.Values{OAUTH_CALLBACK: {"http://printer.example.com/ready"}}
+	req := o.CreateAuthorizedRequest("https://photos.example.net/initiate", "POST", url.Values{}, url.Values{}, authParams, nil)
+	checkSignature(req, "kd94hf93k423kf44%26", c)
+	checkAuthParam(req, OAUTH_SIGNATURE_METHOD, "PLAINTEXT", c)
+
+	authParams = url.Values{OAUTH_VERIFIER: {"hfdp7dh39dks9884"}}
+	token := Token{"hh5s93j4hdidpola", "hdhd0244k9j7ao03"}
+	req = o.CreateAuthorizedRequest("https://photos.example.net/token", "POST", url.Values{}, url.Values{}, authParams, &token)
+	checkSignature(req, "kd94hf93k423kf44%26hdhd0244k9j7ao03", c)
+}
+
+func (s SignatureSuite) TestRSASHA1(c *gocheck.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, gocheck.IsNil)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	parsed, err := ParseRSAPrivateKey(pemBytes)
+	c.Assert(err, gocheck.IsNil)
+
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1(&logger, "dpf43f3p2l4k3l03", "unused")
+	o.SetSignatureMethod(NewRSASHA1(parsed))
+
+	urlParams := url.Values{"file": {"vacaction.jpg"}, "size": {"original"}}
+	authParams := url.Values{
+		"oauth_consumer_key":     {"dpf43f3p2l4k3l03"},
+		"oauth_signature_method": {"RSA-SHA1"},
+		"oauth_timestamp":        {"1196666512"},
+		"oauth_nonce":            {"13917289812797014437"},
+		"oauth_version":          {"1.0"}}
+	baseString := o.makeSignatureBaseString(urlParams, url.Values{}, authParams, "http://photos.example.net/photos", "GET")
+	c.Assert(baseString, gocheck.Equals, "GET&http%3A%2F%2Fphotos.example.net%2Fphotos&file%3Dvacaction.jpg%26oauth_consumer_key%3Ddpf43f3p2l4k3l03%26oauth_nonce%3D13917289812797014437%26oauth_signature_method%3DRSA-SHA1%26oauth_timestamp%3D1196666512%26oauth_version%3D1.0%26size%3Doriginal")
+
+	req := o.authorizedRequestWithParams("http://photos.example.net/photos", "GET", urlParams, url.Values{}, authParams, nil)
+	signature, err := url.QueryUnescape(authParamFromHeader(req, OAUTH_SIGNATURE, c))
+	c.Assert(err, gocheck.IsNil)
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	c.Assert(err, gocheck.IsNil)
+
+	hashed := sha1.Sum([]byte(baseString))
+	c.Assert(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, hashed[:], decoded), gocheck.IsNil)
+}
+
+// Repeated parameters all make it into the request, and the same request
+// always gets the same Authorization header.
+func (s SignatureSuite) TestMultiValuedAndDeterministic(c *gocheck.C) {
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1(&logger, "key", "secret")
+
+	makeRequest := func() (string, string, string) {
+		urlParams := url.Values{"a3": {"a", "2 q"}, "b5": {"=%3D"}}
+		bodyParams := url.Values{"tag": {"one", "two"}}
+		authParams := url.Values{
+			"oauth_consumer_key":     {"key"},
+			"oauth_signature_method": {"HMAC-SHA1"},
+			"oauth_timestamp":        {"137131201"},
+			"oauth_nonce":            {"7d8f3e4a"},
+			"oauth_version":          {"1.0"}}
+		req := o.authorizedRequestWithParams("http://example.com/request", "POST", urlParams, bodyParams, authParams, &Token{"token", "tokensecret"})
+		body := make([]byte, 100)
+		n, _ := req.Body.Read(body)
+		return req.URL.RawQuery, string(body[:n]), req.Header.Get("Authorization")
+	}
+
+	query, body, header := makeRequest()
+	c.Assert(query, gocheck.Equals, "a3=a&a3=2%20q&b5=%3D%253D")
+	c.Assert(body, gocheck.Equals, "tag=one&tag=two")
+	c.Assert(header, gocheck.Matches, "OAuth oauth_consumer_key=\"key\", oauth_nonce=\"7d8f3e4a\", oauth_signature=\"[^\"]+\", "+
+		"oauth_signature_method=\"HMAC-SHA1\", oauth_timestamp=\"137131201\", oauth_token=\"token\", oauth_version=\"1.0\"")
+
+	for i := 0; i < 10; i++ {
+		_, _, again := makeRequest()
+		c.Assert(again, gocheck.Equals, header)
+	}
+}
+
+func authParamFromHeader(req *http.Request, key string, c *gocheck.C) string {
+	regex := regexp.MustCompile(key + "=\"([^\"]*)\"")
+	matches := regex.FindStringSubmatch(req.Header.Get("Authorization"))
+	c.Assert(matches, gocheck.NotNil)
+	return matches[1]
+}
+
+func checkAuthParam(req *http.Request, key, expected string, c *gocheck.C) {
+	c.Assert(authParamFromHeader(req, key, c), gocheck.Equals, expected)
+}
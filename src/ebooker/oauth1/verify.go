@@ -0,0 +1,274 @@
+package oauth1
+
+/*
+The other side of the exchange: checking requests that were signed for us.
+This lets our own HTTP API authenticate its clients with the same scheme we use
+on Twitter.
+
+A request is accepted when, per RFC 5849 section 3.2:
+  * its Authorization header carries all the oauth_ parameters we need,
+  * its signature matches the one we compute from the same base string,
+  * its timestamp is within the allowed skew of our clock, and
+  * we haven't seen its nonce before (for that timestamp, consumer and token).
+
+Where secrets and seen nonces are kept is up to the caller, through the
+CredentialStore and NonceStore interfaces.
+*/
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoAuthorization    = errors.New("oauth1: no OAuth Authorization header")
+	ErrMalformedHeader    = errors.New("oauth1: malformed Authorization header")
+	ErrMissingParameter   = errors.New("oauth1: missing required oauth_ parameter")
+	ErrUnsupportedMethod  = errors.New("oauth1: unsupported signature method")
+	ErrUnknownConsumer    = errors.New("oauth1: unknown consumer key")
+	ErrUnknownToken       = errors.New("oauth1: unknown token")
+	ErrBadTimestamp       = errors.New("oauth1: timestamp outside the allowed window")
+	ErrBadSignature       = errors.New("oauth1: signature does not match")
+	ErrReplayedNonce      = errors.New("oauth1: nonce has already been used")
+	ErrUnsupportedVersion = errors.New("oauth1: unsupported oauth_version")
+)
+
+// Where a Verifier looks up the secrets it checks signatures against.
+type CredentialStore interface {
+	// The secret for a consumer key, if we know the key.
+	ConsumerSecret(consumerKey string) (string, bool)
+
+	// The secret for a token issued to a consumer, if we know the token.
+	TokenSecret(consumerKey, token string) (string, bool)
+}
+
+// CredentialStores that also implement RSAKeyStore can verify RSA-SHA1.
+type RSAKeyStore interface {
+	ConsumerPublicKey(consumerKey string) (*rsa.PublicKey, bool)
+}
+
+// A NonceStore remembers the nonces we've accepted, so a captured request
+// can't be replayed.
+type NonceStore interface {
+	// Records the nonce, returning false if it was already recorded for the
+	// same consumer, token and timestamp.
+	CheckAndStore(consumerKey, token, nonce string, timestamp time.Time) bool
+}
+
+// The Verifier checks signed requests.
+type Verifier struct {
+	// Where clients reach us, e.g. "https://ebooker.example.com", if it's not
+	// where requests arrive: behind a proxy that terminates TLS, say. Clients
+	// sign the URL they sent to, so that's the one we check. If it's empty we
+	// work it out from the request.
+	BaseURL string
+
+	credentials CredentialStore
+	nonces      NonceStore
+	maxSkew     time.Duration
+	now         func() time.Time
+}
+
+// What a successfully verified request was signed with.
+type VerifiedRequest struct {
+	ConsumerKey string
+	Token       string // empty if the request was signed without one
+}
+
+// Creates a Verifier. Requests more than maxSkew away from our clock are
+// rejected, so the NonceStore only needs to remember nonces for that long.
+func NewVerifier(credentials CredentialStore, nonces NonceStore, maxSkew time.Duration) *Verifier {
+	return &Verifier{"", credentials, nonces, maxSkew, time.Now}
+}
+
+// Verifies the OAuth signature on an incoming request. A form-encoded body is
+// read to check its parameters, and then put back for the handler.
+func (v *Verifier) Verify(req *http.Request) (*VerifiedRequest, error) {
+	authParams, err := parseAuthorizationHeader(req.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+
+	consumerKey := authParams.Get(OAUTH_CONSUMER_KEY)
+	token := authParams.Get(OAUTH_TOKEN)
+	nonce := authParams.Get(OAUTH_NONCE)
+	signature := authParams.Get(OAUTH_SIGNATURE)
+	methodName := authParams.Get(OAUTH_SIGNATURE_METHOD)
+	if consumerKey == "" || nonce == "" || signature == "" || methodName == "" || authParams.Get(OAUTH_TIMESTAMP) == "" {
+		return nil, ErrMissingParameter
+	}
+	if version, present := authParams[OAUTH_VERSION]; present && (len(version) != 1 || version[0] != "1.0") {
+		return nil, ErrUnsupportedVersion
+	}
+
+	seconds, err := strconv.ParseInt(authParams.Get(OAUTH_TIMESTAMP), 10, 64)
+	if err != nil {
+		return nil, ErrBadTimestamp
+	}
+	timestamp := time.Unix(seconds, 0)
+	if skew := v.now().Sub(timestamp); skew > v.maxSkew || skew < -v.maxSkew {
+		return nil, ErrBadTimestamp
+	}
+
+	consumerSecret, known := v.credentials.ConsumerSecret(consumerKey)
+	if !known {
+		return nil, ErrUnknownConsumer
+	}
+	tokenSecret := ""
+	if token != "" {
+		if tokenSecret, known = v.credentials.TokenSecret(consumerKey, token); !known {
+			return nil, ErrUnknownToken
+		}
+	}
+
+	bodyParams, err := readFormBody(req)
+	if err != nil {
+		return nil, err
+	}
+	baseString := signatureBaseString(req.Method, v.requestURL(req), url.Values{}, bodyParams, authParams)
+
+	switch methodName {
+	case HMAC_SHA1.Name(), PLAINTEXT.Name():
+		method := HMAC_SHA1
+		if methodName == PLAINTEXT.Name() {
+			method = PLAINTEXT
+		}
+		expected, _ := method.Sign(baseString, signingKey(consumerSecret, tokenSecret))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) != 1 {
+			return nil, ErrBadSignature
+		}
+	case "RSA-SHA1":
+		keys, ok := v.credentials.(RSAKeyStore)
+		if !ok {
+			return nil, ErrUnsupportedMethod
+		}
+		publicKey, known := keys.ConsumerPublicKey(consumerKey)
+		if !known {
+			return nil, ErrUnknownConsumer
+		}
+		decoded, err := base64.StdEncoding.DecodeString(signature)
+		hashed := sha1.Sum([]byte(baseString))
+		if err != nil || rsa.VerifyPKCS1v15(publicKey, crypto.SHA1, hashed[:], decoded) != nil {
+			return nil, ErrBadSignature
+		}
+	default:
+		return nil, ErrUnsupportedMethod
+	}
+
+	// Only once the signature checks out, so forged requests can't use up
+	// nonces.
+	if !v.nonces.CheckAndStore(consumerKey, token, nonce, timestamp) {
+		return nil, ErrReplayedNonce
+	}
+	return &VerifiedRequest{consumerKey, token}, nil
+}
+
+// Parses `OAuth key="value", key="value"` into its (decoded) parameters. The
+// scheme's name isn't case-sensitive (RFC 5849 section 3.5.1).
+func parseAuthorizationHeader(header string) (url.Values, error) {
+	const scheme = "OAuth "
+	if len(header) < len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return nil, ErrNoAuthorization
+	}
+
+	params := url.Values{}
+	for _, pair := range strings.Split(header[len(scheme):], ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(kv[1]) < 2 || !strings.HasPrefix(kv[1], "\"") || !strings.HasSuffix(kv[1], "\"") {
+			return nil, ErrMalformedHeader
+		}
+		key, err := url.PathUnescape(kv[0])
+		if err != nil {
+			return nil, ErrMalformedHeader
+		}
+		value, err := url.PathUnescape(kv[1][1 : len(kv[1])-1])
+		if err != nil {
+			return nil, ErrMalformedHeader
+		}
+		params.Add(key, value)
+	}
+	return params, nil
+}
+
+// Reads the parameters of a form-encoded body, leaving the body in place for
+// whoever handles the request next. Other bodies aren't signed.
+func readFormBody(req *http.Request) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if req.Body == nil || mediaType != "application/x-www-form-urlencoded" {
+		return url.Values{}, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return url.ParseQuery(string(body))
+}
+
+// The URL the client signed. Incoming requests only carry the path, so we
+// rebuild the rest from BaseURL, or failing that from the Host header and the
+// connection.
+func (v *Verifier) requestURL(req *http.Request) string {
+	if v.BaseURL != "" {
+		return strings.TrimRight(v.BaseURL, "/") + req.URL.RequestURI()
+	}
+	if req.URL.IsAbs() {
+		return req.URL.String()
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+// MemoryNonceStore keeps nonces in memory, forgetting them once their
+// timestamps are old enough that the Verifier would reject them anyway.
+type MemoryNonceStore struct {
+	lock   sync.Mutex
+	seen   map[string]time.Time
+	window time.Duration
+}
+
+// window should be at least twice the Verifier's maxSkew.
+func NewMemoryNonceStore(window time.Duration) *MemoryNonceStore {
+	return &MemoryNonceStore{seen: make(map[string]time.Time), window: window}
+}
+
+func (m *MemoryNonceStore) CheckAndStore(consumerKey, token, nonce string, timestamp time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cutoff := time.Now().Add(-m.window)
+	for key, seenAt := range m.seen {
+		if seenAt.Before(cutoff) {
+			delete(m.seen, key)
+		}
+	}
+
+	key := strings.Join([]string{consumerKey, token, nonce, strconv.FormatInt(timestamp.Unix(), 10)}, "\x00")
+	if _, seen := m.seen[key]; seen {
+		return false
+	}
+	m.seen[key] = timestamp
+	return true
+}
@@ -0,0 +1,241 @@
+package oauth1
+
+import (
+	"ebooker/logging"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type VerifySuite struct{}
+
+var _ = gocheck.Suite(&VerifySuite{})
+
+type testCredentials struct {
+	publicKey *rsa.PublicKey
+}
+
+func (t testCredentials) ConsumerSecret(consumerKey string) (string, bool) {
+	if consumerKey == "consumerkey" {
+		return "consumer secret", true
+	}
+	return "", false
+}
+
+func (t testCredentials) TokenSecret(consumerKey, token string) (string, bool) {
+	if consumerKey == "consumerkey" && token == "accesstoken" {
+		return "token+secret", true
+	}
+	return "", false
+}
+
+func (t testCredentials) ConsumerPublicKey(consumerKey string) (*rsa.PublicKey, bool) {
+	return t.publicKey, consumerKey == "consumerkey" && t.publicKey != nil
+}
+
+// A server that verifies everything sent to it, reporting what it found and
+// echoing the body so we know it survived verification.
+func makeVerifyingServer(verifier *Verifier) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified, err := verifier.Verify(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s|%s|%s", verified.ConsumerKey, verified.Token, body)
+	}))
+}
+
+func makeTestVerifier(credentials CredentialStore) *Verifier {
+	return NewVerifier(credentials, NewMemoryNonceStore(10*time.Minute), 5*time.Minute)
+}
+
+func makeSigningClient(server *httptest.Server, secret string) OAuth1 {
+	logger := logging.GetLogMaster(true, false, false)
+	return CreateOAuth1WithClient(&logger, "consumerkey", secret, server.Client(), server.URL)
+}
+
+func send(o OAuth1, req *http.Request) (int, string) {
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func (s VerifySuite) TestRoundTrip(c *gocheck.C) {
+	server := makeVerifyingServer(makeTestVerifier(testCredentials{}))
+	defer server.Close()
+	o := makeSigningClient(server, "consumer secret")
+
+	// Repeated parameters in the query and body, with a token...
+	urlParams := url.Values{"users": {"SrPablo", "laurelita"}, "note": {"a + b = c!"}}
+	bodyParams := url.Values{"status": {"Hello Ladies + Gentlemen"}}
+	req := o.CreateAuthorizedRequest(o.URL("/v1/generate"), "POST", urlParams, bodyParams, url.Values{}, &Token{"accesstoken", "token+secret"})
+	code, body := send(o, req)
+	c.Assert(code, gocheck.Equals, http.StatusOK)
+	c.Assert(body, gocheck.Equals, "consumerkey|accesstoken|status=Hello%20Ladies%20%2B%20Gentlemen")
+
+	// ...without one...
+	req = o.CreateAuthorizedRequest(o.URL("/v1/bots"), "GET", url.Values{}, url.Values{}, url.Values{}, nil)
+	code, body = send(o, req)
+	c.Assert(code, gocheck.Equals, http.StatusOK)
+	c.Assert(body, gocheck.Equals, "consumerkey||")
+
+	// ...and with PLAINTEXT.
+	o.SetSignatureMethod(PLAINTEXT)
+	req = o.CreateAuthorizedRequest(o.URL("/v1/bots"), "GET", url.Values{}, url.Values{}, url.Values{}, &Token{"accesstoken", "token+secret"})
+	code, _ = send(o, req)
+	c.Assert(code, gocheck.Equals, http.StatusOK)
+}
+
+func (s VerifySuite) TestRSASHA1(c *gocheck.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, gocheck.IsNil)
+	server := makeVerifyingServer(makeTestVerifier(testCredentials{&key.PublicKey}))
+	defer server.Close()
+
+	o := makeSigningClient(server, "")
+	o.SetSignatureMethod(NewRSASHA1(key))
+	req := o.CreateAuthorizedRequest(o.URL("/v1/bots"), "GET", url.Values{"q": {"1"}}, url.Values{}, url.Values{}, nil)
+	code, _ := send(o, req)
+	c.Assert(code, gocheck.Equals, http.StatusOK)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	c.Assert(err, gocheck.IsNil)
+	o.SetSignatureMethod(NewRSASHA1(otherKey))
+	req = o.CreateAuthorizedRequest(o.URL("/v1/bots"), "GET", url.Values{"q": {"1"}}, url.Values{}, url.Values{}, nil)
+	code, body := send(o, req)
+	c.Assert(code, gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(body, gocheck.Equals, ErrBadSignature.Error())
+}
+
+func (s VerifySuite) TestRejections(c *gocheck.C) {
+	verifier := makeTestVerifier(testCredentials{})
+	server := makeVerifyingServer(verifier)
+	defer server.Close()
+
+	expectRejection := func(req *http.Request, expected error) {
+		code, body := send(makeSigningClient(server, ""), req)
+		c.Check(code, gocheck.Equals, http.StatusUnauthorized)
+		c.Check(body, gocheck.Equals, expected.Error())
+	}
+
+	// Wrong secrets.
+	o := makeSigningClient(server, "not the consumer secret")
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{}, nil), ErrBadSignature)
+	o = makeSigningClient(server, "consumer secret")
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{}, &Token{"accesstoken", "wrong"}), ErrBadSignature)
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{}, &Token{"madeup", "token+secret"}), ErrUnknownToken)
+
+	// Tampering with a signed parameter.
+	req := o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{"count": {"1"}}, url.Values{}, url.Values{}, nil)
+	req.URL.RawQuery = "count=1000"
+	expectRejection(req, ErrBadSignature)
+
+	// Replays.
+	req = o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{}, nil)
+	replay, _ := http.NewRequest("GET", req.URL.String(), nil)
+	replay.Header = req.Header
+	code, _ := send(o, req)
+	c.Assert(code, gocheck.Equals, http.StatusOK)
+	expectRejection(replay, ErrReplayedNonce)
+
+	// Stale and future timestamps.
+	stale := fmt.Sprint(time.Now().Add(-10 * time.Minute).Unix())
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{OAUTH_TIMESTAMP: {stale}}, nil), ErrBadTimestamp)
+	future := fmt.Sprint(time.Now().Add(10 * time.Minute).Unix())
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{OAUTH_TIMESTAMP: {future}}, nil), ErrBadTimestamp)
+
+	// Unknown consumers, methods and versions.
+	o = makeSigningClient(server, "consumer secret")
+	o.applicationKey = "someoneelse"
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{}, nil), ErrUnknownConsumer)
+	o = makeSigningClient(server, "consumer secret")
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{OAUTH_SIGNATURE_METHOD: {"HMAC-SHA256"}}, nil), ErrUnsupportedMethod)
+	expectRejection(o.CreateAuthorizedRequest(o.URL("/"), "GET", url.Values{}, url.Values{}, url.Values{OAUTH_VERSION: {"2.0"}}, nil), ErrUnsupportedVersion)
+
+	// Not OAuth at all, or mangled.
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	expectRejection(req, ErrNoAuthorization)
+	req.Header.Set("Authorization", "OAuth oauth_consumer_key=consumerkey")
+	expectRejection(req, ErrMalformedHeader)
+	req.Header.Set("Authorization", "OAuth oauth_consumer_key=\"consumerkey\"")
+	expectRejection(req, ErrMissingParameter)
+}
+
+func (s VerifySuite) TestParseAuthorizationHeader(c *gocheck.C) {
+	params, err := parseAuthorizationHeader("OAuth realm=\"Example\", oauth_consumer_key=\"9djdj82h48djs9d2\", oauth_signature=\"bYT5CMsGcbgUdFHObYMEfcx6bsw%3D\"")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(params, gocheck.DeepEquals, url.Values{
+		"realm":              {"Example"},
+		"oauth_consumer_key": {"9djdj82h48djs9d2"},
+		"oauth_signature":    {"bYT5CMsGcbgUdFHObYMEfcx6bsw="}})
+}
+
+// The scheme's name isn't case-sensitive.
+func (s VerifySuite) TestSchemeCase(c *gocheck.C) {
+	for _, scheme := range []string{"oauth", "OAUTH", "oAuth"} {
+		params, err := parseAuthorizationHeader(scheme + " realm=\"Example\", oauth_consumer_key=\"9djdj82h48djs9d2\"")
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(params.Get("oauth_consumer_key"), gocheck.Equals, "9djdj82h48djs9d2")
+	}
+	for _, header := range []string{"", "OAuth", "Bearer abc", "OAuthx=\"y\""} {
+		_, err := parseAuthorizationHeader(header)
+		c.Assert(err, gocheck.Equals, ErrNoAuthorization)
+	}
+}
+
+// Behind a proxy that terminates TLS, clients sign the URL they reach the
+// proxy at, which the request we get doesn't tell us.
+func (s VerifySuite) TestBaseURL(c *gocheck.C) {
+	verifier := makeTestVerifier(testCredentials{})
+	server := makeVerifyingServer(verifier)
+	defer server.Close()
+	logger := logging.GetLogMaster(true, false, false)
+	o := CreateOAuth1WithClient(&logger, "consumerkey", "consumer secret", server.Client(), "https://ebooker.example.com")
+
+	signed := func() *http.Request {
+		req := o.CreateAuthorizedRequest(o.URL("/v1/bots"), "GET", url.Values{"q": {"1"}}, url.Values{}, url.Values{}, nil)
+		proxied, _ := url.Parse(server.URL)
+		req.URL.Scheme, req.URL.Host, req.Host = proxied.Scheme, proxied.Host, ""
+		return req
+	}
+	code, body := send(o, signed())
+	c.Assert(code, gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(body, gocheck.Equals, ErrBadSignature.Error())
+
+	verifier.BaseURL = "https://ebooker.example.com/"
+	code, body = send(o, signed())
+	c.Assert(body, gocheck.Equals, "consumerkey||")
+	c.Assert(code, gocheck.Equals, http.StatusOK)
+}
+
+func (s VerifySuite) TestMemoryNonceStore(c *gocheck.C) {
+	store := NewMemoryNonceStore(time.Minute)
+	now := time.Now()
+
+	c.Assert(store.CheckAndStore("key", "token", "nonce", now), gocheck.Equals, true)
+	c.Assert(store.CheckAndStore("key", "token", "nonce", now), gocheck.Equals, false)
+
+	// The same nonce is fine with another timestamp, consumer or token.
+	c.Assert(store.CheckAndStore("key", "token", "nonce", now.Add(time.Second)), gocheck.Equals, true)
+	c.Assert(store.CheckAndStore("other", "token", "nonce", now), gocheck.Equals, true)
+	c.Assert(store.CheckAndStore("key", "", "nonce", now), gocheck.Equals, true)
+
+	// Old nonces are forgotten.
+	c.Assert(store.CheckAndStore("key", "token", "old", now.Add(-2*time.Minute)), gocheck.Equals, true)
+	store.CheckAndStore("key", "token", "trigger a prune", now)
+	c.Assert(len(store.seen), gocheck.Equals, 5)
+}
@@ -0,0 +1,402 @@
+package main
+
+/*
+Who may do what. Every RPC connection and REST request has to carry an API
+key, as "Authorization: Bearer <key>" (on the CONNECT, for net/rpc). We only
+store keys' SHA-256 hashes, so the key itself is shown once, when it's made
+with the server's -newkey, and never again.
+
+Each key has scopes:
+
+  generate  generate tweets, and export the tweets we have for sources.
+  bots      make bots, and look after the bots it made.
+  metrics   read the server's metrics, at /metrics.
+  admin     everything, including every bot, whoever made it.
+
+Bots belong to the key (by name) that made them; other keys can't see them,
+short of admin ones. Revoking a key and making a new one by the same name
+hands its bots to the new key. Bots from before there were keys belong to no
+key, so only admin keys can get at them.
+
+A key without admin can only make bots post as accounts whose credentials it
+hands over itself. Credentials someone signed in with through the web flow
+are the admin's to hand out.
+*/
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SCOPE_GENERATE = "generate"
+	SCOPE_BOTS     = "bots"
+	SCOPE_METRICS  = "metrics"
+	SCOPE_ADMIN    = "admin"
+)
+
+var API_KEY_SCOPES = []string{SCOPE_GENERATE, SCOPE_BOTS, SCOPE_METRICS, SCOPE_ADMIN}
+
+// Keys are this prefix and API_KEY_BYTES random bytes, base64ed. The prefix
+// makes them easy to spot in a config file, or a leak.
+const (
+	API_KEY_PREFIX = "ebk_"
+	API_KEY_BYTES  = 32
+)
+
+var UNAUTHENTICATED = errors.New("This needs a valid API key, sent as \"Authorization: Bearer <key>\".")
+
+// Asking for something the key isn't allowed to do.
+type forbiddenError string
+
+func (e forbiddenError) Error() string {
+	return string(e)
+}
+
+type apiKey struct {
+	Name    string
+	Hash    string // hex SHA-256 of the key
+	Scopes  []string
+	Created time.Time
+}
+
+func (k *apiKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == SCOPE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *apiKey) owns(bot *Bot) bool {
+	return k.allows(SCOPE_ADMIN) || bot.owner == k.Name
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Reads a comma-separated list of scopes, making sure we know them all.
+func parseScopes(list string) ([]string, error) {
+	var scopes []string
+	for _, scope := range strings.Split(list, ",") {
+		scope = strings.TrimSpace(scope)
+		known := false
+		for _, s := range API_KEY_SCOPES {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, errors.New("No such scope \"" + scope + "\". Try " + strings.Join(API_KEY_SCOPES, ", ") + ".")
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// Makes a key called name with the scopes, and stores its hash. Returns the
+// key; there's no getting it back later.
+func createAPIKey(data Datastore, name string, scopes []string) (string, error) {
+	if name == "" || strings.ContainsAny(name, " \t,") {
+		return "", errors.New("API keys need a name, without spaces or commas.")
+	}
+	random := make([]byte, API_KEY_BYTES)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", err
+	}
+	key := API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(random)
+	if err := data.insertAPIKey(apiKey{name, hashAPIKey(key), scopes, time.Now()}); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Finds the key the request carries.
+func authenticate(data Datastore, r *http.Request) (*apiKey, error) {
+	scheme, key, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, UNAUTHENTICATED
+	}
+	stored, exists := data.getAPIKey(hashAPIKey(strings.TrimSpace(key)))
+	if !exists {
+		return nil, UNAUTHENTICATED
+	}
+	return stored, nil
+}
+
+// Serves net/rpc like rpc.HandleHTTP does, to clients with a key, each
+// connection getting an Ebooker that does only what its key allows. The
+// connections are taken over from the http.Server, which forgets them, so we
+// keep track of them to close when we shut down.
+type rpcGate struct {
+	eb *Ebooker
+
+	lock   sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func newRPCGate(eb *Ebooker) *rpcGate {
+	return &rpcGate{eb: eb, conns: make(map[net.Conn]bool)}
+}
+
+func (g *rpcGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		http.Error(w, "405 must CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := authenticate(g.eb.data, r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		g.eb.logger.StatusWrite("Couldn't take over an RPC connection: %v\n", err)
+		return
+	}
+	if !g.track(conn) {
+		conn.Close()
+		return
+	}
+	defer g.untrack(conn)
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+
+	server := rpc.NewServer()
+	server.RegisterName("Ebooker", &authedEbooker{g.eb, key})
+	server.ServeConn(conn)
+}
+
+// Remembers the connection, unless we've closed them all already.
+func (g *rpcGate) track(conn net.Conn) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.conns[conn] = true
+	return true
+}
+
+func (g *rpcGate) untrack(conn net.Conn) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.conns, conn)
+}
+
+// Closes every RPC connection, and any that come in after. Calls under way
+// finish, but can't answer.
+func (g *rpcGate) closeConnections() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.closed = true
+	for conn := range g.conns {
+		conn.Close()
+	}
+}
+
+// The Ebooker's RPC methods, as the holder of a key may call them. Each is
+// counted in the metrics, however it was called.
+type authedEbooker struct {
+	eb  *Ebooker
+	key *apiKey
+}
+
+// Counts the call, and logs it to the rpc component: successes at Debug,
+// failures at Info, since most are the caller's mistake rather than ours.
+func (a *authedEbooker) observe(method string, start time.Time, err *error) {
+	countRPC(method, start, err)
+	logger := a.eb.logger.Component("rpc").With(logging.Field{"method", method}, logging.Field{"key", a.key.Name},
+		logging.Field{"duration", time.Since(start)})
+	if *err != nil {
+		logger.Info("Call failed.", logging.Field{"error", *err})
+	} else {
+		logger.Debug("Call succeeded.")
+	}
+}
+
+// Makes sure the key (as it is now, so revoking it counts straight away)
+// allows the scope.
+func (a *authedEbooker) require(scope string) (*apiKey, error) {
+	key, exists := a.eb.data.getAPIKey(a.key.Hash)
+	if !exists {
+		return nil, UNAUTHENTICATED
+	}
+	if !key.allows(scope) {
+		return nil, forbiddenError("This API key doesn't have the " + scope + " scope.")
+	}
+	return key, nil
+}
+
+// Makes sure the key can look after the named bot. Bots it can't are none of
+// its business, so as far as it knows they don't exist.
+func (a *authedEbooker) requireBot(name string) error {
+	key, err := a.require(SCOPE_BOTS)
+	if err != nil {
+		return err
+	}
+	if bot, exists := a.eb.bots.get(name); !key.allows(SCOPE_ADMIN) && (!exists || !key.owns(bot)) {
+		return NO_SUCH_BOT
+	}
+	return nil
+}
+
+// Any key will do, so long as it hasn't been revoked.
+func (a *authedEbooker) Ping(_ string, out *string) (err error) {
+	defer a.observe("Ping", time.Now(), &err)
+	if _, exists := a.eb.data.getAPIKey(a.key.Hash); !exists {
+		return UNAUTHENTICATED
+	}
+	return a.eb.Ping("", out)
+}
+
+func (a *authedEbooker) GenerateTweets(args *defs.GenParams, out *defs.Tweets) (err error) {
+	defer a.observe("GenerateTweets", time.Now(), &err)
+	if _, err := a.require(SCOPE_GENERATE); err != nil {
+		return err
+	}
+	return a.eb.GenerateTweets(args, out)
+}
+
+// Makes the bot, belonging to the key. Without admin, the key has to hand
+// over the account's credentials rather than use ones we have stored.
+func (a *authedEbooker) NewBot(args *defs.NewBotParams, out *string) (err error) {
+	defer a.observe("NewBot", time.Now(), &err)
+	key, err := a.require(SCOPE_BOTS)
+	if err != nil {
+		return err
+	}
+	if stored, exists := a.eb.data.getUserAccessToken(credentialKey(args.Publish.Kind, args.Auth.User)); exists && !key.allows(SCOPE_ADMIN) {
+		sameToken := subtle.ConstantTimeCompare([]byte(stored.OAuthToken), []byte(args.Auth.Token)) == 1
+		sameSecret := subtle.ConstantTimeCompare([]byte(stored.OAuthTokenSecret), []byte(args.Auth.TokenSecret)) == 1
+		if !sameToken || !sameSecret {
+			return forbiddenError("Only admin keys can use the credentials stored for " + args.Auth.User + "; provide its token.")
+		}
+	}
+	return a.eb.createBot(args, key.Name, BOT_RUNNING, out)
+}
+
+func (a *authedEbooker) ListBots(_ string, out *[]string) (err error) {
+	defer a.observe("ListBots", time.Now(), &err)
+	key, err := a.require(SCOPE_BOTS)
+	if err != nil {
+		return err
+	}
+	for _, name := range a.eb.bots.names() {
+		if bot, exists := a.eb.bots.get(name); exists && key.owns(bot) {
+			*out = append(*out, name+":"+strings.Join(bot.sources, ","))
+		}
+	}
+	return nil
+}
+
+func (a *authedEbooker) CancelBot(name string, out *string) (err error) {
+	defer a.observe("CancelBot", time.Now(), &err)
+	if err := a.requireBot(name); err != nil {
+		return err
+	}
+	return a.eb.CancelBot(name, out)
+}
+
+func (a *authedEbooker) PauseBot(name string, out *string) (err error) {
+	defer a.observe("PauseBot", time.Now(), &err)
+	if err := a.requireBot(name); err != nil {
+		return err
+	}
+	return a.eb.PauseBot(name, out)
+}
+
+func (a *authedEbooker) ResumeBot(name string, out *string) (err error) {
+	defer a.observe("ResumeBot", time.Now(), &err)
+	if err := a.requireBot(name); err != nil {
+		return err
+	}
+	return a.eb.ResumeBot(name, out)
+}
+
+func (a *authedEbooker) GetBotSchedule(name string, out *defs.BotStatus) (err error) {
+	defer a.observe("GetBotSchedule", time.Now(), &err)
+	if err := a.requireBot(name); err != nil {
+		return err
+	}
+	return a.eb.GetBotSchedule(name, out)
+}
+
+func (a *authedEbooker) SetBotSchedule(args *defs.BotSchedule, out *string) (err error) {
+	defer a.observe("SetBotSchedule", time.Now(), &err)
+	if err := a.requireBot(args.Name); err != nil {
+		return err
+	}
+	return a.eb.SetBotSchedule(args, out)
+}
+
+func (a *authedEbooker) DeleteBot(name string, out *string) (err error) {
+	defer a.observe("DeleteBot", time.Now(), &err)
+	if err := a.requireBot(name); err != nil {
+		return err
+	}
+	return a.eb.DeleteBot(name, out)
+}
+
+// Reports on the sources of the key's bots; admin keys hear about them all.
+func (a *authedEbooker) RefreshStatus(_ string, out *[]defs.SourceStatus) (err error) {
+	defer a.observe("RefreshStatus", time.Now(), &err)
+	key, err := a.require(SCOPE_BOTS)
+	if err != nil {
+		return err
+	}
+	var statuses []defs.SourceStatus
+	a.eb.RefreshStatus("", &statuses)
+	if key.allows(SCOPE_ADMIN) {
+		*out = statuses
+		return nil
+	}
+
+	sources := make(map[string]bool)
+	for _, name := range a.eb.bots.names() {
+		if bot, exists := a.eb.bots.get(name); exists && key.owns(bot) {
+			for _, source := range bot.sources {
+				sources[source] = true
+			}
+		}
+	}
+	for _, status := range statuses {
+		if sources[status.User] {
+			*out = append(*out, status)
+		}
+	}
+	return nil
+}
+
+// Exports sources' tweets for generate keys, and bots' posts for the keys
+// that look after them.
+func (a *authedEbooker) Export(args *defs.ExportParams, out *string) (err error) {
+	defer a.observe("Export", time.Now(), &err)
+	if args.Bot != "" {
+		err = a.requireBot(args.Bot)
+	} else {
+		_, err = a.require(SCOPE_GENERATE)
+	}
+	if err != nil {
+		return err
+	}
+	return a.eb.Export(args, out)
+}
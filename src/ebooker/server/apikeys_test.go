@@ -0,0 +1,181 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/oauth1"
+
+	"bufio"
+	"context"
+	"io"
+	"launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+)
+
+// hook up gocheck into the gotest runner.
+type APIKeySuite struct{}
+
+var _ = gocheck.Suite(&APIKeySuite{})
+
+// An Ebooker as the holder of a new key with these scopes sees it.
+func makeTestAuthed(c *gocheck.C, eb *Ebooker, name string, scopes ...string) *authedEbooker {
+	key, err := createAPIKey(eb.data, name, scopes)
+	c.Assert(err, gocheck.IsNil)
+	stored, _ := eb.data.getAPIKey(hashAPIKey(key))
+	return &authedEbooker{eb, stored}
+}
+
+func (s APIKeySuite) TestAPIKeys(c *gocheck.C) {
+	data := getMemoryDataHandle()
+	key, err := createAPIKey(data, "pablo", []string{SCOPE_BOTS})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(key, gocheck.Matches, API_KEY_PREFIX+"[A-Za-z0-9_-]{43}")
+
+	// We keep the hash, not the key.
+	stored := data.loadAPIKeys()
+	c.Assert(len(stored), gocheck.Equals, 1)
+	c.Assert(stored[0].Hash, gocheck.Equals, hashAPIKey(key))
+	c.Assert(stored[0].Hash, gocheck.Not(gocheck.Equals), key)
+
+	_, err = createAPIKey(data, "pablo", []string{SCOPE_GENERATE})
+	c.Assert(err, gocheck.ErrorMatches, "There's already an API key named pablo.")
+	_, err = createAPIKey(data, "pablo meier", []string{SCOPE_GENERATE})
+	c.Assert(err, gocheck.NotNil)
+
+	request := func(authorization string) *http.Request {
+		r, _ := http.NewRequest("GET", "/v1/bots", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		return r
+	}
+	found, err := authenticate(data, request("Bearer "+key))
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(found.Name, gocheck.Equals, "pablo")
+	_, err = authenticate(data, request("bearer "+key))
+	c.Assert(err, gocheck.IsNil)
+	for _, authorization := range []string{"", key, "Basic " + key, "Bearer ebk_nope", "Bearer " + hashAPIKey(key)} {
+		_, err = authenticate(data, request(authorization))
+		c.Assert(err, gocheck.Equals, UNAUTHENTICATED)
+	}
+
+	scopes, err := parseScopes("generate, bots")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(scopes, gocheck.DeepEquals, []string{SCOPE_GENERATE, SCOPE_BOTS})
+	_, err = parseScopes("generate,everything")
+	c.Assert(err, gocheck.ErrorMatches, "No such scope \"everything\".*")
+}
+
+// Keys only get at what their scopes allow, and at the bots they made.
+func (s APIKeySuite) TestScopesAndOwnership(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+	alice := makeTestAuthed(c, eb, "alice", SCOPE_GENERATE, SCOPE_BOTS)
+	bob := makeTestAuthed(c, eb, "bob", SCOPE_BOTS)
+	generator := makeTestAuthed(c, eb, "generator", SCOPE_GENERATE)
+	admin := makeTestAuthed(c, eb, "admin", SCOPE_ADMIN)
+
+	var tweets defs.Tweets
+	genArgs := makeTestGenParams("SrPablo")
+	c.Assert(generator.GenerateTweets(&genArgs, &tweets), gocheck.IsNil)
+	c.Assert(bob.GenerateTweets(&genArgs, &tweets), gocheck.ErrorMatches, "This API key doesn't have the generate scope.")
+
+	var msg string
+	args := defs.NewBotParams{"alice_ebooks", makeTestGenParams("SrPablo"), defs.AuthParams{"alice_ebooks", "token", "secret"},
+		defs.Schedule{""}, defs.PublisherParams{}}
+	c.Assert(generator.NewBot(&args, &msg), gocheck.FitsTypeOf, forbiddenError(""))
+	c.Assert(alice.NewBot(&args, &msg), gocheck.IsNil)
+	bot, _ := eb.bots.get("alice_ebooks")
+	c.Assert(bot.record().Owner, gocheck.Equals, "alice")
+
+	// Bob can't tell alice's bot is there, let alone touch it.
+	var bots []string
+	c.Assert(bob.ListBots("", &bots), gocheck.IsNil)
+	c.Assert(len(bots), gocheck.Equals, 0)
+	c.Assert(bob.PauseBot("alice_ebooks", &msg), gocheck.Equals, NO_SUCH_BOT)
+	c.Assert(bob.DeleteBot("alice_ebooks", &msg), gocheck.Equals, NO_SUCH_BOT)
+	c.Assert(bob.Export(&defs.ExportParams{Bot: "alice_ebooks"}, &msg), gocheck.Equals, NO_SUCH_BOT)
+	var sources []defs.SourceStatus
+	c.Assert(bob.RefreshStatus("", &sources), gocheck.IsNil)
+	c.Assert(len(sources), gocheck.Equals, 0)
+
+	c.Assert(alice.PauseBot("alice_ebooks", &msg), gocheck.IsNil)
+	c.Assert(alice.RefreshStatus("", &sources), gocheck.IsNil)
+	c.Assert(len(sources), gocheck.Equals, 1)
+	c.Assert(admin.ResumeBot("alice_ebooks", &msg), gocheck.IsNil)
+	bots = nil
+	c.Assert(admin.ListBots("", &bots), gocheck.DeepEquals, nil)
+	c.Assert(bots, gocheck.DeepEquals, []string{"alice_ebooks:SrPablo"})
+
+	// Stored credentials are only for admins, and those who know them.
+	eb.data.insertUserAccessToken("SrPablo_ebooks", &oauth1.Token{"stored", "secret"})
+	args = defs.NewBotParams{"bob_ebooks", makeTestGenParams("SrPablo"), defs.AuthParams{"SrPablo_ebooks", "", ""},
+		defs.Schedule{""}, defs.PublisherParams{}}
+	c.Assert(bob.NewBot(&args, &msg), gocheck.ErrorMatches, "Only admin keys can use the credentials stored for SrPablo_ebooks.*")
+	args.Auth = defs.AuthParams{"SrPablo_ebooks", "stored", "secret"}
+	c.Assert(bob.NewBot(&args, &msg), gocheck.IsNil)
+	args.Name, args.Auth = "admin_ebooks", defs.AuthParams{"SrPablo_ebooks", "", ""}
+	c.Assert(admin.NewBot(&args, &msg), gocheck.IsNil)
+
+	// Revoking a key takes effect straight away.
+	c.Assert(eb.data.deleteAPIKey("alice"), gocheck.Equals, true)
+	c.Assert(alice.ListBots("", &bots), gocheck.Equals, UNAUTHENTICATED)
+	c.Assert(eb.data.deleteAPIKey("alice"), gocheck.Equals, false)
+}
+
+// Connects to an rpcGate the way the client does, carrying key.
+func dialTestRPCGate(server *httptest.Server, key string) (*rpc.Client, *http.Response, error) {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\r\nAuthorization: Bearer "+key+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, resp, err
+	}
+	return rpc.NewClient(conn), resp, nil
+}
+
+func (s APIKeySuite) TestRPCGate(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+	key, err := createAPIKey(eb.data, "generator", []string{SCOPE_GENERATE})
+	c.Assert(err, gocheck.IsNil)
+
+	mux := http.NewServeMux()
+	gate := newRPCGate(eb)
+	mux.Handle(rpc.DefaultRPCPath, gate)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	_, resp, err := dialTestRPCGate(server, "ebk_nope")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusUnauthorized)
+
+	client, _, err := dialTestRPCGate(server, key)
+	c.Assert(err, gocheck.IsNil)
+	defer client.Close()
+	genArgs := makeTestGenParams("SrPablo")
+	var tweets defs.Tweets
+	c.Assert(client.Call("Ebooker.GenerateTweets", &genArgs, &tweets), gocheck.IsNil)
+	c.Assert(len(tweets), gocheck.Equals, genArgs.NumTweets)
+	var bots []string
+	err = client.Call("Ebooker.ListBots", "", &bots)
+	c.Assert(err, gocheck.NotNil)
+	c.Assert(strings.Contains(err.Error(), "bots scope"), gocheck.Equals, true)
+
+	// Shutting down hangs up on everyone, and anyone who calls after.
+	gate.closeConnections()
+	c.Assert(client.Call("Ebooker.GenerateTweets", &genArgs, &tweets), gocheck.NotNil)
+	_, _, err = dialTestRPCGate(server, key)
+	c.Assert(err, gocheck.NotNil)
+}
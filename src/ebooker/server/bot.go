@@ -1,57 +1,278 @@
 package main
 
 import (
+	"ebooker/defs"
 	"ebooker/logging"
 	"ebooker/oauth1"
 
+	"errors"
+	"sync"
 	"time"
 )
 
 /*
 All the data/functions for the bots.
+
+A bot is always in one of three states:
+
+  running  it tweets whenever its schedule ticks.
+  paused   its schedule keeps ticking, but it lets the ticks go by.
+  stopped  its schedule has been killed, and nothing's listening.
+
+    running --pause--> paused --resume--> running
+    running/paused --stop--> stopped --resume--> running (on a fresh schedule)
+
+Rescheduling swaps in a new schedule without changing the state. Anything else
+(pausing a paused bot, say) is an error.
 */
 
+type botState int
+
+// How long past its due time a tick may be before we call the bot stuck. Long
+// enough for a slow post (Twitter timing out, a webhook retrying) to finish.
+const BOT_TICK_GRACE = 5 * time.Minute
+
+const (
+	BOT_RUNNING botState = iota
+	BOT_PAUSED
+	BOT_STOPPED
+)
+
+var botStateNames = []string{"running", "paused", "stopped"}
+
+func (s botState) String() string {
+	return botStateNames[s]
+}
+
+func parseBotState(name string) (botState, error) {
+	for i, stateName := range botStateNames {
+		if name == stateName {
+			return botState(i), nil
+		}
+	}
+	return BOT_RUNNING, errors.New("No such bot state: " + name)
+}
+
 type Bot struct {
-	username string
-	sources  []string
-	gen      *Generator
-	token    *oauth1.Token
-	sched    *Schedule
+	name      string // unique on the server
+	username  string // the account it tweets as
+	sources   []string
+	prefixLen int
+	reps      bool
+	gen       *Generator
+	token     *oauth1.Token
+	publisher Publisher
+	owner     string // the name of the API key that made it, if one did
 
 	logger *logging.LogMaster
-	data   *DataHandle
+	data   Datastore
 	oauth  *oauth1.OAuth1
-	tf     *TweetFetcher
+	tf     TwitterAPI
+
+	lock  sync.Mutex // guards the fields below
+	state botState
+	cron  string
+	sched *Schedule
+	due   time.Time // when sched should next tick, as of the bot's last look
+
+	cycle sync.Mutex // held while tweeting
+}
+
+// What we keep of a bot across restarts: enough to build it again.
+type botRecord struct {
+	Name      string
+	Account   string
+	Sources   []string
+	PrefixLen int
+	Reps      bool
+	Cron      string
+	State     string
+	Publish   defs.PublisherParams
+	Owner     string
+}
+
+// Creates a bot called name posting as username through publisher, in state,
+// sharing the Ebooker's resources.
+func (eb *Ebooker) newBot(name, username string, genArgs *defs.GenParams, cron string, gen *Generator, token *oauth1.Token, publisher Publisher, state botState, sched *Schedule) *Bot {
+	return &Bot{name: name, username: username, sources: genArgs.Users, prefixLen: genArgs.PrefixLen, reps: genArgs.Reps,
+		gen: gen, token: token, publisher: publisher, logger: eb.logger.Component("bots").With(logging.Field{"bot", name}), data: eb.data, oauth: eb.oauth, tf: eb.tf,
+		state: state, cron: cron, sched: sched}
+}
+
+func (b *Bot) record() botRecord {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return botRecord{b.name, b.username, b.sources, b.prefixLen, b.reps, b.cron, b.state.String(), b.publisher.params(), b.owner}
+}
+
+// Reports the bot's schedule and state, and when it'll next tweet if it's
+// running.
+func (b *Bot) status() defs.BotStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status := defs.BotStatus{b.name, b.state.String(), b.sched.String(), time.Time{}, b.sources}
+	if b.state == BOT_RUNNING {
+		status.Next = time.Now().Add(b.sched.next())
+	}
+	return status
+}
+
+func (b *Bot) currentState() botState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+func (b *Bot) schedule() *Schedule {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.sched
 }
 
-// Runs perpetually, forever tweeting
+// Runs perpetually, forever tweeting, until the bot is killed.
 func (b *Bot) Run() {
-	b.logger.StatusWrite("Bot %s ordered to run! Away we go!\n", b.username)
+	b.run(b.schedule())
+}
+
+// Runs the bot on sched until sched is killed. Pausing doesn't stop this; we
+// just skip the ticks.
+func (b *Bot) run(sched *Schedule) {
+	b.logger.Info("Ordered to run! Away we go!", logging.Field{"account", b.username})
 
-	c := b.sched.tickingChannel()
-	for _ = range c {
-		if b.sched.shouldKill() {
-			b.logger.StatusWrite("Bot %s received killing order! Dying...\n", b.username)
-			break
+	c := sched.tickingChannel()
+	for {
+		b.expectTick(sched)
+		select {
+		case <-sched.done():
+			b.logger.Info("Received killing order! Dying...")
+			return
+		case <-c:
 		}
-		b.logger.StatusWrite("At %v bot %s received the order to tweet.\n", time.Now(), b.username)
+		if state := b.currentState(); state != BOT_RUNNING {
+			b.logger.Info("Skipping this tweet.", logging.Field{"state", state.String()})
+			continue
+		}
+		b.logger.Debug("Received the order to tweet.")
+		b.tweet()
+		b.logger.Debug("Next tweet due.", logging.Field{"after", sched.next()})
+	}
+}
 
-		// Update Sources
-		newSources := fetchNewSources(b.sources, b.token, b.data, b.logger, b.tf)
+// Notes when sched should next tick, so we can tell if the bot gets stuck.
+func (b *Bot) expectTick(sched *Schedule) {
+	due := time.Now().Add(sched.next())
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.sched == sched {
+		b.due = due
+	}
+}
 
-		// Add new seeds to generator.
-		for _, val := range newSources {
-			b.gen.AddSeeds(val)
-		}
+// Whether the bot has missed a tick by more than BOT_TICK_GRACE: its schedule
+// should have ticked, and the bot should have been back listening for the
+// next, a while ago. Stopped bots, and bots not yet running, can't be late.
+func (b *Bot) overdue(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state != BOT_STOPPED && !b.due.IsZero() && now.After(b.due.Add(BOT_TICK_GRACE))
+}
+
+// Generates and sends a tweet. Keeping the generator fed is the refresher's
+// job, not ours.
+func (b *Bot) tweet() {
+	b.cycle.Lock()
+	defer b.cycle.Unlock()
 
-		// fire off the new tweet
-		message := b.gen.GenerateText()
-		b.logger.StatusWrite("Sending \"%s\"\n", message)
-		b.tf.sendTweet(message, b.token)
-		b.logger.StatusWrite("Success! Next tweet due after %v\n", b.sched.next().String())
+	// fire off the new tweet
+	message := b.gen.GenerateTextWithin(b.publisher.charLimit())
+	b.logger.Info("Sending a tweet.", logging.Field{"text", message})
+	if err := b.publisher.publish(message); err != nil {
+		b.logger.Error("Couldn't post.", logging.Field{"error", err})
+		POSTS.inc(b.name, "failed")
+		return
 	}
+	POSTS.inc(b.name, "sent")
+	b.data.recordPost(postRecord{b.name, b.username, message, time.Now()})
 }
 
+// Kills the bot's schedule, so Run returns, without changing its state. For
+// when the bot is going away entirely, or the whole server is.
 func (b *Bot) Kill() {
+	b.schedule().kill()
+}
+
+func (b *Bot) pause() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state != BOT_RUNNING {
+		return conflictError(b.name + " is " + b.state.String() + ", not running.")
+	}
+	b.state = BOT_PAUSED
+	return nil
+}
+
+// Sets a paused or stopped bot running again. A stopped bot gets a fresh
+// schedule, returned so the caller can Run the bot on it; for a paused one we
+// return nil, as it's still running on its old one.
+func (b *Bot) resume() (*Schedule, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BOT_PAUSED:
+		b.state = BOT_RUNNING
+		return nil, nil
+	case BOT_STOPPED:
+		sched, err := cronParse(b.cron)
+		if err != nil {
+			return nil, err
+		}
+		b.state = BOT_RUNNING
+		b.sched = sched
+		b.due = time.Time{}
+		return sched, nil
+	}
+	return nil, conflictError(b.name + " is already running.")
+}
+
+func (b *Bot) stop() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == BOT_STOPPED {
+		return conflictError(b.name + " is already stopped.")
+	}
+	b.state = BOT_STOPPED
+	b.sched.kill()
+	return nil
+}
+
+// Moves the bot onto a new schedule. If it's running or paused, the new
+// schedule is returned so the caller can Run the bot on it; the old one is
+// killed. A stopped bot just remembers the schedule for when it's resumed.
+func (b *Bot) reschedule(cron string) (*Schedule, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == BOT_STOPPED {
+		sched, err := parseCron(cron)
+		if err != nil {
+			return nil, err
+		}
+		b.cron = cron
+		b.sched = sched
+		return nil, nil
+	}
+
+	sched, err := cronParse(cron)
+	if err != nil {
+		return nil, err
+	}
 	b.sched.kill()
+	b.cron = cron
+	b.sched = sched
+	b.due = time.Time{}
+	return sched, nil
 }
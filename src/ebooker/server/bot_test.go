@@ -0,0 +1,169 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/oauth1"
+
+	"context"
+	"launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type BotSuite struct{}
+
+var _ = gocheck.Suite(&BotSuite{})
+
+// A bot ticked by hand, rather than by the clock, tweets through the fake.
+// Ticking doesn't fetch anything, or touch the generator's weights; that's for
+// the refresher.
+func (s BotSuite) TestRun(c *gocheck.C) {
+	ft := newFakeTwitter()
+	ft.tweet("SrPablo", TweetData{1, "today is a great day"})
+	eb := makeTestEbooker(ft)
+
+	gen := CreateGenerator(1, 140, eb.logger)
+	gen.AddSeeds("today is a great day")
+	sched := newSchedule("0", "11,19", ALL, ALL, ALL)
+	genArgs := makeTestGenParams("SrPablo")
+	bot := eb.newBot("SrPablo_ebooks", "SrPablo_ebooks", &genArgs, "", gen, &oauth1.Token{}, &twitterPublisher{ft, &oauth1.Token{}}, BOT_RUNNING, sched)
+
+	done := make(chan bool)
+	go func() {
+		bot.Run()
+		done <- true
+	}()
+
+	sched.fireOff <- time.Now()
+	c.Assert(<-ft.posted, gocheck.Equals, "today is a great day")
+	sched.fireOff <- time.Now()
+	<-ft.posted
+	c.Assert(len(eb.data.GetTweetsFromStorage("SrPablo")), gocheck.Equals, 0)
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 1)
+
+	bot.Kill()
+	<-done
+	posts := eb.data.loadPosts("SrPablo_ebooks")
+	c.Assert(len(posts), gocheck.Equals, 2)
+	c.Assert(posts[0].Text, gocheck.Equals, "today is a great day")
+	c.Assert(posts[0].Account, gocheck.Equals, "SrPablo_ebooks")
+}
+
+// Killing a bot stops it even when nothing is ticking, and killing it again
+// (or from several places at once) doesn't block.
+func (s BotSuite) TestKill(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	sched, _ := cronParse("")
+	genArgs := makeTestGenParams("SrPablo")
+	bot := eb.newBot("SrPablo_ebooks", "SrPablo_ebooks", &genArgs, "", CreateGenerator(1, 140, eb.logger), &oauth1.Token{}, &twitterPublisher{eb.tf, &oauth1.Token{}}, BOT_RUNNING, sched)
+
+	done := make(chan bool)
+	go func() {
+		bot.Run()
+		done <- true
+	}()
+
+	for i := 0; i < CHANNEL_BUFFER+2; i++ {
+		go bot.Kill()
+	}
+	<-done
+	bot.Kill()
+}
+
+// Walks a bot through every transition, allowed or not. Ticks sent to a paused
+// bot go by without a tweet; once it's resumed, it tweets again.
+func (s BotSuite) TestStateMachine(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	bot := startTestBot(eb, "SrPablo_ebooks", c)
+	var msg string
+
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_RUNNING)
+	c.Assert(eb.ResumeBot("SrPablo_ebooks", &msg), gocheck.ErrorMatches, ".*already running.*")
+
+	// running -> paused
+	sched := bot.schedule()
+	c.Assert(eb.PauseBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_PAUSED)
+	c.Assert(eb.PauseBot("SrPablo_ebooks", &msg), gocheck.ErrorMatches, ".*paused, not running.*")
+	tickAndWait(bot)
+
+	// paused -> stopped
+	c.Assert(eb.CancelBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_STOPPED)
+	eb.running.Wait()
+	c.Assert(len(ft.posted), gocheck.Equals, 0)
+	c.Assert(eb.CancelBot("SrPablo_ebooks", &msg), gocheck.ErrorMatches, ".*already stopped.*")
+	c.Assert(eb.PauseBot("SrPablo_ebooks", &msg), gocheck.ErrorMatches, ".*stopped, not running.*")
+
+	// stopped -> running, on a new schedule
+	c.Assert(eb.ResumeBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_RUNNING)
+	c.Assert(bot.schedule(), gocheck.Not(gocheck.Equals), sched)
+	tickAndWait(bot)
+	c.Assert(strings.HasPrefix(<-ft.posted, "today"), gocheck.Equals, true)
+
+	// paused -> running, on the same schedule
+	sched = bot.schedule()
+	c.Assert(eb.PauseBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(eb.ResumeBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_RUNNING)
+	c.Assert(bot.schedule(), gocheck.Equals, sched)
+	tickAndWait(bot)
+	<-ft.posted
+
+	// running -> stopped
+	c.Assert(eb.CancelBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_STOPPED)
+	<-sched.done()
+
+	for _, rpc := range []func(string, *string) error{eb.PauseBot, eb.ResumeBot, eb.CancelBot} {
+		c.Assert(rpc("nobody_ebooks", &msg), gocheck.ErrorMatches, "No bot found.*")
+	}
+	eb.shutdown(context.Background())
+}
+
+// Rescheduling keeps the bot in whatever state it was in, and a stopped bot
+// picks up its new schedule when it's resumed.
+func (s BotSuite) TestReschedule(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	bot := startTestBot(eb, "SrPablo_ebooks", c)
+	var msg string
+	var status defs.BotStatus
+
+	c.Assert(eb.GetBotSchedule("SrPablo_ebooks", &status), gocheck.IsNil)
+	c.Assert(status.State, gocheck.Equals, "running")
+	c.Assert(status.Cron, gocheck.Equals, DEFAULT_CRON)
+	c.Assert(status.Next.After(time.Now()), gocheck.Equals, true)
+
+	old := bot.schedule()
+	c.Assert(eb.SetBotSchedule(&defs.BotSchedule{"SrPablo_ebooks", defs.Schedule{"30 8 * * 1-5"}}, &msg), gocheck.IsNil)
+	<-old.done()
+	c.Assert(eb.GetBotSchedule("SrPablo_ebooks", &status), gocheck.IsNil)
+	c.Assert(status.State, gocheck.Equals, "running")
+	c.Assert(status.Cron, gocheck.Equals, "30 8 * * 1-5")
+	tickAndWait(bot)
+	<-ft.posted
+
+	c.Assert(eb.SetBotSchedule(&defs.BotSchedule{"SrPablo_ebooks", defs.Schedule{"every day"}}, &msg), gocheck.NotNil)
+	c.Assert(eb.SetBotSchedule(&defs.BotSchedule{"nobody_ebooks", defs.Schedule{""}}, &msg), gocheck.NotNil)
+	c.Assert(eb.GetBotSchedule("nobody_ebooks", &status), gocheck.NotNil)
+
+	eb.PauseBot("SrPablo_ebooks", &msg)
+	c.Assert(eb.SetBotSchedule(&defs.BotSchedule{"SrPablo_ebooks", defs.Schedule{"0 9 * * *"}}, &msg), gocheck.IsNil)
+	c.Assert(bot.currentState(), gocheck.Equals, BOT_PAUSED)
+
+	eb.CancelBot("SrPablo_ebooks", &msg)
+	c.Assert(eb.SetBotSchedule(&defs.BotSchedule{"SrPablo_ebooks", defs.Schedule{"0 10 * * *"}}, &msg), gocheck.IsNil)
+	c.Assert(eb.GetBotSchedule("SrPablo_ebooks", &status), gocheck.IsNil)
+	c.Assert(status.State, gocheck.Equals, "stopped")
+	c.Assert(status.Next.IsZero(), gocheck.Equals, true)
+	c.Assert(eb.ResumeBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(bot.schedule().String(), gocheck.Equals, "0 10 * * *")
+
+	eb.shutdown(context.Background())
+}
@@ -0,0 +1,63 @@
+package main
+
+/*
+A web dashboard for the server, at /dashboard/: the bots, with their states
+and when they next post; forms to make, pause, resume and delete them; a
+preview of what sources generate; what each bot has posted; and how much we
+have of each source.
+
+It's a page of plain JavaScript over the REST API, so it can do just what the
+API key it's given can, and no more. The key is kept in the browser tab's
+sessionStorage, and sent with each request like any other client's; there are
+no cookies to forge requests with. The assets are embedded in the binary, so
+there's nothing to deploy alongside it.
+*/
+
+import (
+	"embed"
+	"net/http"
+)
+
+const DASHBOARD_PATH = "/dashboard/"
+
+//go:embed dashboard
+var DASHBOARD_ASSETS embed.FS
+
+// The page runs nothing but our own script and talks to nobody but us, and
+// nobody gets to frame it.
+const DASHBOARD_CSP = "default-src 'self'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+type dashboard struct {
+	assets http.Handler
+}
+
+func newDashboard() *dashboard {
+	// The embedded files are under dashboard/, just like the paths we serve
+	// them at.
+	return &dashboard{http.FileServer(http.FS(DASHBOARD_ASSETS))}
+}
+
+// Hooks the dashboard up to the mux, with the server's root sending browsers
+// to it.
+func (d *dashboard) register(mux *http.ServeMux) {
+	mux.Handle(DASHBOARD_PATH, d)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, DASHBOARD_PATH, http.StatusFound)
+	})
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "The dashboard is read-only; it changes things through "+REST_PREFIX+".", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", DASHBOARD_CSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	d.assets.ServeHTTP(w, r)
+}
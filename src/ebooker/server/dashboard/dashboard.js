@@ -0,0 +1,227 @@
+"use strict";
+
+// The dashboard is a page over the REST API (see restapi.go). The API key
+// lives in this tab's sessionStorage and goes with every request.
+
+const KEY_STORAGE = "ebooker-api-key";
+
+// Go's zero time, which the API gives for "never".
+const ZERO_YEAR = 1;
+
+function apiKey() {
+  return sessionStorage.getItem(KEY_STORAGE) || "";
+}
+
+// Calls the API, resolving to its JSON (or text, for exports), or rejecting
+// with the message of the error it sent back.
+async function api(method, path, body) {
+  const response = await fetch(path, {
+    method: method,
+    headers: {"Authorization": "Bearer " + apiKey(), "Content-Type": "application/json"},
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  const type = response.headers.get("Content-Type") || "";
+  const result = type.startsWith("application/json") ? await response.json() : await response.text();
+  if (!response.ok) {
+    throw new Error(result.error ? result.error.message : response.status + " " + response.statusText);
+  }
+  return result;
+}
+
+function botPath(name, action) {
+  return "/v1/bots/" + encodeURIComponent(name) + (action ? "/" + action : "");
+}
+
+function say(text, isError) {
+  const message = document.getElementById("message");
+  message.textContent = text;
+  message.className = isError ? "error" : "";
+}
+
+function splitList(text) {
+  return text.split(",").map((item) => item.trim()).filter((item) => item !== "");
+}
+
+function formatTime(time) {
+  const date = new Date(time);
+  return isNaN(date) || date.getUTCFullYear() <= ZERO_YEAR ? "" : date.toLocaleString();
+}
+
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  row.appendChild(td);
+  return td;
+}
+
+function button(label, onClick) {
+  const b = document.createElement("button");
+  b.type = "button";
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  return b;
+}
+
+// Runs an API call from a button or form, telling the user how it went and
+// refreshing what it might have changed.
+async function act(work) {
+  try {
+    const message = await work();
+    if (message) {
+      say(message, false);
+    }
+  } catch (err) {
+    say(err.message, true);
+  }
+}
+
+async function loadBots() {
+  const result = await api("GET", "/v1/bots");
+  const body = document.querySelector("#bots tbody");
+  body.replaceChildren();
+  for (const bot of result.bots) {
+    const row = document.createElement("tr");
+    row.className = bot.state;
+    cell(row, bot.name);
+    cell(row, bot.state);
+    cell(row, bot.cron);
+    cell(row, formatTime(bot.next));
+    cell(row, (bot.sources || []).join(", "));
+
+    const actions = cell(row, "");
+    if (bot.state === "running") {
+      actions.appendChild(button("Pause", () => botAction(bot.name, "pause")));
+    } else {
+      actions.appendChild(button("Resume", () => botAction(bot.name, "resume")));
+    }
+    actions.appendChild(button("History", () => act(() => showHistory(bot.name))));
+    actions.appendChild(button("Delete", () => {
+      if (confirm("Delete " + bot.name + " for good?")) {
+        act(async () => {
+          const result = await api("DELETE", botPath(bot.name));
+          await refresh();
+          return result.message;
+        });
+      }
+    }));
+    body.appendChild(row);
+  }
+}
+
+function botAction(name, action) {
+  act(async () => {
+    const result = await api("POST", botPath(name, action));
+    await refresh();
+    return result.message;
+  });
+}
+
+async function loadSources() {
+  const result = await api("GET", "/v1/sources");
+  const body = document.querySelector("#sources tbody");
+  body.replaceChildren();
+  for (const source of result.sources || []) {
+    const row = document.createElement("tr");
+    cell(row, source.user);
+    cell(row, source.total);
+    cell(row, formatTime(source.lastRefresh));
+    cell(row, source.lastFetched);
+    cell(row, source.models);
+    body.appendChild(row);
+  }
+}
+
+// Shows what the bot has posted, newest first.
+async function showHistory(name) {
+  const exported = await api("POST", "/v1/export", {bot: name, format: "jsonl"});
+  const posts = exported.split("\n").filter((line) => line !== "").map((line) => JSON.parse(line));
+  const list = document.getElementById("history");
+  list.replaceChildren();
+  for (const post of posts.reverse()) {
+    const item = document.createElement("li");
+    const time = document.createElement("time");
+    time.dateTime = post.time;
+    time.textContent = formatTime(post.time);
+    item.append(time, " ", post.text);
+    list.appendChild(item);
+  }
+  document.getElementById("history-bot").textContent = name;
+  document.getElementById("history-section").hidden = false;
+  return posts.length === 0 ? name + " hasn't posted anything yet." : "";
+}
+
+async function refresh() {
+  if (apiKey() === "") {
+    say("Enter an API key (from the server's -newkey) to get started.", false);
+    return;
+  }
+  await loadBots();
+  await loadSources();
+}
+
+function createBot(form) {
+  const fields = form.elements;
+  const auth = {user: fields.user.value.trim(), token: fields.token.value, tokenSecret: fields.tokenSecret.value};
+  const publish = {kind: fields.kind.value, instance: fields.instance.value.trim(),
+    webhook: {url: fields.webhook.value.trim()}};
+  const bot = {
+    name: fields.name.value.trim(),
+    gen: {users: splitList(fields.users.value), prefixLen: Number(fields.prefixLen.value), auth: auth},
+    auth: auth,
+    sched: {cron: fields.cron.value.trim()},
+    publish: publish,
+  };
+  act(async () => {
+    const result = await api("POST", "/v1/bots", bot);
+    form.reset();
+    await refresh();
+    return result.message;
+  });
+}
+
+function preview(form) {
+  const fields = form.elements;
+  const args = {users: splitList(fields.users.value), prefixLen: Number(fields.prefixLen.value),
+    numTweets: Number(fields.numTweets.value)};
+  act(async () => {
+    const result = await api("POST", "/v1/generate", args);
+    const list = document.getElementById("previews");
+    list.replaceChildren();
+    for (const tweet of result.tweets) {
+      const item = document.createElement("li");
+      item.textContent = tweet;
+      list.appendChild(item);
+    }
+    return "";
+  });
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  document.getElementById("key-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    const key = document.getElementById("key");
+    sessionStorage.setItem(KEY_STORAGE, key.value.trim());
+    key.value = "";
+    act(async () => {
+      await refresh();
+      return "Key accepted.";
+    });
+  });
+  document.getElementById("forget-key").addEventListener("click", () => {
+    sessionStorage.removeItem(KEY_STORAGE);
+    document.querySelector("#bots tbody").replaceChildren();
+    document.querySelector("#sources tbody").replaceChildren();
+    document.getElementById("history-section").hidden = true;
+    say("Forgotten.", false);
+  });
+  document.getElementById("refresh").addEventListener("click", () => act(refresh));
+  document.getElementById("new-bot").addEventListener("submit", (event) => {
+    event.preventDefault();
+    createBot(event.target);
+  });
+  document.getElementById("preview").addEventListener("submit", (event) => {
+    event.preventDefault();
+    preview(event.target);
+  });
+  act(refresh);
+});
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+)
+
+// hook up gocheck into the gotest runner.
+type DashboardSuite struct{}
+
+var _ = gocheck.Suite(&DashboardSuite{})
+
+func startTestDashboard() *httptest.Server {
+	mux := http.NewServeMux()
+	newDashboard().register(mux)
+	return httptest.NewServer(mux)
+}
+
+// Fetches the path, without following redirects.
+func dashboardGet(c *gocheck.C, server *httptest.Server, method, path string) (*http.Response, string) {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	c.Assert(err, gocheck.IsNil)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, gocheck.IsNil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func (s DashboardSuite) TestDashboard(c *gocheck.C) {
+	server := startTestDashboard()
+	defer server.Close()
+
+	resp, page := dashboardGet(c, server, "GET", DASHBOARD_PATH)
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), gocheck.Equals, "text/html; charset=utf-8")
+	c.Assert(resp.Header.Get("Content-Security-Policy"), gocheck.Equals, DASHBOARD_CSP)
+	c.Assert(resp.Header.Get("X-Content-Type-Options"), gocheck.Equals, "nosniff")
+	c.Assert(page, gocheck.Matches, "(?s).*<title>Ebooker</title>.*")
+
+	// Everything the page links to is there, and it links to nothing
+	// elsewhere (the CSP wouldn't let it load anyway).
+	assets := regexp.MustCompile(`(?:src|href)="([^"]+)"`).FindAllStringSubmatch(page, -1)
+	c.Assert(len(assets), gocheck.Equals, 2)
+	for _, asset := range assets {
+		c.Assert(strings.Contains(asset[1], ":"), gocheck.Equals, false)
+		resp, _ := dashboardGet(c, server, "GET", DASHBOARD_PATH+asset[1])
+		c.Assert(resp.StatusCode, gocheck.Equals, http.StatusOK)
+		c.Assert(resp.Header.Get("Content-Security-Policy"), gocheck.Equals, DASHBOARD_CSP)
+	}
+
+	resp, _ = dashboardGet(c, server, "GET", "/")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusFound)
+	c.Assert(resp.Header.Get("Location"), gocheck.Equals, DASHBOARD_PATH)
+	resp, _ = dashboardGet(c, server, "GET", "/favicon.ico")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusNotFound)
+	resp, _ = dashboardGet(c, server, "GET", DASHBOARD_PATH+"nothing.js")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusNotFound)
+	resp, _ = dashboardGet(c, server, "POST", DASHBOARD_PATH)
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusMethodNotAllowed)
+}
+
+// The script only calls routes the REST API serves.
+func (s DashboardSuite) TestDashboardRoutes(c *gocheck.C) {
+	script, err := DASHBOARD_ASSETS.ReadFile("dashboard/dashboard.js")
+	c.Assert(err, gocheck.IsNil)
+	served := make(map[string]bool)
+	for _, route := range newRestAPI(nil).routes() {
+		served[route.method+" "+route.path] = true
+	}
+
+	var called []string
+	for _, call := range regexp.MustCompile(`api\("([A-Z]+)", "([^"]+)"`).FindAllStringSubmatch(string(script), -1) {
+		called = append(called, call[1]+" "+call[2])
+	}
+	// Bots' routes are made by botPath, with the action botAction is given.
+	for _, call := range regexp.MustCompile(`api\("([A-Z]+)", botPath\([\w.]+\)\)`).FindAllStringSubmatch(string(script), -1) {
+		called = append(called, call[1]+" /v1/bots/{name}")
+	}
+	c.Assert(string(script), gocheck.Matches, `(?s).*api\("POST", botPath\(name, action\)\).*`)
+	for _, call := range regexp.MustCompile(`botAction\([\w.]+, "(\w+)"\)`).FindAllStringSubmatch(string(script), -1) {
+		called = append(called, "POST /v1/bots/{name}/"+call[1])
+	}
+
+	c.Assert(len(called), gocheck.Equals, 8)
+	for _, route := range called {
+		c.Assert(served[route], gocheck.Equals, true, gocheck.Commentf("the dashboard calls %s", route))
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+/*
+Gets data back out of storage, for backups, audits, and sharing corpora
+between servers: the tweets we have for sources, and what bots have posted.
+
+Both come out as JSONL or CSV. Tweets are exported so that -import reads them
+back in, under whichever source you like.
+
+Tweets don't carry a date in storage, but since late 2010 Twitter's IDs do
+("snowflake" IDs start with the milliseconds since Twitter's epoch). Tweets
+with older IDs, or none (imported text), have no date we know of, so they're
+only exported when there's no date range to check them against.
+*/
+
+import (
+	"ebooker/defs"
+
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// What a bot posted, and when.
+type postRecord struct {
+	Bot     string
+	Account string
+	Text    string
+	Posted  time.Time
+}
+
+// Snowflake IDs count milliseconds from here, in their bits above the 22nd.
+const SNOWFLAKE_EPOCH_MS = 1288834974657
+
+// No tweet before snowflake IDs got an ID this big.
+const SNOWFLAKE_MIN_ID = 1 << 40
+
+// When the tweet with this ID was tweeted, if its ID tells us.
+func tweetTime(id uint64) (time.Time, bool) {
+	if id < SNOWFLAKE_MIN_ID {
+		return time.Time{}, false
+	}
+	ms := int64(id>>22) + SNOWFLAKE_EPOCH_MS
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC(), true
+}
+
+// Whether a time is in the range asked for. Without a range, everything is,
+// even things whose time we don't know.
+func inExportRange(when time.Time, known bool, args *defs.ExportParams) bool {
+	if args.Since.IsZero() && args.Until.IsZero() {
+		return true
+	}
+	if !known {
+		return false
+	}
+	return !when.Before(args.Since) && (args.Until.IsZero() || when.Before(args.Until))
+}
+
+// Formats a time for export, or nothing if we don't know it.
+func exportTime(when time.Time, known bool) string {
+	if !known {
+		return ""
+	}
+	return when.Format(time.RFC3339)
+}
+
+// A row in an export. It's written to JSONL as it is.
+type exportRecord interface {
+	csvRow() []string
+}
+
+type exportedTweet struct {
+	Source string `json:"source"`
+	Id     uint64 `json:"id"`
+	Time   string `json:"time,omitempty"`
+	Text   string `json:"text"`
+}
+
+// The older archive's column names, so -import reads them back.
+var EXPORTED_TWEET_COLUMNS = []string{"source", "tweet_id", "timestamp", "text"}
+
+func (t exportedTweet) csvRow() []string {
+	return []string{t.Source, strconv.FormatUint(t.Id, 10), t.Time, t.Text}
+}
+
+type exportedPost struct {
+	Bot     string `json:"bot"`
+	Account string `json:"account"`
+	Time    string `json:"time"`
+	Text    string `json:"text"`
+}
+
+var EXPORTED_POST_COLUMNS = []string{"bot", "account", "timestamp", "text"}
+
+func (p exportedPost) csvRow() []string {
+	return []string{p.Bot, p.Account, p.Time, p.Text}
+}
+
+// Export dumps the tweets we have for some sources, or what a bot has posted,
+// as JSONL or CSV.
+func (eb *Ebooker) Export(args *defs.ExportParams, out *string) error {
+	if (len(args.Sources) == 0) == (args.Bot == "") {
+		return errors.New("Export either sources' tweets or a bot's posts.")
+	}
+
+	var records []exportRecord
+	columns := EXPORTED_TWEET_COLUMNS
+	if args.Bot != "" {
+		columns = EXPORTED_POST_COLUMNS
+		for _, post := range eb.data.loadPosts(args.Bot) {
+			if inExportRange(post.Posted, true, args) {
+				records = append(records, exportedPost{post.Bot, post.Account, exportTime(post.Posted, true), post.Text})
+			}
+		}
+	} else {
+		for _, source := range args.Sources {
+			for _, tweet := range eb.data.GetTweetsFromStorage(source) {
+				when, known := tweetTime(tweet.Id)
+				if inExportRange(when, known, args) {
+					records = append(records, exportedTweet{source, tweet.Id, exportTime(when, known), tweet.Text})
+				}
+			}
+		}
+	}
+
+	eb.logger.StatusWrite("Exporting %d records.\n", len(records))
+	exported, err := encodeExport(args.Format, columns, records)
+	if err != nil {
+		return err
+	}
+	*out = exported
+	return nil
+}
+
+func encodeExport(format string, columns []string, records []exportRecord) (string, error) {
+	var buffer bytes.Buffer
+	switch format {
+	case "", FORMAT_JSONL:
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return "", err
+			}
+		}
+	case FORMAT_CSV:
+		writer := csv.NewWriter(&buffer)
+		writer.Write(columns)
+		for _, record := range records {
+			writer.Write(record.csvRow())
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New("Unknown export format \"" + format + "\". Try jsonl or csv.")
+	}
+	return buffer.String(), nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"ebooker/defs"
+
+	"launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type ExportSuite struct{}
+
+var _ = gocheck.Suite(&ExportSuite{})
+
+// 2:19:36.213 UTC on November 7th, 2013, by the ID.
+const SNOWFLAKE_ID = 398273498291122176
+
+func (s ExportSuite) TestTweetTime(c *gocheck.C) {
+	when, known := tweetTime(SNOWFLAKE_ID)
+	c.Assert(known, gocheck.Equals, true)
+	c.Assert(when, gocheck.Equals, time.Date(2013, time.November, 7, 2, 19, 36, 213*int(time.Millisecond), time.UTC))
+
+	_, known = tweetTime(20) // jack's first
+	c.Assert(known, gocheck.Equals, false)
+	_, known = tweetTime(0)
+	c.Assert(known, gocheck.Equals, false)
+}
+
+// Exported tweets come back in with -import, and dates we don't know are left
+// out of a range.
+func (s ExportSuite) TestExportTweets(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	eb.data.InsertFreshTweets("SrPablo", Tweets{{SNOWFLAKE_ID, "Just got an email whose only contents were \"LOL\"."},
+		{0, "Call me Ishmael, & so on"}})
+	eb.data.InsertFreshTweets("laurelita", Tweets{{SNOWFLAKE_ID + 1, "it's kind of the best"}})
+
+	var out string
+	args := defs.ExportParams{Sources: []string{"SrPablo", "laurelita"}}
+	c.Assert(eb.Export(&args, &out), gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `{"source":"SrPablo","id":0,"text":"Call me Ishmael, & so on"}
+{"source":"SrPablo","id":398273498291122176,"time":"2013-11-07T02:19:36Z","text":"Just got an email whose only contents were \"LOL\"."}
+{"source":"laurelita","id":398273498291122177,"time":"2013-11-07T02:19:36Z","text":"it's kind of the best"}
+`)
+	tweets, err := parseCorpus(strings.NewReader(out), FORMAT_JSONL)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(len(tweets), gocheck.Equals, 3)
+	c.Assert(tweets[1], gocheck.Equals, TweetData{SNOWFLAKE_ID, "Just got an email whose only contents were \"LOL\"."})
+
+	args = defs.ExportParams{Sources: []string{"SrPablo"}, Format: FORMAT_CSV,
+		Since: time.Date(2013, time.November, 1, 0, 0, 0, 0, time.UTC)}
+	c.Assert(eb.Export(&args, &out), gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `source,tweet_id,timestamp,text
+SrPablo,398273498291122176,2013-11-07T02:19:36Z,"Just got an email whose only contents were ""LOL""."
+`)
+	tweets, err = parseCorpus(strings.NewReader(out), FORMAT_CSV)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tweets, gocheck.DeepEquals, Tweets{{SNOWFLAKE_ID, "Just got an email whose only contents were \"LOL\"."}})
+
+	args.Until = args.Since
+	c.Assert(eb.Export(&args, &out), gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, "source,tweet_id,timestamp,text\n")
+}
+
+func (s ExportSuite) TestExportPosts(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	for day := 1; day <= 3; day++ {
+		eb.data.recordPost(postRecord{"SrPablo_ebooks", "SrPablo", "day " + string(rune('0'+day)),
+			time.Date(2014, time.January, day, 11, 0, 0, 0, time.UTC)})
+	}
+
+	var out string
+	args := defs.ExportParams{Bot: "SrPablo_ebooks", Format: FORMAT_CSV,
+		Since: time.Date(2014, time.January, 2, 0, 0, 0, 0, time.UTC)}
+	c.Assert(eb.Export(&args, &out), gocheck.IsNil)
+	c.Assert(out, gocheck.Equals, `bot,account,timestamp,text
+SrPablo_ebooks,SrPablo,2014-01-02T11:00:00Z,day 2
+SrPablo_ebooks,SrPablo,2014-01-03T11:00:00Z,day 3
+`)
+
+	c.Assert(eb.Export(&defs.ExportParams{}, &out), gocheck.NotNil)
+	c.Assert(eb.Export(&defs.ExportParams{Sources: []string{"SrPablo"}, Bot: "SrPablo_ebooks"}, &out), gocheck.NotNil)
+	c.Assert(eb.Export(&defs.ExportParams{Bot: "SrPablo_ebooks", Format: "xml"}, &out), gocheck.ErrorMatches, "Unknown export format.*")
+}
@@ -0,0 +1,218 @@
+package main
+
+/*
+RSS and Atom feeds as sources, for bots that parody blogs and news rather than
+tweeters. A feed source is named "feed:" followed by the feed's URL, and can
+be mixed with Twitter users like any other source.
+
+Each entry is split into sentences, and each sentence is stored as a "tweet".
+Feeds don't number their entries, so we remember the GUIDs of the entries
+we've seen, and every fetch keeps only the ones we haven't. The sentences get
+snowflake IDs made from their entry's date, so they're stored in order and
+export with their dates like tweets do.
+*/
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const FEED_SOURCE_PREFIX = "feed:"
+
+// We don't read more of a feed than this.
+const MAX_FEED_BYTES = 10 << 20
+
+// Dates as RSS feeds write them, more or less.
+var RSS_DATE_LAYOUTS = []string{time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST", "2 Jan 2006 15:04:05 -0700", time.RFC3339}
+
+// Words ending in a period that don't end a sentence.
+var ABBREVIATIONS = map[string]bool{"mr.": true, "mrs.": true, "ms.": true, "dr.": true, "st.": true,
+	"vs.": true, "etc.": true, "e.g.": true, "i.e.": true, "no.": true, "jr.": true, "sr.": true}
+
+// Fetches the entries of feeds we haven't seen before.
+type feedFetcher struct {
+	client *http.Client
+	data   Datastore
+	logger *logging.LogMaster
+}
+
+// RSS's items are in its channel; Atom's entries are at the top.
+type feedDocument struct {
+	Items   []feedEntry `xml:"channel>item"`
+	Entries []feedEntry `xml:"entry"`
+}
+
+// RSS's and Atom's names for things, together. Whichever the feed uses are
+// set.
+type feedEntry struct {
+	Guid        string   `xml:"guid"`
+	Id          string   `xml:"id"`
+	Link        string   `xml:"link"`
+	Title       feedText `xml:"title"`
+	Description feedText `xml:"description"`
+	Summary     feedText `xml:"summary"`
+	Encoded     feedText `xml:"encoded"` // RSS's content:encoded
+	Content     feedText `xml:"content"`
+	PubDate     string   `xml:"pubDate"`
+	Published   string   `xml:"published"`
+	Updated     string   `xml:"updated"`
+}
+
+// Text in a feed: escaped HTML, usually, but Atom's xhtml is markup.
+type feedText struct {
+	Text   string `xml:",chardata"`
+	Markup string `xml:",innerxml"`
+}
+
+func (t feedText) plain() string {
+	if strings.TrimSpace(t.Text) != "" {
+		return stripHTML(t.Text)
+	}
+	return stripHTML(t.Markup)
+}
+
+func (f *feedFetcher) DeepDive(feed string, _ *oauth1.Token) (Tweets, error) {
+	return f.GetRecentTimeline(feed, &TweetData{}, nil)
+}
+
+// Feeds only carry their latest entries, so this is all there is to a deep
+// dive, too.
+func (f *feedFetcher) GetRecentTimeline(feed string, _ *TweetData, _ *oauth1.Token) (Tweets, error) {
+	document, err := f.fetch(feed)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read the feed at %s: %v", feed, err)
+	}
+
+	source := FEED_SOURCE_PREFIX + feed
+	seen := f.data.seenFeedItems(source)
+	var fresh []string
+	tweets := Tweets{}
+	for _, entry := range append(document.Items, document.Entries...) {
+		guid := entry.guid()
+		if seen[guid] {
+			continue
+		}
+		seen[guid] = true
+		fresh = append(fresh, guid)
+		tweets = appendSlices(tweets, entry.sentences(guid))
+	}
+	f.data.markFeedItemsSeen(source, fresh)
+	return tweets, nil
+}
+
+func (f *feedFetcher) fetch(feed string) (*feedDocument, error) {
+	resp, err := f.client.Get(feed)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	countRateLimit("feed", resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the feed's server said %s", resp.Status)
+	}
+
+	var document feedDocument
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, MAX_FEED_BYTES)).Decode(&document); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+// What the entry goes by. Feeds are meant to give a GUID (or Atom id), but
+// not all do.
+func (e *feedEntry) guid() string {
+	for _, guid := range []string{e.Guid, e.Id, e.Link} {
+		if guid = strings.TrimSpace(guid); guid != "" {
+			return guid
+		}
+	}
+	return e.Title.plain() + "\n" + e.body()
+}
+
+func (e *feedEntry) body() string {
+	for _, text := range []feedText{e.Encoded, e.Content, e.Description, e.Summary} {
+		if plain := text.plain(); plain != "" {
+			return plain
+		}
+	}
+	return ""
+}
+
+// When the entry was published, or failing that, now.
+func (e *feedEntry) published() time.Time {
+	for _, date := range []string{e.PubDate, e.Published, e.Updated} {
+		for _, layout := range RSS_DATE_LAYOUTS {
+			if when, err := time.Parse(layout, strings.TrimSpace(date)); err == nil {
+				return when
+			}
+		}
+	}
+	return time.Now()
+}
+
+// The entry's title and body, a tweet per sentence.
+func (e *feedEntry) sentences(guid string) Tweets {
+	var tweets Tweets
+	published := e.published()
+	for _, text := range []string{e.Title.plain(), e.body()} {
+		for _, sentence := range splitSentences(text) {
+			tweets = append(tweets, TweetData{feedItemId(published, guid, len(tweets)), sentence})
+		}
+	}
+	return tweets
+}
+
+// A snowflake ID for the index'th sentence of an entry published then: the
+// milliseconds since Twitter's epoch, above 10 bits of the GUID's hash and 12
+// of the index, so entries published in the same millisecond don't collide.
+func feedItemId(published time.Time, guid string, index int) uint64 {
+	ms := published.UnixNano()/int64(time.Millisecond) - SNOWFLAKE_EPOCH_MS
+	if ms < 0 {
+		ms = 0
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(guid))
+	return uint64(ms)<<22 | uint64(hash.Sum32()&0x3ff)<<12 | uint64(index&0xfff)
+}
+
+// Splits text after each word that ends a sentence: one ending in ., ! or ?
+// (perhaps inside quotes or brackets) that isn't an abbreviation we know.
+func splitSentences(text string) []string {
+	var sentences []string
+	var sentence []string
+	for _, word := range strings.Fields(text) {
+		sentence = append(sentence, word)
+		if endsSentence(word) {
+			sentences = append(sentences, strings.Join(sentence, " "))
+			sentence = nil
+		}
+	}
+	if len(sentence) > 0 {
+		sentences = append(sentences, strings.Join(sentence, " "))
+	}
+	return sentences
+}
+
+func endsSentence(word string) bool {
+	trimmed := strings.TrimRightFunc(word, func(r rune) bool {
+		return strings.ContainsRune(`"')]”’»`, r)
+	})
+	last, _ := utf8.DecodeLastRuneInString(trimmed)
+	if !strings.ContainsRune(".!?…", last) || ABBREVIATIONS[strings.ToLower(trimmed)] {
+		return false
+	}
+	// Initials, like the J. in J. R. R. Tolkien.
+	first, size := utf8.DecodeRuneInString(trimmed)
+	return !(unicode.IsUpper(first) && trimmed[size:] == ".")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type FeedsSuite struct{}
+
+var _ = gocheck.Suite(&FeedsSuite{})
+
+const TEST_RSS = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+<channel>
+  <title>Pablo's Blog</title>
+  <item>
+    <title>Today is a great day</title>
+    <guid isPermaLink="false">post-1</guid>
+    <pubDate>Thu, 07 Nov 2013 02:19:36 +0000</pubDate>
+    <description>A summary we don't need.</description>
+    <content:encoded><![CDATA[<p>I went to Dr. Who's house. It was big!</p><p>Was it "bigger on the inside?" Yes.</p>]]></content:encoded>
+  </item>
+  <item>
+    <title>No body at all</title>
+    <link>https://example.com/no-body</link>
+  </item>
+</channel>
+</rss>`
+
+const TEST_ATOM = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Laurel's Feed</title>
+  <entry>
+    <id>tag:example.com,2013:1</id>
+    <title type="html">Fish &amp;amp; chips</title>
+    <published>2013-11-07T02:19:36Z</published>
+    <content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml"><p>Tomorrow is a better day.</p></div></content>
+  </entry>
+  <entry>
+    <id>tag:example.com,2013:2</id>
+    <title>Short</title>
+    <updated>2013-11-08T00:00:00Z</updated>
+    <summary>Summaries work too.</summary>
+  </entry>
+</feed>`
+
+// Serves feeds from memory, at their paths.
+type fakeFeeds struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	feeds  map[string]string
+}
+
+func newFakeFeeds() *fakeFeeds {
+	ff := &fakeFeeds{feeds: make(map[string]string)}
+	ff.server = httptest.NewServer(http.HandlerFunc(ff.serve))
+	return ff
+}
+
+func (ff *fakeFeeds) publish(path, feed string) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	ff.feeds[path] = feed
+}
+
+func (ff *fakeFeeds) serve(w http.ResponseWriter, r *http.Request) {
+	ff.lock.Lock()
+	defer ff.lock.Unlock()
+	feed, exists := ff.feeds[r.URL.Path]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(feed))
+}
+
+func texts(tweets Tweets) []string {
+	var texts []string
+	for _, tweet := range tweets {
+		texts = append(texts, tweet.Text)
+	}
+	return texts
+}
+
+func (s FeedsSuite) TestSplitSentences(c *gocheck.C) {
+	tests := []struct {
+		text      string
+		sentences []string
+	}{
+		{"One. Two! Three? Four", []string{"One.", "Two!", "Three?", "Four"}},
+		{`He said "stop." Then (quietly.) he left.`, []string{`He said "stop."`, "Then (quietly.)", "he left."}},
+		{"Mr. Smith met J. R. R. Tolkien, e.g. at St. Mary's. Fin.",
+			[]string{"Mr. Smith met J. R. R. Tolkien, e.g. at St. Mary's.", "Fin."}},
+		{"  ", nil},
+	}
+	for _, test := range tests {
+		c.Assert(splitSentences(test.text), gocheck.DeepEquals, test.sentences)
+	}
+}
+
+// Sentences' IDs carry their entry's date, and sort in order.
+func (s FeedsSuite) TestFeedItemId(c *gocheck.C) {
+	published := time.Date(2013, 11, 7, 2, 19, 36, 213*int(time.Millisecond), time.UTC)
+	when, known := tweetTime(feedItemId(published, "post-1", 3))
+	c.Assert(known, gocheck.Equals, true)
+	c.Assert(when, gocheck.Equals, published)
+
+	c.Assert(feedItemId(published, "post-1", 0) < feedItemId(published, "post-1", 1), gocheck.Equals, true)
+	c.Assert(feedItemId(published, "post-1", 1) < feedItemId(published.Add(time.Millisecond), "post-1", 0), gocheck.Equals, true)
+	c.Assert(feedItemId(published, "post-1", 0), gocheck.Not(gocheck.Equals), feedItemId(published, "post-2", 0))
+}
+
+// Both kinds of feed come out a sentence per tweet, and only entries we
+// haven't seen come out again.
+func (s FeedsSuite) TestFeedFetch(c *gocheck.C) {
+	ff := newFakeFeeds()
+	defer ff.server.Close()
+	ff.publish("/rss", TEST_RSS)
+	ff.publish("/atom", TEST_ATOM)
+	logger := logging.GetLogMaster(true, false, false)
+	data := getMemoryDataHandle()
+	fetcher := &feedFetcher{ff.server.Client(), data, &logger}
+
+	tweets, err := fetcher.DeepDive(ff.server.URL+"/rss", &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(texts(tweets), gocheck.DeepEquals, []string{"Today is a great day", "I went to Dr. Who's house.",
+		"It was big!", `Was it "bigger on the inside?"`, "Yes.", "No body at all"})
+	when, _ := tweetTime(tweets[0].Id)
+	c.Assert(when, gocheck.Equals, time.Date(2013, 11, 7, 2, 19, 36, 0, time.UTC))
+	c.Assert(data.seenFeedItems(FEED_SOURCE_PREFIX+ff.server.URL+"/rss"), gocheck.DeepEquals,
+		map[string]bool{"post-1": true, "https://example.com/no-body": true})
+
+	fresh, err := fetcher.GetRecentTimeline(ff.server.URL+"/rss", &tweets[0], &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(fresh.Len(), gocheck.Equals, 0)
+
+	tweets, _ = fetcher.DeepDive(ff.server.URL+"/atom", &oauth1.Token{})
+	c.Assert(texts(tweets), gocheck.DeepEquals, []string{"Fish & chips", "Tomorrow is a better day.", "Short",
+		"Summaries work too."})
+
+	// A new entry shows up.
+	ff.publish("/atom", TEST_ATOM[:len(TEST_ATOM)-len("</feed>")]+
+		`<entry><id>tag:example.com,2013:3</id><title>Newer</title><summary>Newest.</summary></entry></feed>`)
+	fresh, _ = fetcher.GetRecentTimeline(ff.server.URL+"/atom", &tweets[0], &oauth1.Token{})
+	c.Assert(texts(fresh), gocheck.DeepEquals, []string{"Newer", "Newest."})
+
+	_, err = fetcher.DeepDive(ff.server.URL+"/missing", &oauth1.Token{})
+	c.Assert(err, gocheck.ErrorMatches, "Couldn't read the feed at .*: the feed's server said 404 Not Found")
+	ff.publish("/broken", "<rss><channel><item>")
+	_, err = fetcher.DeepDive(ff.server.URL+"/broken", &oauth1.Token{})
+	c.Assert(err, gocheck.NotNil)
+}
+
+// Feeds mix with Twitter users, and refreshes add only new entries.
+func (s FeedsSuite) TestFeedSource(c *gocheck.C) {
+	ff := newFakeFeeds()
+	defer ff.server.Close()
+	ff.publish("/rss", TEST_RSS)
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	feed := FEED_SOURCE_PREFIX + ff.server.URL + "/rss"
+
+	gen := CreateGenerator(1, 140, eb.logger)
+	c.Assert(eb.refresher.subscribe(gen, []string{"SrPablo", feed}, &oauth1.Token{}), gocheck.Equals, 8)
+	c.Assert(eb.data.GetTweetsFromStorage(feed).Len(), gocheck.Equals, 6)
+
+	eb.refresher.refreshAll()
+	c.Assert(eb.data.GetTweetsFromStorage(feed).Len(), gocheck.Equals, 6)
+	status := eb.refresher.status()[1]
+	c.Assert(status.User, gocheck.Equals, feed)
+	c.Assert(status.Total, gocheck.Equals, 6)
+	c.Assert(status.LastFetched, gocheck.Equals, 0)
+}
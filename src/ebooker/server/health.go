@@ -0,0 +1,249 @@
+package main
+
+/*
+Health checks, for whatever supervises the server:
+
+  /healthz  is the server alive? The database answers, and no bot has missed
+            a tick of its schedule by more than BOT_TICK_GRACE. If this
+            fails, restarting the server ought to help.
+  /readyz   is it fit to do its job? Everything /healthz checks, and also that
+            we're not shutting down, and that Twitter takes the credentials
+            of every bot that tweets. Restarting won't bring revoked
+            credentials back, so they don't count against /healthz.
+
+Both answer 200 if every check passed and 503 if any failed, with JSON saying
+how each went. Neither needs an API key, so they say how many bots or
+accounts are in trouble, but not which.
+
+Twitter only lets us verify credentials so often, and anyone can ask for
+/readyz as often as they like, so we never ask Twitter on its behalf. We
+verify each account's credentials in the background, once per
+TWITTER_CHECK_INTERVAL (and soon after a bot starts tweeting as it), and
+/readyz reports what Twitter said last.
+*/
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTHZ_PATH = "/healthz"
+	READYZ_PATH  = "/readyz"
+)
+
+// How long Twitter's verdict on an account's credentials stands, and how
+// often we look for accounts due a check.
+const (
+	TWITTER_CHECK_INTERVAL = 15 * time.Minute
+	TWITTER_CHECK_TICK     = time.Minute
+)
+
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"` // ok, or failing if any check failed
+	Checks []healthCheck `json:"checks"`
+}
+
+type healthChecker struct {
+	eb *Ebooker
+
+	lock     sync.Mutex // for verified
+	verified map[string]credentialCheck
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// What Twitter said of an account's credentials, and when.
+type credentialCheck struct {
+	token *oauth1.Token
+	err   error
+	at    time.Time
+}
+
+func newHealthChecker(eb *Ebooker) *healthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &healthChecker{eb: eb, verified: make(map[string]credentialCheck), ctx: ctx, cancel: cancel}
+}
+
+func (h *healthChecker) register(mux *http.ServeMux) {
+	mux.HandleFunc(HEALTHZ_PATH, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, r, h.healthz())
+	})
+	mux.HandleFunc(READYZ_PATH, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, r, h.readyz())
+	})
+}
+
+func (h *healthChecker) healthz() healthReport {
+	return newHealthReport(h.checkDatabase(), h.checkBots())
+}
+
+func (h *healthChecker) readyz() healthReport {
+	return newHealthReport(h.checkShutdown(), h.checkDatabase(), h.checkBots(), h.checkTwitter())
+}
+
+func newHealthReport(checks ...healthCheck) healthReport {
+	report := healthReport{"ok", checks}
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "failing"
+		}
+	}
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, report healthReport) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 must GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *healthChecker) checkShutdown() healthCheck {
+	if h.eb.closing.Load() {
+		return healthCheck{"shutdown", false, SHUTTING_DOWN.Error()}
+	}
+	return healthCheck{"shutdown", true, "Not shutting down."}
+}
+
+func (h *healthChecker) checkDatabase() healthCheck {
+	if err := h.eb.data.ping(); err != nil {
+		return healthCheck{"database", false, "Can't read the database: " + err.Error()}
+	}
+	return healthCheck{"database", true, "The database answers."}
+}
+
+// Bots stuck mid-post, or whose schedules have stopped ticking, fall behind.
+func (h *healthChecker) checkBots() healthCheck {
+	now := time.Now()
+	names := h.eb.bots.names()
+	late := 0
+	for _, name := range names {
+		if bot, exists := h.eb.bots.get(name); exists && bot.overdue(now) {
+			late++
+		}
+	}
+	if late > 0 {
+		return healthCheck{"bots", false, fmt.Sprintf("%d of %d bots have missed a tick by over %v.", late, len(names), BOT_TICK_GRACE)}
+	}
+	return healthCheck{"bots", true, fmt.Sprintf("All %d bots are keeping to their schedules.", len(names))}
+}
+
+// The accounts bots (that aren't stopped) tweet as, and their tokens.
+func (h *healthChecker) tweetingAccounts() map[string]*oauth1.Token {
+	tokens := make(map[string]*oauth1.Token)
+	for _, name := range h.eb.bots.names() {
+		bot, exists := h.eb.bots.get(name)
+		if !exists || bot.currentState() == BOT_STOPPED {
+			continue
+		}
+		if publisher, tweets := bot.publisher.(*twitterPublisher); tweets {
+			tokens[bot.username] = publisher.token
+		}
+	}
+	return tokens
+}
+
+// Verifies the credentials of accounts we haven't asked Twitter about, every
+// TWITTER_CHECK_TICK, until stopped.
+func (h *healthChecker) start() {
+	ticker := time.NewTicker(TWITTER_CHECK_TICK)
+	defer ticker.Stop()
+
+	for {
+		h.verifyAll()
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) stop() {
+	h.cancel()
+}
+
+// Asks Twitter about the credentials of each account a bot tweets as, unless
+// we asked in the last TWITTER_CHECK_INTERVAL. The lock isn't held while we
+// ask, so /readyz can answer meanwhile.
+func (h *healthChecker) verifyAll() {
+	tokens := h.tweetingAccounts()
+	due := make(map[string]*oauth1.Token)
+	h.lock.Lock()
+	for account, token := range tokens {
+		check, exists := h.verified[account]
+		if !exists || check.token != token || time.Since(check.at) > TWITTER_CHECK_INTERVAL {
+			due[account] = token
+		}
+	}
+	// Forget accounts nothing tweets as any more.
+	for account := range h.verified {
+		if _, exists := tokens[account]; !exists {
+			delete(h.verified, account)
+		}
+	}
+	h.lock.Unlock()
+
+	for account, token := range due {
+		check := credentialCheck{token, h.eb.tf.verifyCredentials(token), time.Now()}
+		if check.err != nil {
+			h.eb.logger.Warn("Couldn't verify Twitter credentials.", logging.Field{"account", account}, logging.Field{"error", check.err})
+		}
+		h.lock.Lock()
+		h.verified[account] = check
+		h.lock.Unlock()
+	}
+}
+
+// What Twitter last said of the credentials of each account a bot tweets as.
+// Accounts we haven't asked about yet get the benefit of the doubt.
+func (h *healthChecker) checkTwitter() healthCheck {
+	tokens := h.tweetingAccounts()
+	if len(tokens) == 0 {
+		return healthCheck{"twitter", true, "No bots tweet, so there are no credentials to check."}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	failed, unchecked := 0, 0
+	for account, token := range tokens {
+		check, exists := h.verified[account]
+		if !exists || check.token != token {
+			unchecked++
+		} else if check.err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return healthCheck{"twitter", false, fmt.Sprintf("Couldn't verify the credentials of %d of %d accounts with Twitter.", failed, len(tokens))}
+	}
+	if unchecked > 0 {
+		return healthCheck{"twitter", true, fmt.Sprintf("Twitter takes the credentials of %d of %d accounts; we're yet to ask about the rest.",
+			len(tokens)-unchecked, len(tokens))}
+	}
+	return healthCheck{"twitter", true, fmt.Sprintf("Twitter takes the credentials of all %d accounts.", len(tokens))}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"ebooker/defs"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type HealthSuite struct{}
+
+var _ = gocheck.Suite(&HealthSuite{})
+
+// A Datastore that's lost its database.
+type unreachableStore struct {
+	Datastore
+}
+
+func (s unreachableStore) ping() error {
+	return errors.New("disk I/O error")
+}
+
+// Makes a bot tweeting as SrPablo_ebooks, and waits for it to start listening
+// to its schedule.
+func startHealthTestBot(c *gocheck.C, eb *Ebooker) *Bot {
+	args := defs.NewBotParams{"SrPablo_ebooks", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"SrPablo_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	bot, _ := eb.bots.get("SrPablo_ebooks")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bot.lock.Lock()
+		due := bot.due
+		bot.lock.Unlock()
+		if !due.IsZero() {
+			return bot
+		}
+		c.Assert(time.Now().Before(deadline), gocheck.Equals, true, gocheck.Commentf("the bot never started"))
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Gets the path, returning the status and the report.
+func getHealth(c *gocheck.C, server *httptest.Server, path string) (int, healthReport) {
+	resp, err := server.Client().Get(server.URL + path)
+	c.Assert(err, gocheck.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Type"), gocheck.Equals, "application/json")
+	var report healthReport
+	c.Assert(json.NewDecoder(resp.Body).Decode(&report), gocheck.IsNil)
+	return resp.StatusCode, report
+}
+
+func failingChecks(report healthReport) []string {
+	var failing []string
+	for _, check := range report.Checks {
+		if !check.OK {
+			failing = append(failing, check.Name)
+		}
+	}
+	return failing
+}
+
+func startTestHealth(eb *Ebooker) *httptest.Server {
+	mux := http.NewServeMux()
+	newHealthChecker(eb).register(mux)
+	return httptest.NewServer(mux)
+}
+
+func (s HealthSuite) TestHealthz(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+	server := startTestHealth(eb)
+	defer server.Close()
+
+	status, report := getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(report.Status, gocheck.Equals, "ok")
+	c.Assert(len(report.Checks), gocheck.Equals, 2)
+
+	// A bot that's listening expects its next tick when the schedule says.
+	bot := startHealthTestBot(c, eb)
+	c.Assert(bot.overdue(time.Now()), gocheck.Equals, false)
+	c.Assert(bot.overdue(time.Now().Add(bot.schedule().next()+BOT_TICK_GRACE+time.Minute)), gocheck.Equals, true)
+	status, _ = getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+
+	// One that hasn't come back for its tick is stuck, paused or not.
+	bot.lock.Lock()
+	bot.due = time.Now().Add(-BOT_TICK_GRACE - time.Minute)
+	bot.lock.Unlock()
+	status, report = getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(report.Status, gocheck.Equals, "failing")
+	c.Assert(failingChecks(report), gocheck.DeepEquals, []string{"bots"})
+	c.Assert(report.Checks[1].Message, gocheck.Equals, "1 of 1 bots have missed a tick by over 5m0s.")
+	c.Assert(bot.pause(), gocheck.IsNil)
+	status, _ = getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusServiceUnavailable)
+
+	// Stopped bots aren't listening, so can't be late.
+	var msg string
+	c.Assert(eb.CancelBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	status, _ = getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+
+	eb.data = unreachableStore{eb.data}
+	status, report = getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(failingChecks(report), gocheck.DeepEquals, []string{"database"})
+	c.Assert(report.Checks[0].Message, gocheck.Equals, "Can't read the database: disk I/O error")
+
+	resp, err := server.Client().Post(server.URL+HEALTHZ_PATH, "text/plain", nil)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusMethodNotAllowed)
+}
+
+func (s HealthSuite) TestReadyz(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	health := newHealthChecker(eb)
+	mux := http.NewServeMux()
+	health.register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	status, report := getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(len(report.Checks), gocheck.Equals, 4)
+	c.Assert(report.Checks[3].Message, gocheck.Equals, "No bots tweet, so there are no credentials to check.")
+
+	// We don't ask Twitter about a new bot's credentials until the next
+	// background check; /readyz never does.
+	startHealthTestBot(c, eb)
+	ft.lock.Lock()
+	ft.revoked["token"] = true
+	ft.lock.Unlock()
+	status, report = getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(report.Checks[3].Message, gocheck.Equals, "Twitter takes the credentials of 0 of 1 accounts; we're yet to ask about the rest.")
+	ft.lock.Lock()
+	ft.revoked["token"] = false
+	ft.lock.Unlock()
+	health.verifyAll()
+	status, report = getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(report.Checks[3].Message, gocheck.Equals, "Twitter takes the credentials of all 1 accounts.")
+
+	// Twitter's verdict is remembered for a while, so it takes a while for
+	// us to notice the token's been revoked.
+	ft.lock.Lock()
+	ft.revoked["token"] = true
+	ft.lock.Unlock()
+	health.verifyAll()
+	status, _ = getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	health.lock.Lock()
+	check := health.verified["SrPablo_ebooks"]
+	check.at = check.at.Add(-TWITTER_CHECK_INTERVAL - time.Minute)
+	health.verified["SrPablo_ebooks"] = check
+	health.lock.Unlock()
+	health.verifyAll()
+
+	status, report = getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(failingChecks(report), gocheck.DeepEquals, []string{"twitter"})
+	c.Assert(report.Checks[3].Message, gocheck.Equals, "Couldn't verify the credentials of 1 of 1 accounts with Twitter.")
+	// A restart won't bring the token back.
+	status, _ = getHealth(c, server, HEALTHZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+
+	var msg string
+	c.Assert(eb.CancelBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	status, _ = getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	health.verifyAll()
+	health.lock.Lock()
+	c.Assert(len(health.verified), gocheck.Equals, 0)
+	health.lock.Unlock()
+
+	eb.shutdown(context.Background())
+	status, report = getHealth(c, server, READYZ_PATH)
+	c.Assert(status, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(failingChecks(report), gocheck.DeepEquals, []string{"shutdown"})
+
+	// The background checks stop when told to.
+	stopped := make(chan bool)
+	go func() {
+		health.start()
+		close(stopped)
+	}()
+	health.stop()
+	<-stopped
+}
+
+func (s HealthSuite) TestPing(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	var pong string
+	c.Assert(eb.Ping("", &pong), gocheck.IsNil)
+	c.Assert(pong, gocheck.Equals, "ok")
+
+	// Any key will do, until it's revoked.
+	authed := makeTestAuthed(c, eb, "pinger", SCOPE_GENERATE)
+	pong = ""
+	c.Assert(authed.Ping("", &pong), gocheck.IsNil)
+	c.Assert(pong, gocheck.Equals, "ok")
+	eb.data.deleteAPIKey("pinger")
+	c.Assert(authed.Ping("", &pong), gocheck.Equals, UNAUTHENTICATED)
+}
@@ -0,0 +1,265 @@
+package main
+
+/*
+Imports corpora from files, for when the timeline API isn't enough: it only
+goes back ~3200 tweets, and it only knows about Twitter. We read:
+
+  - Twitter's downloadable archive: tweets.js (or tweet.js, in older ones),
+    which is a JSON array behind a line of JavaScript.
+  - The older archive's tweets.csv.
+  - JSONL, one object per line with a "text" (and, optionally, an "id").
+  - Plain text, one tweet (or sentence, or line of poetry) per line.
+
+Everything goes into storage under a source name, which can be a Twitter user
+(to fill in their history), or "file:" and any name at all, for bots to learn
+from non-Twitter text. Plain text has to go under a "file:" name: under a bare
+one, the refresher would go looking for it on Twitter. Tweets from the archive
+keep their IDs, so refreshes carry on from the newest of them; text without
+IDs gets 0, and sorts before everything.
+
+Importing the same file twice doesn't count anything twice: we skip tweets
+whose ID we have already, and ID-less text we have already.
+*/
+
+import (
+	"ebooker/logging"
+
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The formats we can import.
+const (
+	FORMAT_ARCHIVE = "archive"
+	FORMAT_CSV     = "csv"
+	FORMAT_JSONL   = "jsonl"
+	FORMAT_TEXT    = "text"
+)
+
+// Lines in a text file can be long; a tweet can't, but a paragraph can.
+const MAX_IMPORT_LINE = 1 << 20
+
+// Guesses the format of the file from its name.
+func guessImportFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".js":
+		return FORMAT_ARCHIVE
+	case ".csv":
+		return FORMAT_CSV
+	case ".jsonl", ".ndjson":
+		return FORMAT_JSONL
+	}
+	return FORMAT_TEXT
+}
+
+// Reads the tweets in r, which is in the given format.
+func parseCorpus(r io.Reader, format string) (Tweets, error) {
+	switch format {
+	case FORMAT_ARCHIVE:
+		return parseArchive(r)
+	case FORMAT_CSV:
+		return parseArchiveCSV(r)
+	case FORMAT_JSONL:
+		return parseJSONL(r)
+	case FORMAT_TEXT:
+		return parseText(r)
+	}
+	return nil, errors.New("Unknown import format \"" + format + "\". Try archive, csv, jsonl or text.")
+}
+
+// An entry in tweets.js or a JSONL file. Newer archives wrap each tweet in an
+// object of its own; older ones, and JSONL, don't.
+type importEntry struct {
+	Tweet    *importEntry    `json:"tweet"`
+	Id       json.RawMessage `json:"id"`
+	IdStr    string          `json:"id_str"`
+	Text     string          `json:"text"`
+	FullText string          `json:"full_text"`
+}
+
+func (e *importEntry) tweet() TweetData {
+	if e.Tweet != nil {
+		return e.Tweet.tweet()
+	}
+	id := e.IdStr
+	if id == "" {
+		// Archives quote their IDs; JSONL may not.
+		id = strings.Trim(string(e.Id), "\"")
+	}
+	idInt, _ := strconv.ParseUint(id, 10, 64)
+	text := e.FullText
+	if text == "" {
+		text = e.Text
+	}
+	return TweetData{idInt, text}
+}
+
+// tweets.js starts with "window.YTD.tweets.part0 = ", which isn't JSON; the
+// array after it is.
+func parseArchive(r io.Reader) (Tweets, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	start := bytes.IndexByte(contents, '[')
+	if start < 0 {
+		return nil, errors.New("This doesn't look like a tweets.js from a Twitter archive.")
+	}
+
+	var entries []importEntry
+	if err := json.Unmarshal(contents[start:], &entries); err != nil {
+		return nil, err
+	}
+	var tweets Tweets
+	for _, entry := range entries {
+		tweets = appendArchived(tweets, entry.tweet())
+	}
+	return tweets, nil
+}
+
+// The older archives' tweets.csv, which has a header naming its columns.
+func parseArchiveCSV(r io.Reader) (Tweets, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	textColumn, exists := columns["text"]
+	if !exists {
+		return nil, errors.New("The CSV has no \"text\" column.")
+	}
+
+	var tweets Tweets
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if textColumn >= len(record) || csvField(record, columns, "retweeted_status_id") != "" {
+			continue
+		}
+		id, _ := strconv.ParseUint(csvField(record, columns, "tweet_id"), 10, 64)
+		tweets = appendArchived(tweets, TweetData{id, record[textColumn]})
+	}
+	return tweets, nil
+}
+
+func csvField(record []string, columns map[string]int, name string) string {
+	if i, exists := columns[name]; exists && i < len(record) {
+		return record[i]
+	}
+	return ""
+}
+
+// Twitter escapes the text in archives as it does in the API, and like the
+// API, we leave retweets out; they're someone else's words.
+func appendArchived(tweets Tweets, tweet TweetData) Tweets {
+	tweet.Text = html.UnescapeString(tweet.Text)
+	if tweet.Text == "" || strings.HasPrefix(tweet.Text, "RT @") {
+		return tweets
+	}
+	return append(tweets, tweet)
+}
+
+func parseJSONL(r io.Reader) (Tweets, error) {
+	var tweets Tweets
+	err := scanLines(r, func(number int, line string) error {
+		var entry importEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return fmt.Errorf("Line %d: %v", number, err)
+		}
+		if tweet := entry.tweet(); tweet.Text != "" {
+			tweets = append(tweets, tweet)
+		}
+		return nil
+	})
+	return tweets, err
+}
+
+func parseText(r io.Reader) (Tweets, error) {
+	var tweets Tweets
+	err := scanLines(r, func(_ int, line string) error {
+		tweets = append(tweets, TweetData{0, line})
+		return nil
+	})
+	return tweets, err
+}
+
+// Calls each with every line in r that isn't blank, numbered from 1.
+func scanLines(r io.Reader, each func(int, string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), MAX_IMPORT_LINE)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := each(number, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Loads the tweets in the file into storage under source, skipping any we have
+// already. Returns how many were new.
+func importCorpus(data Datastore, filename, source, format string, logger *logging.LogMaster) (int, error) {
+	if source == "" {
+		return 0, errors.New("Imports need a source to go under.")
+	}
+	if format == "" {
+		format = guessImportFormat(filename)
+	}
+	if format == FORMAT_TEXT && !strings.HasPrefix(source, FILE_SOURCE_PREFIX) {
+		return 0, errors.New("Text isn't anyone's tweets; import it under " + FILE_SOURCE_PREFIX + source + " instead.")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	logger.StatusWrite("Reading %s as %s...\n", filename, format)
+	tweets, err := parseCorpus(file, format)
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make(map[uint64]bool)
+	texts := make(map[string]bool)
+	for _, tweet := range data.GetTweetsFromStorage(source) {
+		if tweet.Id != 0 {
+			ids[tweet.Id] = true
+		} else {
+			texts[tweet.Text] = true
+		}
+	}
+	var fresh Tweets
+	for _, tweet := range tweets {
+		if (tweet.Id != 0 && !ids[tweet.Id]) || (tweet.Id == 0 && !texts[tweet.Text]) {
+			fresh = append(fresh, tweet)
+		}
+	}
+
+	logger.StatusWrite("Importing %d new tweets (of %d) into %s.\n", len(fresh), len(tweets), source)
+	data.InsertFreshTweets(source, fresh)
+	return len(fresh), nil
+}
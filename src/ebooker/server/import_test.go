@@ -0,0 +1,112 @@
+package main
+
+import (
+	"ebooker/logging"
+
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"path/filepath"
+	"strings"
+)
+
+// hook up gocheck into the gotest runner.
+type ImportSuite struct{}
+
+var _ = gocheck.Suite(&ImportSuite{})
+
+const TEST_ARCHIVE = `window.YTD.tweets.part0 = [ {
+  "tweet" : {
+    "retweeted" : false,
+    "id_str" : "398273498291123",
+    "id" : "398273498291123",
+    "full_text" : "Cautionary tales on type system design &amp; notation"
+  }
+}, {
+  "tweet" : {
+    "id_str" : "398273498291124",
+    "full_text" : "RT @laurelita: it's kind of the best"
+  }
+} ]`
+
+// Older archives' tweet.js didn't wrap each tweet.
+const TEST_OLD_ARCHIVE = `window.YTD.tweet.part0 = [ {
+  "id_str" : "298273498291123",
+  "full_text" : "sending good thoughts/mojo to #s17!"
+} ]`
+
+const TEST_CSV = `"tweet_id","in_reply_to_status_id","in_reply_to_user_id","timestamp","source","text","retweeted_status_id","retweeted_status_user_id","retweeted_status_timestamp","expanded_urls"
+"398273498291125","","","2013-11-07 02:01:43 +0000","web","Just got an email whose only contents were ""LOL"". The day is won.","","","",""
+"398273498291126","","","2013-11-07 02:03:43 +0000","web","RT @Popehat: something","398273498291100","","",""
+`
+
+const TEST_JSONL = `{"id": 12, "text": "today is a great day"}
+{"id_str": "13", "full_text": "today is a fine day"}
+
+{"text": "no id at all"}
+`
+
+func (s ImportSuite) TestParseFormats(c *gocheck.C) {
+	tests := []struct {
+		format   string
+		contents string
+		expected Tweets
+	}{
+		{FORMAT_ARCHIVE, TEST_ARCHIVE, Tweets{{398273498291123, "Cautionary tales on type system design & notation"}}},
+		{FORMAT_ARCHIVE, TEST_OLD_ARCHIVE, Tweets{{298273498291123, "sending good thoughts/mojo to #s17!"}}},
+		{FORMAT_CSV, TEST_CSV, Tweets{{398273498291125, "Just got an email whose only contents were \"LOL\". The day is won."}}},
+		{FORMAT_JSONL, TEST_JSONL, Tweets{{12, "today is a great day"}, {13, "today is a fine day"}, {0, "no id at all"}}},
+		{FORMAT_TEXT, "Call me Ishmael.\r\n\n  Some years ago  \n", Tweets{{0, "Call me Ishmael."}, {0, "Some years ago"}}},
+	}
+	for _, test := range tests {
+		tweets, err := parseCorpus(strings.NewReader(test.contents), test.format)
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(tweets, gocheck.DeepEquals, test.expected)
+	}
+
+	_, err := parseCorpus(strings.NewReader("{nope"), FORMAT_JSONL)
+	c.Assert(err, gocheck.ErrorMatches, "Line 1: .*")
+	_, err = parseCorpus(strings.NewReader("no brackets here"), FORMAT_ARCHIVE)
+	c.Assert(err, gocheck.NotNil)
+	_, err = parseCorpus(strings.NewReader(""), "xml")
+	c.Assert(err, gocheck.ErrorMatches, "Unknown import format.*")
+}
+
+func (s ImportSuite) TestGuessFormat(c *gocheck.C) {
+	c.Assert(guessImportFormat("archive/data/tweets.js"), gocheck.Equals, FORMAT_ARCHIVE)
+	c.Assert(guessImportFormat("tweets.CSV"), gocheck.Equals, FORMAT_CSV)
+	c.Assert(guessImportFormat("dump.jsonl"), gocheck.Equals, FORMAT_JSONL)
+	c.Assert(guessImportFormat("moby_dick.txt"), gocheck.Equals, FORMAT_TEXT)
+}
+
+// Importing adds to what's stored, and importing again adds nothing.
+func (s ImportSuite) TestImportCorpus(c *gocheck.C) {
+	data := getMemoryDataHandle()
+	logger := logging.GetLogMaster(true, false, false)
+	data.InsertFreshTweets("SrPablo", Tweets{{12, "today is a great day"}})
+
+	filename := filepath.Join(c.MkDir(), "tweets.jsonl")
+	c.Assert(ioutil.WriteFile(filename, []byte(TEST_JSONL), 0600), gocheck.IsNil)
+
+	count, err := importCorpus(data, filename, "SrPablo", "", &logger)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(count, gocheck.Equals, 2)
+	count, err = importCorpus(data, filename, "SrPablo", "", &logger)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(count, gocheck.Equals, 0)
+	c.Assert(data.GetTweetsFromStorage("SrPablo"), gocheck.DeepEquals,
+		Tweets{{0, "no id at all"}, {12, "today is a great day"}, {13, "today is a fine day"}})
+
+	_, err = importCorpus(data, filename, "", "", &logger)
+	c.Assert(err, gocheck.NotNil)
+	_, err = importCorpus(data, filepath.Join(c.MkDir(), "missing.txt"), "file:moby", "", &logger)
+	c.Assert(err, gocheck.NotNil)
+
+	// Text goes under a name of its own, never a Twitter user's.
+	filename = filepath.Join(c.MkDir(), "moby_dick.txt")
+	c.Assert(ioutil.WriteFile(filename, []byte("Call me Ishmael.\n"), 0600), gocheck.IsNil)
+	_, err = importCorpus(data, filename, "ishmael", "", &logger)
+	c.Assert(err, gocheck.ErrorMatches, ".*file:ishmael.*")
+	count, err = importCorpus(data, filename, "file:ishmael", "", &logger)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(count, gocheck.Equals, 1)
+}
@@ -30,6 +30,14 @@ While this is still here and seemed cool at the time, the quality of the tweets
 it produced was subpar, since sentences had odder-than-desired representional
 noise. Usually, the feature is turned off.
 
+The model is kept compact, since we may hold many of them and a prolific
+user's corpus runs to hundreds of thousands of tweets. Every word is interned
+once and referred to by a small integer ID from then on; a prefix is the list
+of its words' IDs, packed into a short key, and is itself numbered. A prefix's
+suffixes are a pair of arrays, the suffix IDs and running totals of their
+counts, so picking a suffix is a binary search rather than a walk down a list
+of strings.
+
 Note that for tweets, it's unlikely we'll use any prefix length greater than
 1, but it's useful to have in case we'd like to generate a larger output, like
 michaelochurch screeds.
@@ -48,55 +56,67 @@ package main
 import (
 	"ebooker/logging"
 
+	"encoding/binary"
 	"math/rand"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Since both maps (the prefix -> suffix and canonical -> representation)
-// operate about the same way, we abstract their representation into a notion
-// of CountedStrings, where the values of the map contain both the string we
-// care about and a count of how often it occurs.
-type CountedString struct {
-	hits int
-	str  string
-}
-
-// A CountedStringList is a list of all the CountedStrings for a given prefix,
-// and a total number of times that prefix occurs (necessary, with the
-// CountedString hits, for probability calculation).
-type CountedStringList struct {
-	slice []*CountedString
-	total int
+// Words and prefixes are referred to by their index into the Generator's
+// tables.
+type tokenID uint32
+type prefixID uint32
+
+// Since both tables (the prefix -> suffix and canonical -> representation)
+// operate about the same way, we abstract them into suffixTables: the words
+// that follow, how often each does, and running totals of those counts to
+// draw from.
+//
+// Tokens are kept sorted, so we find one with a binary search. Counts go up
+// as we're seeded, but the running totals are only brought up to date
+// (settled) before we generate, so a popular prefix doesn't cost us a pass
+// over its suffixes for every word we add. A table seeded since it was
+// settled (stale) is drawn from its counts instead, which takes a pass.
+type suffixTable struct {
+	tokens     []tokenID // sorted
+	counts     []uint32
+	cumulative []uint32 // running totals of counts, as of the last settle
+	stale      bool     // counts have changed since the last settle
 }
 
-// Map from a prefix in canonical form to CountedStringLists, where one will
-// move canonical prefixes to suffixes, and another to words -> representation.
-type CountedStringMap map[string]*CountedStringList
-
 // Generators gives us all we need to build a fresh data model to generate
-// from.
+// from. They're safe to seed and generate from at the same time.
 type Generator struct {
-	PrefixLen  int
-	CharLimit  int
-	Data       CountedStringMap   // suffix map
-	Reps       CountedStringMap   // representation map
-	Beginnings []string           // acceptable ways to start a tweet.
-	canon      bool               // map sources seperately from representations.
-	logger     *logging.LogMaster // Lets us debug, emit status.
+	PrefixLen int
+	CharLimit int
+
+	words     []string           // every word we've seen, by tokenID
+	wordIDs   map[string]tokenID // and the other way around
+	wordBytes int64
+
+	prefixIDs  map[string]prefixID // a prefix's packed tokenIDs -> prefixID
+	prefixes   []tokenID           // each prefix's tokens, PrefixLen apiece
+	suffixes   []suffixTable       // suffix table, by prefixID
+	reps       []suffixTable       // representation table, by canonical tokenID
+	beginnings []prefixID          // acceptable ways to start a tweet.
+	edges      int                 // how many entries the tables have, all told
+
+	// Tables whose counts have changed since we last generated.
+	dirtySuffixes []prefixID
+	dirtyReps     []tokenID
+
+	canon  bool               // map sources seperately from representations.
+	logger *logging.LogMaster // Lets us debug, emit status.
+	lock   sync.RWMutex       // Writers seed, readers generate.
 }
 
 // CreateGenerator returns a Generator that is fully initialized and ready for
 // use.
 func CreateGenerator(prefixLen int, charLimit int, logger *logging.LogMaster) *Generator {
-	markov := make(CountedStringMap)
-	reps := make(CountedStringMap)
-	beginnings := []string{}
-	return &Generator{prefixLen, charLimit, markov, reps, beginnings, false, logger}
-}
-
-// Convenience method, already populating the first "hit" of the CountedString.
-func createCountedString(str string) *CountedString {
-	return &CountedString{1, str}
+	return &Generator{PrefixLen: prefixLen, CharLimit: charLimit, wordIDs: make(map[string]tokenID),
+		prefixIDs: make(map[string]prefixID), logger: logger}
 }
 
 // AddSeeds takes in a string, breaks it into prefixes, and adds it to the
@@ -104,48 +124,150 @@ func createCountedString(str string) *CountedString {
 func (g *Generator) AddSeeds(input string) {
 	source := tokenize(StripReply(input))
 
-	if g.canon {
-		var canonical []string
-		for i := 0; i < len(source); i++ {
-			canonical = append(canonical, Canonicalize(source[i]))
-			AddToMap(canonical[i], source[i], g.Reps)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	tokens := make([]tokenID, len(source))
+	for i, word := range source {
+		if g.canon {
+			tokens[i] = g.intern(Canonicalize(word))
+			g.addRep(tokens[i], g.intern(word))
+		} else {
+			tokens[i] = g.intern(word)
 		}
-		source = canonical
 	}
 
-	first := true
-	for len(source) > g.PrefixLen {
-		prefix := strings.Join(source[0:g.PrefixLen], " ")
-		AddToMap(prefix, source[g.PrefixLen], g.Data)
-		source = source[1:]
-		if first {
-			g.Beginnings = append(g.Beginnings, prefix)
-			first = false
+	var key []byte
+	for i := 0; i+g.PrefixLen < len(tokens); i++ {
+		window := tokens[i : i+g.PrefixLen]
+		key = packPrefix(key[:0], window)
+		prefix := g.prefix(key, window)
+		g.addSuffix(prefix, tokens[i+g.PrefixLen])
+		if i == 0 {
+			g.beginnings = append(g.beginnings, prefix)
 		}
 	}
 }
 
-// Add to map checks if the key/value pair exists in the map. If not, we create
-// them, and if so, we either increment the counter on the value or initialize
-// it if it didn't exist previously.
-func AddToMap(prefix, toAdd string, aMap CountedStringMap) {
+// Returns the word's tokenID, giving it one if it's new.
+func (g *Generator) intern(word string) tokenID {
+	if id, exists := g.wordIDs[word]; exists {
+		return id
+	}
+	// The word is likely a slice of a whole tweet; don't hold onto the rest.
+	word = strings.Clone(word)
+	id := tokenID(len(g.words))
+	g.words = append(g.words, word)
+	g.wordIDs[word] = id
+	g.wordBytes += int64(len(word))
+	return id
+}
 
-	if csList, exists := aMap[prefix]; exists {
-		if countedStr, member := csList.hasCountedString(toAdd); member {
-			countedStr.hits++
-		} else {
-			countedStr = createCountedString(toAdd)
-			csList.slice = append(csList.slice, countedStr)
-		}
-		csList.total++
-	} else {
-		countedStr := createCountedString(toAdd)
-		countedStrSlice := make([]*CountedString, 0)
-		countedStrSlice = append(countedStrSlice, countedStr)
-		csList := &CountedStringList{countedStrSlice, 1}
+// Returns the prefix's ID, adding it if it's new.
+func (g *Generator) prefix(key []byte, window []tokenID) prefixID {
+	if id, exists := g.prefixIDs[string(key)]; exists {
+		return id
+	}
+	id := prefixID(len(g.suffixes))
+	g.prefixIDs[string(key)] = id
+	g.prefixes = append(g.prefixes, window...)
+	g.suffixes = append(g.suffixes, suffixTable{})
+	return id
+}
+
+func (g *Generator) addSuffix(prefix prefixID, suffix tokenID) {
+	table := &g.suffixes[prefix]
+	if !table.stale {
+		g.dirtySuffixes = append(g.dirtySuffixes, prefix)
+	}
+	if table.add(suffix) {
+		g.edges++
+	}
+}
+
+func (g *Generator) addRep(canonical, rep tokenID) {
+	for len(g.reps) <= int(canonical) {
+		g.reps = append(g.reps, suffixTable{})
+	}
+	table := &g.reps[canonical]
+	if !table.stale {
+		g.dirtyReps = append(g.dirtyReps, canonical)
+	}
+	if table.add(rep) {
+		g.edges++
+	}
+}
+
+// Packs a prefix's tokens into a key for prefixIDs.
+func packPrefix(key []byte, window []tokenID) []byte {
+	for _, token := range window {
+		key = binary.LittleEndian.AppendUint32(key, uint32(token))
+	}
+	return key
+}
+
+// Counts another occurrence of token. Returns whether it's new to the table.
+func (t *suffixTable) add(token tokenID) bool {
+	t.stale = true
+	at := sort.Search(len(t.tokens), func(i int) bool { return t.tokens[i] >= token })
+	if at < len(t.tokens) && t.tokens[at] == token {
+		t.counts[at]++
+		return false
+	}
+	t.tokens = append(t.tokens, 0)
+	copy(t.tokens[at+1:], t.tokens[at:])
+	t.tokens[at] = token
+	t.counts = append(t.counts, 0)
+	copy(t.counts[at+1:], t.counts[at:])
+	t.counts[at] = 1
+	return true
+}
+
+// Brings the running totals up to date with the counts.
+func (t *suffixTable) settle() {
+	if cap(t.cumulative) < len(t.counts) {
+		t.cumulative = make([]uint32, len(t.counts))
+	}
+	t.cumulative = t.cumulative[:len(t.counts)]
+	var total uint32
+	for i, count := range t.counts {
+		total += count
+		t.cumulative[i] = total
+	}
+	t.stale = false
+}
 
-		aMap[prefix] = csList
+// Whether there's anything to draw.
+func (t *suffixTable) empty() bool {
+	return len(t.tokens) == 0
+}
+
+// Picks a token, weighted by how often we've seen it.
+func (t *suffixTable) draw() tokenID {
+	if t.stale {
+		return t.drawFromCounts()
 	}
+	total := t.cumulative[len(t.cumulative)-1]
+	index := uint32(rand.Int63n(int64(total)))
+	at := sort.Search(len(t.cumulative), func(i int) bool { return t.cumulative[i] > index })
+	return t.tokens[at]
+}
+
+// Picks a token like draw, without the running totals, which may have
+// fallen out of step with the tokens.
+func (t *suffixTable) drawFromCounts() tokenID {
+	var total uint32
+	for _, count := range t.counts {
+		total += count
+	}
+	index := uint32(rand.Int63n(int64(total)))
+	for i, count := range t.counts {
+		if index < count {
+			return t.tokens[i]
+		}
+		index -= count
+	}
+	return t.tokens[len(t.tokens)-1]
 }
 
 // tokenize splits the input string into "words" we use as prefixes and
@@ -157,123 +279,238 @@ func tokenize(input string) []string {
 	return strings.Split(input, " ")
 }
 
-// hasCountedString searches a CountedStringList for one that contains the string, and
-// returns the suffix (if applicable) and a boolean describing whether or not
-// we found it.
-func (l CountedStringList) hasCountedString(lookFor string) (*CountedString, bool) {
-	slice := l.slice
-	for i := 0; i < len(slice); i++ {
-		curr := slice[i]
-		if curr.str == lookFor {
-			return curr, true
-		}
+// Settles every table that's changed since we last generated. Generating
+// takes the read lock afterwards, so we may be seeded again in between: a
+// table that is goes stale again, and draw falls back to its counts until the
+// next settle.
+func (g *Generator) settle() {
+	g.lock.RLock()
+	settled := len(g.dirtySuffixes) == 0 && len(g.dirtyReps) == 0
+	g.lock.RUnlock()
+	if settled {
+		return
 	}
 
-	return createCountedString(""), false
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, prefix := range g.dirtySuffixes {
+		g.suffixes[prefix].settle()
+	}
+	for _, canonical := range g.dirtyReps {
+		g.reps[canonical].settle()
+	}
+	g.dirtySuffixes = g.dirtySuffixes[:0]
+	g.dirtyReps = g.dirtyReps[:0]
 }
 
 // Generates text from the given generator. It stops when the character limit
 // has run out, or it encounters a prefix it has no suffixes for.
 func (g *Generator) GenerateText() string {
-	return g.GenerateFromPrefix(g.randomPrefix())
+	return g.GenerateTextWithin(g.CharLimit)
+}
+
+// Generates text like GenerateText, but up to charLimit characters, for when
+// one model serves places with different limits.
+func (g *Generator) GenerateTextWithin(charLimit int) string {
+	defer GENERATION_SECONDS.since(time.Now())
+	g.settle()
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if len(g.beginnings) == 0 {
+		return ""
+	}
+	start := int(g.beginnings[rand.Intn(len(g.beginnings))])
+	return g.generate(g.prefixes[start*g.PrefixLen:(start+1)*g.PrefixLen], charLimit)
 }
 
 // We expose this version primarily for testing.
 func (g *Generator) GenerateFromPrefix(prefix string) string {
+	g.settle()
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	window, known := g.lookupWords(strings.Split(prefix, " "))
+	if !known {
+		g.logger.DebugWrite("Prefix \"%s\" has words we've never seen.\n", prefix)
+		return prefix
+	}
+	return g.generate(window, g.CharLimit)
+}
+
+func (g *Generator) generate(start []tokenID, charLimit int) string {
 
-	g.logger.DebugWrite("Generating text from prefix \"%s\"\n", prefix)
+	g.logger.DebugWrite("Generating text from prefix \"%s\"\n", g.spell(start))
 
 	// Representation gets a special case, since you can have a multi-word
 	// prefix (e.g. "Paul is") but each word needs it's own representation
 	// (e.g. "PAUL" "is" or "pAUL" "Is"). Note that this can break if your
 	// prefix's rep is longer than the charLimit, should we generalize
 	var result []string
-	charLimit := g.CharLimit
-
-	if g.canon {
-		split := strings.Split(prefix, " ")
-		for _, token := range split {
-			rep := g.Reps[token].DrawProbabilistically()
-			charLimit -= len(rep)
-			result = append(result, rep)
-		}
-	} else {
-		result = append(result, prefix)
-		charLimit -= len(prefix)
+	for _, token := range start {
+		result = append(result, g.represent(token))
 	}
+	charLimit -= len(strings.Join(result, " "))
 
+	// Our own copy, since we shift words through it.
+	window := append([]tokenID(nil), start...)
+	key := make([]byte, 0, 4*len(window))
 	for {
-		word, shouldTerminate, newPrefix, newCharLimit := g.popNextWord(prefix, charLimit)
-		prefix = newPrefix
-		charLimit = newCharLimit
-
-		if shouldTerminate {
+		key = packPrefix(key[:0], window)
+		token, rep, ok := g.nextWord(key, charLimit)
+		if !ok {
 			break
-		} else {
-			result = append(result, word)
-			g.logger.DebugWrite("New Prefix is \"%s\", %d characters remain\n", newPrefix, newCharLimit)
 		}
+		result = append(result, rep)
+		charLimit -= len(rep) + 1
+
+		if len(window) > 0 {
+			copy(window, window[1:])
+			window[len(window)-1] = token
+		}
+		g.logger.DebugWrite("New Prefix is \"%s\", %d characters remain\n", g.spell(window), charLimit)
 	}
 
 	return strings.Join(result, " ")
 }
 
-func (g *Generator) popNextWord(prefix string, limit int) (string, bool, string, int) {
+// Draws the word to follow the prefix, as both its canonical token and how
+// we'll write it, if there is one and it fits in the limit.
+func (g *Generator) nextWord(key []byte, limit int) (tokenID, string, bool) {
+	prefix, exists := g.prefixIDs[string(key)]
+	if !exists || g.suffixes[prefix].empty() {
+		g.logger.DebugWrite("Prefix does not exist, terminating this run.\n")
+		return 0, "", false
+	}
+	successor := g.suffixes[prefix].draw()
+	rep := g.represent(successor)
+	g.logger.DebugWrite("Drew \"%s\" as successor, represented by \"%s\".\n", g.words[successor], rep)
 
-	csList, exists := g.Data[prefix]
+	if len(rep)+1 > limit {
+		g.logger.DebugWrite("Exceeding character limit. Terminating run.\n")
+		return 0, "", false
+	}
+	return successor, rep, true
+}
 
-	if !exists {
-		g.logger.DebugWrite("Prefix does not exist, terminating this run.\n")
-		return "", true, "", 0 // terminate path
+// How we'll write the token: itself, or one of its representations if we're
+// canonicalizing.
+func (g *Generator) represent(token tokenID) string {
+	if g.canon && int(token) < len(g.reps) && !g.reps[token].empty() {
+		return g.words[g.reps[token].draw()]
 	}
-	successor := csList.DrawProbabilistically()
-	g.logger.DebugWrite("Drew \"%s\" as successor to \"%s\".\n", successor, prefix)
-	var rep string
-	if g.canon {
-		rep = g.Reps[successor].DrawProbabilistically()
-		g.logger.DebugWrite("After probabilisic draw, successor is respresented by \"%s\"\n", rep)
-	} else {
-		rep = successor
+	return g.words[token]
+}
+
+// The tokens of the words, if we've seen them all.
+func (g *Generator) lookupWords(words []string) ([]tokenID, bool) {
+	tokens := make([]tokenID, len(words))
+	for i, word := range words {
+		token, exists := g.wordIDs[word]
+		if !exists {
+			return nil, false
+		}
+		tokens[i] = token
 	}
+	return tokens, true
+}
+
+func (g *Generator) spell(tokens []tokenID) string {
+	words := make([]string, len(tokens))
+	for i, token := range tokens {
+		words[i] = g.words[token]
+	}
+	return strings.Join(words, " ")
+}
 
-	addsTo := len(rep) + 1
+// Draws the word to follow the (canonical) prefix, returning it, whether we
+// had to stop instead, the prefix that follows, and the characters left.
+func (g *Generator) popNextWord(prefix string, limit int) (string, bool, string, int) {
+	g.settle()
+	g.lock.RLock()
+	defer g.lock.RUnlock()
 
-	if addsTo <= limit {
-		shifted := append(strings.Split(prefix, " ")[1:], rep)
-		newPrefix := strings.Join(shifted, " ")
-		newLimit := limit - addsTo
-		return rep, false, newPrefix, newLimit
+	window, known := g.lookupWords(strings.Split(prefix, " "))
+	if !known {
+		return "", true, "", 0 // terminate path
 	}
-	g.logger.DebugWrite("Exceeding character limit. Terminating run.\n")
-	return "", true, "", 0
+	token, rep, ok := g.nextWord(packPrefix(nil, window), limit)
+	if !ok {
+		return "", true, "", 0
+	}
+	shifted := append(window[1:], token)
+	return rep, false, g.spell(shifted), limit - len(rep) - 1
+}
+
+// Rough guesses at what the model's bookkeeping costs, beyond the words
+// themselves: a word's string header and map entry, a prefix's key, map entry
+// and suffixTable, and a suffix's token, count and running total, with some
+// room to grow.
+const (
+	WORD_OVERHEAD   = 48
+	PREFIX_OVERHEAD = 128
+	SUFFIX_OVERHEAD = 16
+)
+
+// A rough count of the bytes the model takes up, for the model cache's budget.
+func (g *Generator) approxSize() int64 {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	size := g.wordBytes + int64(len(g.words))*WORD_OVERHEAD
+	size += int64(len(g.suffixes)) * int64(PREFIX_OVERHEAD+8*g.PrefixLen)
+	size += int64(g.edges) * SUFFIX_OVERHEAD
+	size += int64(len(g.beginnings)) * 4
+	return size
+}
+
+// How many distinct prefixes and words (tokens) the model has.
+func (g *Generator) counts() (int, int) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return len(g.suffixes), len(g.words)
 }
 
 func (g *Generator) CanonicalizeSources() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
 	g.canon = true
 }
 
-func (cs CountedStringList) DrawProbabilistically() string {
-	index := rand.Intn(cs.total) + 1
-	for i := 0; i < len(cs.slice); i++ {
-		if index <= cs.slice[i].hits {
-			return cs.slice[i].str
-		}
-		index -= cs.slice[i].hits
+// For testing: the words that have followed the (canonical) prefix, and how
+// many times each has.
+func (g *Generator) suffixCounts(prefix string) map[string]int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	window, known := g.lookupWords(strings.Split(prefix, " "))
+	if !known {
+		return nil
 	}
-	return ""
+	id, exists := g.prefixIDs[string(packPrefix(nil, window))]
+	if !exists {
+		return nil
+	}
+	return g.suffixes[id].countsByWord(g.words)
 }
 
-func (g *Generator) randomPrefix() string {
-	index := rand.Intn(len(g.Beginnings))
-	return g.Beginnings[index]
+// For testing: the ways the canonical word has been written, and how many
+// times each has.
+func (g *Generator) repCounts(word string) map[string]int {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	token, exists := g.wordIDs[word]
+	if !exists || int(token) >= len(g.reps) || len(g.reps[token].tokens) == 0 {
+		return nil
+	}
+	return g.reps[token].countsByWord(g.words)
 }
 
-// For testing.
-func (s *CountedStringList) GetSuffix(lookFor string) (*CountedString, bool) {
-	for i := 0; i < len(s.slice); i++ {
-		if s.slice[i].str == lookFor {
-			return s.slice[i], true
-		}
+func (t *suffixTable) countsByWord(words []string) map[string]int {
+	counts := make(map[string]int, len(t.tokens))
+	for i, token := range t.tokens {
+		counts[words[token]] = int(t.counts[i])
 	}
-	return createCountedString(""), false
+	return counts
 }
@@ -0,0 +1,339 @@
+package main
+
+/*
+The Markov model as it was before we interned words: prefixes as joined
+strings, mapped to lists of *CountedStrings we search one at a time. Kept
+around to benchmark the current one against, and to check the two learn the
+same thing from the same text.
+*/
+
+import (
+	"ebooker/logging"
+
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Since both maps (the prefix -> suffix and canonical -> representation)
+// operate about the same way, we abstract their representation into a notion
+// of legacyCountedStrings, where the values of the map contain both the string we
+// care about and a count of how often it occurs.
+type legacyCountedString struct {
+	hits int
+	str  string
+}
+
+// A legacyCountedStringList is a list of all the legacyCountedStrings for a given prefix,
+// and a total number of times that prefix occurs (necessary, with the
+// legacyCountedString hits, for probability calculation).
+type legacyCountedStringList struct {
+	slice []*legacyCountedString
+	total int
+}
+
+// Map from a prefix in canonical form to legacyCountedStringLists, where one will
+// move canonical prefixes to suffixes, and another to words -> representation.
+type legacyCountedStringMap map[string]*legacyCountedStringList
+
+// legacyGenerators give us all we need to build a fresh data model to generate
+// from. They're safe to seed and generate from at the same time.
+type legacyGenerator struct {
+	PrefixLen  int
+	CharLimit  int
+	Data       legacyCountedStringMap // suffix map
+	Reps       legacyCountedStringMap // representation map
+	Beginnings []string               // acceptable ways to start a tweet.
+	canon      bool                   // map sources seperately from representations.
+	logger     *logging.LogMaster     // Lets us debug, emit status.
+	lock       sync.RWMutex           // Writers seed, readers generate.
+}
+
+// createLegacyGenerator returns a legacyGenerator that is fully initialized and ready for
+// use.
+func createLegacyGenerator(prefixLen int, charLimit int, logger *logging.LogMaster) *legacyGenerator {
+	markov := make(legacyCountedStringMap)
+	reps := make(legacyCountedStringMap)
+	beginnings := []string{}
+	return &legacyGenerator{PrefixLen: prefixLen, CharLimit: charLimit, Data: markov, Reps: reps,
+		Beginnings: beginnings, logger: logger}
+}
+
+// Convenience method, already populating the first "hit" of the legacyCountedString.
+func createLegacyCountedString(str string) *legacyCountedString {
+	return &legacyCountedString{1, str}
+}
+
+// AddSeeds takes in a string, breaks it into prefixes, and adds it to the
+// data model.
+func (g *legacyGenerator) AddSeeds(input string) {
+	source := tokenize(StripReply(input))
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.canon {
+		var canonical []string
+		for i := 0; i < len(source); i++ {
+			canonical = append(canonical, Canonicalize(source[i]))
+			legacyAddToMap(canonical[i], source[i], g.Reps)
+		}
+		source = canonical
+	}
+
+	first := true
+	for len(source) > g.PrefixLen {
+		prefix := strings.Join(source[0:g.PrefixLen], " ")
+		legacyAddToMap(prefix, source[g.PrefixLen], g.Data)
+		source = source[1:]
+		if first {
+			g.Beginnings = append(g.Beginnings, prefix)
+			first = false
+		}
+	}
+}
+
+// legacyAddToMap checks if the key/value pair exists in the map. If not, we create
+// them, and if so, we either increment the counter on the value or initialize
+// it if it didn't exist previously.
+func legacyAddToMap(prefix, toAdd string, aMap legacyCountedStringMap) {
+
+	if csList, exists := aMap[prefix]; exists {
+		if countedStr, member := csList.hasCountedString(toAdd); member {
+			countedStr.hits++
+		} else {
+			countedStr = createLegacyCountedString(toAdd)
+			csList.slice = append(csList.slice, countedStr)
+		}
+		csList.total++
+	} else {
+		countedStr := createLegacyCountedString(toAdd)
+		countedStrSlice := make([]*legacyCountedString, 0)
+		countedStrSlice = append(countedStrSlice, countedStr)
+		csList := &legacyCountedStringList{countedStrSlice, 1}
+
+		aMap[prefix] = csList
+	}
+}
+
+// hasCountedString searches a legacyCountedStringList for one that contains the string, and
+// returns the suffix (if applicable) and a boolean describing whether or not
+// we found it.
+func (l legacyCountedStringList) hasCountedString(lookFor string) (*legacyCountedString, bool) {
+	slice := l.slice
+	for i := 0; i < len(slice); i++ {
+		curr := slice[i]
+		if curr.str == lookFor {
+			return curr, true
+		}
+	}
+
+	return createLegacyCountedString(""), false
+}
+
+// Generates text from the given generator. It stops when the character limit
+// has run out, or it encounters a prefix it has no suffixes for.
+func (g *legacyGenerator) GenerateText() string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.generateFromPrefix(g.randomPrefix())
+}
+
+// We expose this version primarily for testing.
+func (g *legacyGenerator) GenerateFromPrefix(prefix string) string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.generateFromPrefix(prefix)
+}
+
+func (g *legacyGenerator) generateFromPrefix(prefix string) string {
+
+	g.logger.DebugWrite("Generating text from prefix \"%s\"\n", prefix)
+
+	// Representation gets a special case, since you can have a multi-word
+	// prefix (e.g. "Paul is") but each word needs it's own representation
+	// (e.g. "PAUL" "is" or "pAUL" "Is"). Note that this can break if your
+	// prefix's rep is longer than the charLimit, should we generalize
+	var result []string
+	charLimit := g.CharLimit
+
+	if g.canon {
+		split := strings.Split(prefix, " ")
+		for _, token := range split {
+			rep := g.Reps[token].DrawProbabilistically()
+			charLimit -= len(rep)
+			result = append(result, rep)
+		}
+	} else {
+		result = append(result, prefix)
+		charLimit -= len(prefix)
+	}
+
+	for {
+		word, shouldTerminate, newPrefix, newCharLimit := g.popNextWord(prefix, charLimit)
+		prefix = newPrefix
+		charLimit = newCharLimit
+
+		if shouldTerminate {
+			break
+		} else {
+			result = append(result, word)
+			g.logger.DebugWrite("New Prefix is \"%s\", %d characters remain\n", newPrefix, newCharLimit)
+		}
+	}
+
+	return strings.Join(result, " ")
+}
+
+func (g *legacyGenerator) popNextWord(prefix string, limit int) (string, bool, string, int) {
+
+	csList, exists := g.Data[prefix]
+
+	if !exists {
+		g.logger.DebugWrite("Prefix does not exist, terminating this run.\n")
+		return "", true, "", 0 // terminate path
+	}
+	successor := csList.DrawProbabilistically()
+	g.logger.DebugWrite("Drew \"%s\" as successor to \"%s\".\n", successor, prefix)
+	var rep string
+	if g.canon {
+		rep = g.Reps[successor].DrawProbabilistically()
+		g.logger.DebugWrite("After probabilisic draw, successor is respresented by \"%s\"\n", rep)
+	} else {
+		rep = successor
+	}
+
+	addsTo := len(rep) + 1
+
+	if addsTo <= limit {
+		shifted := append(strings.Split(prefix, " ")[1:], rep)
+		newPrefix := strings.Join(shifted, " ")
+		newLimit := limit - addsTo
+		return rep, false, newPrefix, newLimit
+	}
+	g.logger.DebugWrite("Exceeding character limit. Terminating run.\n")
+	return "", true, "", 0
+}
+
+func (g *legacyGenerator) CanonicalizeSources() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.canon = true
+}
+
+func (cs legacyCountedStringList) DrawProbabilistically() string {
+	index := rand.Intn(cs.total) + 1
+	for i := 0; i < len(cs.slice); i++ {
+		if index <= cs.slice[i].hits {
+			return cs.slice[i].str
+		}
+		index -= cs.slice[i].hits
+	}
+	return ""
+}
+
+func (g *legacyGenerator) randomPrefix() string {
+	index := rand.Intn(len(g.Beginnings))
+	return g.Beginnings[index]
+}
+
+// A synthetic corpus, so the benchmarks don't need anyone's real tweets: 100k
+// tweets of 5 to 25 words, drawn from a vocabulary with a Zipf-like spread,
+// as real text has. Built once, and the same every run.
+const (
+	BENCH_TWEETS     = 100000
+	BENCH_VOCABULARY = 20000
+)
+
+var benchCorpus []string
+var benchCorpusOnce sync.Once
+
+func syntheticCorpus(tweets int) []string {
+	random := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(random, 1.1, 1, BENCH_VOCABULARY-1)
+
+	corpus := make([]string, tweets)
+	for i := range corpus {
+		words := make([]string, 5+random.Intn(21))
+		for j := range words {
+			words[j] = fmt.Sprintf("w%d", zipf.Uint64())
+		}
+		corpus[i] = strings.Join(words, " ")
+	}
+	return corpus
+}
+
+func getBenchCorpus() []string {
+	benchCorpusOnce.Do(func() {
+		benchCorpus = syntheticCorpus(BENCH_TWEETS)
+	})
+	return benchCorpus
+}
+
+func trainGenerator(corpus []string) *Generator {
+	gen := CreateGenerator(1, 140, &logging.LogMaster{})
+	for _, tweet := range corpus {
+		gen.AddSeeds(tweet)
+	}
+	return gen
+}
+
+func trainLegacyGenerator(corpus []string) *legacyGenerator {
+	gen := createLegacyGenerator(1, 140, &logging.LogMaster{})
+	for _, tweet := range corpus {
+		gen.AddSeeds(tweet)
+	}
+	return gen
+}
+
+// How much the heap grows to hold what train builds.
+func heapGrowth(train func() interface{}) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	model := train()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(model)
+	return float64(after.HeapAlloc) - float64(before.HeapAlloc)
+}
+
+func BenchmarkTrain(b *testing.B) {
+	corpus := getBenchCorpus()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trainGenerator(corpus)
+	}
+	b.StopTimer()
+	b.ReportMetric(heapGrowth(func() interface{} { return trainGenerator(corpus) }), "model-bytes")
+}
+
+func BenchmarkTrainLegacy(b *testing.B) {
+	corpus := getBenchCorpus()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trainLegacyGenerator(corpus)
+	}
+	b.StopTimer()
+	b.ReportMetric(heapGrowth(func() interface{} { return trainLegacyGenerator(corpus) }), "model-bytes")
+}
+
+func BenchmarkGenerateText(b *testing.B) {
+	gen := trainGenerator(getBenchCorpus())
+	gen.GenerateText()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gen.GenerateText()
+	}
+}
+
+func BenchmarkGenerateTextLegacy(b *testing.B) {
+	gen := trainLegacyGenerator(getBenchCorpus())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gen.GenerateText()
+	}
+}
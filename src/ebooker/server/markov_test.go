@@ -52,7 +52,7 @@ func (s MarkovSuite) TestAddSeeds(c *gocheck.C) {
 	expectedPrefixes := []string{"today is", "is a", "a great", "great day", "day to", "to be"}
 
 	for i := 0; i < len(expectedPrefixes); i++ {
-		assertHasPrefix(gen.Data, expectedPrefixes[i], c)
+		assertHasPrefix(gen.suffixCounts, expectedPrefixes[i], c)
 	}
 
 	gen.AddSeeds("today is a terrible day to be me")
@@ -78,7 +78,7 @@ func (s MarkovSuite) TestAddSeeds(c *gocheck.C) {
 
 	for i := 0; i < len(suffixTests); i++ {
 		triple := suffixTests[i]
-		assertSuffixFrequencyCount(gen.Data, triple.prefix, triple.suffix, triple.count, c)
+		assertSuffixFrequencyCount(gen.suffixCounts, triple.prefix, triple.suffix, triple.count, c)
 	}
 }
 
@@ -94,23 +94,23 @@ func (s MarkovSuite) TestRepresentationCount(c *gocheck.C) {
 	gen.AddSeeds("IVE NEVER KILLED A MAN STOP ASKING")
 	gen.AddSeeds("you have been so sad!!!")
 
-	assertHasPrefix(gen.Data, "ive never", c)
-	assertHasPrefix(gen.Reps, "ive", c)
-	assertHasPrefix(gen.Reps, "never", c)
-	assertSuffixFrequencyCount(gen.Data, "ive never", "been", 2, c)
-	assertSuffixFrequencyCount(gen.Reps, "ive", "IVE", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "ive", "I've", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "ive", "Ive", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "never", "never", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "never", "NEVER", 2, c)
-
-	assertHasPrefix(gen.Reps, "been", c)
-	assertHasPrefix(gen.Reps, "so", c)
-	assertSuffixFrequencyCount(gen.Data, "been so", "sad", 2, c)
-	assertSuffixFrequencyCount(gen.Data, "been so", "mad", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "mad", "mad", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "sad", "sad!!!", 1, c)
-	assertSuffixFrequencyCount(gen.Reps, "sad", "sad", 1, c)
+	assertHasPrefix(gen.suffixCounts, "ive never", c)
+	assertHasPrefix(gen.repCounts, "ive", c)
+	assertHasPrefix(gen.repCounts, "never", c)
+	assertSuffixFrequencyCount(gen.suffixCounts, "ive never", "been", 2, c)
+	assertSuffixFrequencyCount(gen.repCounts, "ive", "IVE", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "ive", "I've", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "ive", "Ive", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "never", "never", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "never", "NEVER", 2, c)
+
+	assertHasPrefix(gen.repCounts, "been", c)
+	assertHasPrefix(gen.repCounts, "so", c)
+	assertSuffixFrequencyCount(gen.suffixCounts, "been so", "sad", 2, c)
+	assertSuffixFrequencyCount(gen.suffixCounts, "been so", "mad", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "mad", "mad", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "sad", "sad!!!", 1, c)
+	assertSuffixFrequencyCount(gen.repCounts, "sad", "sad", 1, c)
 }
 
 // Much harder to test in that we require some level of randomness.
@@ -174,24 +174,121 @@ func testCharLimit(charLimit int, c *gocheck.C) {
 	}
 }
 
-func assertHasPrefix(aMap CountedStringMap, prefix string, c *gocheck.C) {
-	_, exists := aMap[prefix]
+// The interned model should learn exactly what the old one did, suffix counts
+// and representations alike.
+func (s MarkovSuite) TestMatchesLegacy(c *gocheck.C) {
+	for _, canon := range []bool{false, true} {
+		gen := makeGenerator(2, 140)
+		legacy := createLegacyGenerator(2, 140, &logging.LogMaster{})
+		if canon {
+			gen.CanonicalizeSources()
+			legacy.CanonicalizeSources()
+		}
+		for _, tweet := range append(syntheticCorpus(2000), "I've NEVER BEEN so mad", "Ive never been so sad") {
+			gen.AddSeeds(tweet)
+			legacy.AddSeeds(tweet)
+		}
+
+		c.Assert(len(gen.beginnings), gocheck.Equals, len(legacy.Beginnings))
+		c.Assert(len(gen.suffixes), gocheck.Equals, len(legacy.Data))
+		for prefix, csList := range legacy.Data {
+			counts := gen.suffixCounts(prefix)
+			c.Assert(totalCount(counts), gocheck.Equals, csList.total)
+			for _, countedStr := range csList.slice {
+				c.Assert(counts[countedStr.str], gocheck.Equals, countedStr.hits)
+			}
+		}
+		for word, csList := range legacy.Reps {
+			counts := gen.repCounts(word)
+			c.Assert(totalCount(counts), gocheck.Equals, csList.total)
+			for _, countedStr := range csList.slice {
+				c.Assert(counts[countedStr.str], gocheck.Equals, countedStr.hits)
+			}
+		}
+	}
+}
+
+// Text seeded after we've generated is drawn from next time, and a model with
+// nothing in it has nothing to say.
+func (s MarkovSuite) TestSeedAfterGenerating(c *gocheck.C) {
+	gen := makeGenerator(1, 140)
+	c.Assert(gen.GenerateText(), gocheck.Equals, "")
+
+	gen.AddSeeds("today is great")
+	c.Assert(gen.GenerateText(), gocheck.Equals, "today is great")
+
+	gen.AddSeeds("is fine")
+	gen.AddSeeds("is fine")
+	gen.AddSeeds("is fine")
+	assertProperFrequencyGeneration(gen, "is", "great", 0.25, c)
+	assertProperFrequencyGeneration(gen, "is", "fine", 0.75, c)
+}
+
+// Seeding between settling and generating can add a token in the middle of a
+// table, leaving its running totals out of step; we still draw by the counts.
+func (s MarkovSuite) TestDrawWhileStale(c *gocheck.C) {
+	var table suffixTable
+	for i := 0; i < 3; i++ {
+		table.add(5)
+	}
+	table.settle()
+	table.add(3)
+	c.Assert(table.tokens, gocheck.DeepEquals, []tokenID{3, 5})
+	c.Assert(table.cumulative, gocheck.DeepEquals, []uint32{3})
+
+	drawn := make(map[tokenID]int)
+	for i := 0; i < 1000; i++ {
+		drawn[table.draw()]++
+	}
+	c.Assert(drawn[3]+drawn[5], gocheck.Equals, 1000)
+	c.Assert(drawn[5] > drawn[3], gocheck.Equals, true, gocheck.Commentf("drew %v", drawn))
+
+	table.settle()
+	c.Assert(table.cumulative, gocheck.DeepEquals, []uint32{1, 4})
+}
+
+// In canonical mode, we walk the canonical words, whichever way we wrote the
+// last one.
+func (s MarkovSuite) TestCanonicalGeneration(c *gocheck.C) {
+	gen := makeGenerator(1, 140)
+	gen.CanonicalizeSources()
+	gen.AddSeeds("Today IS great")
+
+	c.Assert(gen.GenerateFromPrefix("today"), gocheck.Equals, "Today IS great")
+	c.Assert(gen.GenerateFromPrefix("nobody"), gocheck.Equals, "nobody")
+}
+
+// Looks up the counts for a prefix (or canonical word) in one of the
+// Generator's tables: gen.suffixCounts or gen.repCounts.
+type countLookup func(prefix string) map[string]int
+
+func assertHasPrefix(lookup countLookup, prefix string, c *gocheck.C) {
+	exists := lookup(prefix) != nil
 	if !exists {
 		fmt.Printf("failure to find prefix \"%s\"", prefix)
 	}
 	c.Assert(exists, gocheck.Equals, true)
 }
 
-func assertSuffixFrequencyCount(aMap CountedStringMap, prefix, suffix string, count int, c *gocheck.C) {
-	assertHasPrefix(aMap, prefix, c)
-	countedStr, exists := aMap[prefix].GetSuffix(suffix)
+func assertSuffixFrequencyCount(lookup countLookup, prefix, suffix string, count int, c *gocheck.C) {
+	assertHasPrefix(lookup, prefix, c)
+	hits, exists := lookup(prefix)[suffix]
 
 	c.Assert(exists, gocheck.Equals, true)
 
-	if count != countedStr.hits {
-		fmt.Printf("expecting %d and got %d for '%s' -> '%s'", count, countedStr.hits, prefix, suffix)
+	if count != hits {
+		fmt.Printf("expecting %d and got %d for '%s' -> '%s'", count, hits, prefix, suffix)
+	}
+	c.Assert(hits, gocheck.Equals, count)
+}
+
+// How many times we've seen the prefix, over all its suffixes.
+func totalCount(counts map[string]int) int {
+	total := 0
+	for _, hits := range counts {
+		total += hits
 	}
-	c.Assert(countedStr.hits, gocheck.Equals, count)
+	return total
 }
 
 func assertProperFrequencyGeneration(g *Generator, prefix, suffix string, prob float64, c *gocheck.C) {
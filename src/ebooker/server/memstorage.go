@@ -0,0 +1,209 @@
+package main
+
+/*
+An in-memory Datastore. Nothing survives the process, so this is no use to a
+real server, but it lets us exercise the RPC methods and bots in tests without
+leaving .db files lying around.
+*/
+
+import (
+	"ebooker/oauth1"
+
+	"errors"
+	"sort"
+	"sync"
+)
+
+type memoryDataHandle struct {
+	lock   sync.Mutex
+	tweets map[string]Tweets
+	tokens map[string]oauth1.Token
+	bots   []botRecord
+	posts  []postRecord
+	feeds  map[string]map[string]bool
+	keys   map[string]apiKey // by name
+}
+
+func getMemoryDataHandle() *memoryDataHandle {
+	return &memoryDataHandle{tweets: make(map[string]Tweets), tokens: make(map[string]oauth1.Token),
+		feeds: make(map[string]map[string]bool), keys: make(map[string]apiKey)}
+}
+
+// Nothing to release, but we satisfy Datastore.
+func (mh *memoryDataHandle) Cleanup() {}
+
+// Memory's always there.
+func (mh *memoryDataHandle) ping() error {
+	return nil
+}
+
+// Retrieves all tweets we have for a given user, sorted by ID like the sqlite
+// version.
+func (mh *memoryDataHandle) GetTweetsFromStorage(username string) Tweets {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	stored := mh.tweets[username]
+	tweets := make(Tweets, len(stored))
+	copy(tweets, stored)
+	sort.Sort(tweets)
+	return tweets
+}
+
+// Inserts tweets into memory.
+func (mh *memoryDataHandle) InsertFreshTweets(username string, newTweets Tweets) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.tweets[username] = appendSlices(mh.tweets[username], newTweets)
+}
+
+func (mh *memoryDataHandle) getUserAccessToken(username string) (*oauth1.Token, bool) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	token, exists := mh.tokens[username]
+	if !exists {
+		return nil, false
+	}
+	return &token, true
+}
+
+func (mh *memoryDataHandle) insertUserAccessToken(username string, token *oauth1.Token) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.tokens[username] = *token
+}
+
+func (mh *memoryDataHandle) saveBot(bot botRecord) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.removeBot(bot.Name)
+	mh.bots = append(mh.bots, bot)
+	sort.Sort(byBotName(mh.bots))
+}
+
+func (mh *memoryDataHandle) deleteBot(name string) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.removeBot(name)
+}
+
+// Call with the lock held.
+func (mh *memoryDataHandle) removeBot(name string) {
+	for i, saved := range mh.bots {
+		if saved.Name == name {
+			mh.bots = append(mh.bots[:i:i], mh.bots[i+1:]...)
+			return
+		}
+	}
+}
+
+func (mh *memoryDataHandle) loadBots() []botRecord {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	return append([]botRecord(nil), mh.bots...)
+}
+
+func (mh *memoryDataHandle) recordPost(post postRecord) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	mh.posts = append(mh.posts, post)
+}
+
+func (mh *memoryDataHandle) loadPosts(bot string) []postRecord {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	var posts []postRecord
+	for _, post := range mh.posts {
+		if post.Bot == bot {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
+func (mh *memoryDataHandle) seenFeedItems(feed string) map[string]bool {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	seen := make(map[string]bool)
+	for guid := range mh.feeds[feed] {
+		seen[guid] = true
+	}
+	return seen
+}
+
+func (mh *memoryDataHandle) markFeedItemsSeen(feed string, guids []string) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	if mh.feeds[feed] == nil {
+		mh.feeds[feed] = make(map[string]bool)
+	}
+	for _, guid := range guids {
+		mh.feeds[feed][guid] = true
+	}
+}
+
+func (mh *memoryDataHandle) insertAPIKey(key apiKey) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	for _, stored := range mh.keys {
+		if stored.Name == key.Name || stored.Hash == key.Hash {
+			return errors.New("There's already an API key named " + key.Name + ".")
+		}
+	}
+	mh.keys[key.Name] = key
+	return nil
+}
+
+func (mh *memoryDataHandle) getAPIKey(hash string) (*apiKey, bool) {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	for _, key := range mh.keys {
+		if key.Hash == hash {
+			return &key, true
+		}
+	}
+	return nil, false
+}
+
+func (mh *memoryDataHandle) deleteAPIKey(name string) bool {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	_, exists := mh.keys[name]
+	delete(mh.keys, name)
+	return exists
+}
+
+func (mh *memoryDataHandle) loadAPIKeys() []apiKey {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+
+	names := make([]string, 0, len(mh.keys))
+	for name := range mh.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([]apiKey, len(names))
+	for i, name := range names {
+		keys[i] = mh.keys[name]
+	}
+	return keys
+}
+
+type byBotName []botRecord
+
+func (b byBotName) Len() int           { return len(b) }
+func (b byBotName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBotName) Less(i, j int) bool { return b[i].Name < b[j].Name }
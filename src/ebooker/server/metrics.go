@@ -0,0 +1,314 @@
+package main
+
+/*
+What the server's been up to, at /metrics, in the text format Prometheus
+scrapes: RPC calls by method and how they went, and how long they took; tweets
+ingested, by source; requests to Twitter, by endpoint and status; how often
+we've been rate limited; posts sent and failed, by bot; how long generating a
+tweet takes; and how big each cached model is.
+
+Scraping needs an API key with the metrics scope (or admin), since bot and
+source names are in there. Point Prometheus at it with a bearer token.
+
+Counters and histograms live as long as the process does; the model sizes are
+read off the cache when we're scraped.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	METRICS_PATH         = "/metrics"
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// Upper bounds of histograms' buckets, in seconds. Generating a tweet takes
+// well under a millisecond, while a NewBot may wait on Twitter for a while.
+var LATENCY_BUCKETS = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+var (
+	RPC_CALLS = newCounterVec("ebooker_rpc_calls_total",
+		"RPC calls, over net/rpc or REST, by method and status (ok, or the REST API's error code).", "method", "status")
+	RPC_SECONDS = newHistogramVec("ebooker_rpc_call_seconds",
+		"How long RPC calls took, by method.", LATENCY_BUCKETS, "method")
+	TWEETS_INGESTED = newCounterVec("ebooker_tweets_ingested_total",
+		"New tweets fetched and stored, by source. Mastodon statuses count as tweets, as do the sentences of feed entries.", "source")
+	TWITTER_REQUESTS = newCounterVec("ebooker_twitter_requests_total",
+		"Requests made to Twitter's API, by endpoint and HTTP status (error if there was no response).", "endpoint", "status")
+	RATE_LIMIT_WAITS = newCounterVec("ebooker_rate_limit_waits_total",
+		"Times a service told us to slow down (HTTP 429), by service. Webhook posts wait and try again; everything else waits for its next turn.", "service")
+	POSTS = newCounterVec("ebooker_posts_total",
+		"Posts bots tried to make, by bot and result (sent or failed).", "bot", "result")
+	GENERATION_SECONDS = newHistogramVec("ebooker_generation_seconds",
+		"How long generating a tweet took.", LATENCY_BUCKETS)
+)
+
+// In the order /metrics lists them.
+var METRICS = []metric{RPC_CALLS, RPC_SECONDS, TWEETS_INGESTED, TWITTER_REQUESTS, RATE_LIMIT_WAITS, POSTS, GENERATION_SECONDS}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// A counter for each combination of label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lock   sync.Mutex
+	values map[string]float64 // by rendered label values
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Counts one, for the label values (in the order the labels were given).
+func (cv *counterVec) inc(values ...string) {
+	cv.add(1, values...)
+}
+
+func (cv *counterVec) add(n float64, values ...string) {
+	series := renderLabels(cv.labels, values)
+	cv.lock.Lock()
+	cv.values[series] += n
+	cv.lock.Unlock()
+}
+
+func (cv *counterVec) value(values ...string) float64 {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	return cv.values[renderLabels(cv.labels, values)]
+}
+
+func (cv *counterVec) write(w io.Writer) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+
+	writeHeader(w, cv.name, cv.help, "counter")
+	for _, series := range sortedKeys(cv.values) {
+		writeSample(w, cv.name, series, cv.values[series])
+	}
+}
+
+// A histogram for each combination of label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*histogram // by rendered label values
+}
+
+type histogram struct {
+	counts []uint64 // observations in each bucket (not cumulative), then above them all
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (hv *histogramVec) observe(seconds float64, values ...string) {
+	series := renderLabels(hv.labels, values)
+	bucket := sort.SearchFloat64s(hv.buckets, seconds)
+
+	hv.lock.Lock()
+	defer hv.lock.Unlock()
+	h, exists := hv.series[series]
+	if !exists {
+		h = &histogram{counts: make([]uint64, len(hv.buckets)+1)}
+		hv.series[series] = h
+	}
+	h.counts[bucket]++
+	h.sum += seconds
+}
+
+// Observes how long it's been since start.
+func (hv *histogramVec) since(start time.Time, values ...string) {
+	hv.observe(time.Since(start).Seconds(), values...)
+}
+
+// How many observations there have been, for the label values.
+func (hv *histogramVec) count(values ...string) uint64 {
+	hv.lock.Lock()
+	defer hv.lock.Unlock()
+
+	var total uint64
+	if h, exists := hv.series[renderLabels(hv.labels, values)]; exists {
+		for _, n := range h.counts {
+			total += n
+		}
+	}
+	return total
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	hv.lock.Lock()
+	defer hv.lock.Unlock()
+
+	writeHeader(w, hv.name, hv.help, "histogram")
+	keys := make([]string, 0, len(hv.series))
+	for series := range hv.series {
+		keys = append(keys, series)
+	}
+	sort.Strings(keys)
+	for _, series := range keys {
+		h := hv.series[series]
+		var cumulative uint64
+		for i, n := range h.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(hv.buckets) {
+				le = formatValue(hv.buckets[i])
+			}
+			writeSample(w, hv.name+"_bucket", joinLabels(series, `le="`+le+`"`), float64(cumulative))
+		}
+		writeSample(w, hv.name+"_sum", series, h.sum)
+		writeSample(w, hv.name+"_count", series, float64(cumulative))
+	}
+}
+
+// How big a cached model is.
+type modelSize struct {
+	sources   []string
+	prefixLen int
+	canon     bool
+	prefixes  int
+	tokens    int
+}
+
+// Writes the sizes of the models in the cache, as gauges.
+func writeModelMetrics(w io.Writer, models *modelCache) {
+	sizes := models.sizes()
+	series := make([]string, len(sizes))
+	for i, size := range sizes {
+		series[i] = renderLabels([]string{"sources", "prefix_len", "canonical"},
+			[]string{strings.Join(size.sources, ","), strconv.Itoa(size.prefixLen), strconv.FormatBool(size.canon)})
+	}
+	writeHeader(w, "ebooker_model_prefixes", "Distinct prefixes in each cached model.", "gauge")
+	for i, size := range sizes {
+		writeSample(w, "ebooker_model_prefixes", series[i], float64(size.prefixes))
+	}
+	writeHeader(w, "ebooker_model_tokens", "Distinct words (tokens) in each cached model.", "gauge")
+	for i, size := range sizes {
+		writeSample(w, "ebooker_model_tokens", series[i], float64(size.tokens))
+	}
+}
+
+// Times an RPC method, and counts it by how it went. Deferred at the top of
+// each method, with a pointer to its error.
+func countRPC(method string, start time.Time, err *error) {
+	status := "ok"
+	if *err != nil {
+		status = asRestError(*err).Code
+	}
+	RPC_CALLS.inc(method, status)
+	RPC_SECONDS.since(start, method)
+}
+
+// Counts responses that tell us we've hit the service's rate limit.
+func countRateLimit(service string, resp *http.Response) {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		RATE_LIMIT_WAITS.inc(service)
+	}
+}
+
+// Renders label values as Prometheus wants them between the braces:
+// method="NewBot",status="ok".
+func renderLabels(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metric with labels %v given values %v", names, values))
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + LABEL_ESCAPER.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var LABEL_ESCAPER = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(series, more string) string {
+	if series == "" {
+		return more
+	}
+	return series + "," + more
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, series string, value float64) {
+	if series != "" {
+		name += "{" + series + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatValue(value))
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Serves the metrics to holders of a key with the metrics scope.
+type metricsHandler struct {
+	eb *Ebooker
+}
+
+func newMetricsHandler(eb *Ebooker) *metricsHandler {
+	return &metricsHandler{eb}
+}
+
+func (m *metricsHandler) register(mux *http.ServeMux) {
+	mux.Handle(METRICS_PATH, m)
+}
+
+func (m *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 must GET", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := authenticate(m.eb.data, r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !key.allows(SCOPE_METRICS) {
+		http.Error(w, "This API key doesn't have the "+SCOPE_METRICS+" scope.", http.StatusForbidden)
+		return
+	}
+
+	// Written out in full first, so a slow scraper doesn't hold the locks.
+	var buf bytes.Buffer
+	for _, metric := range METRICS {
+		metric.write(&buf)
+	}
+	writeModelMetrics(&buf, m.eb.models)
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"ebooker/oauth1"
+
+	"bytes"
+	"context"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type MetricsSuite struct{}
+
+var _ = gocheck.Suite(&MetricsSuite{})
+
+func (s MetricsSuite) TestExposition(c *gocheck.C) {
+	counter := newCounterVec("test_calls_total", "Calls.\nBy method.", "method", "status")
+	counter.inc("NewBot", "ok")
+	counter.add(2, "GenerateTweets", "bad_request")
+	counter.inc("NewBot", "ok")
+	counter.inc(`say "hi"\`, "ok")
+	c.Assert(counter.value("NewBot", "ok"), gocheck.Equals, float64(2))
+	c.Assert(counter.value("NewBot", "conflict"), gocheck.Equals, float64(0))
+	c.Assert(func() { counter.inc("NewBot") }, gocheck.Panics, "metric with labels [method status] given values [NewBot]")
+
+	histogram := newHistogramVec("test_seconds", "Latency.", []float64{0.5, 1})
+	histogram.observe(0.25)
+	histogram.observe(1)
+	histogram.observe(3)
+	c.Assert(histogram.count(), gocheck.Equals, uint64(3))
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	histogram.write(&buf)
+	c.Assert(buf.String(), gocheck.Equals, `# HELP test_calls_total Calls.\nBy method.
+# TYPE test_calls_total counter
+test_calls_total{method="GenerateTweets",status="bad_request"} 2
+test_calls_total{method="NewBot",status="ok"} 2
+test_calls_total{method="say \"hi\"\\",status="ok"} 1
+# HELP test_seconds Latency.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 4.25
+test_seconds_count 3
+`)
+}
+
+// What we do shows up in the counters. They're shared by every test, so we
+// look at how much they've gone up.
+func (s MetricsSuite) TestInstrumentation(c *gocheck.C) {
+	ts := newTwitterServer()
+	ts.fill("SrPablo", 3)
+	tf := ts.fetcher()
+	fetches := TWITTER_REQUESTS.value(USER_TIMELINE_PATH, "200")
+	tf.GetRecentTimeline("SrPablo", &TweetData{}, &oauth1.Token{"token", "secret"})
+	c.Assert(TWITTER_REQUESTS.value(USER_TIMELINE_PATH, "200"), gocheck.Equals, fetches+1)
+	ts.Close()
+	failures := TWITTER_REQUESTS.value(UPDATE_STATUS_PATH, "error")
+	tf.sendTweet("into the void", &oauth1.Token{"token", "secret"})
+	c.Assert(TWITTER_REQUESTS.value(UPDATE_STATUS_PATH, "error"), gocheck.Equals, failures+1)
+
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+	ingested := TWEETS_INGESTED.value("SrPablo")
+	generated := GENERATION_SECONDS.count()
+	gen, err := eb.models.acquire([]string{"SrPablo"}, 1, false, &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(TWEETS_INGESTED.value("SrPablo") > ingested, gocheck.Equals, true)
+	gen.GenerateText()
+	c.Assert(GENERATION_SECONDS.count(), gocheck.Equals, generated+1)
+
+	// A post that goes out, and one that doesn't after being rate limited.
+	fw := newFakeWebhook(http.StatusTooManyRequests, http.StatusBadRequest)
+	defer fw.server.Close()
+	genArgs := makeTestGenParams("SrPablo")
+	sched := newSchedule("0", "11,19", ALL, ALL, ALL)
+	sent := POSTS.value("metrics_ebooks", "sent")
+	failed := POSTS.value("metrics_ebooks", "failed")
+	waits := RATE_LIMIT_WAITS.value("webhook")
+	bot := eb.newBot("metrics_ebooks", "metrics_ebooks", &genArgs, "", gen, &oauth1.Token{}, &twitterPublisher{ft, &oauth1.Token{}}, BOT_RUNNING, sched)
+	bot.tweet()
+	<-ft.posted
+	bot.publisher = makeTestWebhook(c, makeTestWebhookParams(fw, ""))
+	bot.tweet()
+	c.Assert(POSTS.value("metrics_ebooks", "sent"), gocheck.Equals, sent+1)
+	c.Assert(POSTS.value("metrics_ebooks", "failed"), gocheck.Equals, failed+1)
+	c.Assert(RATE_LIMIT_WAITS.value("webhook"), gocheck.Equals, waits+1)
+
+	var out []string
+	authed := makeTestAuthed(c, eb, "pablo", SCOPE_BOTS)
+	listed := RPC_CALLS.value("ListBots", "ok")
+	paused := RPC_CALLS.value("PauseBot", "not_found")
+	c.Assert(authed.ListBots("", &out), gocheck.IsNil)
+	var msg string
+	c.Assert(authed.PauseBot("nobody", &msg), gocheck.NotNil)
+	c.Assert(RPC_CALLS.value("ListBots", "ok"), gocheck.Equals, listed+1)
+	c.Assert(RPC_CALLS.value("PauseBot", "not_found"), gocheck.Equals, paused+1)
+	c.Assert(RPC_SECONDS.count("ListBots") > 0, gocheck.Equals, true)
+	eb.models.release(gen)
+}
+
+// Fetches /metrics with the key, if it's given.
+func scrapeMetrics(c *gocheck.C, server *httptest.Server, key string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", server.URL+METRICS_PATH, nil)
+	c.Assert(err, gocheck.IsNil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := server.Client().Do(req)
+	c.Assert(err, gocheck.IsNil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func (s MetricsSuite) TestMetricsEndpoint(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+	eb.data.insertAPIKey(apiKey{"prometheus", hashAPIKey("ebk_scraper"), []string{SCOPE_METRICS}, time.Now()})
+	eb.data.insertAPIKey(apiKey{"pablo", hashAPIKey("ebk_pablo"), []string{SCOPE_GENERATE, SCOPE_BOTS}, time.Now()})
+	mux := http.NewServeMux()
+	newMetricsHandler(eb).register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, _ := scrapeMetrics(c, server, "")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(resp.Header.Get("WWW-Authenticate"), gocheck.Equals, "Bearer")
+	resp, _ = scrapeMetrics(c, server, "ebk_pablo")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusForbidden)
+
+	var out []string
+	c.Assert(makeTestAuthed(c, eb, "lister", SCOPE_BOTS).ListBots("", &out), gocheck.IsNil)
+	gen, err := eb.models.acquire([]string{"SrPablo", "laurelita", "SrPablo"}, 1, true, &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	defer eb.models.release(gen)
+	prefixes, tokens := gen.counts()
+	c.Assert(prefixes > 0 && tokens > 0, gocheck.Equals, true)
+
+	resp, metrics := scrapeMetrics(c, server, "ebk_scraper")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), gocheck.Equals, METRICS_CONTENT_TYPE)
+	for _, name := range []string{"rpc_calls_total counter", "rpc_call_seconds histogram", "tweets_ingested_total counter",
+		"twitter_requests_total counter", "rate_limit_waits_total counter", "posts_total counter", "generation_seconds histogram"} {
+		c.Assert(metrics, gocheck.Matches, "(?s).*\n# TYPE ebooker_"+name+"\n.*")
+	}
+	c.Assert(metrics, gocheck.Matches, `(?s).*\nebooker_rpc_calls_total\{method="ListBots",status="ok"\} \d+\n.*`)
+	c.Assert(metrics, gocheck.Matches, `(?s).*\nebooker_rpc_call_seconds_bucket\{method="ListBots",le="\+Inf"\} \d+\n.*`)
+	c.Assert(metrics, gocheck.Matches, `(?s).*\n# TYPE ebooker_model_prefixes gauge\n`+
+		`ebooker_model_prefixes\{sources="SrPablo,laurelita",prefix_len="1",canonical="true"\} \d+\n.*`)
+	c.Assert(metrics, gocheck.Matches, `(?s).*\nebooker_model_tokens\{sources="SrPablo,laurelita",prefix_len="1",canonical="true"\} \d+\n.*`)
+
+	resp, _ = scrapeMetrics(c, server, "ebk_test_nope")
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusUnauthorized)
+}
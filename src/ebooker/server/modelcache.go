@@ -0,0 +1,210 @@
+package main
+
+/*
+Models (Generators) are shared by every bot and GenerateTweets call that wants
+the same thing: the same sources, prefix length, and representation setting.
+Ten bots off the same celebrity cost one model, and one subscription to the
+refresher.
+
+Models are reference counted. A model nobody's using stays cached, so the next
+GenerateTweets for the same sources is quick, until the unused models go over
+the memory budget; then they're evicted, least recently used first. Models in
+use are never evicted, and don't count against the budget: it's only for
+what we keep around in case.
+
+Generators lock themselves, so the refresher can feed a model while bots
+generate from it.
+*/
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// How much memory the cache may spend on models nobody's using, unless told
+// otherwise.
+const DEFAULT_MODEL_BUDGET = 256 << 20
+
+type modelCache struct {
+	lock   sync.Mutex
+	models map[string]*cachedModel
+	byGen  map[*Generator]*cachedModel
+	lru    *list.List // of *cachedModel, most recently used at the front
+
+	budget    int64
+	refresher *corpusRefresher
+	logger    *logging.LogMaster
+}
+
+type cachedModel struct {
+	key     string
+	sources []string // sorted, without repeats
+	gen     *Generator
+	err     error
+	ready   chan struct{} // closed once gen (or err) is set
+	refs    int
+	used    *list.Element
+}
+
+func newModelCache(budget int64, refresher *corpusRefresher, logger *logging.LogMaster) *modelCache {
+	return &modelCache{models: make(map[string]*cachedModel), byGen: make(map[*Generator]*cachedModel),
+		lru: list.New(), budget: budget, refresher: refresher, logger: logger}
+}
+
+// Models built from the same sources in any order are the same model.
+func modelKey(sources []string, prefixLen int, canon bool) string {
+	return fmt.Sprintf("%q|%d|%t", uniqueSources(sources), prefixLen, canon)
+}
+
+// The sources, sorted, without repeats.
+func uniqueSources(sources []string) []string {
+	sorted := append([]string(nil), sources...)
+	sort.Strings(sorted)
+	unique := sorted[:0]
+	for i, source := range sorted {
+		if i == 0 || source != sorted[i-1] {
+			unique = append(unique, source)
+		}
+	}
+	return unique
+}
+
+// Hands out the model for these parameters, building it (with token, a
+// Twitter one or nil, if we need to fetch tweets) if we don't have it
+// already. Every model acquired must be released.
+func (mc *modelCache) acquire(sources []string, prefixLen int, canon bool, token *oauth1.Token) (*Generator, error) {
+	key := modelKey(sources, prefixLen, canon)
+
+	mc.lock.Lock()
+	if model, exists := mc.models[key]; exists {
+		model.refs++
+		mc.lru.MoveToFront(model.used)
+		mc.lock.Unlock()
+
+		// Someone else may still be building it.
+		<-model.ready
+		return model.gen, model.err
+	}
+	model := &cachedModel{key: key, sources: uniqueSources(sources), ready: make(chan struct{}), refs: 1}
+	model.used = mc.lru.PushFront(model)
+	mc.models[key] = model
+	mc.lock.Unlock()
+
+	gen := CreateGenerator(prefixLen, 140, mc.logger)
+	if canon {
+		gen.CanonicalizeSources()
+	}
+	var err error
+	// Each source once: the model's shared with everyone naming the same
+	// ones, however many times.
+	if mc.refresher.subscribe(gen, model.sources, token) == 0 {
+		mc.refresher.unsubscribe(gen)
+		mc.logger.StatusWrite("Can't write nonsense tweets, as we don't have a corpus!\n")
+		err = errors.New("No text for users in list. Either unauthorized, or they don't exist")
+	}
+
+	mc.lock.Lock()
+	if err != nil {
+		// Everyone waiting gets the error, and the next to ask tries again.
+		model.err = err
+		delete(mc.models, key)
+		mc.lru.Remove(model.used)
+	} else {
+		model.gen = gen
+		mc.byGen[gen] = model
+	}
+	mc.lock.Unlock()
+	close(model.ready)
+
+	if err != nil {
+		return nil, err
+	}
+	mc.evict()
+	return gen, nil
+}
+
+// Lets go of a model acquired earlier.
+func (mc *modelCache) release(gen *Generator) {
+	mc.lock.Lock()
+	if model, exists := mc.byGen[gen]; exists && model.refs > 0 {
+		model.refs--
+	}
+	mc.lock.Unlock()
+	mc.evict()
+}
+
+// Evicts unused models, least recently used first, until those left are
+// within budget.
+func (mc *modelCache) evict() {
+	var evicted []*Generator
+
+	mc.lock.Lock()
+	// Only unused models count; the budget's for them.
+	var total int64
+	for element := mc.lru.Front(); element != nil; element = element.Next() {
+		if model := element.Value.(*cachedModel); model.refs == 0 && model.gen != nil {
+			total += model.gen.approxSize()
+		}
+	}
+
+	for element := mc.lru.Back(); element != nil && total > mc.budget; {
+		model := element.Value.(*cachedModel)
+		element = element.Prev()
+		if model.refs > 0 || model.gen == nil {
+			continue
+		}
+		mc.logger.StatusWrite("Evicting the model for %s from the cache.\n", model.key)
+		total -= model.gen.approxSize()
+		evicted = append(evicted, model.gen)
+		mc.lru.Remove(model.used)
+		delete(mc.models, model.key)
+		delete(mc.byGen, model.gen)
+	}
+	mc.lock.Unlock()
+
+	// The refresher may be busy fetching; no need to hold up the cache.
+	for _, gen := range evicted {
+		mc.refresher.unsubscribe(gen)
+	}
+}
+
+// How many models we have, and how many of them are in use.
+func (mc *modelCache) size() (int, int) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	inUse := 0
+	for _, model := range mc.models {
+		if model.refs > 0 {
+			inUse++
+		}
+	}
+	return len(mc.models), inUse
+}
+
+// How big each model we have is, in order of their keys.
+func (mc *modelCache) sizes() []modelSize {
+	mc.lock.Lock()
+	var models []*cachedModel
+	for _, model := range mc.models {
+		if model.gen != nil {
+			models = append(models, model)
+		}
+	}
+	mc.lock.Unlock()
+	sort.Slice(models, func(i, j int) bool { return models[i].key < models[j].key })
+
+	// Generators lock themselves; no need to hold up the cache counting.
+	sizes := make([]modelSize, len(models))
+	for i, model := range models {
+		prefixes, tokens := model.gen.counts()
+		sizes[i] = modelSize{model.sources, model.gen.PrefixLen, model.gen.canon, prefixes, tokens}
+	}
+	return sizes
+}
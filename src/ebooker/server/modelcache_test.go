@@ -0,0 +1,176 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/oauth1"
+
+	"fmt"
+	"launchpad.net/gocheck"
+	"sync"
+)
+
+// hook up gocheck into the gotest runner.
+type ModelCacheSuite struct{}
+
+var _ = gocheck.Suite(&ModelCacheSuite{})
+
+func (s ModelCacheSuite) TestModelKey(c *gocheck.C) {
+	c.Assert(modelKey([]string{"b", "a", "b"}, 1, false), gocheck.Equals, modelKey([]string{"a", "b"}, 1, false))
+	c.Assert(modelKey([]string{"a"}, 1, false), gocheck.Not(gocheck.Equals), modelKey([]string{"a"}, 2, false))
+	c.Assert(modelKey([]string{"a"}, 1, false), gocheck.Not(gocheck.Equals), modelKey([]string{"a"}, 1, true))
+	c.Assert(modelKey([]string{"a,b"}, 1, false), gocheck.Not(gocheck.Equals), modelKey([]string{"a", "b"}, 1, false))
+}
+
+// A source named twice is still learned from once, and letting go of the
+// model stops it being fed.
+func (s ModelCacheSuite) TestRepeatedSources(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	gen, err := eb.models.acquire([]string{"SrPablo", "SrPablo"}, 1, false, &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 2)
+	again, err := eb.models.acquire([]string{"SrPablo"}, 1, false, &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(again, gocheck.Equals, gen)
+	c.Assert(eb.refresher.status()[0].Models, gocheck.Equals, 1)
+
+	eb.models.release(gen)
+	eb.models.release(again)
+	eb.models.budget = 0
+	eb.models.evict()
+	c.Assert(eb.refresher.status()[0].Models, gocheck.Equals, 0)
+	ft.tweet("SrPablo", TweetData{4, "today is a strange day"})
+	eb.refresher.refreshAll()
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 2)
+}
+
+// Bots wanting the same model share one, fed once by the refresher.
+func (s ModelCacheSuite) TestSharing(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	var msg string
+	for i := 0; i < 10; i++ {
+		args := defs.NewBotParams{fmt.Sprintf("bot%d", i), makeTestGenParams("SrPablo", "laurelita"),
+			defs.AuthParams{"SrPablo_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+		c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	}
+	args := defs.NewBotParams{"different", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"SrPablo_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+
+	first, _ := eb.bots.get("bot0")
+	last, _ := eb.bots.get("bot9")
+	different, _ := eb.bots.get("different")
+	c.Assert(first.gen, gocheck.Equals, last.gen)
+	c.Assert(first.gen, gocheck.Not(gocheck.Equals), different.gen)
+	c.Assert(totalCount(first.gen.suffixCounts("today")), gocheck.Equals, 2)
+
+	models, inUse := eb.models.size()
+	c.Assert(models, gocheck.Equals, 2)
+	c.Assert(inUse, gocheck.Equals, 2)
+
+	// GenerateTweets borrows the same model, and gives it back.
+	genArgs := makeTestGenParams("laurelita", "SrPablo")
+	var tweets defs.Tweets
+	c.Assert(eb.GenerateTweets(&genArgs, &tweets), gocheck.IsNil)
+	models, _ = eb.models.size()
+	c.Assert(models, gocheck.Equals, 2)
+
+	// New tweets reach every bot through the one model, once.
+	ft.tweet("SrPablo", TweetData{4, "today is a strange day"})
+	eb.refresher.refreshAll()
+	c.Assert(totalCount(first.gen.suffixCounts("today")), gocheck.Equals, 3)
+	c.Assert(totalCount(different.gen.suffixCounts("today")), gocheck.Equals, 3)
+
+	for i := 0; i < 10; i++ {
+		eb.DeleteBot(fmt.Sprintf("bot%d", i), &msg)
+	}
+	models, inUse = eb.models.size()
+	c.Assert(models, gocheck.Equals, 2)
+	c.Assert(inUse, gocheck.Equals, 1)
+	eb.DeleteBot("different", &msg)
+}
+
+// Unused models go, least recently used first, once they're over budget.
+// Models in use stay whatever the budget, and don't count against it.
+func (s ModelCacheSuite) TestEviction(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	ft.tweet("someone", TweetData{5, "yesterday was a long day"})
+	eb := makeTestEbooker(ft)
+	mc := newModelCache(0, eb.refresher, eb.logger)
+	token := &oauth1.Token{}
+
+	_, err := mc.acquire([]string{"SrPablo"}, 1, false, token)
+	c.Assert(err, gocheck.IsNil)
+	older, _ := mc.acquire([]string{"laurelita"}, 1, false, token)
+	newer, _ := mc.acquire([]string{"someone"}, 1, false, token)
+	mc.budget = newer.approxSize()
+
+	mc.release(older)
+	mc.release(newer)
+	models, _ := mc.size()
+	c.Assert(models, gocheck.Equals, 2)
+	again, _ := mc.acquire([]string{"someone"}, 1, false, token)
+	c.Assert(again, gocheck.Equals, newer)
+	evicted, _ := mc.acquire([]string{"laurelita"}, 1, false, token)
+	c.Assert(evicted, gocheck.Not(gocheck.Equals), older)
+
+	mc.budget = 0
+	mc.release(again)
+	mc.release(evicted)
+	models, _ = mc.size()
+	c.Assert(models, gocheck.Equals, 1)
+
+	// Evicted models aren't refreshed any more.
+	var sources []defs.SourceStatus
+	eb.RefreshStatus("", &sources)
+	for _, source := range sources {
+		if source.User == "SrPablo" {
+			c.Assert(source.Models, gocheck.Equals, 1)
+		} else {
+			c.Assert(source.Models, gocheck.Equals, 0)
+		}
+	}
+}
+
+// A model nobody has a corpus for is an error, and isn't cached.
+func (s ModelCacheSuite) TestNoCorpus(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	_, err := eb.models.acquire([]string{"nobody"}, 1, false, &oauth1.Token{})
+	c.Assert(err, gocheck.NotNil)
+	models, _ := eb.models.size()
+	c.Assert(models, gocheck.Equals, 0)
+}
+
+// Many asking for the same model at once get the same one. Meant for running
+// under -race.
+func (s ModelCacheSuite) TestConcurrentAcquire(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	gens := make(chan *Generator, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gen, _ := eb.models.acquire([]string{"SrPablo", "laurelita"}, 1, false, &oauth1.Token{})
+			gen.GenerateText()
+			gens <- gen
+		}()
+	}
+	wg.Wait()
+	close(gens)
+
+	first := <-gens
+	for gen := range gens {
+		c.Assert(gen, gocheck.Equals, first)
+	}
+	c.Assert(totalCount(first.suffixCounts("today")), gocheck.Equals, 2)
+}
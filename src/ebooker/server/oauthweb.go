@@ -0,0 +1,178 @@
+package main
+
+/*
+The browser-based way of giving the server access to an account. The server
+has no terminal to read a PIN from, so instead we hand the user off to Twitter
+with a callback pointing back at us:
+
+    GET /oauth/start     -> redirect to Twitter's sign-in page
+    GET /oauth/callback  <- Twitter sends the user back here with a verifier
+
+Request tokens we've handed out are remembered until they're used or expire.
+Anyone can start signing in, so we only let so many start each minute; each
+costs a request to Twitter and a pending token.
+Once the verifier is exchanged, the access token goes straight into the
+Datastore under the screen name Twitter tells us it belongs to, and any bot for
+that account can start tweeting.
+
+The PIN flow is still around for the command-line client; see
+OAuth1.ObtainAccessToken.
+*/
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"fmt"
+	"html"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	OAUTH_START_PATH    = "/oauth/start"
+	OAUTH_CALLBACK_PATH = "/oauth/callback"
+
+	// How long a user has to finish signing in to Twitter.
+	PENDING_TOKEN_TTL = 15 * time.Minute
+
+	// How many sign-ins may start in a minute, whoever starts them.
+	MAX_SIGNINS_PER_MINUTE = 10
+)
+
+// The parts of OAuth1 the web flow needs; tests substitute a fake.
+type tokenExchanger interface {
+	ObtainRequestTokenWithCallback(callback string) *oauth1.Token
+	AuthenticationURL(requestToken *oauth1.Token) string
+	ExchangeVerifier(requestToken *oauth1.Token, verifier string) (*oauth1.Token, string)
+}
+
+type pendingToken struct {
+	token   *oauth1.Token
+	expires time.Time
+}
+
+type oauthFlow struct {
+	lock    sync.Mutex
+	pending map[string]pendingToken // keyed on the request token's public half
+	started []time.Time             // when the sign-ins of the last minute started
+
+	callbackURL string
+	oauth       tokenExchanger
+	data        Datastore
+	logger      *logging.LogMaster
+	now         func() time.Time
+}
+
+// callbackURL is the address Twitter should send users back to, as they'd
+// reach us from their browser, e.g. "http://ebooker.example.com:8998/oauth/callback".
+func newOAuthFlow(callbackURL string, oauth tokenExchanger, data Datastore, logger *logging.LogMaster) *oauthFlow {
+	return &oauthFlow{pending: make(map[string]pendingToken), callbackURL: callbackURL,
+		oauth: oauth, data: data, logger: logger, now: time.Now}
+}
+
+// Hooks the flow's handlers up to the mux.
+func (f *oauthFlow) register(mux *http.ServeMux) {
+	mux.HandleFunc(OAUTH_START_PATH, f.handleStart)
+	mux.HandleFunc(OAUTH_CALLBACK_PATH, f.handleCallback)
+}
+
+// Gets a request token from Twitter and sends the user off to sign in.
+func (f *oauthFlow) handleStart(w http.ResponseWriter, r *http.Request) {
+	if !f.allowStart() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Too many people are signing in right now, please try again in a minute.", http.StatusTooManyRequests)
+		return
+	}
+	requestToken := f.oauth.ObtainRequestTokenWithCallback(f.callbackURL)
+	if requestToken == nil || requestToken.OAuthToken == "" {
+		f.logger.Error("Twitter didn't give us a request token.")
+		http.Error(w, "Couldn't start signing in with Twitter, please try again later.", http.StatusBadGateway)
+		return
+	}
+
+	f.addPending(requestToken)
+	http.Redirect(w, r, f.oauth.AuthenticationURL(requestToken), http.StatusFound)
+}
+
+// Where Twitter sends the user back to. We trade the verifier for an access
+// token and keep it.
+func (f *oauthFlow) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("denied") != "" {
+		f.takePending(query.Get("denied"))
+		fmt.Fprintln(w, "No worries, we won't tweet for you.")
+		return
+	}
+
+	requestToken, ok := f.takePending(query.Get("oauth_token"))
+	verifier := query.Get("oauth_verifier")
+	if !ok || verifier == "" {
+		http.Error(w, "This sign-in link has expired or was already used. Please start again at "+OAUTH_START_PATH+".", http.StatusBadRequest)
+		return
+	}
+
+	accessToken, screenName := f.oauth.ExchangeVerifier(requestToken, verifier)
+	if accessToken == nil || accessToken.OAuthToken == "" || screenName == "" {
+		f.logger.Error("Twitter wouldn't exchange a verifier for an access token.")
+		http.Error(w, "Twitter didn't accept the sign-in, please try again.", http.StatusBadGateway)
+		return
+	}
+
+	f.logger.StatusWrite("Received an access token for %s via the web.\n", screenName)
+	f.data.insertUserAccessToken(screenName, accessToken)
+	fmt.Fprintf(w, "Thanks, @%s! Your bots can tweet now.\n", html.EscapeString(screenName))
+}
+
+// Counts a sign-in starting, unless too many have in the last minute.
+func (f *oauthFlow) allowStart() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.now()
+	recent := f.started[:0]
+	for _, started := range f.started {
+		if now.Sub(started) < time.Minute {
+			recent = append(recent, started)
+		}
+	}
+	f.started = recent
+	if len(f.started) >= MAX_SIGNINS_PER_MINUTE {
+		return false
+	}
+	f.started = append(f.started, now)
+	return true
+}
+
+// Remembers a request token until it's used or expires. Expired tokens are
+// cleared out here, so the map doesn't grow with abandoned sign-ins.
+func (f *oauthFlow) addPending(requestToken *oauth1.Token) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	now := f.now()
+	for key, pending := range f.pending {
+		if now.After(pending.expires) {
+			delete(f.pending, key)
+		}
+	}
+	f.pending[requestToken.OAuthToken] = pendingToken{requestToken, now.Add(PENDING_TOKEN_TTL)}
+}
+
+// Retrieves and forgets a pending request token, so each can be used once.
+func (f *oauthFlow) takePending(publicToken string) (*oauth1.Token, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	pending, exists := f.pending[publicToken]
+	if !exists {
+		return nil, false
+	}
+	delete(f.pending, publicToken)
+
+	if f.now().After(pending.expires) {
+		return nil, false
+	}
+	return pending.token, true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type OAuthWebSuite struct{}
+
+var _ = gocheck.Suite(&OAuthWebSuite{})
+
+// fakeExchanger plays Twitter's part of the three-legged dance.
+type fakeExchanger struct {
+	callback  string
+	exchanged int
+}
+
+func (fe *fakeExchanger) ObtainRequestTokenWithCallback(callback string) *oauth1.Token {
+	fe.callback = callback
+	return &oauth1.Token{"requesttoken", "requestsecret"}
+}
+
+func (fe *fakeExchanger) AuthenticationURL(requestToken *oauth1.Token) string {
+	return "https://twitter.example/authenticate?oauth_token=" + requestToken.OAuthToken
+}
+
+func (fe *fakeExchanger) ExchangeVerifier(requestToken *oauth1.Token, verifier string) (*oauth1.Token, string) {
+	if *requestToken != (oauth1.Token{"requesttoken", "requestsecret"}) || verifier != "verifier" {
+		return &oauth1.Token{}, ""
+	}
+	fe.exchanged++
+	return &oauth1.Token{"accesstoken", "accesssecret"}, "SrPablo_ebooks"
+}
+
+func makeTestOAuthFlow() (*oauthFlow, *fakeExchanger, *http.ServeMux) {
+	logger := logging.GetLogMaster(true, false, false)
+	fe := &fakeExchanger{}
+	flow := newOAuthFlow("http://ebooker.example/oauth/callback", fe, getMemoryDataHandle(), &logger)
+	mux := http.NewServeMux()
+	flow.register(mux)
+	return flow, fe, mux
+}
+
+func get(mux *http.ServeMux, url string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func (s OAuthWebSuite) TestSignIn(c *gocheck.C) {
+	flow, fe, mux := makeTestOAuthFlow()
+
+	resp := get(mux, "/oauth/start")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusFound)
+	c.Assert(resp.Header().Get("Location"), gocheck.Equals, "https://twitter.example/authenticate?oauth_token=requesttoken")
+	c.Assert(fe.callback, gocheck.Equals, "http://ebooker.example/oauth/callback")
+
+	resp = get(mux, "/oauth/callback?oauth_token=requesttoken&oauth_verifier=verifier")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusOK)
+	token, exists := flow.data.getUserAccessToken("SrPablo_ebooks")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"accesstoken", "accesssecret"})
+
+	// Request tokens are good for one use only.
+	resp = get(mux, "/oauth/callback?oauth_token=requesttoken&oauth_verifier=verifier")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusBadRequest)
+	c.Assert(fe.exchanged, gocheck.Equals, 1)
+}
+
+func (s OAuthWebSuite) TestExpiredRequestToken(c *gocheck.C) {
+	flow, fe, mux := makeTestOAuthFlow()
+	start := time.Now()
+	flow.now = func() time.Time { return start }
+
+	get(mux, "/oauth/start")
+	flow.now = func() time.Time { return start.Add(PENDING_TOKEN_TTL + time.Second) }
+
+	resp := get(mux, "/oauth/callback?oauth_token=requesttoken&oauth_verifier=verifier")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusBadRequest)
+	c.Assert(fe.exchanged, gocheck.Equals, 0)
+	_, exists := flow.data.getUserAccessToken("SrPablo_ebooks")
+	c.Assert(exists, gocheck.Equals, false)
+}
+
+// Each sign-in costs a request to Twitter, so only so many start a minute.
+func (s OAuthWebSuite) TestStartsLimited(c *gocheck.C) {
+	flow, _, mux := makeTestOAuthFlow()
+	start := time.Now()
+	flow.now = func() time.Time { return start }
+
+	for i := 0; i < MAX_SIGNINS_PER_MINUTE; i++ {
+		c.Assert(get(mux, "/oauth/start").Code, gocheck.Equals, http.StatusFound)
+	}
+	resp := get(mux, "/oauth/start")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Header().Get("Retry-After"), gocheck.Equals, "60")
+
+	flow.now = func() time.Time { return start.Add(time.Minute) }
+	c.Assert(get(mux, "/oauth/start").Code, gocheck.Equals, http.StatusFound)
+}
+
+func (s OAuthWebSuite) TestUnknownAndDenied(c *gocheck.C) {
+	flow, fe, mux := makeTestOAuthFlow()
+
+	resp := get(mux, "/oauth/callback?oauth_token=madeup&oauth_verifier=verifier")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusBadRequest)
+
+	get(mux, "/oauth/start")
+	resp = get(mux, "/oauth/callback?denied=requesttoken")
+	c.Assert(resp.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(len(flow.pending), gocheck.Equals, 0)
+	c.Assert(fe.exchanged, gocheck.Equals, 0)
+}
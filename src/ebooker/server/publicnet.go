@@ -0,0 +1,58 @@
+package main
+
+/*
+Keeping the server to the public internet. Whoever holds an API key can name
+URLs for us to fetch (feed and Mastodon sources) or post to (webhooks and
+Mastodon instances), and without a check they could point us at the machine
+we run on, or the network behind it, and read or poke at what's there.
+
+So everything but Twitter goes through a client whose dialer refuses
+loopback, private, link-local and other addresses that aren't out on the
+internet. It checks the address we're actually connecting to, after DNS and
+after any redirect, so a public name that resolves to 127.0.0.1 is refused as
+surely as 127.0.0.1 itself. The client doesn't use a proxy: we'd only be
+checking the proxy's address.
+*/
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Shared address space (RFC 6598), which net.IP doesn't count as private.
+var CARRIER_NAT = net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// Makes the client for everything that isn't Twitter: only public addresses,
+// giving up after timeout.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: refusePrivate}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+// A net.Dialer's Control, refusing to connect to addresses that aren't public.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublic(ip) {
+		return errors.New("Refusing to connect to " + host + ": it isn't a public address.")
+	}
+	return nil
+}
+
+func isPublic(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || CARRIER_NAT.Contains(ip))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/http/httptest"
+)
+
+// hook up gocheck into the gotest runner.
+type PublicNetSuite struct{}
+
+var _ = gocheck.Suite(&PublicNetSuite{})
+
+func (s PublicNetSuite) TestIsPublic(c *gocheck.C) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false}, // where clouds keep their metadata
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, test := range tests {
+		c.Assert(isPublic(net.ParseIP(test.ip)), gocheck.Equals, test.public, gocheck.Commentf(test.ip))
+	}
+}
+
+// The client won't reach anything on our own machine, by address or by name,
+// so a key can't have us fetch from it.
+func (s PublicNetSuite) TestPublicClient(c *gocheck.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secrets"))
+	}))
+	defer server.Close()
+
+	client := newPublicClient(0)
+	_, err := client.Get(server.URL)
+	c.Assert(err, gocheck.ErrorMatches, ".*127.0.0.1: it isn't a public address.*")
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	_, err = client.Get("http://localhost:" + port)
+	c.Assert(err, gocheck.ErrorMatches, ".*isn't a public address.*")
+
+	// Nor will an Ebooker's, when a feed points at it.
+	eb := makeTestEbooker(newFakeTwitter())
+	eb.httpClient.Transport = client.Transport
+	_, err = eb.refresher.fetcher.DeepDive(FEED_SOURCE_PREFIX+server.URL, nil)
+	c.Assert(err, gocheck.ErrorMatches, ".*isn't a public address.*")
+}
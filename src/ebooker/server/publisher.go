@@ -0,0 +1,207 @@
+package main
+
+/*
+Where bots post. A bot generates its text and hands it to its Publisher, which
+knows how long a post may be and how to get it out there: to Twitter through
+the TwitterAPI, to a Mastodon instance's REST API, or to a webhook (see
+webhook.go).
+
+Mastodon bots authenticate with an access token from the instance (Preferences
+> Development > New application, with the write:statuses scope), sent as a
+bearer token. Like Twitter tokens, it's stored, encrypted, so the bot can be
+restored after a restart, but apart from them: under "mastodon:" and the
+account name (webhooks' secrets under "webhook:"), so it's never taken for a
+Twitter account's. Only Twitter tokens are used to fetch sources.
+*/
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Publisher is somewhere a bot can post.
+type Publisher interface {
+	publish(status string) error
+	charLimit() int
+	params() defs.PublisherParams // what it takes to make this Publisher again
+}
+
+// Kinds of Publisher.
+const (
+	PUBLISH_TWITTER  = "twitter"
+	PUBLISH_MASTODON = "mastodon"
+	PUBLISH_WEBHOOK  = "webhook"
+)
+
+const (
+	TWITTER_CHAR_LIMIT  = 140
+	MASTODON_CHAR_LIMIT = 500
+)
+
+// How many times we try a status, waiting MASTODON_BACKOFF after the first
+// failure and twice as long after each one after.
+const (
+	MASTODON_ATTEMPTS = 3
+	MASTODON_BACKOFF  = time.Second
+)
+
+// Relative to the Mastodon instance's URL.
+const MASTODON_STATUSES_PATH = "/api/v1/statuses"
+
+var MASTODON_VISIBILITIES = []string{"public", "unlisted", "private", "direct"}
+
+// Where the credentials a bot posts with are stored: under the account for
+// Twitter, and under kind:account for anything else. Twitter names can't have
+// colons, so the two never meet.
+func credentialKey(kind, account string) string {
+	if kind == "" || kind == PUBLISH_TWITTER {
+		return account
+	}
+	return kind + ":" + account
+}
+
+// Makes the Publisher params ask for, posting with token.
+func (eb *Ebooker) newPublisher(params *defs.PublisherParams, token *oauth1.Token) (Publisher, error) {
+	switch params.Kind {
+	case "", PUBLISH_TWITTER:
+		return &twitterPublisher{eb.tf, token}, nil
+	case PUBLISH_MASTODON:
+		return newMastodonPublisher(params, token.OAuthToken, eb.httpClient, eb.logger)
+	case PUBLISH_WEBHOOK:
+		return newWebhookPublisher(params, token.OAuthToken, eb.httpClient, eb.logger)
+	}
+	return nil, errors.New("Can't publish to \"" + params.Kind + "\". Try twitter, mastodon or webhook.")
+}
+
+type twitterPublisher struct {
+	tf    TwitterAPI
+	token *oauth1.Token
+}
+
+func (t *twitterPublisher) publish(status string) error {
+	return t.tf.sendTweet(status, t.token)
+}
+
+func (t *twitterPublisher) charLimit() int {
+	return TWITTER_CHAR_LIMIT
+}
+
+// Twitter is the default, so its params are the zero value.
+func (t *twitterPublisher) params() defs.PublisherParams {
+	return defs.PublisherParams{}
+}
+
+type mastodonPublisher struct {
+	instance       string
+	token          string
+	visibility     string
+	contentWarning string
+
+	client  *http.Client
+	logger  *logging.LogMaster
+	backoff time.Duration
+}
+
+func newMastodonPublisher(params *defs.PublisherParams, token string, client *http.Client, logger *logging.LogMaster) (*mastodonPublisher, error) {
+	instance, err := url.Parse(params.Instance)
+	if err != nil || (instance.Scheme != "http" && instance.Scheme != "https") || instance.Host == "" {
+		return nil, errors.New("Mastodon bots need the instance's URL, like https://mastodon.social.")
+	}
+	if token == "" {
+		return nil, errors.New("Mastodon bots need an access token.")
+	}
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = MASTODON_VISIBILITIES[0]
+	}
+	known := false
+	for _, name := range MASTODON_VISIBILITIES {
+		known = known || name == visibility
+	}
+	if !known {
+		return nil, errors.New("No such visibility \"" + visibility + "\". Try " + strings.Join(MASTODON_VISIBILITIES, ", ") + ".")
+	}
+	return &mastodonPublisher{strings.TrimRight(params.Instance, "/"), token, visibility, params.ContentWarning,
+		client, logger, MASTODON_BACKOFF}, nil
+}
+
+// Posts the status, trying again (after a backoff, as webhooks do) if it fails
+// in a way that might pass. Every try sends the same Idempotency-Key, so if
+// one got through but we never heard back, Mastodon doesn't post it twice.
+func (m *mastodonPublisher) publish(status string) error {
+	form := url.Values{"status": {status}, "visibility": {m.visibility}}
+	if m.contentWarning != "" {
+		form.Set("spoiler_text", m.contentWarning)
+	}
+	key := idempotencyKey()
+
+	wait := m.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := m.send(form, key)
+		if err == nil || !retry || attempt == MASTODON_ATTEMPTS {
+			return err
+		}
+		m.logger.Warn("Posting to Mastodon failed; trying again.", logging.Field{"error", err}, logging.Field{"wait", wait})
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// POSTs the status once. Returns whether it's worth trying again if it failed.
+func (m *mastodonPublisher) send(form url.Values, key string) (bool, error) {
+	req, err := http.NewRequest("POST", m.instance+MASTODON_STATUSES_PATH, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Idempotency-Key", key)
+
+	m.logger.DebugWrite("Sending status POST request to %s!\n", m.instance)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	countRateLimit("mastodon", resp)
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+
+	// Mastodon explains itself in an "error" field.
+	body, _ := ioutil.ReadAll(resp.Body)
+	var explanation struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &explanation) == nil && explanation.Error != "" {
+		return retry, fmt.Errorf("Mastodon said %s: %s", resp.Status, explanation.Error)
+	}
+	return retry, fmt.Errorf("Mastodon said %s", resp.Status)
+}
+
+func (m *mastodonPublisher) charLimit() int {
+	return MASTODON_CHAR_LIMIT
+}
+
+func (m *mastodonPublisher) params() defs.PublisherParams {
+	return defs.PublisherParams{PUBLISH_MASTODON, m.instance, m.visibility, m.contentWarning, defs.WebhookParams{}}
+}
+
+func idempotencyKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
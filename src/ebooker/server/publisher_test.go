@@ -0,0 +1,271 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"context"
+	"encoding/json"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type PublisherSuite struct{}
+
+var _ = gocheck.Suite(&PublisherSuite{})
+
+// A Mastodon instance that takes statuses from one token, and hands them to
+// the test, after answering the first unavailable of them with a 503. It
+// remembers the Idempotency-Key of each status POSTed. It serves its accounts' statuses too, newest first, honoring
+// limit, max_id and since_id; it leaves the boosts in, whatever we ask.
+type fakeMastodon struct {
+	server *httptest.Server
+	token  string
+	posted chan url.Values
+
+	lock        sync.Mutex
+	accounts    map[string][]mastodonStatus
+	unavailable int
+	keys        []string
+}
+
+func newFakeMastodon(token string) *fakeMastodon {
+	fm := &fakeMastodon{token: token, posted: make(chan url.Values, 10), accounts: make(map[string][]mastodonStatus)}
+	fm.server = httptest.NewServer(http.HandlerFunc(fm.serve))
+	return fm
+}
+
+// Adds statuses to a user's account, as if they'd just posted them.
+func (fm *fakeMastodon) toot(user string, statuses ...mastodonStatus) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	fm.accounts[user] = append(fm.accounts[user], statuses...)
+}
+
+// The Idempotency-Keys of the statuses POSTed so far.
+func (fm *fakeMastodon) sentKeys() []string {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	return append([]string{}, fm.keys...)
+}
+
+// The source name for a user on this instance.
+func (fm *fakeMastodon) source(user string) string {
+	return MASTODON_SOURCE_PREFIX + "@" + user + "@" + strings.TrimPrefix(fm.server.URL, "http://")
+}
+
+func (fm *fakeMastodon) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "GET" {
+		fm.serveAccounts(w, r)
+		return
+	}
+	if r.Method != "POST" || r.URL.Path != MASTODON_STATUSES_PATH {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Record not found"}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fm.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"The access token is invalid"}`))
+		return
+	}
+	r.ParseForm()
+	if len([]rune(r.PostForm.Get("status"))) > MASTODON_CHAR_LIMIT || r.Header.Get("Idempotency-Key") == "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"error":"Validation failed"}`))
+		return
+	}
+	fm.lock.Lock()
+	fm.keys = append(fm.keys, r.Header.Get("Idempotency-Key"))
+	unavailable := fm.unavailable > 0
+	fm.unavailable--
+	fm.lock.Unlock()
+	if unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	fm.posted <- r.PostForm
+	w.Write([]byte(`{"id":"103704874086360371"}`))
+}
+
+func (fm *fakeMastodon) serveAccounts(w http.ResponseWriter, r *http.Request) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+
+	query := r.URL.Query()
+	if r.URL.Path == MASTODON_LOOKUP_PATH {
+		if _, exists := fm.accounts[query.Get("acct")]; exists {
+			json.NewEncoder(w).Encode(map[string]string{"id": query.Get("acct")})
+			return
+		}
+	} else if user := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, MASTODON_ACCOUNTS_PATH), "/statuses"); fm.accounts[user] != nil {
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		maxId, _ := strconv.ParseUint(query.Get("max_id"), 10, 64)
+		sinceId, _ := strconv.ParseUint(query.Get("since_id"), 10, 64)
+		page := []mastodonStatus{}
+		statuses := fm.accounts[user]
+		for i := len(statuses) - 1; i >= 0 && len(page) < limit; i-- {
+			id, _ := strconv.ParseUint(statuses[i].Id, 10, 64)
+			if id > sinceId && (maxId == 0 || id < maxId) {
+				page = append(page, statuses[i])
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"error":"Record not found"}`))
+}
+
+func makeTestMastodonParams(fm *fakeMastodon) defs.PublisherParams {
+	return defs.PublisherParams{PUBLISH_MASTODON, fm.server.URL + "/", "unlisted", "markov nonsense", defs.WebhookParams{}}
+}
+
+func (s PublisherSuite) TestMastodonPublish(c *gocheck.C) {
+	fm := newFakeMastodon("mastotoken")
+	defer fm.server.Close()
+	logger := logging.GetLogMaster(true, false, false)
+	params := makeTestMastodonParams(fm)
+
+	publisher, err := newMastodonPublisher(&params, "mastotoken", fm.server.Client(), &logger)
+	c.Assert(err, gocheck.IsNil)
+	publisher.backoff = time.Millisecond
+	c.Assert(publisher.charLimit(), gocheck.Equals, 500)
+	c.Assert(publisher.params(), gocheck.DeepEquals, defs.PublisherParams{PUBLISH_MASTODON, fm.server.URL, "unlisted", "markov nonsense", defs.WebhookParams{}})
+
+	c.Assert(publisher.publish("today is a great day"), gocheck.IsNil)
+	posted := <-fm.posted
+	c.Assert(posted.Get("status"), gocheck.Equals, "today is a great day")
+	c.Assert(posted.Get("visibility"), gocheck.Equals, "unlisted")
+	c.Assert(posted.Get("spoiler_text"), gocheck.Equals, "markov nonsense")
+
+	// A status that doesn't get through at first is tried again, as the same
+	// status, so Mastodon can tell if it already has it.
+	fm.lock.Lock()
+	fm.unavailable, fm.keys = 1, nil
+	fm.lock.Unlock()
+	c.Assert(publisher.publish("today is a good day"), gocheck.IsNil)
+	c.Assert((<-fm.posted).Get("status"), gocheck.Equals, "today is a good day")
+	keys := fm.sentKeys()
+	c.Assert(len(keys), gocheck.Equals, 2)
+	c.Assert(keys[1], gocheck.Equals, keys[0])
+	c.Assert(publisher.publish("today is a good day"), gocheck.IsNil)
+	<-fm.posted
+	c.Assert(fm.sentKeys()[2], gocheck.Not(gocheck.Equals), keys[0])
+
+	// Unless it never will.
+	fm.lock.Lock()
+	fm.unavailable, fm.keys = MASTODON_ATTEMPTS, nil
+	fm.lock.Unlock()
+	c.Assert(publisher.publish("today is a good day"), gocheck.ErrorMatches, "Mastodon said 503.*")
+	c.Assert(len(fm.sentKeys()), gocheck.Equals, MASTODON_ATTEMPTS)
+
+	// Mastodon's complaints make it back to us.
+	publisher.token = "wrong"
+	c.Assert(publisher.publish("today is a fine day"), gocheck.ErrorMatches, "Mastodon said 401.*: The access token is invalid")
+	fm.server.Close()
+	c.Assert(publisher.publish("today is a fine day"), gocheck.NotNil)
+}
+
+func (s PublisherSuite) TestNewPublisher(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	token := &oauth1.Token{"token", "secret"}
+
+	publisher, err := eb.newPublisher(&defs.PublisherParams{}, token)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(publisher.charLimit(), gocheck.Equals, 140)
+	c.Assert(publisher.params(), gocheck.DeepEquals, defs.PublisherParams{})
+
+	publisher, err = eb.newPublisher(&defs.PublisherParams{PUBLISH_MASTODON, "https://mastodon.social", "", "", defs.WebhookParams{}}, token)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(publisher.params().Visibility, gocheck.Equals, "public")
+
+	bad := []defs.PublisherParams{{"myspace", "", "", "", defs.WebhookParams{}},
+		{PUBLISH_MASTODON, "", "", "", defs.WebhookParams{}},
+		{PUBLISH_MASTODON, "mastodon.social", "", "", defs.WebhookParams{}},
+		{PUBLISH_MASTODON, "https://mastodon.social", "everyone", "", defs.WebhookParams{}}}
+	for _, params := range bad {
+		_, err = eb.newPublisher(&params, token)
+		c.Assert(err, gocheck.NotNil)
+	}
+	_, err = eb.newPublisher(&defs.PublisherParams{PUBLISH_MASTODON, "https://mastodon.social", "", "", defs.WebhookParams{}}, &oauth1.Token{})
+	c.Assert(err, gocheck.NotNil)
+}
+
+// A Mastodon bot posts there, up to Mastodon's limit, and comes back posting
+// there after a restart.
+func (s PublisherSuite) TestMastodonBot(c *gocheck.C) {
+	fm := newFakeMastodon("mastotoken")
+	defer fm.server.Close()
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	args := defs.NewBotParams{"mastodon_ebooks", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"@ebooks@localhost", "mastotoken", ""}, defs.Schedule{""}, makeTestMastodonParams(fm)}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	bot, _ := eb.bots.get("mastodon_ebooks")
+	c.Assert(bot.publisher.charLimit(), gocheck.Equals, MASTODON_CHAR_LIMIT)
+
+	tickAndWait(bot)
+	posted := <-fm.posted
+	c.Assert(posted.Get("status"), gocheck.Matches, "today is a (great|fine) day")
+	c.Assert(posted.Get("visibility"), gocheck.Equals, "unlisted")
+	c.Assert(eb.shutdown(context.Background()), gocheck.Equals, true)
+	c.Assert(len(eb.data.loadPosts("mastodon_ebooks")), gocheck.Equals, 1)
+
+	restored := newEbooker(eb.logger, eb.data, eb.oauth, ft, DEFAULT_REFRESH_INTERVAL, DEFAULT_MODEL_BUDGET)
+	restored.httpClient.Transport = http.DefaultTransport
+	restored.restoreBots()
+	defer restored.shutdown(context.Background())
+	bot, exists := restored.bots.get("mastodon_ebooks")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(bot.record().Publish, gocheck.DeepEquals, defs.PublisherParams{PUBLISH_MASTODON, fm.server.URL, "unlisted", "markov nonsense", defs.WebhookParams{}})
+
+	tickAndWait(bot)
+	select {
+	case <-fm.posted:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the restored bot didn't post to Mastodon")
+	}
+	c.Assert(len(ft.posted), gocheck.Equals, 0)
+}
+
+// A Mastodon bot's token is kept apart from Twitter's, even when it's named
+// after a Twitter account, and isn't used to fetch tweets.
+func (s PublisherSuite) TestCredentialsApart(c *gocheck.C) {
+	fm := newFakeMastodon("mastotoken")
+	defer fm.server.Close()
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+
+	args := defs.NewBotParams{"", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"SrPablo_ebooks", "twittertoken", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	args = defs.NewBotParams{"mastodon_ebooks", makeTestGenParams("SrPablo", "laurelita"),
+		defs.AuthParams{"SrPablo_ebooks", "mastotoken", ""}, defs.Schedule{""}, makeTestMastodonParams(fm)}
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+
+	token, _ := eb.data.getUserAccessToken("SrPablo_ebooks")
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"twittertoken", "secret"})
+	token, _ = eb.data.getUserAccessToken("mastodon:SrPablo_ebooks")
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"mastotoken", ""})
+	bot, _ := eb.bots.get("mastodon_ebooks")
+	c.Assert(bot.publisher.(*mastodonPublisher).token, gocheck.Equals, "mastotoken")
+
+	c.Assert(eb.refresher.source("SrPablo").tokens(nil), gocheck.DeepEquals, []*oauth1.Token{{"twittertoken", "secret"}})
+	c.Assert(eb.refresher.source("laurelita").tokens(nil), gocheck.DeepEquals, []*oauth1.Token{nil})
+}
@@ -0,0 +1,275 @@
+package main
+
+/*
+Keeps the bots' corpora up to date, separately from their tweeting.
+
+Each source (a Twitter user whose tweets we learn from, or another account;
+see sources.go) is fetched once per
+refresh no matter how many bots use it, and only the tweets we haven't seen
+before are fed to the models (Generators) subscribed to it. Feeding a model
+its whole corpus again would count every word twice, and each refresh would
+drift the weights further towards the oldest tweets.
+
+A model subscribing to a source gets the whole stored corpus once, up front;
+from then on it only ever sees the deltas. Each source has its own lock, held
+while we store and feed, so a subscription can't slip in between storing new
+tweets and handing them out. It isn't held while we fetch, which can take a
+while (a deep dive especially), so the source can be looked at and
+unsubscribed from meanwhile; fetches of a source take turns on a lock of
+their own.
+
+Twitter sources need an access token to fetch with. Each subscription brings
+one, and we keep them all: we fetch with whichever last worked, and only if
+that fails try the others, so one bad token can't stop a source being
+refreshed for everyone.
+*/
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often we look for new tweets, unless told otherwise.
+const DEFAULT_REFRESH_INTERVAL = time.Hour
+
+type corpusRefresher struct {
+	lock    sync.Mutex
+	sources map[string]*sourceState
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	interval time.Duration
+	data     Datastore
+	logger   *logging.LogMaster
+	fetcher  SourceFetcher
+}
+
+type sourceState struct {
+	fetching sync.Mutex // held while fetching, so we fetch one delta at a time
+	lock     sync.Mutex // held while storing and feeding, and for the fields below
+
+	username    string
+	working     *oauth1.Token // the last token we fetched with successfully
+	total       int
+	lastRefresh time.Time
+	lastFetched int
+	subscribers []subscriber
+}
+
+// A model fed from a source, and the token it subscribed with.
+type subscriber struct {
+	model *Generator
+	token *oauth1.Token
+}
+
+// Creates a refresher that looks for new tweets every interval once it's
+// started.
+func newCorpusRefresher(interval time.Duration, data Datastore, logger *logging.LogMaster, fetcher SourceFetcher) *corpusRefresher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &corpusRefresher{sources: make(map[string]*sourceState), ctx: ctx, cancel: cancel,
+		interval: interval, data: data, logger: logger, fetcher: fetcher}
+}
+
+func (r *corpusRefresher) source(username string) *sourceState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	source, exists := r.sources[username]
+	if !exists {
+		source = &sourceState{username: username}
+		r.sources[username] = source
+	}
+	return source
+}
+
+// Feeds the model everything we know of each source, fetching anything new
+// first (with token, if nothing better works), and keeps it up to date from
+// then on. Returns how many tweets the model started out with.
+func (r *corpusRefresher) subscribe(gen *Generator, sources []string, token *oauth1.Token) int {
+	count := 0
+	for _, username := range sources {
+		source := r.source(username)
+		r.refreshLocking(source, token)
+		tweets := r.data.GetTweetsFromStorage(username)
+		for _, tweet := range tweets {
+			gen.AddSeeds(tweet.Text)
+		}
+		count += len(tweets)
+		source.subscribers = append(source.subscribers, subscriber{gen, token})
+		source.lock.Unlock()
+	}
+	return count
+}
+
+// Stops feeding the model, however many times it subscribed to a source.
+// Sources nobody uses any more aren't refreshed.
+func (r *corpusRefresher) unsubscribe(gen *Generator) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, source := range r.sources {
+		source.lock.Lock()
+		kept := source.subscribers[:0]
+		for _, subscription := range source.subscribers {
+			if subscription.model != gen {
+				kept = append(kept, subscription)
+			}
+		}
+		source.subscribers = kept
+		source.lock.Unlock()
+	}
+}
+
+// Fetches new tweets for every source someone's subscribed to.
+func (r *corpusRefresher) refreshAll() {
+	r.lock.Lock()
+	sources := make([]*sourceState, 0, len(r.sources))
+	for _, source := range r.sources {
+		sources = append(sources, source)
+	}
+	r.lock.Unlock()
+
+	for _, source := range sources {
+		source.lock.Lock()
+		subscribed := len(source.subscribers) > 0
+		source.lock.Unlock()
+		if subscribed {
+			r.refreshLocking(source, nil)
+			source.lock.Unlock()
+		}
+	}
+}
+
+// Fetches what's new for the source, stores it, and feeds it to the models.
+// Returns with the source's lock held, so the caller can subscribe before
+// anything else comes in.
+func (r *corpusRefresher) refreshLocking(source *sourceState, token *oauth1.Token) {
+	source.fetching.Lock()
+	defer source.fetching.Unlock()
+
+	source.lock.Lock()
+	tokens := source.tokens(token)
+	source.lock.Unlock()
+
+	logger := r.logger.With(logging.Field{"source", source.username})
+	stored := r.data.GetTweetsFromStorage(source.username)
+	var fresh Tweets
+	var used *oauth1.Token
+	var err error
+	for _, candidate := range tokens {
+		if fresh, err = r.fetchNew(source.username, stored, candidate, logger); err == nil {
+			used = candidate
+			break
+		}
+		logger.Warn("Couldn't fetch new tweets.", logging.Field{"error", err})
+	}
+
+	source.lock.Lock()
+	source.total = len(stored)
+	if err != nil {
+		return
+	}
+	if used != nil {
+		source.working = used
+	}
+	logger.Info("Inserting new tweets into persistent storage.", logging.Field{"count", len(fresh)})
+	r.data.InsertFreshTweets(source.username, fresh)
+	TWEETS_INGESTED.add(float64(len(fresh)), source.username)
+	for _, tweet := range fresh {
+		for _, subscription := range source.subscribers {
+			subscription.model.AddSeeds(tweet.Text)
+		}
+	}
+	source.total += len(fresh)
+	source.lastRefresh = time.Now()
+	source.lastFetched = len(fresh)
+}
+
+// The tokens to fetch the source with, best first: the one that last worked,
+// then token, then the ones it was subscribed with. Other sources than
+// Twitter's don't need one.
+func (source *sourceState) tokens(token *oauth1.Token) []*oauth1.Token {
+	if !isTwitterSource(source.username) {
+		return []*oauth1.Token{nil}
+	}
+	var tokens []*oauth1.Token
+	add := func(candidate *oauth1.Token) {
+		if candidate == nil {
+			return
+		}
+		for _, known := range tokens {
+			if *known == *candidate {
+				return
+			}
+		}
+		tokens = append(tokens, candidate)
+	}
+	add(source.working)
+	add(token)
+	for _, subscription := range source.subscribers {
+		add(subscription.token)
+	}
+	if len(tokens) == 0 {
+		return []*oauth1.Token{nil}
+	}
+	return tokens
+}
+
+// Fetches the source's tweets newer than the stored ones: all of them, with a
+// deep dive, if we have none.
+func (r *corpusRefresher) fetchNew(username string, stored Tweets, token *oauth1.Token, logger *logging.LogMaster) (Tweets, error) {
+	if len(stored) == 0 {
+		logger.Info("Found no tweets, doing a deep dive to retrieve their history.")
+		return r.fetcher.DeepDive(username, token)
+	}
+	logger.Debug("Found stored tweets.", logging.Field{"count", len(stored)})
+	return r.fetcher.GetRecentTimeline(username, &stored[len(stored)-1], token)
+}
+
+// Refreshes every interval until stopped.
+func (r *corpusRefresher) start() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.logger.Info("Refreshing corpora.")
+			r.refreshAll()
+		}
+	}
+}
+
+func (r *corpusRefresher) stop() {
+	r.cancel()
+}
+
+// How each source is doing, sorted by name.
+func (r *corpusRefresher) status() []defs.SourceStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	statuses := make([]defs.SourceStatus, 0, len(r.sources))
+	for _, source := range r.sources {
+		source.lock.Lock()
+		statuses = append(statuses, defs.SourceStatus{source.username, source.lastRefresh,
+			source.lastFetched, source.total, len(source.subscribers)})
+		source.lock.Unlock()
+	}
+	sort.Sort(bySourceName(statuses))
+	return statuses
+}
+
+type bySourceName []defs.SourceStatus
+
+func (s bySourceName) Len() int           { return len(s) }
+func (s bySourceName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySourceName) Less(i, j int) bool { return s[i].User < s[j].User }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/oauth1"
+
+	"launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type RefresherSuite struct{}
+
+var _ = gocheck.Suite(&RefresherSuite{})
+
+// Models start with the whole corpus, and after that only ever get what's new,
+// however many times we refresh.
+func (s RefresherSuite) TestOnlyDeltas(c *gocheck.C) {
+	ft := newFakeTwitter()
+	ft.tweet("SrPablo", TweetData{1, "today is a great day"})
+	eb := makeTestEbooker(ft)
+	r := eb.refresher
+
+	gen := CreateGenerator(1, 140, eb.logger)
+	c.Assert(r.subscribe(gen, []string{"SrPablo"}, &oauth1.Token{}), gocheck.Equals, 1)
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 1)
+
+	r.refreshAll()
+	r.refreshAll()
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 1)
+
+	ft.tweet("SrPablo", TweetData{2, "today is a fine day"})
+	r.refreshAll()
+	r.refreshAll()
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 2)
+	c.Assert(len(eb.data.GetTweetsFromStorage("SrPablo")), gocheck.Equals, 2)
+
+	// A model that comes along later gets everything, once.
+	late := CreateGenerator(1, 140, eb.logger)
+	c.Assert(r.subscribe(late, []string{"SrPablo"}, &oauth1.Token{}), gocheck.Equals, 2)
+	c.Assert(totalCount(late.suffixCounts("today")), gocheck.Equals, 2)
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 2)
+
+	// Once unsubscribed, a model is left alone.
+	r.unsubscribe(gen)
+	ft.tweet("SrPablo", TweetData{3, "today is a strange day"})
+	r.refreshAll()
+	c.Assert(totalCount(gen.suffixCounts("today")), gocheck.Equals, 2)
+	c.Assert(totalCount(late.suffixCounts("today")), gocheck.Equals, 3)
+}
+
+func (s RefresherSuite) TestStatus(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	args := defs.NewBotParams{"", makeTestGenParams("SrPablo", "laurelita"),
+		defs.AuthParams{"SrPablo_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	args.Name, args.Gen = "another", makeTestGenParams("SrPablo")
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+
+	ft.tweet("SrPablo", TweetData{4, "today is a strange day"})
+	eb.refresher.refreshAll()
+
+	var sources []defs.SourceStatus
+	c.Assert(eb.RefreshStatus("", &sources), gocheck.IsNil)
+	c.Assert(len(sources), gocheck.Equals, 2)
+	c.Assert(sources[0].User, gocheck.Equals, "SrPablo")
+	c.Assert(sources[0].Total, gocheck.Equals, 3)
+	c.Assert(sources[0].LastFetched, gocheck.Equals, 1)
+	c.Assert(sources[0].Models, gocheck.Equals, 2)
+	c.Assert(sources[0].LastRefresh.IsZero(), gocheck.Equals, false)
+	c.Assert(sources[1].User, gocheck.Equals, "laurelita")
+	c.Assert(sources[1].Models, gocheck.Equals, 1)
+
+	// The bots tweet from what was refreshed in.
+	bot, _ := eb.bots.get("another")
+	c.Assert(strings.HasPrefix(bot.gen.GenerateText(), "today"), gocheck.Equals, true)
+
+	// Its model stays cached, and subscribed, until it's evicted.
+	c.Assert(eb.DeleteBot("another", &msg), gocheck.IsNil)
+	sources = nil
+	c.Assert(eb.RefreshStatus("", &sources), gocheck.IsNil)
+	c.Assert(sources[0].Models, gocheck.Equals, 2)
+	eb.models.budget = 0
+	eb.models.evict()
+	sources = nil
+	c.Assert(eb.RefreshStatus("", &sources), gocheck.IsNil)
+	c.Assert(sources[0].Models, gocheck.Equals, 1)
+	eb.DeleteBot("SrPablo_ebooks", &msg)
+}
+
+// A bad token, from a GenerateTweets say, doesn't stop the source being
+// refreshed, and when the token that was working stops, another takes over.
+func (s RefresherSuite) TestTokenFallback(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	ft.revoked["bogus"] = true
+	eb := makeTestEbooker(ft)
+	r := eb.refresher
+
+	first := CreateGenerator(1, 140, eb.logger)
+	c.Assert(r.subscribe(first, []string{"SrPablo"}, &oauth1.Token{"first", "secret"}), gocheck.Equals, 2)
+	second := CreateGenerator(2, 140, eb.logger)
+	c.Assert(r.subscribe(second, []string{"SrPablo"}, &oauth1.Token{"bogus", "secret"}), gocheck.Equals, 2)
+	third := CreateGenerator(3, 140, eb.logger)
+	c.Assert(r.subscribe(third, []string{"SrPablo"}, &oauth1.Token{"third", "secret"}), gocheck.Equals, 2)
+
+	ft.tweet("SrPablo", TweetData{4, "today is a strange day"})
+	r.refreshAll()
+	c.Assert(r.status()[0].Total, gocheck.Equals, 3)
+	c.Assert(*r.source("SrPablo").working, gocheck.Equals, oauth1.Token{"first", "secret"})
+
+	// The first is revoked; the bogus one is tried, and doesn't take over.
+	ft.lock.Lock()
+	ft.revoked["first"] = true
+	ft.lock.Unlock()
+	ft.tweet("SrPablo", TweetData{5, "today is a long day"})
+	r.refreshAll()
+	c.Assert(r.status()[0].Total, gocheck.Equals, 4)
+	c.Assert(r.status()[0].LastFetched, gocheck.Equals, 1)
+	c.Assert(*r.source("SrPablo").working, gocheck.Equals, oauth1.Token{"third", "secret"})
+
+	// With no token that works, nothing changes.
+	ft.lock.Lock()
+	ft.revoked["third"] = true
+	ft.lock.Unlock()
+	r.refreshAll()
+	c.Assert(r.status()[0].Total, gocheck.Equals, 4)
+	c.Assert(*r.source("SrPablo").working, gocheck.Equals, oauth1.Token{"third", "secret"})
+}
+
+// A SourceFetcher whose fetches, once it's armed, wait until they're let go.
+type slowFetcher struct {
+	*fakeTwitter
+	armed   bool
+	started chan bool
+	release chan bool
+}
+
+func (f *slowFetcher) GetRecentTimeline(username string, latest *TweetData, accessToken *oauth1.Token) (Tweets, error) {
+	if f.armed {
+		f.started <- true
+		<-f.release
+	}
+	return f.fakeTwitter.GetRecentTimeline(username, latest, accessToken)
+}
+
+// A slow fetch doesn't hold up looking at the source, or unsubscribing from
+// it.
+func (s RefresherSuite) TestSlowFetch(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	slow := &slowFetcher{ft, false, make(chan bool), make(chan bool)}
+	r := newCorpusRefresher(DEFAULT_REFRESH_INTERVAL, eb.data, eb.logger, slow)
+	gen := CreateGenerator(1, 140, eb.logger)
+	c.Assert(r.subscribe(gen, []string{"SrPablo"}, &oauth1.Token{}), gocheck.Equals, 2)
+	other := CreateGenerator(2, 140, eb.logger)
+	c.Assert(r.subscribe(other, []string{"SrPablo"}, &oauth1.Token{}), gocheck.Equals, 2)
+
+	slow.armed = true
+	refreshed := make(chan bool)
+	go func() {
+		r.refreshAll()
+		refreshed <- true
+	}()
+	<-slow.started
+
+	done := make(chan bool)
+	go func() {
+		r.status()
+		r.unsubscribe(other)
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("held up by a fetch")
+	}
+	c.Assert(r.status()[0].Models, gocheck.Equals, 1)
+
+	slow.release <- true
+	<-refreshed
+}
+
+// Stopping the refresher lets it return.
+func (s RefresherSuite) TestStop(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+	eb.startRefresher()
+	eb.refresher.stop()
+	eb.running.Wait()
+}
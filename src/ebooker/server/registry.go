@@ -0,0 +1,70 @@
+package main
+
+/*
+The bots a server is running, kept safe for the concurrent RPC handlers that
+add, list and remove them.
+*/
+
+import (
+	"sort"
+	"sync"
+)
+
+type botRegistry struct {
+	lock sync.RWMutex
+	bots map[string]*Bot
+}
+
+func newBotRegistry() *botRegistry {
+	return &botRegistry{bots: make(map[string]*Bot)}
+}
+
+// Registers a bot under a name, unless there's already one by that name, in
+// which case we return false and leave it be.
+func (r *botRegistry) add(name string, bot *Bot) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exists := r.bots[name]; exists {
+		return false
+	}
+	r.bots[name] = bot
+	return true
+}
+
+func (r *botRegistry) get(name string) (*Bot, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	bot, exists := r.bots[name]
+	return bot, exists
+}
+
+// Unregisters a bot, returning it if it was there.
+func (r *botRegistry) remove(name string) (*Bot, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	bot, exists := r.bots[name]
+	delete(r.bots, name)
+	return bot, exists
+}
+
+// The names of all the bots, sorted.
+func (r *botRegistry) names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.bots))
+	for name := range r.bots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *botRegistry) size() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.bots)
+}
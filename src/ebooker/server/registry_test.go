@@ -0,0 +1,51 @@
+package main
+
+import (
+	"launchpad.net/gocheck"
+	"strconv"
+	"sync"
+)
+
+// hook up gocheck into the gotest runner.
+type RegistrySuite struct{}
+
+var _ = gocheck.Suite(&RegistrySuite{})
+
+func (s RegistrySuite) TestRegistry(c *gocheck.C) {
+	r := newBotRegistry()
+	first, second := &Bot{name: "first"}, &Bot{name: "second"}
+
+	c.Assert(r.add("bot", first), gocheck.Equals, true)
+	c.Assert(r.add("bot", second), gocheck.Equals, false)
+	got, exists := r.get("bot")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(got, gocheck.Equals, first)
+
+	r.add("another", second)
+	c.Assert(r.names(), gocheck.DeepEquals, []string{"another", "bot"})
+
+	removed, exists := r.remove("bot")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(removed, gocheck.Equals, first)
+	_, exists = r.remove("bot")
+	c.Assert(exists, gocheck.Equals, false)
+	c.Assert(r.size(), gocheck.Equals, 1)
+}
+
+// Meant for running under -race.
+func (s RegistrySuite) TestConcurrentAccess(c *gocheck.C) {
+	r := newBotRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := strconv.Itoa(i % 5)
+			r.add(name, &Bot{name: name})
+			r.get(name)
+			r.names()
+			r.remove(name)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,414 @@
+package main
+
+/*
+A JSON-over-HTTP API to the service, for clients that aren't written in Go.
+Each route calls the RPC method that does the same thing:
+
+    POST   /v1/generate              GenerateTweets
+    GET    /v1/bots                  GetBotSchedule, for every bot
+    POST   /v1/bots                  NewBot
+    GET    /v1/bots/{name}           GetBotSchedule
+    DELETE /v1/bots/{name}           DeleteBot
+    POST   /v1/bots/{name}/pause     PauseBot
+    POST   /v1/bots/{name}/resume    ResumeBot
+    POST   /v1/bots/{name}/cancel    CancelBot
+    PUT    /v1/bots/{name}/schedule  SetBotSchedule
+    GET    /v1/sources               RefreshStatus
+    POST   /v1/export                Export
+    GET    /v1/openapi.json          this API, as an OpenAPI document
+
+Every route but the last needs an API key, as "Authorization: Bearer <key>",
+and does only what that key may (see apikeys.go).
+
+Requests and responses are the defs structs, by their JSON names. Errors come
+back as {"error": {"code", "message", "fields"}}, with a status to match: 400
+for requests we won't take (fields says which of their fields are wrong, and
+how), 401 without a key we know, 403 for things the key isn't allowed to do,
+404 for bots (or routes) that don't exist, 405 for routes that don't take the
+method, 409 for bots that are already how you asked, and 503 while we're
+shutting down.
+*/
+
+import (
+	"ebooker/defs"
+
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const REST_PREFIX = "/v1/"
+
+// The one route anyone can use.
+const OPENAPI_PATH = "/v1/openapi.json"
+
+// We don't read more of a request than this.
+const MAX_REST_BODY = 1 << 20
+
+// The prefix length requests get if they don't say, as in the client.
+const DEFAULT_REST_PREFIX_LEN = 2
+
+//go:embed openapi.json
+var OPENAPI_DOCUMENT []byte
+
+type restAPI struct {
+	eb *Ebooker
+}
+
+// Answers a request, made with the key authed has, with a status and something
+// to send as JSON, or an error.
+type restHandler func(r *http.Request, authed *authedEbooker) (int, interface{}, error)
+
+type restRoute struct {
+	method  string
+	path    string
+	handler restHandler
+}
+
+// What's wrong with a request, as we tell the client.
+type restError struct {
+	status  int
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"` // by their JSON names, e.g. "gen.users"
+}
+
+func (e *restError) Error() string {
+	return e.Message
+}
+
+// What the bot routes answer with: how it went, and how the bot is now.
+type restMessage struct {
+	Message string          `json:"message"`
+	Bot     *defs.BotStatus `json:"bot,omitempty"`
+}
+
+// Sent as it is, rather than as JSON.
+type restRaw struct {
+	contentType string
+	body        string
+}
+
+func newRestAPI(eb *Ebooker) *restAPI {
+	return &restAPI{eb}
+}
+
+func (api *restAPI) routes() []restRoute {
+	return []restRoute{
+		{"POST", "/v1/generate", api.generate},
+		{"GET", "/v1/bots", api.listBots},
+		{"POST", "/v1/bots", api.newBot},
+		{"GET", "/v1/bots/{name}", api.getBot},
+		{"DELETE", "/v1/bots/{name}", api.deleteBot},
+		{"POST", "/v1/bots/{name}/pause", api.botAction((*authedEbooker).PauseBot)},
+		{"POST", "/v1/bots/{name}/resume", api.botAction((*authedEbooker).ResumeBot)},
+		{"POST", "/v1/bots/{name}/cancel", api.botAction((*authedEbooker).CancelBot)},
+		{"PUT", "/v1/bots/{name}/schedule", api.setSchedule},
+		{"GET", "/v1/sources", api.sources},
+		{"POST", "/v1/export", api.export},
+		{"GET", OPENAPI_PATH, api.openAPI},
+	}
+}
+
+// Hooks the API up to the mux. We route within it ourselves, as without a
+// go.mod the mux doesn't match on methods or wildcards.
+func (api *restAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc(REST_PREFIX, api.route)
+}
+
+// Hands the request to the route for its method and path, with the path's
+// wildcards as its PathValues, once we know whose key it carries.
+func (api *restAPI) route(w http.ResponseWriter, r *http.Request) {
+	pathFound := false
+	for _, route := range api.routes() {
+		values, matches := matchRestPath(route.path, r.URL.Path)
+		if !matches {
+			continue
+		}
+		pathFound = true
+		if route.method != r.Method {
+			continue
+		}
+		for name, value := range values {
+			r.SetPathValue(name, value)
+		}
+		var authed *authedEbooker
+		if route.path != OPENAPI_PATH {
+			key, err := authenticate(api.eb.data, r)
+			if err != nil {
+				api.respond(w, 0, nil, err)
+				return
+			}
+			authed = &authedEbooker{api.eb, key}
+		}
+		status, body, err := route.handler(r, authed)
+		api.respond(w, status, body, err)
+		return
+	}
+
+	if pathFound {
+		api.respond(w, 0, nil, &restError{http.StatusMethodNotAllowed, "method_not_allowed", "Can't " + r.Method + " " + r.URL.Path, nil})
+	} else {
+		api.respond(w, 0, nil, &restError{http.StatusNotFound, "not_found", "No such endpoint: " + r.Method + " " + r.URL.Path, nil})
+	}
+}
+
+// Whether the path fits the pattern, where a {name} segment fits any one
+// segment. Returns what the wildcards matched.
+func matchRestPath(pattern, path string) (map[string]string, bool) {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return nil, false
+	}
+	values := make(map[string]string)
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") && pathSegments[i] != "" {
+			values[segment[1:len(segment)-1]] = pathSegments[i]
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// Writes what a handler answered with.
+func (api *restAPI) respond(w http.ResponseWriter, status int, body interface{}, err error) {
+	if err != nil {
+		restErr := asRestError(err)
+		status, body = restErr.status, map[string]*restError{"error": restErr}
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+
+	if raw, isRaw := body.(restRaw); isRaw {
+		w.Header().Set("Content-Type", raw.contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, raw.body)
+		return
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		api.eb.logger.StatusWrite("Couldn't encode a REST response.\n")
+		api.eb.logger.DebugWrite("Error was %v\n", err)
+		status, encoded = http.StatusInternalServerError, []byte(`{"error":{"code":"internal","message":"Something went wrong."}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(encoded, '\n'))
+}
+
+// Works out how to tell the client about an error from an RPC method.
+func asRestError(err error) *restError {
+	var restErr *restError
+	var conflict conflictError
+	var forbidden forbiddenError
+	var invalid invalidError
+	switch {
+	case errors.As(err, &restErr):
+		return restErr
+	case errors.Is(err, UNAUTHENTICATED):
+		return &restError{http.StatusUnauthorized, "unauthorized", err.Error(), nil}
+	case errors.As(err, &forbidden):
+		return &restError{http.StatusForbidden, "forbidden", err.Error(), nil}
+	case errors.Is(err, NO_SUCH_BOT):
+		return &restError{http.StatusNotFound, "not_found", err.Error(), nil}
+	case errors.Is(err, SHUTTING_DOWN):
+		return &restError{http.StatusServiceUnavailable, "unavailable", err.Error(), nil}
+	case errors.As(err, &conflict):
+		return &restError{http.StatusConflict, "conflict", err.Error(), nil}
+	case errors.As(err, &invalid):
+		return &restError{http.StatusBadRequest, "invalid_request", err.Error(), nil}
+	}
+	return &restError{http.StatusBadRequest, "bad_request", err.Error(), nil}
+}
+
+// Reads the request's JSON body into v. Fields we don't know are mistakes.
+func decodeRequest(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, MAX_REST_BODY))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return &restError{http.StatusBadRequest, "bad_json", "Couldn't read the request's JSON: " + err.Error(), nil}
+	}
+	if decoder.More() {
+		return &restError{http.StatusBadRequest, "bad_json", "The request has more than one JSON value in it.", nil}
+	}
+	return nil
+}
+
+// An error for a request with problems in some fields, or nil if it has none.
+func invalidFields(fields map[string]string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &restError{http.StatusBadRequest, "invalid_request", "Some fields aren't right: " + strings.Join(names, ", ") + ".", fields}
+}
+
+// Checks what bots and generating have in common, filling in the prefix
+// length if it's missing. Fields are named under prefix.
+func validateGenParams(gen *defs.GenParams, prefix string, fields map[string]string) {
+	if len(gen.Users) == 0 {
+		fields[prefix+"users"] = "needs at least one source to learn from"
+	}
+	for _, user := range gen.Users {
+		if strings.TrimSpace(user) == "" {
+			fields[prefix+"users"] = "can't have empty sources"
+		}
+	}
+	if gen.PrefixLen == 0 {
+		gen.PrefixLen = DEFAULT_REST_PREFIX_LEN
+	}
+	if gen.PrefixLen < 1 {
+		fields[prefix+"prefixLen"] = "must be at least 1"
+	}
+}
+
+func (api *restAPI) generate(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	var args defs.GenParams
+	if err := decodeRequest(r, &args); err != nil {
+		return 0, nil, err
+	}
+	fields := make(map[string]string)
+	validateGenParams(&args, "", fields)
+	if args.NumTweets < 1 || args.NumTweets > MAX_TWEETS {
+		fields["numTweets"] = "must be between 1 and " + strconv.Itoa(MAX_TWEETS)
+	}
+	if err := invalidFields(fields); err != nil {
+		return 0, nil, err
+	}
+
+	var tweets defs.Tweets
+	if err := authed.GenerateTweets(&args, &tweets); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]defs.Tweets{"tweets": tweets}, nil
+}
+
+func (api *restAPI) listBots(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	if _, err := authed.require(SCOPE_BOTS); err != nil {
+		return 0, nil, err
+	}
+	bots := []defs.BotStatus{}
+	for _, name := range api.eb.bots.names() {
+		var status defs.BotStatus
+		// Other keys' bots, and bots deleted since we got the names, are left
+		// out.
+		if authed.GetBotSchedule(name, &status) == nil {
+			bots = append(bots, status)
+		}
+	}
+	return http.StatusOK, map[string][]defs.BotStatus{"bots": bots}, nil
+}
+
+func (api *restAPI) newBot(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	var args defs.NewBotParams
+	if err := decodeRequest(r, &args); err != nil {
+		return 0, nil, err
+	}
+	fields := make(map[string]string)
+	validateGenParams(&args.Gen, "gen.", fields)
+	if args.Auth.User == "" {
+		fields["auth.user"] = "is required; it's the account the bot posts as"
+	}
+	if err := invalidFields(fields); err != nil {
+		return 0, nil, err
+	}
+
+	var msg string
+	if err := authed.NewBot(&args, &msg); err != nil {
+		return 0, nil, err
+	}
+	name := args.Name
+	if name == "" {
+		name = args.Auth.User
+	}
+	return http.StatusCreated, api.botMessage(authed, name, msg), nil
+}
+
+func (api *restAPI) getBot(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	var status defs.BotStatus
+	if err := authed.GetBotSchedule(r.PathValue("name"), &status); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, status, nil
+}
+
+func (api *restAPI) deleteBot(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	var msg string
+	if err := authed.DeleteBot(r.PathValue("name"), &msg); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, restMessage{msg, nil}, nil
+}
+
+// A route for an RPC method that does something to the bot named in the path.
+func (api *restAPI) botAction(method func(authed *authedEbooker, name string, out *string) error) restHandler {
+	return func(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+		var msg string
+		name := r.PathValue("name")
+		if err := method(authed, name, &msg); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, api.botMessage(authed, name, msg), nil
+	}
+}
+
+func (api *restAPI) setSchedule(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	args := defs.BotSchedule{r.PathValue("name"), defs.Schedule{}}
+	if err := decodeRequest(r, &args.Sched); err != nil {
+		return 0, nil, err
+	}
+	var msg string
+	if err := authed.SetBotSchedule(&args, &msg); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, api.botMessage(authed, args.Name, msg), nil
+}
+
+func (api *restAPI) sources(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	var statuses []defs.SourceStatus
+	if err := authed.RefreshStatus("", &statuses); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string][]defs.SourceStatus{"sources": statuses}, nil
+}
+
+func (api *restAPI) export(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	var args defs.ExportParams
+	if err := decodeRequest(r, &args); err != nil {
+		return 0, nil, err
+	}
+	var exported string
+	if err := authed.Export(&args, &exported); err != nil {
+		return 0, nil, err
+	}
+	contentType := "application/x-ndjson"
+	if args.Format == FORMAT_CSV {
+		contentType = "text/csv"
+	}
+	return http.StatusOK, restRaw{contentType + "; charset=utf-8", exported}, nil
+}
+
+func (api *restAPI) openAPI(r *http.Request, authed *authedEbooker) (int, interface{}, error) {
+	return http.StatusOK, restRaw{"application/json", string(OPENAPI_DOCUMENT)}, nil
+}
+
+// The message, with how the bot is now, if it's still around.
+func (api *restAPI) botMessage(authed *authedEbooker, name, msg string) restMessage {
+	var status defs.BotStatus
+	if authed.GetBotSchedule(name, &status) != nil {
+		return restMessage{msg, nil}
+	}
+	return restMessage{msg, &status}
+}
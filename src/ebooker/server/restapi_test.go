@@ -0,0 +1,252 @@
+package main
+
+import (
+	"ebooker/defs"
+
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type RestSuite struct{}
+
+var _ = gocheck.Suite(&RestSuite{})
+
+// An admin key the test REST API knows.
+const TEST_REST_KEY = "ebk_test"
+
+// Serves the REST API of an Ebooker with a fake Twitter.
+func startTestRestAPI() (*Ebooker, *httptest.Server) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	eb.data.insertAPIKey(apiKey{"test", hashAPIKey(TEST_REST_KEY), []string{SCOPE_ADMIN}, time.Now()})
+	mux := http.NewServeMux()
+	newRestAPI(eb).register(mux)
+	return eb, httptest.NewServer(mux)
+}
+
+// Sends a request with body as its JSON, and decodes the JSON that comes back
+// into out, if it's given. Returns the response's status.
+func restCall(c *gocheck.C, server *httptest.Server, method, path, body string, out interface{}) int {
+	return restCallAs(c, server, TEST_REST_KEY, method, path, body, out)
+}
+
+// restCall, with the API key given, or none if it's empty.
+func restCallAs(c *gocheck.C, server *httptest.Server, key, method, path, body string, out interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	c.Assert(err, gocheck.IsNil)
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := server.Client().Do(req)
+	c.Assert(err, gocheck.IsNil)
+	defer resp.Body.Close()
+	if out != nil {
+		c.Assert(resp.Header.Get("Content-Type"), gocheck.Equals, "application/json")
+		c.Assert(json.NewDecoder(resp.Body).Decode(out), gocheck.IsNil)
+	}
+	return resp.StatusCode
+}
+
+type testRestError struct {
+	Error restError `json:"error"`
+}
+
+const TEST_REST_BOT = `{"name": "SrPablo_ebooks", "gen": {"users": ["SrPablo"], "prefixLen": 1},
+	"auth": {"user": "SrPablo_ebooks", "token": "token", "tokenSecret": "secret"}, "sched": {"cron": "0 8 * * *"}}`
+
+func (s RestSuite) TestGenerate(c *gocheck.C) {
+	eb, server := startTestRestAPI()
+	defer server.Close()
+	defer eb.shutdown(context.Background())
+
+	var generated struct{ Tweets []string }
+	status := restCall(c, server, "POST", "/v1/generate",
+		`{"users": ["SrPablo"], "numTweets": 3, "prefixLen": 1, "auth": {"user": "SrPablo", "token": "t", "tokenSecret": "s"}}`, &generated)
+	c.Assert(status, gocheck.Equals, http.StatusOK)
+	c.Assert(len(generated.Tweets), gocheck.Equals, 3)
+	for _, tweet := range generated.Tweets {
+		c.Assert(tweet, gocheck.Matches, "today is a (great|fine) day")
+	}
+
+	// The prefix length has a default; the rest has to be right.
+	var failed testRestError
+	status = restCall(c, server, "POST", "/v1/generate", `{"users": ["", "SrPablo"], "numTweets": 1000, "prefixLen": -1}`, &failed)
+	c.Assert(status, gocheck.Equals, http.StatusBadRequest)
+	c.Assert(failed.Error.Code, gocheck.Equals, "invalid_request")
+	c.Assert(failed.Error.Fields, gocheck.DeepEquals, map[string]string{"users": "can't have empty sources",
+		"numTweets": "must be between 1 and 100", "prefixLen": "must be at least 1"})
+
+	bad := []string{`{"users": ["SrPablo"], "numTweets": 1`, `{"users": ["SrPablo"], "tweets": 1}`, `{} {}`, ``}
+	for _, body := range bad {
+		failed = testRestError{}
+		c.Assert(restCall(c, server, "POST", "/v1/generate", body, &failed), gocheck.Equals, http.StatusBadRequest)
+		c.Assert(failed.Error.Code, gocheck.Equals, "bad_json")
+	}
+
+	// Sources with nothing in them.
+	failed = testRestError{}
+	c.Assert(restCall(c, server, "POST", "/v1/generate", `{"users": ["nobody"], "numTweets": 1}`, &failed), gocheck.Equals, http.StatusBadRequest)
+	c.Assert(failed.Error.Code, gocheck.Equals, "bad_request")
+}
+
+// Bots can be made, looked at, changed and got rid of.
+func (s RestSuite) TestBots(c *gocheck.C) {
+	eb, server := startTestRestAPI()
+	defer server.Close()
+	defer eb.shutdown(context.Background())
+
+	var created restMessage
+	c.Assert(restCall(c, server, "POST", "/v1/bots", TEST_REST_BOT, &created), gocheck.Equals, http.StatusCreated)
+	c.Assert(created.Message, gocheck.Matches, "The next tweet will arrive at: .*")
+	c.Assert(created.Bot.Name, gocheck.Equals, "SrPablo_ebooks")
+	c.Assert(created.Bot.State, gocheck.Equals, "running")
+	c.Assert(created.Bot.Cron, gocheck.Equals, "0 8 * * *")
+	c.Assert(created.Bot.Sources, gocheck.DeepEquals, []string{"SrPablo"})
+
+	var failed testRestError
+	c.Assert(restCall(c, server, "POST", "/v1/bots", TEST_REST_BOT, &failed), gocheck.Equals, http.StatusConflict)
+	c.Assert(failed.Error.Message, gocheck.Equals, "There's already a bot named SrPablo_ebooks.")
+	failed = testRestError{}
+	c.Assert(restCall(c, server, "POST", "/v1/bots", `{"gen": {"users": []}}`, &failed), gocheck.Equals, http.StatusBadRequest)
+	c.Assert(failed.Error.Fields, gocheck.DeepEquals, map[string]string{"gen.users": "needs at least one source to learn from",
+		"auth.user": "is required; it's the account the bot posts as"})
+
+	var listed struct{ Bots []defs.BotStatus }
+	c.Assert(restCall(c, server, "GET", "/v1/bots", "", &listed), gocheck.Equals, http.StatusOK)
+	c.Assert(len(listed.Bots), gocheck.Equals, 1)
+	c.Assert(listed.Bots[0].Name, gocheck.Equals, "SrPablo_ebooks")
+
+	var changed restMessage
+	c.Assert(restCall(c, server, "POST", "/v1/bots/SrPablo_ebooks/pause", "", &changed), gocheck.Equals, http.StatusOK)
+	c.Assert(changed.Bot.State, gocheck.Equals, "paused")
+	c.Assert(restCall(c, server, "POST", "/v1/bots/SrPablo_ebooks/pause", "", &failed), gocheck.Equals, http.StatusConflict)
+	c.Assert(restCall(c, server, "POST", "/v1/bots/SrPablo_ebooks/resume", "", &changed), gocheck.Equals, http.StatusOK)
+	c.Assert(changed.Bot.State, gocheck.Equals, "running")
+	c.Assert(restCall(c, server, "PUT", "/v1/bots/SrPablo_ebooks/schedule", `{"cron": "30 9 * * 1-5"}`, &changed), gocheck.Equals, http.StatusOK)
+	c.Assert(changed.Bot.Cron, gocheck.Equals, "30 9 * * 1-5")
+	failed = testRestError{}
+	c.Assert(restCall(c, server, "PUT", "/v1/bots/SrPablo_ebooks/schedule", `{"cron": "whenever"}`, &failed), gocheck.Equals, http.StatusBadRequest)
+	c.Assert(failed.Error.Code, gocheck.Equals, "bad_request")
+	c.Assert(restCall(c, server, "POST", "/v1/bots/SrPablo_ebooks/cancel", "", &changed), gocheck.Equals, http.StatusOK)
+	c.Assert(changed.Bot.State, gocheck.Equals, "stopped")
+
+	var bot defs.BotStatus
+	c.Assert(restCall(c, server, "GET", "/v1/bots/SrPablo_ebooks", "", &bot), gocheck.Equals, http.StatusOK)
+	c.Assert(bot.State, gocheck.Equals, "stopped")
+
+	var deleted restMessage
+	c.Assert(restCall(c, server, "DELETE", "/v1/bots/SrPablo_ebooks", "", &deleted), gocheck.Equals, http.StatusOK)
+	c.Assert(deleted, gocheck.DeepEquals, restMessage{"SrPablo_ebooks gone!", nil})
+	for _, method := range []string{"GET", "DELETE"} {
+		failed = testRestError{}
+		c.Assert(restCall(c, server, method, "/v1/bots/SrPablo_ebooks", "", &failed), gocheck.Equals, http.StatusNotFound)
+		c.Assert(failed.Error.Code, gocheck.Equals, "not_found")
+	}
+	c.Assert(restCall(c, server, "POST", "/v1/bots/SrPablo_ebooks/resume", "", &failed), gocheck.Equals, http.StatusNotFound)
+}
+
+func (s RestSuite) TestShuttingDown(c *gocheck.C) {
+	eb, server := startTestRestAPI()
+	defer server.Close()
+	eb.shutdown(context.Background())
+
+	var failed testRestError
+	c.Assert(restCall(c, server, "POST", "/v1/bots", TEST_REST_BOT, &failed), gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(failed.Error.Code, gocheck.Equals, "unavailable")
+}
+
+func (s RestSuite) TestSourcesAndExport(c *gocheck.C) {
+	eb, server := startTestRestAPI()
+	defer server.Close()
+	defer eb.shutdown(context.Background())
+	c.Assert(restCall(c, server, "POST", "/v1/bots", TEST_REST_BOT, &restMessage{}), gocheck.Equals, http.StatusCreated)
+
+	var sources struct{ Sources []defs.SourceStatus }
+	c.Assert(restCall(c, server, "GET", "/v1/sources", "", &sources), gocheck.Equals, http.StatusOK)
+	c.Assert(len(sources.Sources), gocheck.Equals, 1)
+	c.Assert(sources.Sources[0].User, gocheck.Equals, "SrPablo")
+	c.Assert(sources.Sources[0].Total, gocheck.Equals, 2)
+
+	req, _ := http.NewRequest("POST", server.URL+"/v1/export", strings.NewReader(`{"sources": ["SrPablo"], "format": "csv"}`))
+	req.Header.Set("Authorization", "Bearer "+TEST_REST_KEY)
+	resp, err := server.Client().Do(req)
+	c.Assert(err, gocheck.IsNil)
+	exported, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Type"), gocheck.Equals, "text/csv; charset=utf-8")
+	c.Assert(string(exported), gocheck.Equals, "source,tweet_id,timestamp,text\nSrPablo,1,,today is a great day\nSrPablo,2,,today is a fine day\n")
+
+	var failed testRestError
+	c.Assert(restCall(c, server, "POST", "/v1/export", `{}`, &failed), gocheck.Equals, http.StatusBadRequest)
+	c.Assert(restCall(c, server, "GET", "/v1/nothing", "", &failed), gocheck.Equals, http.StatusNotFound)
+	c.Assert(failed.Error.Message, gocheck.Equals, "No such endpoint: GET /v1/nothing")
+	c.Assert(restCall(c, server, "GET", "/v1/export", "", &failed), gocheck.Equals, http.StatusMethodNotAllowed)
+	c.Assert(restCall(c, server, "GET", "/v1/bots//pause", "", &failed), gocheck.Equals, http.StatusNotFound)
+}
+
+// Only requests with a key get anywhere, and only as far as the key allows.
+func (s RestSuite) TestAuth(c *gocheck.C) {
+	eb, server := startTestRestAPI()
+	defer server.Close()
+	defer eb.shutdown(context.Background())
+	generateOnly, err := createAPIKey(eb.data, "generator", []string{SCOPE_GENERATE})
+	c.Assert(err, gocheck.IsNil)
+
+	for _, key := range []string{"", "ebk_nope"} {
+		req, _ := http.NewRequest("GET", server.URL+"/v1/bots", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := server.Client().Do(req)
+		c.Assert(err, gocheck.IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, gocheck.Equals, http.StatusUnauthorized)
+		c.Assert(resp.Header.Get("WWW-Authenticate"), gocheck.Equals, "Bearer")
+	}
+
+	var failed testRestError
+	c.Assert(restCallAs(c, server, generateOnly, "POST", "/v1/bots", TEST_REST_BOT, &failed), gocheck.Equals, http.StatusForbidden)
+	c.Assert(failed.Error.Code, gocheck.Equals, "forbidden")
+	c.Assert(restCallAs(c, server, generateOnly, "GET", "/v1/bots", "", &failed), gocheck.Equals, http.StatusForbidden)
+	var generated struct{ Tweets []string }
+	c.Assert(restCallAs(c, server, generateOnly, "POST", "/v1/generate", `{"users": ["SrPablo"], "numTweets": 1}`, &generated), gocheck.Equals, http.StatusOK)
+
+	// Nobody needs a key to find out how to use one.
+	c.Assert(restCallAs(c, server, "", "GET", "/v1/openapi.json", "", &struct{}{}), gocheck.Equals, http.StatusOK)
+}
+
+// The OpenAPI document describes every route we serve, and nothing else.
+func (s RestSuite) TestOpenAPI(c *gocheck.C) {
+	eb, server := startTestRestAPI()
+	defer server.Close()
+	defer eb.shutdown(context.Background())
+
+	var document struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	c.Assert(restCall(c, server, "GET", "/v1/openapi.json", "", &document), gocheck.Equals, http.StatusOK)
+	c.Assert(document.OpenAPI, gocheck.Matches, "3\\..*")
+
+	documented := make(map[string]bool)
+	for path, operations := range document.Paths {
+		for method := range operations {
+			if method != "parameters" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	served := make(map[string]bool)
+	for _, route := range newRestAPI(eb).routes() {
+		served[route.method+" "+route.path] = true
+	}
+	c.Assert(documented, gocheck.DeepEquals, served)
+}
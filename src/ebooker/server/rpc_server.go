@@ -11,74 +11,318 @@ import (
 
 	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Ebooker is the provider of the service, and maintains its internal resources
 // in this struct.
 type Ebooker struct {
-	bots map[string]*Bot
-
-	logger *logging.LogMaster
-	data   *DataHandle
-	oauth  *oauth1.OAuth1
-	tf     *TweetFetcher
+	bots      *botRegistry
+	refresher *corpusRefresher
+	models    *modelCache
+	running   sync.WaitGroup // bots and refresher that haven't returned yet
+	lifecycle sync.Mutex     // held to set closing, and by whatever mustn't overlap it
+	closing   atomic.Bool    // set once we start shutting down
+
+	logger     *logging.LogMaster
+	data       Datastore
+	oauth      *oauth1.OAuth1
+	tf         TwitterAPI
+	httpClient *http.Client // for everything that isn't Twitter; see publicnet.go
 }
 
 const DEFAULT_USER = "SrPablo"
 
+// Errors the RPC methods return that callers (the REST API, say) may want to
+// tell apart.
+var (
+	NO_SUCH_BOT   = errors.New("No bot found for that name.")
+	SHUTTING_DOWN = errors.New("The server is shutting down.")
+)
+
+// Asking for something that clashes with how things are: a name that's
+// taken, or a bot that's already how you want it.
+type conflictError string
+
+func (e conflictError) Error() string {
+	return string(e)
+}
+
+// Asking for something that makes no sense: no tweets, say, or a prefix of
+// no words.
+type invalidError string
+
+func (e invalidError) Error() string {
+	return string(e)
+}
+
+// The most tweets one call can generate.
+const MAX_TWEETS = 100
+
+// Models need prefixes of at least a word; we'd panic building one without.
+func checkPrefixLen(prefixLen int) error {
+	if prefixLen < 1 {
+		return invalidError("The prefix length must be at least 1.")
+	}
+	return nil
+}
+
+// Creates an Ebooker whose bots' corpora are refreshed every refreshInterval,
+// once startRefresher is called, and which keeps models nobody's using around
+// until they take up more than modelBudget bytes.
+func newEbooker(logger *logging.LogMaster, data Datastore, oauth *oauth1.OAuth1, tf TwitterAPI, refreshInterval time.Duration, modelBudget int64) *Ebooker {
+	httpClient := newPublicClient(oauth1.DEFAULT_TIMEOUT)
+	refresherLogger := logger.Component("refresher")
+	refresher := newCorpusRefresher(refreshInterval, data, refresherLogger, newSourceFetchers(tf, data, httpClient, refresherLogger))
+	return &Ebooker{bots: newBotRegistry(), refresher: refresher, models: newModelCache(modelBudget, refresher, logger),
+		logger: logger, data: data, oauth: oauth, tf: tf, httpClient: httpClient}
+}
+
+// Starts refreshing corpora in the background, until shutdown.
+func (eb *Ebooker) startRefresher() {
+	eb.running.Add(1)
+	go func() {
+		defer eb.running.Done()
+		eb.refresher.start()
+	}()
+}
+
 // Starts the service
 func main() {
 	var debug, timestamps, silent bool
-	var port, keyFile string
+	var apiTimeout, shutdownTimeout, refreshInterval time.Duration
+	var modelBudget int64
+	var bind, port, keyFile, masterKeyFile, newMasterKeyFile, callbackURL string
+	var importFile, importSource, importFormat string
+	var newAPIKey, apiKeyScopes, revokeAPIKey string
+	var listAPIKeys bool
+	var logLevels, logFormat, logFile, logFileFormat string
+	var logFileSize int64
+	var logFileBackups int
 	flag.BoolVar(&silent, "silent", false, "Generate only the tweets, without other status information.")
 	flag.BoolVar(&debug, "debug", false, "Print debugging information.")
 	flag.BoolVar(&timestamps, "timestamps", false, "Print log/debug with timestamps.")
+	flag.StringVar(&logLevels, "loglevel", "", "Levels to log at, like info,refresher=debug: debug, info, warn or error, for everything then by component (bots, refresher, rpc). Overrides -debug.")
+	flag.StringVar(&logFormat, "logformat", "text", "How to print the log: text or json.")
+	flag.StringVar(&logFile, "logfile", "", "File to log to as well, rotated as it fills up.")
+	flag.StringVar(&logFileFormat, "logfileformat", "json", "How to write the -logfile: text or json.")
+	flag.Int64Var(&logFileSize, "logfilesize", 10<<20, "Bytes the -logfile can grow to before it's rotated.")
+	flag.IntVar(&logFileBackups, "logfilebackups", 5, "How many rotated -logfiles to keep.")
+	flag.StringVar(&bind, "bind", "127.0.0.1", "Address to listen on. Use 0.0.0.0 to be reachable from other machines.")
 	flag.StringVar(&port, "port", "8998", "Port to run the server on.")
 	flag.StringVar(&keyFile, "keyfile", "keys.txt", "File containing the application keys assigned to you by Twitter.")
+	flag.DurationVar(&apiTimeout, "apitimeout", oauth1.DEFAULT_TIMEOUT, "How long to wait on a request to Twitter before giving up.")
+	flag.StringVar(&masterKeyFile, "masterkey", "master.key", "File containing the hex-encoded key that encrypts stored access tokens. "+MASTER_KEY_ENV+" overrides it.")
+	flag.StringVar(&callbackURL, "callback", "", "Public URL of this server's "+OAUTH_CALLBACK_PATH+" page, for signing in with Twitter from a browser. Defaults to localhost.")
+	flag.DurationVar(&refreshInterval, "refresh", DEFAULT_REFRESH_INTERVAL, "How often to check the bots' sources for new tweets.")
+	flag.Int64Var(&modelBudget, "modelbudget", DEFAULT_MODEL_BUDGET, "Bytes of memory to keep models no bot is using cached in.")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", 30*time.Second, "How long to wait for bots to finish tweeting when shutting down.")
+	flag.StringVar(&newMasterKeyFile, "rotatekey", "", "Re-encrypt all stored access tokens with the key in this file, then exit.")
+	flag.StringVar(&importFile, "import", "", "Load the tweets (or lines of text) in this file into storage under -source, then exit.")
+	flag.StringVar(&importSource, "source", "", "Source to -import into: a Twitter user, or file: and any name (file:ishmael) bots can then learn from.")
+	flag.StringVar(&importFormat, "format", "", "Format of the -import file: archive (tweets.js), csv, jsonl or text. Guessed from its name by default.")
+	flag.StringVar(&newAPIKey, "newkey", "", "Make an API key with this name and -scopes, print it, then exit.")
+	flag.StringVar(&apiKeyScopes, "scopes", SCOPE_GENERATE+","+SCOPE_BOTS, "Comma-separated scopes of the -newkey: generate, bots, metrics and/or admin.")
+	flag.StringVar(&revokeAPIKey, "revokekey", "", "Revoke the API key with this name, then exit.")
+	flag.BoolVar(&listAPIKeys, "listkeys", false, "List the API keys, then exit.")
 	flag.Parse()
 
 	rand.Seed(time.Now().UnixNano())
 
 	// Silent default to false, since there isn't really an aesthetic need to do so
-	logger := logging.GetLogMaster(silent, debug, timestamps)
-	dh := getDataHandle("./ebooker_tweets.db", &logger)
-	defer dh.Cleanup()
+	logger, err := setUpLogging(silent, debug, timestamps, logLevels, logFormat, logFile, logFileFormat, logFileSize, logFileBackups)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't set up logging: %v\n", err)
+		os.Exit(1)
+	}
+	var tc *tokenCipher
+	masterKey, err := loadMasterKey(masterKeyFile)
+	if err == nil {
+		tc, err = newTokenCipher(masterKey)
+	}
+	if err != nil {
+		logger.StatusWrite("Couldn't load the master key: %v.\nTerminating...", err)
+		os.Exit(1)
+	}
+	dh := getDataHandle("./ebooker_tweets.db", tc, &logger)
+
+	if newMasterKeyFile != "" {
+		defer dh.Cleanup()
+		rotateMasterKey(dh, newMasterKeyFile, &logger)
+		return
+	}
+	if importFile != "" {
+		defer dh.Cleanup()
+		importFromFile(dh, importFile, importSource, importFormat, &logger)
+		return
+	}
+	if newAPIKey != "" || revokeAPIKey != "" || listAPIKeys {
+		defer dh.Cleanup()
+		manageAPIKeys(dh, newAPIKey, apiKeyScopes, revokeAPIKey, &logger)
+		return
+	}
+
 	applicationKey, applicationSecret := oauth1.ParseFromFile(keyFile)
-	oauth1 := oauth1.CreateOAuth1(&logger, applicationKey, applicationSecret)
+	logger.Redact(applicationSecret)
+	client := &http.Client{Timeout: apiTimeout}
+	oauth1 := oauth1.CreateOAuth1WithClient(&logger, applicationKey, applicationSecret, client, oauth1.TWITTER_BASE_URL)
 	tf := getTweetFetcher(&logger, &oauth1)
-	bots := make(map[string]*Bot)
 
 	logger.StatusWrite("Welcome to EBOOKER -- let's make some nonsense ^_^\n")
 	logger.StatusWrite("Registering Ebooker RPC...\n")
 
-	eb := Ebooker{bots, &logger, &dh, &oauth1, &tf}
-	rpc.Register(&eb)
-	rpc.HandleHTTP()
+	eb := newEbooker(&logger, dh, &oauth1, tf, refreshInterval, modelBudget)
+	eb.httpClient.Timeout = apiTimeout
+	gate := newRPCGate(eb)
+	http.Handle(rpc.DefaultRPCPath, gate)
+	if len(dh.loadAPIKeys()) == 0 {
+		logger.StatusWrite("There are no API keys yet, so nobody can use this server. Make one with -newkey.\n")
+	}
 
-	logger.StatusWrite("Starting up on port %s\n", port)
-	l, e := net.Listen("tcp", ":"+port)
+	if callbackURL == "" {
+		callbackURL = "http://localhost:" + port + OAUTH_CALLBACK_PATH
+	}
+	newOAuthFlow(callbackURL, &oauth1, dh, &logger).register(http.DefaultServeMux)
+	newRestAPI(eb).register(http.DefaultServeMux)
+	newDashboard().register(http.DefaultServeMux)
+	newMetricsHandler(eb).register(http.DefaultServeMux)
+	health := newHealthChecker(eb)
+	health.register(http.DefaultServeMux)
+
+	logger.StatusWrite("Starting up on %s, port %s. The dashboard is at %s.\n", bind, port, DASHBOARD_PATH)
+	l, e := net.Listen("tcp", net.JoinHostPort(bind, port))
 	if e != nil {
 		logger.StatusWrite("Listen error: %v.\nTerminating...", e)
 		os.Exit(1)
 	}
-	http.Serve(l, nil)
+
+	srv := &http.Server{}
+	srv.RegisterOnShutdown(gate.closeConnections)
+	srv.RegisterOnShutdown(health.stop)
+	go srv.Serve(l)
+	go health.start()
+	eb.startRestoringBots()
+	eb.startRefresher()
+	waitForShutdown(srv, eb, shutdownTimeout)
+}
+
+// Makes the LogMaster the flags ask for: printing to stdout unless silent, and
+// to a rotating file as well if there is one.
+func setUpLogging(silent, debug, timestamps bool, levels, format, file, fileFormat string, fileSize int64, fileBackups int) (logging.LogMaster, error) {
+	logger := logging.GetLogMaster(true, debug, timestamps)
+	if levels != "" {
+		if err := logger.SetLevels(levels); err != nil {
+			return logger, err
+		}
+	}
+	if !silent {
+		stdoutFormat, err := logging.ParseFormat(format)
+		if err != nil {
+			return logger, err
+		}
+		logger.AddSink(os.Stdout, stdoutFormat, timestamps)
+	}
+	if file != "" {
+		encoding, err := logging.ParseFormat(fileFormat)
+		if err != nil {
+			return logger, err
+		}
+		rotating, err := logging.OpenRotatingFile(file, fileSize, fileBackups)
+		if err != nil {
+			return logger, err
+		}
+		logger.AddSink(rotating, encoding, true)
+	}
+	return logger, nil
+}
+
+// Moves every stored access token, and where each saved bot posts, over to
+// the key in newKeyFile. Once this
+// succeeds, the server must be started with the new key.
+func rotateMasterKey(dh DataHandle, newKeyFile string, logger *logging.LogMaster) {
+	newKey, err := readMasterKey(newKeyFile)
+	var newCipher *tokenCipher
+	if err == nil {
+		newCipher, err = newTokenCipher(newKey)
+	}
+	if err != nil {
+		logger.StatusWrite("Couldn't load the new master key: %v\n", err)
+		os.Exit(1)
+	}
+
+	count, err := dh.rotateMasterKey(newCipher)
+	if err != nil {
+		logger.StatusWrite("Key rotation failed, nothing was changed: %v\n", err)
+		os.Exit(1)
+	}
+	logger.StatusWrite("Re-encrypted %d access tokens and bots. Restart with -masterkey %s.\n", count, newKeyFile)
+}
+
+// Makes the API key called newKey, revokes the one called revokeKey, or if
+// neither, lists them all.
+func manageAPIKeys(dh DataHandle, newKey, scopeList, revokeKey string, logger *logging.LogMaster) {
+	if newKey != "" {
+		scopes, err := parseScopes(scopeList)
+		var key string
+		if err == nil {
+			key, err = createAPIKey(dh, newKey, scopes)
+		}
+		if err != nil {
+			logger.StatusWrite("Couldn't make the API key: %v\n", err)
+			os.Exit(1)
+		}
+		// Printed even when -silent: it's the one thing we're here for.
+		fmt.Printf("API key %s (%s): %s\nKeep it safe; it can't be shown again.\n", newKey, strings.Join(scopes, ","), key)
+	} else if revokeKey != "" {
+		if !dh.deleteAPIKey(revokeKey) {
+			logger.StatusWrite("No API key named %s.\n", revokeKey)
+			os.Exit(1)
+		}
+		logger.StatusWrite("Revoked API key %s.\n", revokeKey)
+	} else {
+		for _, key := range dh.loadAPIKeys() {
+			fmt.Printf("%s\t%s\tmade %s\n", key.Name, strings.Join(key.Scopes, ","), key.Created.Format(time.RFC3339))
+		}
+	}
+}
+
+// Loads a corpus from a file into storage, for bots to learn from.
+func importFromFile(dh DataHandle, filename, source, format string, logger *logging.LogMaster) {
+	count, err := importCorpus(dh, filename, source, format, logger)
+	if err != nil {
+		logger.StatusWrite("Couldn't import %s: %v\n", filename, err)
+		os.Exit(1)
+	}
+	logger.StatusWrite("Imported %d tweets into %s.\n", count, source)
 }
 
 // GenerateTweets is the core service: given a set of arguments (namely the
 // Twitter user(s) in question), generate a bunch of Markovian Tweets.
 func (eb *Ebooker) GenerateTweets(args *defs.GenParams, out *defs.Tweets) error {
-	gen, err := eb.createSeededGenerator(args)
+	if args.NumTweets < 1 || args.NumTweets > MAX_TWEETS {
+		*out = defs.Tweets{}
+		return invalidError(fmt.Sprintf("The number of tweets must be between 1 and %d.", MAX_TWEETS))
+	}
+	if err := checkPrefixLen(args.PrefixLen); err != nil {
+		*out = defs.Tweets{}
+		return err
+	}
+	userToken := &oauth1.Token{args.Auth.Token, args.Auth.TokenSecret}
+	gen, err := eb.models.acquire(args.Users, args.PrefixLen, args.Reps, userToken)
 	if err != nil {
 		*out = defs.Tweets{}
 		return err
 	}
+	defer eb.models.release(gen)
 
 	eb.logger.StatusWrite("Outputting nonsense tweets for \"%v\":\n", args.Users)
 	tweets := make(defs.Tweets, args.NumTweets)
@@ -90,43 +334,169 @@ func (eb *Ebooker) GenerateTweets(args *defs.GenParams, out *defs.Tweets) error
 }
 
 // NewBot takes parameters needed to create a self-tweeting, perpetual bot,
-// sets it running on the server.
+// sets it running on the server. Bots are known by their name, which must be
+// unique; an account can have as many bots tweeting to it as you like.
 func (eb *Ebooker) NewBot(args *defs.NewBotParams, out *string) error {
+	return eb.createBot(args, "", BOT_RUNNING, out)
+}
+
+// Does NewBot's work, for a bot belonging to the API key called owner (or to
+// no key, if it's empty), starting out in state.
+func (eb *Ebooker) createBot(args *defs.NewBotParams, owner string, state botState, out *string) error {
 
 	user := args.Auth.User
-	eb.logger.StatusWrite("Creating a new bot for %v\n", user)
-	token, exists := eb.data.getUserAccessToken(user)
-	if !exists {
-		eb.logger.StatusWrite("%v does not have credentials in the database. Adding...\n", user)
-		token := &oauth1.Token{args.Auth.Token, args.Auth.TokenSecret}
-		eb.data.insertUserAccessToken(user, token)
+	name := args.Name
+	if name == "" {
+		name = user
+	}
+	if eb.closing.Load() {
+		*out = "fail"
+		return SHUTTING_DOWN
+	}
+	if _, exists := eb.bots.get(name); exists {
+		*out = "fail"
+		return conflictError("There's already a bot named " + name + ".")
+	}
+	if err := checkPrefixLen(args.Gen.PrefixLen); err != nil {
+		*out = "fail"
+		return err
+	}
+	eb.logger.StatusWrite("Creating a new bot %v for %v\n", name, user)
+	credentials := credentialKey(args.Publish.Kind, user)
+	if _, exists := eb.data.getUserAccessToken(credentials); !exists && args.Auth.Token != "" {
+		eb.logger.StatusWrite("%v does not have credentials in the database. Adding...\n", credentials)
+		eb.data.insertUserAccessToken(credentials, &oauth1.Token{args.Auth.Token, args.Auth.TokenSecret})
+	}
+	token, err := eb.getAccessToken(credentials)
+	if err != nil {
+		*out = "fail"
+		return err
 	}
 
-	eb.logger.StatusWrite("Creating a generator...\n")
-	gen, err := eb.createSeededGenerator(&args.Gen)
+	if _, err := parseCron(args.Sched.Cron); err != nil {
+		*out = "fail"
+		return err
+	}
+	publisher, err := eb.newPublisher(&args.Publish, token)
 	if err != nil {
 		*out = "fail"
-		eb.logger.DebugWrite("Generator creation failed. Error: %v\n", err)
 		return err
 	}
 
-	schedule := cronParse(args.Sched.Cron)
-	bot := Bot{user, args.Gen.Users, gen, token, &schedule,
-		eb.logger, eb.data, eb.oauth, eb.tf}
+	// Only a Twitter token can fetch tweets. Bots posting elsewhere make do
+	// with the tokens of whoever else learns from the same sources.
+	var sourceToken *oauth1.Token
+	if _, tweets := publisher.(*twitterPublisher); tweets {
+		sourceToken = token
+	}
+	eb.logger.StatusWrite("Getting a generator...\n")
+	gen, err := eb.models.acquire(args.Gen.Users, args.Gen.PrefixLen, args.Gen.Reps, sourceToken)
+	if err != nil {
+		*out = "fail"
+		return err
+	}
 
-	eb.bots[user] = &bot
-	*out = "The next tweet will arrive at: " + schedule.next().String()
+	// A stopped bot keeps a schedule that doesn't tick, as stop leaves it;
+	// resuming gives it one that does.
+	var schedule *Schedule
+	if state == BOT_STOPPED {
+		schedule, _ = parseCron(args.Sched.Cron)
+	} else {
+		schedule, _ = cronParse(args.Sched.Cron)
+	}
+	bot := eb.newBot(name, user, &args.Gen, schedule.String(), gen, token, publisher, state, schedule)
+	bot.owner = owner
+
+	// Someone may have taken the name while we were busy fetching tweets, or
+	// we may have started shutting down.
+	err = eb.unlessClosing(func() error {
+		if !eb.bots.add(name, bot) {
+			return conflictError("There's already a bot named " + name + ".")
+		}
+		if state != BOT_STOPPED {
+			eb.runBot(bot, schedule)
+		}
+		eb.data.saveBot(bot.record())
+		return nil
+	})
+	if err != nil {
+		schedule.kill()
+		eb.models.release(gen)
+		*out = "fail"
+		return err
+	}
+	if state == BOT_RUNNING {
+		*out = "The next tweet will arrive at: " + schedule.next().String()
+	} else {
+		*out = name + " is " + state.String() + "."
+	}
 	eb.logger.StatusWrite("Bot created! %s\n", *out)
-	go bot.Run()
+	return nil
+}
+
+// Runs f, unless we've started shutting down, and keeps us from starting
+// until it's done. So shutdown sees any bot f starts, and waits for it.
+func (eb *Ebooker) unlessClosing(f func() error) error {
+	eb.lifecycle.Lock()
+	defer eb.lifecycle.Unlock()
+
+	if eb.closing.Load() {
+		return SHUTTING_DOWN
+	}
+	return f()
+}
+
+// Runs the bot on sched in the background, keeping track of it so shutdown
+// can wait for it. Call it through unlessClosing.
+func (eb *Ebooker) runBot(bot *Bot, sched *Schedule) {
+	eb.running.Add(1)
+	go func() {
+		defer eb.running.Done()
+		bot.run(sched)
+	}()
+}
+
+// Saves the bot as it is now, so a restart brings it back that way, unless
+// it's been deleted. Once we're shutting down, shutdown saves it instead.
+func (eb *Ebooker) persist(bot *Bot) {
+	eb.unlessClosing(func() error {
+		if current, exists := eb.bots.get(bot.name); exists && current == bot {
+			eb.data.saveBot(bot.record())
+		}
+		return nil
+	})
+}
+
+// Runs the bot on the new schedule resume or reschedule gave it, if they did,
+// and saves it as it is now.
+func (eb *Ebooker) restart(bot *Bot, sched *Schedule) error {
+	if sched != nil {
+		err := eb.unlessClosing(func() error {
+			eb.runBot(bot, sched)
+			return nil
+		})
+		if err != nil {
+			sched.kill()
+			return err
+		}
+	}
+	eb.persist(bot)
+	return nil
+}
+
+// Lets a client check the server's there, answering "ok".
+func (eb *Ebooker) Ping(_ string, out *string) error {
+	*out = "ok"
 	return nil
 }
 
 // Lists the bots this Ebooker server is running.
 func (eb *Ebooker) ListBots(_ string, out *[]string) error {
 
-	for k, v := range eb.bots {
-		botstring := k + ":" + strings.Join(v.sources, ",")
-		*out = append(*out, botstring)
+	for _, name := range eb.bots.names() {
+		if bot, exists := eb.bots.get(name); exists {
+			*out = append(*out, name+":"+strings.Join(bot.sources, ","))
+		}
 	}
 
 	return nil
@@ -135,110 +505,159 @@ func (eb *Ebooker) ListBots(_ string, out *[]string) error {
 // Cancels this bot, preventing it from tweeting.
 func (eb *Ebooker) CancelBot(name string, out *string) error {
 
-	bot, exists := eb.bots[name]
+	bot, exists := eb.bots.get(name)
 	if !exists {
 		*out = ""
-		return errors.New("No bot found for that name.")
+		return NO_SUCH_BOT
 	}
 
-	bot.Kill()
+	if err := bot.stop(); err != nil {
+		*out = ""
+		return err
+	}
+	eb.persist(bot)
 	*out = name + " now inactive. You can always start it up again later ^_^"
 	return nil
 }
 
-// Cancels this bot, preventing it from tweeting.
-func (eb *Ebooker) DeleteBot(name string, out *string) error {
+// Pauses this bot: it keeps its schedule, but lets the ticks go by until it's
+// resumed.
+func (eb *Ebooker) PauseBot(name string, out *string) error {
 
-	bot, exists := eb.bots[name]
+	bot, exists := eb.bots.get(name)
 	if !exists {
 		*out = ""
-		return errors.New("No bot found for that name.")
+		return NO_SUCH_BOT
 	}
 
-	bot.Kill()
-	delete(eb.bots, name)
-	*out = name + " gone!"
+	if err := bot.pause(); err != nil {
+		*out = ""
+		return err
+	}
+	eb.persist(bot)
+	*out = name + " paused."
 	return nil
 }
 
-func (eb *Ebooker) createSeededGenerator(args *defs.GenParams) (*Generator, error) {
+// Sets a paused or cancelled bot tweeting again.
+func (eb *Ebooker) ResumeBot(name string, out *string) error {
 
-	userToken := &oauth1.Token{args.Auth.Token, args.Auth.TokenSecret}
-	sourcestrings := fetchNewSources(args.Users, userToken, eb.data, eb.logger, eb.tf)
-
-	if len(sourcestrings) == 0 {
-		eb.logger.StatusWrite("Can't write nonsense tweets, as we don't have a corpus!\n")
-		noTextError := errors.New("No text for users in list. Either unauthorized, or they don't exist")
-		return nil, noTextError
+	if eb.closing.Load() {
+		*out = ""
+		return SHUTTING_DOWN
+	}
+	bot, exists := eb.bots.get(name)
+	if !exists {
+		*out = ""
+		return NO_SUCH_BOT
 	}
 
-	// fetch or create a Generator
-	gen := CreateGenerator(args.PrefixLen, 140, eb.logger)
-	if args.Reps {
-		gen.CanonicalizeSources()
+	sched, err := bot.resume()
+	if err != nil {
+		*out = ""
+		return err
 	}
+	if err := eb.restart(bot, sched); err != nil {
+		*out = ""
+		return err
+	}
+	*out = name + " is back! The next tweet will arrive at: " + bot.schedule().next().String()
+	return nil
+}
 
-	// Seed the Generator
-	for _, str := range sourcestrings {
-		gen.AddSeeds(str)
+// Reports when this bot tweets, and whether it's running.
+func (eb *Ebooker) GetBotSchedule(name string, out *defs.BotStatus) error {
+
+	bot, exists := eb.bots.get(name)
+	if !exists {
+		return NO_SUCH_BOT
 	}
 
-	return gen, nil
+	*out = bot.status()
+	return nil
 }
 
-// fetchNewSources will check the Twitter API for new tweets by 'sources,' using the
-// authentication from 'token.' Note that we'd like this to be a member function of some
-// struct interface "ResourceHolder," but Goobuntu + GBus Wifi are so craptacularly out
-// of sync that I have to do this one offline, and can't look up whether we could even
-// attach an implementation to an interface in Go, or what that would look like.
-//
-// Feel my first 'rants' email coming along...
-func fetchNewSources(userlist []string, userToken *oauth1.Token, data *DataHandle, logger *logging.LogMaster, tf *TweetFetcher) []string {
+// Changes when this bot tweets.
+func (eb *Ebooker) SetBotSchedule(args *defs.BotSchedule, out *string) error {
 
-	var sourcestrings []string
-	for _, username := range userlist {
-		// get tweets from persistent storage
-		logger.StatusWrite("Reading from persistent storage for %s...\n", username)
-		oldTweets := data.GetTweetsFromStorage(username)
+	if eb.closing.Load() {
+		*out = ""
+		return SHUTTING_DOWN
+	}
+	bot, exists := eb.bots.get(args.Name)
+	if !exists {
+		*out = ""
+		return NO_SUCH_BOT
+	}
 
-		var newTweets Tweets
-		if len(oldTweets) == 0 {
-			logger.StatusWrite("Found no tweets for %s, doing a deep dive to retrieve their history.\n", username)
-			newTweets = tf.DeepDive(username, userToken)
-		} else {
-			logger.StatusWrite("Found %d tweets for %s.\n", len(oldTweets), username)
-			newest := oldTweets[len(oldTweets)-1]
-			newTweets = tf.GetRecentTimeline(username, &newest, userToken)
-		}
+	sched, err := bot.reschedule(args.Sched.Cron)
+	if err != nil {
+		*out = ""
+		return err
+	}
+	if err := eb.restart(bot, sched); err != nil {
+		*out = ""
+		return err
+	}
+	*out = args.Name + " now tweets on \"" + bot.schedule().String() + "\"."
+	return nil
+}
 
-		// update the persistent storage
-		logger.StatusWrite("Inserting %d new tweets into persistent storage.\n", len(newTweets))
-		data.InsertFreshTweets(username, newTweets)
+// Removes this bot from the server entirely.
+func (eb *Ebooker) DeleteBot(name string, out *string) error {
 
-		copyFrom(&sourcestrings, &oldTweets)
-		copyFrom(&sourcestrings, &newTweets)
+	var bot *Bot
+	err := eb.unlessClosing(func() error {
+		var exists bool
+		if bot, exists = eb.bots.remove(name); !exists {
+			return NO_SUCH_BOT
+		}
+		eb.data.deleteBot(name)
+		return nil
+	})
+	if err != nil {
+		*out = ""
+		return err
 	}
-	return sourcestrings
+
+	bot.Kill()
+	eb.models.release(bot.gen)
+	eb.forgetToken(bot.token)
+	*out = name + " gone!"
+	return nil
 }
 
-func copyFrom(dst *[]string, src *Tweets) {
-	for _, str := range *src {
-		*dst = append(*dst, str.Text)
+// Stops redacting a deleted bot's token, unless another bot still posts with
+// it. If it's wanted again, it's registered again as it's loaded.
+func (eb *Ebooker) forgetToken(token *oauth1.Token) {
+	if token == nil {
+		return
 	}
+	for _, name := range eb.bots.names() {
+		if other, exists := eb.bots.get(name); exists && other.token != nil && other.token.OAuthToken == token.OAuthToken {
+			return
+		}
+	}
+	eb.logger.Forget(token.OAuthToken, token.OAuthTokenSecret)
 }
 
-// Returns the access token we have in storage for the user. If the user doesn't
-// exist, we return an error.
-func (eb *Ebooker) getAccessToken(user string) *oauth1.Token {
+// Reports on the sources the refresher keeps up to date for the bots.
+func (eb *Ebooker) RefreshStatus(_ string, out *[]defs.SourceStatus) error {
+	*out = eb.refresher.status()
+	return nil
+}
+
+// Returns the access token we have in storage for the user. If we don't have
+// one, the user needs to sign in through the web flow (or hand us a token from
+// the client's PIN flow) first; there's no one at the server's terminal to do
+// it for them.
+func (eb *Ebooker) getAccessToken(user string) (*oauth1.Token, error) {
 	accessToken, exists := eb.data.getUserAccessToken(user)
 
 	if !exists {
-		eb.logger.StatusWrite("Access token for %v not present! Beginning OAuth...\n", user)
-		requestToken := eb.oauth.ObtainRequestToken()
-		token := eb.oauth.ObtainAccessToken(requestToken)
-
-		eb.data.insertUserAccessToken(user, token)
-		accessToken = token
+		eb.logger.StatusWrite("Access token for %v not present!\n", user)
+		return nil, errors.New("No credentials for " + user + ". Sign in at " + OAUTH_START_PATH +
+			" on the server, or provide a token.")
 	}
-	return accessToken
+	return accessToken, nil
 }
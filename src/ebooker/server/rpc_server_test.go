@@ -0,0 +1,269 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"bytes"
+	"context"
+	"fmt"
+	"launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+)
+
+// hook up gocheck into the gotest runner.
+type RPCSuite struct{}
+
+var _ = gocheck.Suite(&RPCSuite{})
+
+// Builds an Ebooker backed by memory and a fake Twitter, so nothing touches
+// the disk or the network.
+func makeTestEbooker(ft *fakeTwitter) *Ebooker {
+	logger := logging.GetLogMaster(true, false, false)
+	oauth := oauth1.CreateOAuth1(&logger, "key", "secret")
+	eb := newEbooker(&logger, getMemoryDataHandle(), &oauth, ft, DEFAULT_REFRESH_INTERVAL, DEFAULT_MODEL_BUDGET)
+	// Our fake Mastodons, feeds and webhooks are all on loopback, which the
+	// real client refuses.
+	eb.httpClient.Transport = http.DefaultTransport
+	return eb
+}
+
+func makeTestGenParams(users ...string) defs.GenParams {
+	return defs.GenParams{users, 3, false, 1, defs.AuthParams{"SrPablo", "token", "secret"}}
+}
+
+func seedFakeTwitter(ft *fakeTwitter) {
+	ft.tweet("SrPablo", TweetData{1, "today is a great day"}, TweetData{2, "today is a fine day"})
+	ft.tweet("laurelita", TweetData{3, "tomorrow is a better day"})
+}
+
+func (s RPCSuite) TestFetchNewTweets(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	// First fetch does the deep dive and stores everything.
+	gen := CreateGenerator(1, 140, eb.logger)
+	c.Assert(eb.refresher.subscribe(gen, []string{"SrPablo", "laurelita"}, &oauth1.Token{}), gocheck.Equals, 3)
+	c.Assert(len(eb.data.GetTweetsFromStorage("SrPablo")), gocheck.Equals, 2)
+	c.Assert(len(eb.data.GetTweetsFromStorage("laurelita")), gocheck.Equals, 1)
+
+	// Later fetches only pull in what's new.
+	ft.tweet("SrPablo", TweetData{4, "today is a strange day"})
+	eb.refresher.refreshAll()
+	c.Assert(len(eb.data.GetTweetsFromStorage("SrPablo")), gocheck.Equals, 3)
+	c.Assert(eb.refresher.status()[0].LastFetched, gocheck.Equals, 1)
+}
+
+func (s RPCSuite) TestGenerateTweets(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	args := makeTestGenParams("SrPablo")
+	var out defs.Tweets
+	c.Assert(eb.GenerateTweets(&args, &out), gocheck.IsNil)
+	c.Assert(len(out), gocheck.Equals, 3)
+	for _, tweet := range out {
+		c.Assert(strings.HasPrefix(tweet, "today"), gocheck.Equals, true)
+	}
+}
+
+func (s RPCSuite) TestGenerateTweetsNoCorpus(c *gocheck.C) {
+	eb := makeTestEbooker(newFakeTwitter())
+
+	args := makeTestGenParams("nobody")
+	var out defs.Tweets
+	c.Assert(eb.GenerateTweets(&args, &out), gocheck.NotNil)
+	c.Assert(len(out), gocheck.Equals, 0)
+}
+
+// However they're called, nonsense parameters are refused, not panicked on.
+func (s RPCSuite) TestInvalidParams(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	var out defs.Tweets
+	for _, numTweets := range []int{-1, 0, MAX_TWEETS + 1, 1e9} {
+		args := makeTestGenParams("SrPablo")
+		args.NumTweets = numTweets
+		err := eb.GenerateTweets(&args, &out)
+		c.Assert(err, gocheck.ErrorMatches, "The number of tweets must be between 1 and 100.")
+		c.Assert(asRestError(err).status, gocheck.Equals, http.StatusBadRequest)
+		c.Assert(len(out), gocheck.Equals, 0)
+	}
+	args := makeTestGenParams("SrPablo")
+	args.PrefixLen = -1
+	c.Assert(eb.GenerateTweets(&args, &out), gocheck.ErrorMatches, "The prefix length must be at least 1.")
+
+	var msg string
+	botArgs := defs.NewBotParams{"", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"SrPablo_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	botArgs.Gen.PrefixLen = -1
+	c.Assert(eb.NewBot(&botArgs, &msg), gocheck.ErrorMatches, "The prefix length must be at least 1.")
+	c.Assert(eb.bots.names(), gocheck.HasLen, 0)
+}
+
+// A token's masked in the logs while some bot posts with it, and no longer.
+func (s RPCSuite) TestDeletingForgetsToken(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	var buf bytes.Buffer
+	eb.logger.AddSink(&buf, logging.TEXT, false)
+
+	var msg string
+	for _, name := range []string{"first", "second"} {
+		args := defs.NewBotParams{name, makeTestGenParams("SrPablo"),
+			defs.AuthParams{"SrPablo_ebooks", "long-enough-token", "long-enough-secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+		c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	}
+	// As a stored token is, when it's loaded.
+	eb.logger.Redact("long-enough-token", "long-enough-secret")
+
+	c.Assert(eb.DeleteBot("first", &msg), gocheck.IsNil)
+	eb.logger.StatusWrite("One bot left: %s\n", "long-enough-token")
+	c.Assert(eb.DeleteBot("second", &msg), gocheck.IsNil)
+	eb.logger.StatusWrite("No bots left: %s\n", "long-enough-token")
+	// The bots log as they go; they're done once they're deleted.
+	eb.running.Wait()
+	c.Assert(strings.Contains(buf.String(), "One bot left: [REDACTED]\n"), gocheck.Equals, true)
+	c.Assert(strings.Contains(buf.String(), "No bots left: long-enough-token\n"), gocheck.Equals, true)
+}
+
+func (s RPCSuite) TestBotLifecycle(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	args := defs.NewBotParams{"", makeTestGenParams("SrPablo", "laurelita"),
+		defs.AuthParams{"SrPablo_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+
+	// Credentials passed in are kept for next time.
+	token, exists := eb.data.getUserAccessToken("SrPablo_ebooks")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"token", "secret"})
+	bot, _ := eb.bots.get("SrPablo_ebooks")
+	c.Assert(*bot.token, gocheck.Equals, oauth1.Token{"token", "secret"})
+
+	var bots []string
+	c.Assert(eb.ListBots("", &bots), gocheck.IsNil)
+	c.Assert(bots, gocheck.DeepEquals, []string{"SrPablo_ebooks:SrPablo,laurelita"})
+
+	c.Assert(eb.DeleteBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(eb.DeleteBot("SrPablo_ebooks", &msg), gocheck.NotNil)
+
+	bots = nil
+	c.Assert(eb.ListBots("", &bots), gocheck.IsNil)
+	c.Assert(len(bots), gocheck.Equals, 0)
+}
+
+// Without a token in the request or in storage, there's no one at the server
+// to sign in, so we refuse rather than make a bot that can't tweet.
+func (s RPCSuite) TestNewBotWithoutCredentials(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	args := defs.NewBotParams{"", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"SrPablo_ebooks", "", ""}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.ErrorMatches, "No credentials for SrPablo_ebooks.*")
+	c.Assert(eb.bots.size(), gocheck.Equals, 0)
+
+	// Once they've signed in through the web, it works.
+	eb.data.insertUserAccessToken("SrPablo_ebooks", &oauth1.Token{"token", "secret"})
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	eb.DeleteBot("SrPablo_ebooks", &msg)
+}
+
+// One account can have several bots, but no two bots can share a name.
+func (s RPCSuite) TestBotNames(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+
+	auth := defs.AuthParams{"SrPablo_ebooks", "token", "secret"}
+	var msg string
+	c.Assert(eb.NewBot(&defs.NewBotParams{"mornings", makeTestGenParams("SrPablo"), auth, defs.Schedule{"0 8 * * *"}, defs.PublisherParams{}}, &msg), gocheck.IsNil)
+	c.Assert(eb.NewBot(&defs.NewBotParams{"evenings", makeTestGenParams("laurelita"), auth, defs.Schedule{"0 20 * * *"}, defs.PublisherParams{}}, &msg), gocheck.IsNil)
+	c.Assert(eb.NewBot(&defs.NewBotParams{"mornings", makeTestGenParams("laurelita"), auth, defs.Schedule{""}, defs.PublisherParams{}}, &msg),
+		gocheck.ErrorMatches, "There's already a bot named mornings.")
+
+	// The duplicate didn't disturb the original.
+	mornings, _ := eb.bots.get("mornings")
+	c.Assert(mornings.sources, gocheck.DeepEquals, []string{"SrPablo"})
+	c.Assert(mornings.currentState(), gocheck.Equals, BOT_RUNNING)
+
+	var bots []string
+	c.Assert(eb.ListBots("", &bots), gocheck.IsNil)
+	c.Assert(bots, gocheck.DeepEquals, []string{"evenings:laurelita", "mornings:SrPablo"})
+
+	// Both tweet as the one account.
+	evenings, _ := eb.bots.get("evenings")
+	c.Assert(mornings.username, gocheck.Equals, "SrPablo_ebooks")
+	c.Assert(evenings.username, gocheck.Equals, "SrPablo_ebooks")
+
+	// Leaving out the name names the bot after its account.
+	c.Assert(eb.NewBot(&defs.NewBotParams{"", makeTestGenParams("SrPablo"), auth, defs.Schedule{""}, defs.PublisherParams{}}, &msg), gocheck.IsNil)
+	c.Assert(eb.NewBot(&defs.NewBotParams{"", makeTestGenParams("SrPablo"), auth, defs.Schedule{""}, defs.PublisherParams{}}, &msg), gocheck.NotNil)
+	c.Assert(eb.bots.names(), gocheck.DeepEquals, []string{"SrPablo_ebooks", "evenings", "mornings"})
+}
+
+// Serves an Ebooker over net/rpc in memory, the way the server does over HTTP.
+func makeTestRPCClient(eb *Ebooker) *rpc.Client {
+	server := rpc.NewServer()
+	server.Register(eb)
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	return rpc.NewClient(clientConn)
+}
+
+// Many clients at once creating, listing, cancelling and deleting bots, and
+// generating tweets. Meant for running under -race.
+func (s RPCSuite) TestConcurrentRPCs(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := makeTestRPCClient(eb)
+			defer client.Close()
+
+			name := fmt.Sprintf("bot%d", i)
+			args := defs.NewBotParams{name, makeTestGenParams("SrPablo", "laurelita"),
+				defs.AuthParams{fmt.Sprintf("account%d", i%3), "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+			genArgs := makeTestGenParams("SrPablo")
+			var msg string
+			var bots []string
+			var tweets defs.Tweets
+
+			errs <- client.Call("Ebooker.NewBot", &args, &msg)
+			errs <- client.Call("Ebooker.ListBots", "", &bots)
+			errs <- client.Call("Ebooker.GenerateTweets", &genArgs, &tweets)
+			client.Call("Ebooker.CancelBot", name, &msg)
+			client.Call("Ebooker.DeleteBot", name, &msg)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		c.Assert(err, gocheck.IsNil)
+	}
+	c.Assert(eb.bots.size(), gocheck.Equals, 0)
+}
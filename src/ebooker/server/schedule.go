@@ -2,11 +2,22 @@ package main
 
 /*
 File contains the functions meant to schedule tweets. We use the cron model
-for specifying when, and how often.
+for specifying when, and how often: five space-separated fields for the
+minute, hour, day of the month, month and day of the week, each of which is
+"*", a number, a range like "9-17", a list like "11,19", or any of those with
+a step like "0-30/10". As with cron, if both the day of the month and the day of
+the week are restricted, a day matching either will do.
+
+A Schedule ticks on its channel until it's killed. Killing cancels its context,
+which both the ticking goroutine and the bot listening to it watch, so it's
+safe to do from any goroutine, any number of times.
 */
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,19 +25,29 @@ const (
 	ALL = "*"
 )
 
+// What a bot gets if it's not told otherwise: twice a day, at 11:00 and 19:00.
+const DEFAULT_CRON = "0 11,19 * * *"
+
 const CHANNEL_BUFFER = 3
 
 type Schedule struct {
-	fireOff   chan time.Time
-	killOrder bool
+	fireOff chan time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
 
 	minute     string
 	hour       string
 	dayOfMonth string
 	month      string
 	dayOfWeek  string
+
+	// The fields above, parsed: bit n is set if n matches.
+	minutes, hours, days, months, weekdays uint64
 }
 
+// The range of values each field may take, in order.
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
 // Returns when the next Tick should be from now.
 func (s *Schedule) next() time.Duration {
 	return s.nextFromTime(time.Now())
@@ -34,39 +55,161 @@ func (s *Schedule) next() time.Duration {
 
 // Isolated for testing.
 func (s *Schedule) nextFromTime(t time.Time) time.Duration {
-	//		d, _ := time.ParseDuration("6s")
-	d, _ := time.ParseDuration("11h")
-	return d
+	return s.nextAfter(t).Sub(t)
+}
+
+// Finds the first minute after t that the schedule matches. We skip whole
+// months, days and hours that can't match, so this is quick even for sparse
+// schedules. Every valid schedule matches within a few years (Feb 29th being
+// the worst of it), so we stop looking after that.
+func (s *Schedule) nextAfter(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	limit := next.AddDate(5, 0, 0)
+	for next.Before(limit) {
+		switch {
+		case !has(s.months, int(next.Month())):
+			next = time.Date(next.Year(), next.Month()+1, 1, 0, 0, 0, 0, next.Location())
+		case !s.matchesDay(next):
+			next = time.Date(next.Year(), next.Month(), next.Day()+1, 0, 0, 0, 0, next.Location())
+		case !has(s.hours, next.Hour()):
+			// Not Truncate, which rounds absolute time: in zones half an
+			// hour off UTC that's half past on the clock.
+			next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour()+1, 0, 0, 0, next.Location())
+		case !has(s.minutes, next.Minute()):
+			next = next.Add(time.Minute)
+		default:
+			return next
+		}
+	}
+	return limit
+}
+
+// Cron's rule for days: if only one of the two day fields is restricted, it
+// decides; if both are, either will do.
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := has(s.days, t.Day())
+	dow := has(s.weekdays, int(t.Weekday()))
+	if s.dayOfMonth == ALL || s.dayOfWeek == ALL {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func has(set uint64, n int) bool {
+	return set&(1<<uint(n)) != 0
 }
 
 // start runs the schedule, having it send ticks at the times specified upon
-// creation.
+// creation, until the schedule is killed.
 func (s *Schedule) start() {
-	fmt.Println("Start called!")
-	duration := s.next()
-	c := time.After(duration)
+	timer := time.NewTimer(s.next())
+	defer timer.Stop()
 
 	for {
-		<-c
-		fmt.Println("Entered loop!")
-		if s.shouldKill() {
-			break
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-timer.C:
+			select {
+			case s.fireOff <- now:
+			case <-s.ctx.Done():
+				return
+			}
+			timer.Reset(s.next())
 		}
-		s.fireOff <- time.Now()
-		duration = s.next()
-		c = time.After(duration)
 	}
 }
 
-// We then calculate the difference between time.Now() and the next tick,
-// and set an After()
-func cronParse(s string) Schedule {
+// Creates a Schedule that doesn't tick on its own; ticks can be sent on its
+// channel by hand. The fields must be valid; see parseCron.
+func newSchedule(minute, hour, dayOfMonth, month, dayOfWeek string) *Schedule {
+	ctx, cancel := context.WithCancel(context.Background())
 	fireOff := make(chan time.Time, CHANNEL_BUFFER)
-	schedule := Schedule{fireOff, false, "0", "11,19", ALL, ALL, ALL}
+	s := &Schedule{fireOff: fireOff, ctx: ctx, cancel: cancel,
+		minute: minute, hour: hour, dayOfMonth: dayOfMonth, month: month, dayOfWeek: dayOfWeek}
+	s.minutes, _ = parseCronField(minute, cronBounds[0])
+	s.hours, _ = parseCronField(hour, cronBounds[1])
+	s.days, _ = parseCronField(dayOfMonth, cronBounds[2])
+	s.months, _ = parseCronField(month, cronBounds[3])
+	s.weekdays, _ = parseCronField(dayOfWeek, cronBounds[4])
+	return s
+}
+
+// Checks a cron-formatted string and makes a Schedule of it, without starting
+// it. The empty string means DEFAULT_CRON.
+func parseCron(cron string) (*Schedule, error) {
+	if strings.TrimSpace(cron) == "" {
+		cron = DEFAULT_CRON
+	}
+	fields := strings.Fields(cron)
+	if len(fields) != 5 {
+		return nil, errors.New("A schedule needs 5 fields (minute hour day-of-month month day-of-week), got \"" + cron + "\"")
+	}
+	for i, field := range fields {
+		if _, err := parseCronField(field, cronBounds[i]); err != nil {
+			return nil, err
+		}
+	}
+	return newSchedule(fields[0], fields[1], fields[2], fields[3], fields[4]), nil
+}
+
+// Parses the cron string and sets the Schedule ticking.
+func cronParse(cron string) (*Schedule, error) {
+	schedule, err := parseCron(cron)
+	if err != nil {
+		return nil, err
+	}
 
 	go schedule.start()
 
-	return schedule
+	return schedule, nil
+}
+
+// Parses one field of a cron string into the set of values it matches.
+func parseCronField(field string, bounds [2]int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		slash := strings.Index(part, "/")
+		if slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step < 1 {
+				return 0, errors.New("Bad step in schedule field \"" + field + "\"")
+			}
+			part = part[:slash]
+		}
+
+		low, high := bounds[0], bounds[1]
+		if part != ALL {
+			ends := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(ends[0]); err != nil {
+				return 0, errors.New("Bad value in schedule field \"" + field + "\"")
+			}
+			if len(ends) == 2 {
+				if high, err = strconv.Atoi(ends[1]); err != nil {
+					return 0, errors.New("Bad range in schedule field \"" + field + "\"")
+				}
+			} else if slash < 0 {
+				// a lone number; "5/10" on the other hand means from 5 on.
+				high = low
+			}
+		}
+		if low < bounds[0] || high > bounds[1] || low > high {
+			return 0, errors.New("Schedule field \"" + field + "\" is out of range")
+		}
+
+		for n := low; n <= high; n += step {
+			set |= 1 << uint(n)
+		}
+	}
+	return set, nil
+}
+
+// The cron string this Schedule was made from.
+func (s *Schedule) String() string {
+	return strings.Join([]string{s.minute, s.hour, s.dayOfMonth, s.month, s.dayOfWeek}, " ")
 }
 
 // TickingChannel returns the channel we 'tick' on whenever we need to send
@@ -75,11 +218,11 @@ func (s *Schedule) tickingChannel() chan time.Time {
 	return s.fireOff
 }
 
-func (s *Schedule) shouldKill() bool {
-	return s.killOrder
+// Closed once the schedule has been killed.
+func (s *Schedule) done() <-chan struct{} {
+	return s.ctx.Done()
 }
 
 func (s *Schedule) kill() {
-	s.killOrder = true
-	s.fireOff <- time.Now()
+	s.cancel()
 }
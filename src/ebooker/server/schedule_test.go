@@ -0,0 +1,71 @@
+package main
+
+import (
+	"launchpad.net/gocheck"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type ScheduleSuite struct{}
+
+var _ = gocheck.Suite(&ScheduleSuite{})
+
+type NextTest struct {
+	cron     string
+	from     string
+	expected string
+}
+
+func (s ScheduleSuite) TestNextAfter(c *gocheck.C) {
+	tests := []NextTest{
+		NextTest{DEFAULT_CRON, "2014-02-03 09:30", "2014-02-03 11:00"},
+		NextTest{DEFAULT_CRON, "2014-02-03 11:00", "2014-02-03 19:00"},
+		NextTest{DEFAULT_CRON, "2014-02-03 19:00", "2014-02-04 11:00"},
+		NextTest{"* * * * *", "2014-02-03 09:30", "2014-02-03 09:31"},
+		NextTest{"0-30/10 * * * *", "2014-02-03 09:25", "2014-02-03 09:30"},
+		NextTest{"0-30/10 * * * *", "2014-02-03 09:31", "2014-02-03 10:00"},
+		NextTest{"45/5 * * * *", "2014-02-03 09:31", "2014-02-03 09:45"},
+		NextTest{"30 8 * * 1-5", "2014-02-07 09:00", "2014-02-10 08:30"}, // Friday to Monday
+		NextTest{"0 0 1 * *", "2014-12-15 00:00", "2015-01-01 00:00"},
+		NextTest{"0 0 29 2 *", "2014-01-01 00:00", "2016-02-29 00:00"},
+		// both day fields restricted: the 13th, or any Friday.
+		NextTest{"0 12 13 * 5", "2014-02-03 00:00", "2014-02-07 12:00"},
+		NextTest{"0 12 13 * 5", "2014-02-08 00:00", "2014-02-13 12:00"},
+	}
+
+	for _, test := range tests {
+		sched, err := parseCron(test.cron)
+		c.Assert(err, gocheck.IsNil)
+		from, _ := time.Parse("2006-01-02 15:04", test.from)
+		expected, _ := time.Parse("2006-01-02 15:04", test.expected)
+		c.Check(sched.nextAfter(from), gocheck.Equals, expected, gocheck.Commentf("%s from %s", test.cron, test.from))
+		c.Check(sched.nextFromTime(from), gocheck.Equals, expected.Sub(from))
+	}
+}
+
+// Hours are the clock's, even where it's half an hour off UTC.
+func (s ScheduleSuite) TestNextAfterHalfHourZone(c *gocheck.C) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	sched, err := parseCron("0 11 * * *")
+	c.Assert(err, gocheck.IsNil)
+	from := time.Date(2014, 2, 3, 10, 15, 0, 0, kolkata)
+	c.Assert(sched.nextAfter(from).Equal(time.Date(2014, 2, 3, 11, 0, 0, 0, kolkata)), gocheck.Equals, true)
+	from = time.Date(2014, 2, 3, 11, 0, 0, 0, kolkata)
+	c.Assert(sched.nextAfter(from).Equal(time.Date(2014, 2, 4, 11, 0, 0, 0, kolkata)), gocheck.Equals, true)
+}
+
+func (s ScheduleSuite) TestParseCron(c *gocheck.C) {
+	sched, err := parseCron("")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sched.String(), gocheck.Equals, DEFAULT_CRON)
+
+	sched, err = parseCron("  5  4 * *   0 ")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(sched.String(), gocheck.Equals, "5 4 * * 0")
+
+	for _, bad := range []string{"* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 7", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-b * * * *"} {
+		_, err := parseCron(bad)
+		c.Check(err, gocheck.NotNil, gocheck.Commentf("%q", bad))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+/*
+Stopping the server cleanly. On SIGINT or SIGTERM we:
+
+  * stop accepting connections, and close the RPC ones, so no new RPCs come
+    in,
+  * refuse to make or start any more bots, and kill the ones we have,
+  * stop refreshing their corpora,
+  * wait (up to a deadline) for any bot that's mid-way through tweeting, and
+    any refresh that's under way, to finish,
+  * save the bots, and what state they're in, so they're started again next
+    time, and
+  * close the database.
+
+Bots are saved as they're made, changed and deleted too, so they'll be back
+even if we never got to shut down cleanly. Bringing them back, next time,
+happens in the background: their sources may need fetching, and we'd rather
+be answering clients meanwhile.
+*/
+
+import (
+	"ebooker/defs"
+
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Blocks until we're told to stop, then shuts everything down, waiting at most
+// timeout for it all to finish.
+func waitForShutdown(srv *http.Server, eb *Ebooker, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	signal.Stop(sigs)
+
+	eb.logger.StatusWrite("Received %v, shutting down...\n", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		eb.logger.StatusWrite("Couldn't close all connections: %v\n", err)
+	}
+	eb.shutdown(ctx)
+	eb.data.Cleanup()
+	eb.logger.StatusWrite("Goodbye!\n")
+}
+
+// Kills every bot, waits for them to finish what they're doing (or for ctx to
+// expire), and saves them all, paused, stopped or otherwise, so they can be
+// restored as they were. Returns false if we gave up waiting.
+func (eb *Ebooker) shutdown(ctx context.Context) bool {
+	// Once closing's set, no bot is added or started, so we have them all.
+	eb.lifecycle.Lock()
+	eb.closing.Store(true)
+	eb.lifecycle.Unlock()
+
+	var bots []*Bot
+	for _, name := range eb.bots.names() {
+		if bot, exists := eb.bots.get(name); exists {
+			bots = append(bots, bot)
+			bot.Kill()
+		}
+	}
+	eb.refresher.stop()
+
+	finished := make(chan struct{})
+	go func() {
+		eb.running.Wait()
+		close(finished)
+	}()
+
+	clean := true
+	select {
+	case <-finished:
+		eb.logger.StatusWrite("All bots stopped.\n")
+	case <-ctx.Done():
+		eb.logger.StatusWrite("Gave up waiting for bots to stop: %v\n", ctx.Err())
+		clean = false
+	}
+
+	eb.logger.StatusWrite("Saving %d bots.\n", len(bots))
+	for _, bot := range bots {
+		eb.data.saveBot(bot.record())
+	}
+	return clean
+}
+
+// Restores the bots in the background, keeping track of it so shutdown can
+// wait for it.
+func (eb *Ebooker) startRestoringBots() {
+	eb.running.Add(1)
+	go func() {
+		defer eb.running.Done()
+		eb.restoreBots()
+	}()
+}
+
+// Brings back the bots we had when we last shut down, in the state they were
+// in.
+func (eb *Ebooker) restoreBots() {
+	for _, record := range eb.data.loadBots() {
+		credentials := credentialKey(record.Publish.Kind, record.Account)
+		if _, exists := eb.data.getUserAccessToken(credentials); !exists && credentials != record.Account {
+			// Bots saved before publishers' credentials were kept apart.
+			if token, exists := eb.data.getUserAccessToken(record.Account); exists {
+				eb.data.insertUserAccessToken(credentials, token)
+			}
+		}
+		token, err := eb.getAccessToken(credentials)
+		if err != nil {
+			eb.logger.StatusWrite("Can't restore bot %s: %v\n", record.Name, err)
+			continue
+		}
+
+		state, err := parseBotState(record.State)
+		if err != nil {
+			eb.logger.StatusWrite("Bot %s: %v. Leaving it running.\n", record.Name, err)
+		}
+		auth := defs.AuthParams{record.Account, token.OAuthToken, token.OAuthTokenSecret}
+		args := defs.NewBotParams{record.Name, defs.GenParams{record.Sources, 0, record.Reps, record.PrefixLen, auth},
+			auth, defs.Schedule{record.Cron}, record.Publish}
+		var msg string
+		// Built in the state it was saved in, so it never runs, or is saved
+		// as running, if it wasn't.
+		if err := eb.createBot(&args, record.Owner, state, &msg); err != nil {
+			eb.logger.StatusWrite("Can't restore bot %s: %v\n", record.Name, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/oauth1"
+
+	"context"
+	"launchpad.net/gocheck"
+	"sync"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type ShutdownSuite struct{}
+
+var _ = gocheck.Suite(&ShutdownSuite{})
+
+// Starts a bot tweeting as name, from SrPablo's timeline.
+func startTestBot(eb *Ebooker, name string, c *gocheck.C) *Bot {
+	args := defs.NewBotParams{"", makeTestGenParams("SrPablo"),
+		defs.AuthParams{name, "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	bot, _ := eb.bots.get(name)
+	return bot
+}
+
+// Ticks the bot by hand, and waits for it to start on the tick.
+func tickAndWait(bot *Bot) {
+	bot.sched.fireOff <- time.Now()
+	for len(bot.sched.fireOff) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A bot in the middle of tweeting gets to finish before we call it a day, and
+// every bot is saved, along with its state.
+func (s ShutdownSuite) TestShutdownWaitsForBots(c *gocheck.C) {
+	ft := newFakeTwitter()
+	ft.posted = make(chan string) // so sendTweet blocks until we read it
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	busy := startTestBot(eb, "SrPablo_ebooks", c)
+	startTestBot(eb, "laurelita_ebooks", c)
+	cancelled := startTestBot(eb, "cancelled_ebooks", c)
+	c.Assert(cancelled.stop(), gocheck.IsNil)
+
+	tickAndWait(busy)
+	finished := make(chan bool)
+	go func() {
+		finished <- eb.shutdown(context.Background())
+	}()
+
+	select {
+	case <-finished:
+		c.Fatal("shutdown returned while a bot was still tweeting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-ft.posted
+	c.Assert(<-finished, gocheck.Equals, true)
+
+	saved := eb.data.loadBots()
+	c.Assert(len(saved), gocheck.Equals, 3)
+	c.Assert(saved[0], gocheck.DeepEquals, botRecord{"SrPablo_ebooks", "SrPablo_ebooks", []string{"SrPablo"}, 1, false, DEFAULT_CRON, "running", defs.PublisherParams{}, ""})
+	c.Assert(saved[1].State, gocheck.Equals, "stopped")
+	c.Assert(saved[2].Name, gocheck.Equals, "laurelita_ebooks")
+
+	// No new bots once we're shutting down.
+	args := defs.NewBotParams{"", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"late_ebooks", "token", "secret"}, defs.Schedule{""}, defs.PublisherParams{}}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.ErrorMatches, ".*shutting down.*")
+}
+
+// If a bot is stuck, we give up at the deadline, but still save it.
+func (s ShutdownSuite) TestShutdownDeadline(c *gocheck.C) {
+	ft := newFakeTwitter()
+	ft.posted = make(chan string)
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	bot := startTestBot(eb, "SrPablo_ebooks", c)
+	tickAndWait(bot)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Assert(eb.shutdown(ctx), gocheck.Equals, false)
+	c.Assert(len(eb.data.loadBots()), gocheck.Equals, 1)
+
+	<-ft.posted
+	eb.running.Wait()
+}
+
+// Bots saved at shutdown come back on the next start, with stored credentials,
+// in the state they were in.
+func (s ShutdownSuite) TestRestoreBots(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	eb.data.insertUserAccessToken("SrPablo_ebooks", &oauth1.Token{"token", "secret"})
+	for _, record := range []botRecord{{"SrPablo_ebooks", "SrPablo_ebooks", []string{"SrPablo", "laurelita"}, 2, true, "0 9 * * *", "running", defs.PublisherParams{}, "pablo"},
+		{"nobody_ebooks", "nobody_ebooks", []string{"SrPablo"}, 1, false, "", "running", defs.PublisherParams{}, ""},
+		{"paused_ebooks", "SrPablo_ebooks", []string{"SrPablo"}, 1, false, "", "paused", defs.PublisherParams{}, ""}} {
+		eb.data.saveBot(record)
+	}
+
+	eb.restoreBots()
+	defer eb.shutdown(context.Background())
+
+	// nobody_ebooks has no credentials, so it stays down.
+	c.Assert(eb.bots.names(), gocheck.DeepEquals, []string{"SrPablo_ebooks", "paused_ebooks"})
+	bot, _ := eb.bots.get("SrPablo_ebooks")
+	c.Assert(bot.record(), gocheck.DeepEquals, botRecord{"SrPablo_ebooks", "SrPablo_ebooks", []string{"SrPablo", "laurelita"}, 2, true, "0 9 * * *", "running", defs.PublisherParams{}, "pablo"})
+	paused, _ := eb.bots.get("paused_ebooks")
+	c.Assert(paused.currentState(), gocheck.Equals, BOT_PAUSED)
+	c.Assert(*bot.token, gocheck.Equals, oauth1.Token{"token", "secret"})
+
+	// nobody_ebooks is still saved, for when it has credentials.
+	saved := eb.data.loadBots()
+	c.Assert(len(saved), gocheck.Equals, 3)
+	c.Assert(saved[1].Name, gocheck.Equals, "nobody_ebooks")
+	c.Assert(saved[2].State, gocheck.Equals, "paused")
+}
+
+// Remembers the state of every bot saved, in order.
+type saveRecorder struct {
+	Datastore
+	lock   sync.Mutex
+	states []string
+}
+
+func (r *saveRecorder) saveBot(bot botRecord) {
+	r.lock.Lock()
+	r.states = append(r.states, bot.Name+" "+bot.State)
+	r.lock.Unlock()
+	r.Datastore.saveBot(bot)
+}
+
+// Paused and stopped bots come back that way from the start: they're never
+// run or saved as running along the way.
+func (s ShutdownSuite) TestRestoreInSavedState(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	recorder := &saveRecorder{Datastore: eb.data}
+	eb.data = recorder
+	eb.data.insertUserAccessToken("SrPablo_ebooks", &oauth1.Token{"token", "secret"})
+	eb.data.saveBot(botRecord{"paused_ebooks", "SrPablo_ebooks", []string{"SrPablo"}, 1, false, "", "paused", defs.PublisherParams{}, ""})
+	eb.data.saveBot(botRecord{"stopped_ebooks", "SrPablo_ebooks", []string{"SrPablo"}, 1, false, "", "stopped", defs.PublisherParams{}, ""})
+
+	eb.restoreBots()
+	defer eb.shutdown(context.Background())
+
+	c.Assert(recorder.states, gocheck.DeepEquals, []string{"paused_ebooks paused", "stopped_ebooks stopped", "paused_ebooks paused", "stopped_ebooks stopped"})
+	stopped, _ := eb.bots.get("stopped_ebooks")
+	c.Assert(stopped.currentState(), gocheck.Equals, BOT_STOPPED)
+
+	// Resuming it gives it a schedule that ticks.
+	var msg string
+	c.Assert(eb.ResumeBot("stopped_ebooks", &msg), gocheck.IsNil)
+	tickAndWait(stopped)
+	<-ft.posted
+}
+
+// Bots are saved as they're made, changed and deleted, not just when we shut
+// down cleanly.
+func (s ShutdownSuite) TestBotsSavedAsTheyChange(c *gocheck.C) {
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	defer eb.shutdown(context.Background())
+
+	startTestBot(eb, "SrPablo_ebooks", c)
+	startTestBot(eb, "laurelita_ebooks", c)
+	saved := eb.data.loadBots()
+	c.Assert(len(saved), gocheck.Equals, 2)
+	c.Assert(saved[0].State, gocheck.Equals, "running")
+
+	var msg string
+	c.Assert(eb.PauseBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(eb.data.loadBots()[0].State, gocheck.Equals, "paused")
+	c.Assert(eb.CancelBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(eb.data.loadBots()[0].State, gocheck.Equals, "stopped")
+	c.Assert(eb.SetBotSchedule(&defs.BotSchedule{"SrPablo_ebooks", defs.Schedule{"0 9 * * *"}}, &msg), gocheck.IsNil)
+	c.Assert(eb.data.loadBots()[0].Cron, gocheck.Equals, "0 9 * * *")
+	c.Assert(eb.ResumeBot("SrPablo_ebooks", &msg), gocheck.IsNil)
+	c.Assert(eb.data.loadBots()[0].State, gocheck.Equals, "running")
+
+	c.Assert(eb.DeleteBot("laurelita_ebooks", &msg), gocheck.IsNil)
+	saved = eb.data.loadBots()
+	c.Assert(len(saved), gocheck.Equals, 1)
+	c.Assert(saved[0].Name, gocheck.Equals, "SrPablo_ebooks")
+
+	// Once we're shutting down, bots stay as they are.
+	eb.shutdown(context.Background())
+	c.Assert(eb.DeleteBot("SrPablo_ebooks", &msg), gocheck.Equals, SHUTTING_DOWN)
+	c.Assert(len(eb.data.loadBots()), gocheck.Equals, 1)
+}
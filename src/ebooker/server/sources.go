@@ -0,0 +1,252 @@
+package main
+
+/*
+Where bots' corpora come from. A source is a Twitter user by default, or, with
+a namespace in front of its name, somewhere else: "mastodon:@user@instance" is
+that Mastodon account's public statuses, "feed:" and a URL an RSS or Atom
+feed (see feeds.go), and "file:" and any name text we've imported (see
+import.go), which is never fetched from anywhere.
+
+Every kind of source is fetched the same way as a Twitter timeline: a deep
+dive through its whole history the first time, then only what's newer than
+the newest thing we've stored. Mastodon's status IDs only ever go up, like
+Twitter's, so they're stored and compared as tweet IDs are.
+*/
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SourceFetcher gets the tweets (or statuses, or posts) of a source. Twitter
+// sources need an access token; others may ignore it. An error means we
+// couldn't fetch anything at all, not that there was nothing new.
+type SourceFetcher interface {
+	DeepDive(source string, accessToken *oauth1.Token) (Tweets, error)
+	GetRecentTimeline(source string, latest *TweetData, accessToken *oauth1.Token) (Tweets, error)
+}
+
+const MASTODON_SOURCE_PREFIX = "mastodon:"
+
+// Sources of text imported from files. There's nowhere to fetch them from.
+const FILE_SOURCE_PREFIX = "file:"
+
+// Relative to the Mastodon instance's URL.
+const (
+	MASTODON_LOOKUP_PATH   = "/api/v1/accounts/lookup"
+	MASTODON_ACCOUNTS_PATH = "/api/v1/accounts/"
+)
+
+// The most statuses Mastodon hands out per request.
+const MASTODON_PAGE_SIZE = 40
+
+// Sends each source to the fetcher for its kind, with its namespace stripped.
+type sourceFetchers struct {
+	twitter  SourceFetcher
+	mastodon *mastodonFetcher
+	feeds    *feedFetcher
+	files    fileFetcher
+}
+
+func newSourceFetchers(twitter SourceFetcher, data Datastore, client *http.Client, logger *logging.LogMaster) *sourceFetchers {
+	return &sourceFetchers{twitter, &mastodonFetcher{"https", client, logger}, &feedFetcher{client, data, logger}, fileFetcher{}}
+}
+
+func (s *sourceFetchers) fetcherFor(source string) (SourceFetcher, string) {
+	if strings.HasPrefix(source, MASTODON_SOURCE_PREFIX) {
+		return s.mastodon, strings.TrimPrefix(source, MASTODON_SOURCE_PREFIX)
+	}
+	if strings.HasPrefix(source, FEED_SOURCE_PREFIX) {
+		return s.feeds, strings.TrimPrefix(source, FEED_SOURCE_PREFIX)
+	}
+	if strings.HasPrefix(source, FILE_SOURCE_PREFIX) {
+		return s.files, strings.TrimPrefix(source, FILE_SOURCE_PREFIX)
+	}
+	return s.twitter, source
+}
+
+// Whether the source is a Twitter user's, and so needs an access token.
+func isTwitterSource(source string) bool {
+	for _, prefix := range []string{MASTODON_SOURCE_PREFIX, FEED_SOURCE_PREFIX, FILE_SOURCE_PREFIX} {
+		if strings.HasPrefix(source, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *sourceFetchers) DeepDive(source string, accessToken *oauth1.Token) (Tweets, error) {
+	fetcher, name := s.fetcherFor(source)
+	return fetcher.DeepDive(name, accessToken)
+}
+
+func (s *sourceFetchers) GetRecentTimeline(source string, latest *TweetData, accessToken *oauth1.Token) (Tweets, error) {
+	fetcher, name := s.fetcherFor(source)
+	return fetcher.GetRecentTimeline(name, latest, accessToken)
+}
+
+// Imported text has nothing new, ever: what we have is all there is.
+type fileFetcher struct{}
+
+func (fileFetcher) DeepDive(source string, accessToken *oauth1.Token) (Tweets, error) {
+	return nil, nil
+}
+
+func (fileFetcher) GetRecentTimeline(source string, latest *TweetData, accessToken *oauth1.Token) (Tweets, error) {
+	return nil, nil
+}
+
+// Fetches Mastodon accounts' public statuses, without boosts. Accounts are
+// named "@user@instance", and the instance is reached over scheme.
+type mastodonFetcher struct {
+	scheme string
+	client *http.Client
+	logger *logging.LogMaster
+}
+
+// What we need of a Mastodon status. Reblog is set for boosts.
+type mastodonStatus struct {
+	Id      string           `json:"id"`
+	Content string           `json:"content"`
+	Reblog  *json.RawMessage `json:"reblog"`
+}
+
+func (m *mastodonFetcher) DeepDive(account string, _ *oauth1.Token) (Tweets, error) {
+	m.logger.StatusWrite("Doing a deep dive on Mastodon!\n")
+	return m.statuses(account, 0)
+}
+
+func (m *mastodonFetcher) GetRecentTimeline(account string, latest *TweetData, _ *oauth1.Token) (Tweets, error) {
+	return m.statuses(account, latest.Id)
+}
+
+// Pages back through the account's statuses with max_id, from the newest to
+// just after sinceId (or the first, if it's 0). Unlike Twitter, Mastodon
+// gives us the newest page after since_id rather than the oldest, so we page
+// even when catching up. If a page after the first fails, we keep what we
+// got.
+func (m *mastodonFetcher) statuses(account string, sinceId uint64) (Tweets, error) {
+	user, instance, err := parseMastodonAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	base := m.scheme + "://" + instance
+
+	var id struct {
+		Id string `json:"id"`
+	}
+	if err := m.get(base+MASTODON_LOOKUP_PATH, url.Values{"acct": {user}}, &id); err != nil {
+		return nil, fmt.Errorf("Couldn't look up %s: %v", account, err)
+	}
+
+	endpoint := base + MASTODON_ACCOUNTS_PATH + url.PathEscape(id.Id) + "/statuses"
+	params := url.Values{
+		"limit":           {strconv.Itoa(MASTODON_PAGE_SIZE)},
+		"exclude_reblogs": {"true"}}
+	if sinceId > 0 {
+		params.Set("since_id", strconv.FormatUint(sinceId, 10))
+	}
+
+	tweets := Tweets{}
+	var maxId uint64
+	for {
+		var page []mastodonStatus
+		if err := m.get(endpoint, params, &page); err != nil {
+			if maxId == 0 {
+				return nil, fmt.Errorf("Couldn't fetch %s's statuses: %v", account, err)
+			}
+			m.logger.Warn("Couldn't fetch the rest of the Mastodon account's statuses.", logging.Field{"account", account}, logging.Field{"error", err})
+			break
+		}
+		if len(page) == 0 {
+			break
+		}
+
+		// Guard against looping forever if max_id is ignored.
+		oldestId, _ := strconv.ParseUint(page[len(page)-1].Id, 10, 64)
+		if maxId != 0 && oldestId >= maxId {
+			break
+		}
+		for _, status := range page {
+			statusId, err := strconv.ParseUint(status.Id, 10, 64)
+			text := stripHTML(status.Content)
+			if err != nil || status.Reblog != nil || text == "" || statusId <= sinceId {
+				continue
+			}
+			tweets = append(tweets, TweetData{statusId, text})
+		}
+		if len(tweets) > 0 && sinceId == 0 {
+			m.logger.StatusWrite("Statuses have grown to %d\n", tweets.Len())
+		}
+
+		// max_id is exclusive on Mastodon.
+		maxId = oldestId
+		params.Set("max_id", strconv.FormatUint(maxId, 10))
+	}
+	return tweets, nil
+}
+
+// GETs the endpoint, and decodes its JSON into out.
+func (m *mastodonFetcher) get(endpoint string, params url.Values, out interface{}) error {
+	resp, err := m.client.Get(endpoint + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	countRateLimit("mastodon", resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Mastodon said %s", resp.Status)
+	}
+	return json.Unmarshal(body, out)
+}
+
+// Splits "@user@instance" into its user and instance.
+func parseMastodonAccount(account string) (string, string, error) {
+	trimmed := strings.TrimPrefix(account, "@")
+	at := strings.Index(trimmed, "@")
+	if at <= 0 || at == len(trimmed)-1 {
+		return "", "", errors.New("Mastodon sources look like " + MASTODON_SOURCE_PREFIX + "@user@instance, not " +
+			MASTODON_SOURCE_PREFIX + account + ".")
+	}
+	return trimmed[:at], trimmed[at+1:], nil
+}
+
+// Mastodon hands us statuses as HTML, as most feeds do their entries. We keep
+// only the text, with paragraphs and line breaks as spaces. Links come through whole; Mastodon hides parts
+// of them in invisible spans, but the text of all the spans is the URL.
+func stripHTML(content string) string {
+	var text strings.Builder
+	for {
+		start := strings.IndexByte(content, '<')
+		if start < 0 {
+			text.WriteString(content)
+			break
+		}
+		text.WriteString(content[:start])
+		end := strings.IndexByte(content[start:], '>')
+		if end < 0 {
+			break
+		}
+		tag := strings.ToLower(strings.Trim(content[start+1:start+end], "/ "))
+		if tag == "p" || strings.HasPrefix(tag, "p ") || tag == "br" || strings.HasPrefix(tag, "br ") {
+			text.WriteString(" ")
+		}
+		content = content[start+end+1:]
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(text.String())), " ")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"encoding/json"
+	"launchpad.net/gocheck"
+	"strconv"
+)
+
+// hook up gocheck into the gotest runner.
+type SourcesSuite struct{}
+
+var _ = gocheck.Suite(&SourcesSuite{})
+
+// The Mastodon fetcher the Ebooker's refresher uses, pointed at the fake.
+func testMastodonFetcher(eb *Ebooker) *mastodonFetcher {
+	fetcher := eb.refresher.fetcher.(*sourceFetchers).mastodon
+	fetcher.scheme = "http"
+	return fetcher
+}
+
+func (s SourcesSuite) TestStripHTML(c *gocheck.C) {
+	tests := []struct{ content, text string }{
+		{"<p>today is a great day</p>", "today is a great day"},
+		{"<p>first</p><p>second<br>third<br />fourth</p>", "first second third fourth"},
+		{`<p><span class="h-card"><a href="https://mastodon.social/@laurelita" class="u-url mention">@<span>laurelita</span></a></span> fish &amp; chips</p>`,
+			"@laurelita fish & chips"},
+		{`<p>see <a href="https://example.com/a/long/path"><span class="invisible">https://</span><span class="ellipsis">example.com/a/lo</span><span class="invisible">ng/path</span></a></p>`,
+			"see https://example.com/a/long/path"},
+		{"<pre>a&lt;b</pre>", "a<b"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		c.Assert(stripHTML(test.content), gocheck.Equals, test.text)
+	}
+}
+
+func (s SourcesSuite) TestParseMastodonAccount(c *gocheck.C) {
+	user, instance, err := parseMastodonAccount("@SrPablo@mastodon.social")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(user, gocheck.Equals, "SrPablo")
+	c.Assert(instance, gocheck.Equals, "mastodon.social")
+
+	user, instance, err = parseMastodonAccount("laurelita@127.0.0.1:3000")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(user, gocheck.Equals, "laurelita")
+	c.Assert(instance, gocheck.Equals, "127.0.0.1:3000")
+
+	for _, account := range []string{"", "SrPablo", "@SrPablo", "@@mastodon.social", "@SrPablo@"} {
+		_, _, err = parseMastodonAccount(account)
+		c.Assert(err, gocheck.NotNil)
+	}
+}
+
+// Deep dives page back through everything, and refreshes only pick up
+// what's new; neither keeps boosts, or statuses with no text.
+func (s SourcesSuite) TestMastodonFetch(c *gocheck.C) {
+	fm := newFakeMastodon("mastotoken")
+	defer fm.server.Close()
+	logger := logging.GetLogMaster(true, false, false)
+	fetcher := &mastodonFetcher{"http", fm.server.Client(), &logger}
+	boost := json.RawMessage(`{"id":"1"}`)
+
+	for i := 1; i <= MASTODON_PAGE_SIZE+5; i++ {
+		fm.toot("SrPablo", mastodonStatus{strconv.Itoa(100 + i), "<p>toot number " + strconv.Itoa(i) + "</p>", nil})
+	}
+	fm.toot("SrPablo", mastodonStatus{"200", "<p>boosted</p>", &boost}, mastodonStatus{"201", `<p><img src="cat.png"></p>`, nil})
+	account := fm.source("SrPablo")[len(MASTODON_SOURCE_PREFIX):]
+
+	tweets, err := fetcher.DeepDive(account, &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tweets.Len(), gocheck.Equals, MASTODON_PAGE_SIZE+5)
+	c.Assert(tweets[0], gocheck.Equals, TweetData{145, "toot number 45"})
+	c.Assert(tweets[tweets.Len()-1], gocheck.Equals, TweetData{101, "toot number 1"})
+
+	fm.toot("SrPablo", mastodonStatus{"202", "<p>today is a strange day</p>", nil})
+	tweets, err = fetcher.GetRecentTimeline(account, &TweetData{145, "toot number 45"}, &oauth1.Token{})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tweets, gocheck.DeepEquals, Tweets{{202, "today is a strange day"}})
+
+	_, err = fetcher.DeepDive("@nobody@"+account[len("@SrPablo@"):], &oauth1.Token{})
+	c.Assert(err, gocheck.ErrorMatches, "Couldn't look up @nobody@.*: Mastodon said 404 Not Found")
+	_, err = fetcher.DeepDive("not an account", &oauth1.Token{})
+	c.Assert(err, gocheck.ErrorMatches, "Mastodon sources look like .*")
+}
+
+// Mastodon sources are stored under their namespaced name, next to Twitter
+// ones, and bots can learn from both.
+func (s SourcesSuite) TestMastodonSource(c *gocheck.C) {
+	fm := newFakeMastodon("mastotoken")
+	defer fm.server.Close()
+	fm.toot("laurelita", mastodonStatus{"103704874086360371", "<p>tomorrow is a better day</p>", nil})
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+	testMastodonFetcher(eb)
+
+	gen := CreateGenerator(1, 140, eb.logger)
+	c.Assert(eb.refresher.subscribe(gen, []string{"SrPablo", fm.source("laurelita")}, &oauth1.Token{}), gocheck.Equals, 3)
+	c.Assert(eb.data.GetTweetsFromStorage(fm.source("laurelita")), gocheck.DeepEquals,
+		Tweets{{103704874086360371, "tomorrow is a better day"}})
+	c.Assert(len(eb.data.GetTweetsFromStorage("laurelita")), gocheck.Equals, 0)
+
+	fm.toot("laurelita", mastodonStatus{"103704874086360372", "<p>tomorrow is a worse day</p>", nil})
+	eb.refresher.refreshAll()
+	status := eb.refresher.status()[1]
+	c.Assert(status.User, gocheck.Equals, fm.source("laurelita"))
+	c.Assert(status.Total, gocheck.Equals, 2)
+	c.Assert(status.LastFetched, gocheck.Equals, 1)
+}
+
+// Imported text is only ever what we imported: Twitter's never asked for it.
+func (s SourcesSuite) TestFileSource(c *gocheck.C) {
+	ft := newFakeTwitter()
+	ft.tweet("ishmael", TweetData{1, "today is a great day"})
+	ft.tweet("file:ishmael", TweetData{2, "today is a fine day"})
+	eb := makeTestEbooker(ft)
+	eb.data.InsertFreshTweets("file:ishmael", Tweets{{0, "Call me Ishmael."}})
+
+	gen := CreateGenerator(1, 140, eb.logger)
+	c.Assert(eb.refresher.subscribe(gen, []string{"file:ishmael"}, nil), gocheck.Equals, 1)
+	eb.refresher.refreshAll()
+	c.Assert(eb.data.GetTweetsFromStorage("file:ishmael"), gocheck.DeepEquals, Tweets{{0, "Call me Ishmael."}})
+	c.Assert(isTwitterSource("file:ishmael"), gocheck.Equals, false)
+}
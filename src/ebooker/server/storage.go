@@ -2,7 +2,8 @@ package main
 
 /*
 Contains functions + data structures for persistent data storage. Currently
-using sqlite3.
+using sqlite3. Access tokens are encrypted before they reach the database; see
+tokencrypt.go.
 */
 
 import (
@@ -12,13 +13,40 @@ import (
 	"ebooker/oauth1"
 
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Datastore is everything the server asks of persistent storage. DataHandle
+// backs it with sqlite; memoryDataHandle keeps it all in memory, for tests.
+type Datastore interface {
+	GetTweetsFromStorage(username string) Tweets
+	InsertFreshTweets(username string, newTweets Tweets)
+	getUserAccessToken(username string) (*oauth1.Token, bool)
+	insertUserAccessToken(username string, token *oauth1.Token)
+	saveBot(bot botRecord)
+	deleteBot(name string)
+	loadBots() []botRecord
+	recordPost(post postRecord)
+	loadPosts(bot string) []postRecord
+	seenFeedItems(feed string) map[string]bool
+	markFeedItemsSeen(feed string, guids []string)
+	insertAPIKey(key apiKey) error
+	getAPIKey(hash string) (*apiKey, bool)
+	deleteAPIKey(name string) bool
+	loadAPIKeys() []apiKey
+	ping() error
+	Cleanup()
+}
+
 // Top-level object that maintains the database connection.
 type DataHandle struct {
 	handle *sql.DB
+	cipher *tokenCipher
 	logger *logging.LogMaster
 }
 
@@ -28,12 +56,18 @@ func (dh DataHandle) Cleanup() {
 	dh.handle.Close()
 }
 
+// Makes sure we can still read the database, for the health checks.
+func (dh DataHandle) ping() error {
+	var tables int
+	return dh.handle.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
+}
+
 // Ensures we've got a valid instance of the database, and if not, creates one
 // with the appropriate tables.
-func getDataHandle(filename string, logger *logging.LogMaster) DataHandle {
+func getDataHandle(filename string, tc *tokenCipher, logger *logging.LogMaster) DataHandle {
 
 	db, err := sql.Open("sqlite3", filename)
-	handle := DataHandle{db, logger}
+	handle := DataHandle{db, tc, logger}
 	if err != nil {
 		logger.StatusWrite("sql.Open returned non-nil error!\n")
 		logger.DebugWrite("sql.Open returned error: %v\n", err)
@@ -41,10 +75,26 @@ func getDataHandle(filename string, logger *logging.LogMaster) DataHandle {
 	}
 
 	sqls := []string{"CREATE TABLE Tweets (Id TEXT NOT NULL, Screen_Name TEXT NOT NULL, Content TEXT NOT NULL)",
-		"CREATE TABLE TwitterUsers (Screen_Name TEXT NOT NULL, Token TEXT NOT NULL, Token_Secret TEXT NOT NULL)"}
+		"CREATE TABLE TwitterUsers (Screen_Name TEXT NOT NULL, Token TEXT NOT NULL, Token_Secret TEXT NOT NULL)",
+		"CREATE TABLE Bots (Name TEXT NOT NULL, Account TEXT NOT NULL, Sources TEXT NOT NULL, Prefix_Len INTEGER NOT NULL, Reps INTEGER NOT NULL, Cron TEXT NOT NULL, State TEXT NOT NULL, Publisher TEXT NOT NULL, Owner TEXT NOT NULL)",
+		"CREATE TABLE Posts (Bot TEXT NOT NULL, Account TEXT NOT NULL, Content TEXT NOT NULL, Posted_At INTEGER NOT NULL)",
+		"CREATE TABLE FeedItems (Feed TEXT NOT NULL, Guid TEXT NOT NULL)",
+		"CREATE TABLE ApiKeys (Name TEXT NOT NULL UNIQUE, Hash TEXT NOT NULL UNIQUE, Scopes TEXT NOT NULL, Created INTEGER NOT NULL)",
+		// Bots tables from before bots could be paused or stopped.
+		"ALTER TABLE Bots ADD COLUMN State TEXT NOT NULL DEFAULT 'running'",
+		// ...and from before a bot's name could differ from its account's.
+		"ALTER TABLE Bots ADD COLUMN Account TEXT NOT NULL DEFAULT ''",
+		// ...and from before bots could post anywhere but Twitter.
+		"ALTER TABLE Bots ADD COLUMN Publisher TEXT NOT NULL DEFAULT ''",
+		// ...and from before bots belonged to API keys.
+		"ALTER TABLE Bots ADD COLUMN Owner TEXT NOT NULL DEFAULT ''",
+		// Signing in again used to add another token rather than replace the
+		// one we had; the newest is the one to keep.
+		"DELETE FROM TwitterUsers WHERE rowid NOT IN (SELECT MAX(rowid) FROM TwitterUsers GROUP BY Screen_Name)",
+		"CREATE UNIQUE INDEX TwitterUsersByName ON TwitterUsers (Screen_Name)"}
 	for _, sql := range sqls {
 		_, err = db.Exec(sql)
-		if err != nil && err.Error() != "table Tweets already exists" && err.Error() != "table TwitterUsers already exists" {
+		if err != nil && !strings.HasSuffix(err.Error(), "already exists") && !strings.HasPrefix(err.Error(), "duplicate column name") {
 			logger.StatusWrite("sql.Exec returned unexpected error on DataHandle Aquisition.\n")
 			logger.DebugWrite("Error: %v\n", err)
 		}
@@ -62,7 +112,7 @@ func (dh DataHandle) GetTweetsFromStorage(username string) Tweets {
 	rows, err := db.Query(queryStr, username)
 	if err != nil {
 		dh.logger.StatusWrite("Unexpected error on query to datastore\n")
-		dh.logger.DebugWrite("Error was %v\n", queryStr, username, err)
+		dh.logger.DebugWrite("Error was %v, querying %s on %s\n", err, queryStr, username)
 		return Tweets{}
 	}
 	defer rows.Close()
@@ -120,12 +170,12 @@ func (dh DataHandle) InsertFreshTweets(username string, newTweets Tweets) {
 func (dh DataHandle) getUserAccessToken(username string) (*oauth1.Token, bool) {
 	db := dh.handle
 
-	queryStr := "SELECT Token, Token_Secret FROM TwitterUsers WHERE Screen_name = ?"
+	queryStr := "SELECT Token, Token_Secret FROM TwitterUsers WHERE Screen_name = ? ORDER BY rowid"
 
 	rows, err := db.Query(queryStr, username)
 	if err != nil {
 		dh.logger.StatusWrite("Unexpected error on query to datastore\n")
-		dh.logger.DebugWrite("Error was %v\n", queryStr, username, err)
+		dh.logger.DebugWrite("Error was %v, querying %s on %s\n", err, queryStr, username)
 		return nil, false
 	}
 	defer rows.Close()
@@ -140,12 +190,38 @@ func (dh DataHandle) getUserAccessToken(username string) (*oauth1.Token, bool) {
 	if length == 0 {
 		return nil, false
 	}
+
+	token, err = dh.cipher.decrypt(token, username, "Token")
+	if err == nil {
+		tokenSecret, err = dh.cipher.decrypt(tokenSecret, username, "Token_Secret")
+	}
+	if err != nil {
+		dh.logger.StatusWrite("Couldn't decrypt the access token for %s. Wrong master key?\n", username)
+		dh.logger.DebugWrite("Error was %v\n", err)
+		return nil, false
+	}
+
+	dh.logger.Redact(token, tokenSecret)
 	return &oauth1.Token{token, tokenSecret}, true
 }
 
-// Inserts tweets into persistent storage.
+// Inserts an access token into persistent storage, encrypted, in place of
+// any we had for the user.
 func (dh DataHandle) insertUserAccessToken(username string, token *oauth1.Token) {
 	db := dh.handle
+	dh.logger.Redact(token.OAuthToken, token.OAuthTokenSecret)
+
+	sealedToken, err := dh.cipher.encrypt(token.OAuthToken, username, "Token")
+	if err == nil {
+		var sealedSecret string
+		sealedSecret, err = dh.cipher.encrypt(token.OAuthTokenSecret, username, "Token_Secret")
+		token = &oauth1.Token{sealedToken, sealedSecret}
+	}
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected Error encrypting the access token for %s.\n", username)
+		dh.logger.DebugWrite("Error is %v\n", err)
+		return
+	}
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -154,7 +230,7 @@ func (dh DataHandle) insertUserAccessToken(username string, token *oauth1.Token)
 		return
 	}
 
-	insertStr := "INSERT INTO TwitterUsers (Screen_name, Token, Token_Secret) VALUES (?, ?, ?)"
+	insertStr := "INSERT OR REPLACE INTO TwitterUsers (Screen_name, Token, Token_Secret) VALUES (?, ?, ?)"
 
 	stmt, err := tx.Prepare(insertStr)
 	if err != nil {
@@ -172,3 +248,337 @@ func (dh DataHandle) insertUserAccessToken(username string, token *oauth1.Token)
 	}
 	tx.Commit()
 }
+
+// Saves the bot, in place of any we'd saved by its name. Where it posts is
+// sealed like an access token: a webhook's URL is as good as a password to it,
+// and its headers may carry more.
+func (dh DataHandle) saveBot(bot botRecord) {
+	// Sources are JSON too, as feed URLs can have commas in them.
+	sources, err := json.Marshal(bot.Sources)
+	var publisher string
+	if err == nil {
+		var encoded []byte
+		if encoded, err = json.Marshal(bot.Publish); err == nil {
+			publisher, err = dh.cipher.encrypt(string(encoded), bot.Name, "Publisher")
+		}
+	}
+	if err != nil {
+		dh.logger.StatusWrite("Couldn't save where bot %s posts.\n", bot.Name)
+		dh.logger.DebugWrite("Error is %v\n", err)
+		return
+	}
+	tx, err := dh.handle.Begin()
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected Error in Aquiring a Transaction to save a bot.\n")
+		dh.logger.DebugWrite("Error is %v\n", err)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM Bots WHERE Name = ?", bot.Name)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO Bots (Name, Account, Sources, Prefix_Len, Reps, Cron, State, Publisher, Owner) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			bot.Name, bot.Account, string(sources), bot.PrefixLen, bot.Reps, bot.Cron, bot.State, publisher, bot.Owner)
+	}
+	if err != nil {
+		tx.Rollback()
+		dh.logger.StatusWrite("Unexpected Error saving bot %s.\n", bot.Name)
+		dh.logger.DebugWrite("Error is %v\n", err)
+		return
+	}
+	tx.Commit()
+}
+
+// Forgets the saved bot by this name, if there is one.
+func (dh DataHandle) deleteBot(name string) {
+	if _, err := dh.handle.Exec("DELETE FROM Bots WHERE Name = ?", name); err != nil {
+		dh.logger.StatusWrite("Unexpected Error deleting bot %s.\n", name)
+		dh.logger.DebugWrite("Error is %v\n", err)
+	}
+}
+
+// Retrieves the bots we've saved, by name.
+func (dh DataHandle) loadBots() []botRecord {
+	rows, err := dh.handle.Query("SELECT Name, Account, Sources, Prefix_Len, Reps, Cron, State, Publisher, Owner FROM Bots ORDER BY Name")
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected error on query to datastore\n")
+		dh.logger.DebugWrite("Error was %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var bots []botRecord
+	for rows.Next() {
+		var bot botRecord
+		var sources, publisher string
+		if err := rows.Scan(&bot.Name, &bot.Account, &sources, &bot.PrefixLen, &bot.Reps, &bot.Cron, &bot.State, &publisher, &bot.Owner); err != nil {
+			dh.logger.StatusWrite("Couldn't read a saved bot.\n")
+			dh.logger.DebugWrite("Error was %v\n", err)
+			continue
+		}
+		// Bots saved before sources were JSON had them joined with commas.
+		if strings.HasPrefix(sources, "[") {
+			if err := json.Unmarshal([]byte(sources), &bot.Sources); err != nil {
+				dh.logger.StatusWrite("Couldn't read what bot %s learns from.\n", bot.Name)
+				dh.logger.DebugWrite("Error was %v\n", err)
+				continue
+			}
+		} else {
+			bot.Sources = strings.Split(sources, ",")
+		}
+		if bot.Account == "" {
+			bot.Account = bot.Name
+		}
+		// Bots saved before there were publishers posted to Twitter.
+		if publisher != "" {
+			publisher, err := dh.cipher.decrypt(publisher, bot.Name, "Publisher")
+			if err == nil {
+				err = json.Unmarshal([]byte(publisher), &bot.Publish)
+			}
+			if err != nil {
+				dh.logger.StatusWrite("Couldn't read where bot %s posts.\n", bot.Name)
+				dh.logger.DebugWrite("Error was %v\n", err)
+				continue
+			}
+		}
+		bots = append(bots, bot)
+	}
+	return bots
+}
+
+// Remembers that a bot posted something.
+func (dh DataHandle) recordPost(post postRecord) {
+	_, err := dh.handle.Exec("INSERT INTO Posts (Bot, Account, Content, Posted_At) VALUES (?, ?, ?, ?)",
+		post.Bot, post.Account, post.Text, post.Posted.UnixNano())
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected Error recording a post.\n")
+		dh.logger.DebugWrite("Error is %v\n", err)
+	}
+}
+
+// Retrieves everything the bot has posted, oldest first.
+func (dh DataHandle) loadPosts(bot string) []postRecord {
+	rows, err := dh.handle.Query("SELECT Bot, Account, Content, Posted_At FROM Posts WHERE Bot = ? ORDER BY Posted_At", bot)
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected error on query to datastore\n")
+		dh.logger.DebugWrite("Error was %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var posts []postRecord
+	for rows.Next() {
+		var post postRecord
+		var posted int64
+		if err := rows.Scan(&post.Bot, &post.Account, &post.Text, &posted); err != nil {
+			dh.logger.StatusWrite("Couldn't read a post.\n")
+			dh.logger.DebugWrite("Error was %v\n", err)
+			continue
+		}
+		post.Posted = time.Unix(0, posted)
+		posts = append(posts, post)
+	}
+	return posts
+}
+
+// Retrieves the GUIDs of the feed's entries we've already read.
+func (dh DataHandle) seenFeedItems(feed string) map[string]bool {
+	seen := make(map[string]bool)
+	rows, err := dh.handle.Query("SELECT Guid FROM FeedItems WHERE Feed = ?", feed)
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected error on query to datastore\n")
+		dh.logger.DebugWrite("Error was %v\n", err)
+		return seen
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var guid string
+		if err := rows.Scan(&guid); err != nil {
+			dh.logger.StatusWrite("Couldn't read a feed entry's GUID.\n")
+			dh.logger.DebugWrite("Error was %v\n", err)
+			continue
+		}
+		seen[guid] = true
+	}
+	return seen
+}
+
+// Remembers that we've read these entries of the feed.
+func (dh DataHandle) markFeedItemsSeen(feed string, guids []string) {
+	for _, guid := range guids {
+		_, err := dh.handle.Exec("INSERT INTO FeedItems (Feed, Guid) VALUES (?, ?)", feed, guid)
+		if err != nil {
+			dh.logger.StatusWrite("Unexpected Error remembering a feed entry.\n")
+			dh.logger.DebugWrite("Error is %v\n", err)
+		}
+	}
+}
+
+// Stores an API key's hash, under its name. Names are unique.
+func (dh DataHandle) insertAPIKey(key apiKey) error {
+	_, err := dh.handle.Exec("INSERT INTO ApiKeys (Name, Hash, Scopes, Created) VALUES (?, ?, ?, ?)",
+		key.Name, key.Hash, strings.Join(key.Scopes, ","), key.Created.UnixNano())
+	if err != nil && strings.HasPrefix(err.Error(), "UNIQUE constraint failed") {
+		return errors.New("There's already an API key named " + key.Name + ".")
+	}
+	return err
+}
+
+// Retrieves the API key with this hash, if there is one.
+func (dh DataHandle) getAPIKey(hash string) (*apiKey, bool) {
+	keys := dh.queryAPIKeys("SELECT Name, Hash, Scopes, Created FROM ApiKeys WHERE Hash = ?", hash)
+	if len(keys) == 0 {
+		return nil, false
+	}
+	return &keys[0], true
+}
+
+// Forgets the API key with this name. Returns whether there was one.
+func (dh DataHandle) deleteAPIKey(name string) bool {
+	result, err := dh.handle.Exec("DELETE FROM ApiKeys WHERE Name = ?", name)
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected Error deleting an API key.\n")
+		dh.logger.DebugWrite("Error is %v\n", err)
+		return false
+	}
+	deleted, _ := result.RowsAffected()
+	return deleted > 0
+}
+
+// Retrieves every API key, by name.
+func (dh DataHandle) loadAPIKeys() []apiKey {
+	return dh.queryAPIKeys("SELECT Name, Hash, Scopes, Created FROM ApiKeys ORDER BY Name")
+}
+
+func (dh DataHandle) queryAPIKeys(query string, args ...interface{}) []apiKey {
+	rows, err := dh.handle.Query(query, args...)
+	if err != nil {
+		dh.logger.StatusWrite("Unexpected error on query to datastore\n")
+		dh.logger.DebugWrite("Error was %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var keys []apiKey
+	for rows.Next() {
+		var key apiKey
+		var scopes string
+		var created int64
+		if err := rows.Scan(&key.Name, &key.Hash, &scopes, &created); err != nil {
+			dh.logger.StatusWrite("Couldn't read an API key.\n")
+			dh.logger.DebugWrite("Error was %v\n", err)
+			continue
+		}
+		key.Scopes = strings.Split(scopes, ",")
+		key.Created = time.Unix(0, created)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Re-encrypts every stored access token, and where every saved bot posts,
+// under a new master key, in a single transaction: either every row moves to
+// the new key or none do. Rows written before encryption was introduced are
+// encrypted for the first time. Returns the number of rows re-encrypted.
+func (dh DataHandle) rotateMasterKey(newCipher *tokenCipher) (int, error) {
+	tx, err := dh.handle.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query("SELECT rowid, Screen_Name, Token, Token_Secret FROM TwitterUsers")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	type sealedRow struct {
+		rowid              int64
+		token, tokenSecret string
+	}
+	var resealed []sealedRow
+	for rows.Next() {
+		var rowid int64
+		var username, token, tokenSecret string
+		if err = rows.Scan(&rowid, &username, &token, &tokenSecret); err != nil {
+			break
+		}
+		if token, err = dh.cipher.decrypt(token, username, "Token"); err != nil {
+			break
+		}
+		if tokenSecret, err = dh.cipher.decrypt(tokenSecret, username, "Token_Secret"); err != nil {
+			break
+		}
+		if token, err = newCipher.encrypt(token, username, "Token"); err != nil {
+			break
+		}
+		if tokenSecret, err = newCipher.encrypt(tokenSecret, username, "Token_Secret"); err != nil {
+			break
+		}
+		resealed = append(resealed, sealedRow{rowid, token, tokenSecret})
+	}
+	rows.Close()
+	if err != nil {
+		tx.Rollback()
+		return 0, errors.New("couldn't re-encrypt access tokens, is the current master key right? " + err.Error())
+	}
+
+	for _, row := range resealed {
+		_, err = tx.Exec("UPDATE TwitterUsers SET Token = ?, Token_Secret = ? WHERE rowid = ?", row.token, row.tokenSecret, row.rowid)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	bots, err := resealPublishers(tx, dh.cipher, newCipher)
+	if err != nil {
+		tx.Rollback()
+		return 0, errors.New("couldn't re-encrypt saved bots, is the current master key right? " + err.Error())
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(resealed) + bots, nil
+}
+
+// Moves the saved bots' publishers from oldCipher to newCipher, within tx.
+// Returns how many there were.
+func resealPublishers(tx *sql.Tx, oldCipher, newCipher *tokenCipher) (int, error) {
+	rows, err := tx.Query("SELECT rowid, Name, Publisher FROM Bots WHERE Publisher != ''")
+	if err != nil {
+		return 0, err
+	}
+
+	type sealedRow struct {
+		rowid     int64
+		publisher string
+	}
+	var resealed []sealedRow
+	for rows.Next() {
+		var rowid int64
+		var name, publisher string
+		if err = rows.Scan(&rowid, &name, &publisher); err != nil {
+			break
+		}
+		if publisher, err = oldCipher.decrypt(publisher, name, "Publisher"); err != nil {
+			break
+		}
+		if publisher, err = newCipher.encrypt(publisher, name, "Publisher"); err != nil {
+			break
+		}
+		resealed = append(resealed, sealedRow{rowid, publisher})
+	}
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range resealed {
+		if _, err = tx.Exec("UPDATE Bots SET Publisher = ? WHERE rowid = ?", row.publisher, row.rowid); err != nil {
+			return 0, err
+		}
+	}
+	return len(resealed), nil
+}
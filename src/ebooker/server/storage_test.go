@@ -1,8 +1,13 @@
 package main
 
 import (
+	"ebooker/defs"
 	"ebooker/logging"
+	"ebooker/oauth1"
+
 	"launchpad.net/gocheck"
+	"path/filepath"
+	"time"
 )
 
 // hook up gocheck into the gotest runner.
@@ -12,9 +17,168 @@ var _ = gocheck.Suite(&StorageSuite{})
 
 // Simple test case, where we acquire a handle, save some tweets to it, and retrieve them.
 func (s StorageSuite) TestStorageFunctionality(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	runStorageFunctionality(dh, c)
+}
+
+// The in-memory Datastore should behave just like the sqlite one.
+func (s StorageSuite) TestMemoryStorageFunctionality(c *gocheck.C) {
+	runStorageFunctionality(getMemoryDataHandle(), c)
+}
+
+func (s StorageSuite) TestAccessTokens(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	runAccessTokens(dh, c)
+	runAccessTokens(getMemoryDataHandle(), c)
+}
+
+func (s StorageSuite) TestSavedBots(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	runSavedBots(dh, c)
+	runSavedBots(getMemoryDataHandle(), c)
+}
+
+func runSavedBots(dh Datastore, c *gocheck.C) {
+	c.Assert(len(dh.loadBots()), gocheck.Equals, 0)
+
+	bots := []botRecord{{"SrPablo_weekdays", "SrPablo_ebooks", []string{"SrPablo", "laurelita"}, 2, true, "0 11,19 * * *", "running", defs.PublisherParams{}, "pablo"},
+		{"laurelita_ebooks", "@laurelita@mastodon.social", []string{"laurelita"}, 1, false, "", "paused",
+			defs.PublisherParams{"mastodon", "https://mastodon.social", "unlisted", "bot", defs.WebhookParams{}}, ""},
+		{"news_ebooks", "news_hook", []string{"feed:https://example.com/rss?tags=go,rust", "SrPablo"}, 2, false, "", "running",
+			defs.PublisherParams{"webhook", "", "", "", defs.WebhookParams{"https://hooks.slack.com/services/T0/B0/x", "discord",
+				[]string{"X-Team: news"}, "X-Signature"}}, "news"}}
+	for _, bot := range bots {
+		dh.saveBot(bot)
+	}
+	c.Assert(dh.loadBots(), gocheck.DeepEquals, bots)
+
+	// Saving a bot again replaces it.
+	paused := bots[0]
+	paused.State = "paused"
+	dh.saveBot(paused)
+	dh.deleteBot("laurelita_ebooks")
+	dh.deleteBot("nobody_ebooks")
+	c.Assert(dh.loadBots(), gocheck.DeepEquals, []botRecord{paused, bots[2]})
+}
+
+// Bots saved before sources were JSON had them joined with commas.
+func (s StorageSuite) TestCommaJoinedSources(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	_, err := dh.handle.Exec("INSERT INTO Bots (Name, Account, Sources, Prefix_Len, Reps, Cron, State, Publisher, Owner) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"old_ebooks", "SrPablo_ebooks", "SrPablo,laurelita", 1, false, "", "running", "", "")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(dh.loadBots()[0].Sources, gocheck.DeepEquals, []string{"SrPablo", "laurelita"})
+}
+
+func (s StorageSuite) TestPosts(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	runPosts(dh, c)
+	runPosts(getMemoryDataHandle(), c)
+}
+
+func runPosts(dh Datastore, c *gocheck.C) {
+	c.Assert(len(dh.loadPosts("SrPablo_ebooks")), gocheck.Equals, 0)
+
+	posts := []postRecord{{"SrPablo_ebooks", "SrPablo_ebooks", "today is a great day", time.Unix(1000, 5)},
+		{"laurelita_ebooks", "laurelita_ebooks", "i want to play dota2", time.Unix(1500, 0)},
+		{"SrPablo_ebooks", "SrPablo_ebooks", "today is a fine day", time.Unix(2000, 0)}}
+	for _, post := range posts {
+		dh.recordPost(post)
+	}
+	c.Assert(dh.loadPosts("SrPablo_ebooks"), gocheck.DeepEquals, []postRecord{posts[0], posts[2]})
+}
+
+func (s StorageSuite) TestFeedItems(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	runFeedItems(dh, c)
+	runFeedItems(getMemoryDataHandle(), c)
+}
+
+func runFeedItems(dh Datastore, c *gocheck.C) {
+	c.Assert(dh.seenFeedItems("feed:https://example.com/rss"), gocheck.DeepEquals, map[string]bool{})
+
+	dh.markFeedItemsSeen("feed:https://example.com/rss", []string{"post-1", "post-2"})
+	dh.markFeedItemsSeen("feed:https://example.com/atom", []string{"post-1"})
+	dh.markFeedItemsSeen("feed:https://example.com/rss", []string{"post-3"})
+	c.Assert(dh.seenFeedItems("feed:https://example.com/rss"), gocheck.DeepEquals,
+		map[string]bool{"post-1": true, "post-2": true, "post-3": true})
+	c.Assert(dh.seenFeedItems("feed:https://example.com/atom"), gocheck.DeepEquals, map[string]bool{"post-1": true})
+}
+
+func (s StorageSuite) TestAPIKeys(c *gocheck.C) {
+	dh := getDataHandle(filepath.Join(c.MkDir(), "ebooker_tweets.db"), makeTestCipher(c), &logging.LogMaster{})
+	defer dh.Cleanup()
+	runAPIKeys(dh, c)
+	runAPIKeys(getMemoryDataHandle(), c)
+}
+
+func runAPIKeys(dh Datastore, c *gocheck.C) {
+	c.Assert(len(dh.loadAPIKeys()), gocheck.Equals, 0)
 
-	dh := getDataHandle("./ebooker_tweets.db", &logging.LogMaster{})
+	keys := []apiKey{{"admin", hashAPIKey("ebk_admin"), []string{SCOPE_ADMIN}, time.Unix(1000, 5)},
+		{"pablo", hashAPIKey("ebk_pablo"), []string{SCOPE_GENERATE, SCOPE_BOTS}, time.Unix(2000, 0)}}
+	c.Assert(dh.insertAPIKey(keys[1]), gocheck.IsNil)
+	c.Assert(dh.insertAPIKey(keys[0]), gocheck.IsNil)
+	c.Assert(dh.insertAPIKey(apiKey{"pablo", hashAPIKey("ebk_other"), nil, time.Unix(3000, 0)}), gocheck.NotNil)
+	c.Assert(dh.loadAPIKeys(), gocheck.DeepEquals, keys)
+
+	key, exists := dh.getAPIKey(hashAPIKey("ebk_pablo"))
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*key, gocheck.DeepEquals, keys[1])
+	_, exists = dh.getAPIKey("ebk_pablo")
+	c.Assert(exists, gocheck.Equals, false)
+
+	c.Assert(dh.deleteAPIKey("pablo"), gocheck.Equals, true)
+	c.Assert(dh.deleteAPIKey("pablo"), gocheck.Equals, false)
+	c.Assert(dh.loadAPIKeys(), gocheck.DeepEquals, keys[:1])
+}
+
+func runAccessTokens(dh Datastore, c *gocheck.C) {
+	_, exists := dh.getUserAccessToken("SrPablo")
+	c.Assert(exists, gocheck.Equals, false)
+
+	dh.insertUserAccessToken("SrPablo", &oauth1.Token{"token", "secret"})
+	token, exists := dh.getUserAccessToken("SrPablo")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"token", "secret"})
+
+	// Signing in again replaces the token; the old one's likely revoked.
+	dh.insertUserAccessToken("SrPablo", &oauth1.Token{"newtoken", "newsecret"})
+	token, exists = dh.getUserAccessToken("SrPablo")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"newtoken", "newsecret"})
+}
+
+// Databases from before tokens were replaced keep only the newest of each
+// user's.
+func (s StorageSuite) TestDuplicateTokensMigrated(c *gocheck.C) {
+	filename := filepath.Join(c.MkDir(), "ebooker_tweets.db")
+	dh := getDataHandle(filename, makeTestCipher(c), &logging.LogMaster{})
+	_, err := dh.handle.Exec("DROP INDEX TwitterUsersByName")
+	c.Assert(err, gocheck.IsNil)
+	for _, token := range []string{"oldtoken", "newtoken"} {
+		_, err = dh.handle.Exec("INSERT INTO TwitterUsers (Screen_name, Token, Token_Secret) VALUES (?, ?, ?)", "laurelita", token, "secret")
+		c.Assert(err, gocheck.IsNil)
+	}
+	dh.Cleanup()
+
+	dh = getDataHandle(filename, makeTestCipher(c), &logging.LogMaster{})
 	defer dh.Cleanup()
+	var rows int
+	c.Assert(dh.handle.QueryRow("SELECT COUNT(*) FROM TwitterUsers").Scan(&rows), gocheck.IsNil)
+	c.Assert(rows, gocheck.Equals, 1)
+	token, exists := dh.getUserAccessToken("laurelita")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"newtoken", "secret"})
+}
+
+func runStorageFunctionality(dh Datastore, c *gocheck.C) {
 
 	pabloTweets := []TweetData{TweetData{398273498291123, "Just got an email whose only contents were \"LOL\". The day is won."},
 		TweetData{398273498291124, "@Popehat When I was 8 and asked my dad what his job was, he confused me with \"I'm a transaction cost.\""},
@@ -0,0 +1,125 @@
+package main
+
+/*
+Access tokens are as good as a password to the account they belong to, so we
+don't keep them in the database as plaintext; nor where bots post, since a
+webhook's URL (and its headers) are as good as a password to it. Each value is sealed with
+AES-GCM under a server-wide master key, which lives in a file (or in the
+EBOOKER_MASTER_KEY environment variable) rather than alongside the database.
+
+The master key is 32 random bytes, hex-encoded, e.g.
+
+    openssl rand -hex 32 > master.key
+
+Rows written before encryption was introduced are still read transparently;
+rotating the key (see DataHandle.rotateMasterKey) encrypts them along with
+everything else.
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	MASTER_KEY_ENV = "EBOOKER_MASTER_KEY"
+
+	// Marks a stored value as sealed, and with which scheme, in case we ever
+	// need another one.
+	ENCRYPTED_PREFIX = "enc1:"
+)
+
+type tokenCipher struct {
+	aead cipher.AEAD
+}
+
+// Reads the hex-encoded master key from the environment if it's set there,
+// and from the file otherwise.
+func loadMasterKey(filename string) ([]byte, error) {
+	if encoded := os.Getenv(MASTER_KEY_ENV); encoded != "" {
+		return decodeMasterKey(encoded)
+	}
+	return readMasterKey(filename)
+}
+
+// Reads the hex-encoded master key from a file, ignoring the environment.
+func readMasterKey(filename string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMasterKey(string(contents))
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid hex: %v", err)
+	}
+	return key, nil
+}
+
+// Creates a tokenCipher from a 256-bit key.
+func newTokenCipher(key []byte) (*tokenCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCipher{aead}, nil
+}
+
+// Seals a value for storage. The username and column are bound in as
+// additional data, so a sealed value can't be moved to another row or column
+// and still decrypt.
+func (tc *tokenCipher) encrypt(plain, username, column string) (string, error) {
+	nonce := make([]byte, tc.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := tc.aead.Seal(nonce, nonce, []byte(plain), additionalData(username, column))
+	return ENCRYPTED_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Opens a value sealed by encrypt. Values without the prefix predate
+// encryption and are returned as they are.
+func (tc *tokenCipher) decrypt(stored, username, column string) (string, error) {
+	if !strings.HasPrefix(stored, ENCRYPTED_PREFIX) {
+		return stored, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, ENCRYPTED_PREFIX))
+	if err != nil {
+		return "", err
+	}
+	nonceSize := tc.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("sealed value is too short")
+	}
+
+	plain, err := tc.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData(username, column))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func additionalData(username, column string) []byte {
+	return []byte(username + "\x00" + column)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"bytes"
+	"launchpad.net/gocheck"
+	"path/filepath"
+	"strings"
+)
+
+// hook up gocheck into the gotest runner.
+type TokenCryptSuite struct{}
+
+var _ = gocheck.Suite(&TokenCryptSuite{})
+
+func makeTestCipherFromByte(b byte, c *gocheck.C) *tokenCipher {
+	tc, err := newTokenCipher(bytes.Repeat([]byte{b}, 32))
+	c.Assert(err, gocheck.IsNil)
+	return tc
+}
+
+func makeTestCipher(c *gocheck.C) *tokenCipher {
+	return makeTestCipherFromByte(7, c)
+}
+
+func (s TokenCryptSuite) TestRoundTrip(c *gocheck.C) {
+	tc := makeTestCipher(c)
+
+	sealed, err := tc.encrypt("LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE", "SrPablo", "Token_Secret")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(strings.HasPrefix(sealed, ENCRYPTED_PREFIX), gocheck.Equals, true)
+	c.Assert(strings.Contains(sealed, "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE"), gocheck.Equals, false)
+
+	plain, err := tc.decrypt(sealed, "SrPablo", "Token_Secret")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(plain, gocheck.Equals, "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE")
+
+	// Sealed values are bound to their row and column.
+	_, err = tc.decrypt(sealed, "laurelita", "Token_Secret")
+	c.Assert(err, gocheck.NotNil)
+	_, err = tc.decrypt(sealed, "SrPablo", "Token")
+	c.Assert(err, gocheck.NotNil)
+
+	// And, of course, to the key.
+	_, err = makeTestCipherFromByte(8, c).decrypt(sealed, "SrPablo", "Token_Secret")
+	c.Assert(err, gocheck.NotNil)
+}
+
+func (s TokenCryptSuite) TestLegacyPlaintext(c *gocheck.C) {
+	plain, err := makeTestCipher(c).decrypt("370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb", "SrPablo", "Token")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(plain, gocheck.Equals, "370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb")
+}
+
+func (s TokenCryptSuite) TestBadKeys(c *gocheck.C) {
+	_, err := newTokenCipher([]byte("too short"))
+	c.Assert(err, gocheck.NotNil)
+
+	_, err = decodeMasterKey("not hex at all")
+	c.Assert(err, gocheck.NotNil)
+
+	key, err := decodeMasterKey(strings.Repeat("ab", 32) + "\n")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(len(key), gocheck.Equals, 32)
+}
+
+// Tokens never hit the database in the clear, and survive a key rotation,
+// including ones stored before we started encrypting.
+func (s TokenCryptSuite) TestStorageAndRotation(c *gocheck.C) {
+	oldCipher := makeTestCipher(c)
+	newCipher := makeTestCipherFromByte(8, c)
+	filename := filepath.Join(c.MkDir(), "ebooker_tweets.db")
+
+	logger := logging.GetLogMaster(true, false, false)
+	dh := getDataHandle(filename, oldCipher, &logger)
+	defer dh.Cleanup()
+	dh.insertUserAccessToken("SrPablo", &oauth1.Token{"token", "secret"})
+	_, err := dh.handle.Exec("INSERT INTO TwitterUsers (Screen_name, Token, Token_Secret) VALUES (?, ?, ?)", "laurelita", "oldtoken", "oldsecret")
+	c.Assert(err, gocheck.IsNil)
+
+	dh.saveBot(botRecord{"news_ebooks", "news_hook", []string{"feed:https://example.com/rss"}, 1, false, "", "running",
+		defs.PublisherParams{"webhook", "", "", "", defs.WebhookParams{"https://hooks.slack.com/services/T0/B0/x", "",
+			[]string{"Authorization: Bearer hooksecret"}, ""}}, ""})
+	_, err = dh.handle.Exec("INSERT INTO Bots (Name, Account, Sources, Prefix_Len, Reps, Cron, State, Publisher, Owner) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"old_ebooks", "old_hook", "SrPablo", 1, false, "", "running", `{"kind":"webhook","webhook":{"url":"https://example.com/hook"}}`, "")
+	c.Assert(err, gocheck.IsNil)
+
+	var rawToken, rawSecret, rawPublisher string
+	err = dh.handle.QueryRow("SELECT Token, Token_Secret FROM TwitterUsers WHERE Screen_Name = ?", "SrPablo").Scan(&rawToken, &rawSecret)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(strings.HasPrefix(rawToken, ENCRYPTED_PREFIX), gocheck.Equals, true)
+	c.Assert(strings.HasPrefix(rawSecret, ENCRYPTED_PREFIX), gocheck.Equals, true)
+	err = dh.handle.QueryRow("SELECT Publisher FROM Bots WHERE Name = ?", "news_ebooks").Scan(&rawPublisher)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(strings.HasPrefix(rawPublisher, ENCRYPTED_PREFIX), gocheck.Equals, true)
+	c.Assert(strings.Contains(rawPublisher, "hooks.slack.com"), gocheck.Equals, false)
+
+	count, err := dh.rotateMasterKey(newCipher)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(count, gocheck.Equals, 4)
+
+	// The old key no longer opens anything...
+	_, exists := dh.getUserAccessToken("SrPablo")
+	c.Assert(exists, gocheck.Equals, false)
+
+	// ...while the new one opens everything.
+	rotated := getDataHandle(filename, newCipher, &logger)
+	defer rotated.Cleanup()
+	token, exists := rotated.getUserAccessToken("SrPablo")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"token", "secret"})
+	token, exists = rotated.getUserAccessToken("laurelita")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(*token, gocheck.Equals, oauth1.Token{"oldtoken", "oldsecret"})
+	bots := rotated.loadBots()
+	c.Assert(len(bots), gocheck.Equals, 2)
+	c.Assert(bots[0].Publish.Webhook.Headers, gocheck.DeepEquals, []string{"Authorization: Bearer hooksecret"})
+	c.Assert(bots[1].Publish.Webhook.URL, gocheck.Equals, "https://example.com/hook")
+
+	// Rotating with the wrong current key changes nothing.
+	_, err = dh.rotateMasterKey(makeTestCipherFromByte(9, c))
+	c.Assert(err, gocheck.NotNil)
+	token, exists = rotated.getUserAccessToken("SrPablo")
+	c.Assert(exists, gocheck.Equals, true)
+}
@@ -11,12 +11,23 @@ import (
 	"ebooker/oauth1"
 
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 )
 
+// TwitterAPI is the part of Twitter the server relies on. TweetFetcher talks
+// to the real thing; tests substitute a fake.
+type TwitterAPI interface {
+	SourceFetcher
+	sendTweet(status string, accessToken *oauth1.Token) error
+	verifyCredentials(accessToken *oauth1.Token) error
+}
+
 type TweetFetcher struct {
 	logger *logging.LogMaster
 	oauth  *oauth1.OAuth1
@@ -34,8 +45,10 @@ func (t Tweets) Len() int           { return len(t) }
 func (t Tweets) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
 func (t Tweets) Less(i, j int) bool { return t[i].Id < t[j].Id }
 
-const USER_TIMELINE_URL = "https://api.twitter.com/1.1/statuses/user_timeline.json"
-const UPDATE_STATUS_URL = "https://api.twitter.com/1.1/statuses/update.json"
+// Endpoints, relative to the OAuth1's base URL.
+const USER_TIMELINE_PATH = "/1.1/statuses/user_timeline.json"
+const UPDATE_STATUS_PATH = "/1.1/statuses/update.json"
+const VERIFY_CREDENTIALS_PATH = "/1.1/account/verify_credentials.json"
 
 func getTweetFetcher(logger *logging.LogMaster, oauth *oauth1.OAuth1) TweetFetcher {
 	return TweetFetcher{logger, oauth}
@@ -46,117 +59,152 @@ func getTweetFetcher(logger *logging.LogMaster, oauth *oauth1.OAuth1) TweetFetch
 // as we can by recursively calling with the max_id. See:
 //
 // https://dev.twitter.com/docs/working-with-timelines
-func (tf TweetFetcher) DeepDive(username string, accessToken *oauth1.Token) Tweets {
+//
+// If a page after the first fails, we keep what we got.
+func (tf TweetFetcher) DeepDive(username string, accessToken *oauth1.Token) (Tweets, error) {
 	tf.logger.StatusWrite("Doing a deep dive!\n")
 
-	url := USER_TIMELINE_URL
+	endpoint := tf.oauth.URL(USER_TIMELINE_PATH)
 	method := "GET"
-	urlParams := map[string]string{
-		"screen_name": username,
-		"count":       "50",
-		"include_rts": "false"}
-	bodyParams := map[string]string{}
-	authParams := map[string]string{}
-
-	req := tf.oauth.CreateAuthorizedRequest(url, method, urlParams, bodyParams, authParams, accessToken)
-	resp := tf.oauth.ExecuteRequest(req)
-
-	tweets := tf.getTweetsFromResponse(resp)
-
-	// in case of error
-	if len(tweets) == 0 {
-		return tweets
+	urlParams := url.Values{
+		"screen_name": {username},
+		"count":       {"50"},
+		"include_rts": {"false"}}
+	bodyParams := url.Values{}
+	authParams := url.Values{}
+
+	req := tf.oauth.CreateAuthorizedRequest(endpoint, method, urlParams, bodyParams, authParams, accessToken)
+	resp := tf.execute(USER_TIMELINE_PATH, req)
+
+	tweets, err := tf.getTweetsFromResponse(resp)
+	if err != nil || len(tweets) == 0 {
+		return tweets, err
 	}
 
 	// the "- 1" is because max_id is inclusive, and we already have the tweet
 	// represented by this ID.
 	maxId := tweets[tweets.Len()-1].Id - 1
 	for {
-		urlParams["max_id"] = strconv.FormatUint(maxId, 10)
+		urlParams.Set("max_id", strconv.FormatUint(maxId, 10))
 
-		req := tf.oauth.CreateAuthorizedRequest(url, method, urlParams, bodyParams, authParams, accessToken)
-		resp := tf.oauth.ExecuteRequest(req)
+		req := tf.oauth.CreateAuthorizedRequest(endpoint, method, urlParams, bodyParams, authParams, accessToken)
+		resp := tf.execute(USER_TIMELINE_PATH, req)
 
-		olderTweets := tf.getTweetsFromResponse(resp)
+		olderTweets, err := tf.getTweetsFromResponse(resp)
+		if err != nil {
+			tf.logger.Warn("Couldn't fetch the rest of the timeline.", logging.Field{"source", username}, logging.Field{"error", err})
+			break
+		}
 		if olderTweets.Len() == 0 {
 			break
 		}
 
+		// Guard against looping forever if max_id is ignored.
 		newOldestId := olderTweets[olderTweets.Len()-1].Id
-		if maxId == newOldestId {
+		if newOldestId > maxId {
 			break
-		} else {
-			maxId = newOldestId
-			tweets = appendSlices(tweets, olderTweets)
-			tf.logger.StatusWrite("Tweets have grown to %d\n", tweets.Len())
 		}
+		tweets = appendSlices(tweets, olderTweets)
+		tf.logger.StatusWrite("Tweets have grown to %d\n", tweets.Len())
+		maxId = newOldestId - 1
 	}
 
-	return tweets
+	return tweets, nil
 }
 
 // GetRecentTimeline is the much more common use case: we fetch tweets from the
 // timeline, using since_id. This allows us to incrementally build our tweet
 // database.
-func (tf TweetFetcher) GetRecentTimeline(username string, latest *TweetData, accessToken *oauth1.Token) Tweets {
-	url := USER_TIMELINE_URL
+func (tf TweetFetcher) GetRecentTimeline(username string, latest *TweetData, accessToken *oauth1.Token) (Tweets, error) {
+	endpoint := tf.oauth.URL(USER_TIMELINE_PATH)
 	method := "GET"
-	urlParams := map[string]string{
-		"screen_name": username,
-		"count":       "50",
-		"include_rts": "false",
-		"since_id":    strconv.FormatUint(latest.Id, 10)}
-	bodyParams := map[string]string{}
-	authParams := map[string]string{}
-
-	req := tf.oauth.CreateAuthorizedRequest(url, method, urlParams, bodyParams, authParams, accessToken)
-	resp := tf.oauth.ExecuteRequest(req)
-
-	tweets := tf.getTweetsFromResponse(resp)
-
-	return tweets
+	urlParams := url.Values{
+		"screen_name": {username},
+		"count":       {"50"},
+		"include_rts": {"false"},
+		"since_id":    {strconv.FormatUint(latest.Id, 10)}}
+	bodyParams := url.Values{}
+	authParams := url.Values{}
+
+	req := tf.oauth.CreateAuthorizedRequest(endpoint, method, urlParams, bodyParams, authParams, accessToken)
+	resp := tf.execute(USER_TIMELINE_PATH, req)
+
+	return tf.getTweetsFromResponse(resp)
 }
 
 // Calls the Twitter API's "update" function on the account name provided, with
 // the status text assigned. We assume the user has already provided the app
 // access to their credentials with OAuth; in case they haven't, we ask for them
-// and otherwise drop the request from this scope.
-func (tf TweetFetcher) sendTweet(status string, accessToken *oauth1.Token) {
+// and otherwise drop the request from this scope. Returns an error if the
+// tweet didn't go out.
+func (tf TweetFetcher) sendTweet(status string, accessToken *oauth1.Token) error {
 	tf.logger.DebugWrite("Sending Tweet POST request!\n")
-	url := UPDATE_STATUS_URL
+	endpoint := tf.oauth.URL(UPDATE_STATUS_PATH)
 	method := "POST"
-	urlParams := map[string]string{}
-	bodyParams := map[string]string{"status": status}
-	authParams := map[string]string{}
-	req := tf.oauth.CreateAuthorizedRequest(url, method, urlParams, bodyParams, authParams, accessToken)
-	tf.oauth.ExecuteRequest(req)
+	urlParams := url.Values{}
+	bodyParams := url.Values{"status": {status}}
+	authParams := url.Values{}
+	req := tf.oauth.CreateAuthorizedRequest(endpoint, method, urlParams, bodyParams, authParams, accessToken)
+	return responseError(tf.execute(UPDATE_STATUS_PATH, req))
 }
 
-func (tf TweetFetcher) getTweetsFromResponse(resp *http.Response) Tweets {
-
-	if resp.StatusCode == http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-		defer resp.Body.Close()
-		if err != nil {
-			tf.logger.StatusWrite("Received unexpected error from reading HTTP Response.\n")
-			tf.logger.DebugWrite("error is: %v\n", err)
-		}
+// Checks that Twitter still accepts the access token, and our application's
+// keys along with it.
+func (tf TweetFetcher) verifyCredentials(accessToken *oauth1.Token) error {
+	endpoint := tf.oauth.URL(VERIFY_CREDENTIALS_PATH)
+	urlParams := url.Values{"skip_status": {"true"}}
+	req := tf.oauth.CreateAuthorizedRequest(endpoint, "GET", urlParams, url.Values{}, url.Values{}, accessToken)
+	return responseError(tf.execute(VERIFY_CREDENTIALS_PATH, req))
+}
 
-		var tweets Tweets
+// Closes a response we only care about the status of, returning an error if
+// there wasn't one or it wasn't a 200.
+func responseError(resp *http.Response) error {
+	if resp == nil {
+		return errors.New("Couldn't reach Twitter.")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Twitter said %s", resp.Status)
+	}
+	return nil
+}
 
-		err = json.Unmarshal(body, &tweets)
-		if err != nil {
-			tf.logger.StatusWrite("Received unexpected error from Unmarshalling JSON Response.\n")
-			tf.logger.DebugWrite("error is: %v\n", err)
-		}
+// Sends the request to the endpoint (its path, for the metrics), counting how
+// it went.
+func (tf TweetFetcher) execute(path string, req *http.Request) *http.Response {
+	resp := tf.oauth.ExecuteRequest(req)
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	TWITTER_REQUESTS.inc(path, status)
+	countRateLimit("twitter", resp)
+	return resp
+}
 
-		for i := range tweets {
-			tweets[i].Text = html.UnescapeString(tweets[i].Text)
-		}
+// Reads the tweets out of a timeline response, or says why there aren't any.
+func (tf TweetFetcher) getTweetsFromResponse(resp *http.Response) (Tweets, error) {
+	if resp == nil {
+		return nil, errors.New("Couldn't reach Twitter.")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Twitter said %s", resp.Status)
+	}
 
-		return tweets
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var tweets Tweets
+	if err := json.Unmarshal(body, &tweets); err != nil {
+		return nil, err
+	}
+	for i := range tweets {
+		tweets[i].Text = html.UnescapeString(tweets[i].Text)
 	}
-	return Tweets{}
+	return tweets, nil
 }
 
 func appendSlices(slice1, slice2 Tweets) Tweets {
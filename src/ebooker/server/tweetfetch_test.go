@@ -1,7 +1,20 @@
 package main
 
 import (
+	"ebooker/logging"
+	"ebooker/oauth1"
+
+	"encoding/json"
+	"errors"
+	"fmt"
 	"launchpad.net/gocheck"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // hook up gocheck into the gotest runner.
@@ -12,3 +25,224 @@ var _ = gocheck.Suite(&TweetFetchSuite{})
 func (t TweetFetchSuite) TestGetUserTimeline(c *gocheck.C) {
 	c.Assert(2, gocheck.Equals, 2)
 }
+
+// fakeTwitter stands in for TweetFetcher, serving timelines from memory and
+// recording what would have been posted.
+type fakeTwitter struct {
+	lock      sync.Mutex
+	timelines map[string]Tweets
+	posted    chan string
+	revoked   map[string]bool // access tokens Twitter no longer takes
+}
+
+func newFakeTwitter() *fakeTwitter {
+	return &fakeTwitter{timelines: make(map[string]Tweets), posted: make(chan string, 10), revoked: make(map[string]bool)}
+}
+
+// Adds tweets to a user's timeline, as if they'd just tweeted them.
+func (ft *fakeTwitter) tweet(username string, tweets ...TweetData) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.timelines[username] = appendSlices(ft.timelines[username], tweets)
+}
+
+func (ft *fakeTwitter) DeepDive(username string, accessToken *oauth1.Token) (Tweets, error) {
+	return ft.GetRecentTimeline(username, &TweetData{}, accessToken)
+}
+
+// Tokens in revoked are refused, as they are by verifyCredentials.
+func (ft *fakeTwitter) GetRecentTimeline(username string, latest *TweetData, accessToken *oauth1.Token) (Tweets, error) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+
+	if accessToken != nil && ft.revoked[accessToken.OAuthToken] {
+		return nil, errors.New("Twitter said 401 Unauthorized")
+	}
+	var tweets Tweets
+	for _, tweet := range ft.timelines[username] {
+		if tweet.Id > latest.Id {
+			tweets = append(tweets, tweet)
+		}
+	}
+	return tweets, nil
+}
+
+func (ft *fakeTwitter) sendTweet(status string, accessToken *oauth1.Token) error {
+	ft.posted <- status
+	return nil
+}
+
+// Tokens in revoked are refused.
+func (ft *fakeTwitter) verifyCredentials(accessToken *oauth1.Token) error {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	if ft.revoked[accessToken.OAuthToken] {
+		return errors.New("Twitter said 401 Unauthorized")
+	}
+	return nil
+}
+
+// twitterServer is a fake of Twitter's HTTP API, for testing TweetFetcher
+// against. It serves user_timeline from memory, newest first, honoring count,
+// max_id and since_id, records statuses posted to update, and verifies any
+// credentials but the token "revoked".
+type twitterServer struct {
+	*httptest.Server
+	lock      sync.Mutex
+	timelines map[string]Tweets
+	posted    []string
+	requests  int
+}
+
+func newTwitterServer() *twitterServer {
+	ts := &twitterServer{timelines: make(map[string]Tweets)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(USER_TIMELINE_PATH, ts.handleTimeline)
+	mux.HandleFunc(UPDATE_STATUS_PATH, ts.handleUpdate)
+	mux.HandleFunc(VERIFY_CREDENTIALS_PATH, ts.handleVerify)
+	ts.Server = httptest.NewServer(mux)
+	return ts
+}
+
+// A TweetFetcher pointed at this server.
+func (ts *twitterServer) fetcher() TweetFetcher {
+	logger := logging.GetLogMaster(true, false, false)
+	oauth := oauth1.CreateOAuth1WithClient(&logger, "key", "secret", ts.Client(), ts.URL)
+	return getTweetFetcher(&logger, &oauth)
+}
+
+func (ts *twitterServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	ts.lock.Lock()
+	ts.requests++
+	ts.lock.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "OAuth ") || !strings.Contains(auth, "oauth_token=") {
+		http.Error(w, "{\"errors\":[{\"code\":215}]}", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (ts *twitterServer) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	count, _ := strconv.Atoi(query.Get("count"))
+	maxId, err := strconv.ParseUint(query.Get("max_id"), 10, 64)
+	if err != nil {
+		maxId = math.MaxUint64
+	}
+	sinceId, _ := strconv.ParseUint(query.Get("since_id"), 10, 64)
+
+	ts.lock.Lock()
+	timeline := ts.timelines[query.Get("screen_name")]
+	ts.lock.Unlock()
+
+	page := Tweets{}
+	for i := len(timeline) - 1; i >= 0 && len(page) < count; i-- {
+		if timeline[i].Id <= maxId && timeline[i].Id > sinceId {
+			page = append(page, timeline[i])
+		}
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func (ts *twitterServer) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(w, r) {
+		return
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.posted = append(ts.posted, r.FormValue("status"))
+	fmt.Fprint(w, "{}")
+}
+
+func (ts *twitterServer) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if !ts.authorized(w, r) {
+		return
+	}
+	if strings.Contains(r.Header.Get("Authorization"), `oauth_token="revoked"`) {
+		http.Error(w, "{\"errors\":[{\"code\":89}]}", http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprint(w, "{}")
+}
+
+// Fills a timeline with tweets numbered from 1 to n, oldest first.
+func (ts *twitterServer) fill(username string, n int) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for i := 1; i <= n; i++ {
+		ts.timelines[username] = append(ts.timelines[username], TweetData{uint64(i), "tweet &amp; number " + strconv.Itoa(i)})
+	}
+}
+
+// DeepDive pages back through the whole timeline, without duplicates.
+func (t TweetFetchSuite) TestDeepDive(c *gocheck.C) {
+	ts := newTwitterServer()
+	defer ts.Close()
+	ts.fill("SrPablo", 120)
+
+	tweets, err := ts.fetcher().DeepDive("SrPablo", &oauth1.Token{"token", "secret"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tweets.Len(), gocheck.Equals, 120)
+
+	seen := make(map[uint64]bool)
+	for _, tweet := range tweets {
+		c.Assert(seen[tweet.Id], gocheck.Equals, false)
+		seen[tweet.Id] = true
+	}
+	c.Assert(tweets[0].Text, gocheck.Equals, "tweet & number 120")
+	c.Assert(ts.requests, gocheck.Equals, 4)
+}
+
+func (t TweetFetchSuite) TestGetRecentTimeline(c *gocheck.C) {
+	ts := newTwitterServer()
+	defer ts.Close()
+	ts.fill("SrPablo", 10)
+
+	tweets, err := ts.fetcher().GetRecentTimeline("SrPablo", &TweetData{7, ""}, &oauth1.Token{"token", "secret"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(tweets.Len(), gocheck.Equals, 3)
+	sort.Sort(tweets)
+	c.Assert(tweets[0].Id, gocheck.Equals, uint64(8))
+}
+
+func (t TweetFetchSuite) TestSendTweet(c *gocheck.C) {
+	ts := newTwitterServer()
+	defer ts.Close()
+
+	err := ts.fetcher().sendTweet("Hello Ladies + Gentlemen, a signed OAuth request!", &oauth1.Token{"token", "secret"})
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(ts.posted, gocheck.DeepEquals, []string{"Hello Ladies + Gentlemen, a signed OAuth request!"})
+}
+
+func (t TweetFetchSuite) TestVerifyCredentials(c *gocheck.C) {
+	ts := newTwitterServer()
+	defer ts.Close()
+	tf := ts.fetcher()
+
+	c.Assert(tf.verifyCredentials(&oauth1.Token{"token", "secret"}), gocheck.IsNil)
+	c.Assert(tf.verifyCredentials(&oauth1.Token{"revoked", "secret"}), gocheck.ErrorMatches, "Twitter said 401 Unauthorized")
+	ts.Close()
+	c.Assert(tf.verifyCredentials(&oauth1.Token{"token", "secret"}), gocheck.ErrorMatches, "Couldn't reach Twitter.")
+}
+
+// Twitter being down (or refusing us) shouldn't bring us down with it.
+func (t TweetFetchSuite) TestTwitterErrors(c *gocheck.C) {
+	ts := newTwitterServer()
+	ts.fill("SrPablo", 10)
+	tf := ts.fetcher()
+
+	tweets, err := tf.DeepDive("SrPablo", nil)
+	c.Assert(tweets.Len(), gocheck.Equals, 0)
+	c.Assert(err, gocheck.ErrorMatches, "Twitter said 400 Bad Request")
+
+	ts.Close()
+	tweets, err = tf.DeepDive("SrPablo", &oauth1.Token{"token", "secret"})
+	c.Assert(tweets.Len(), gocheck.Equals, 0)
+	c.Assert(err, gocheck.ErrorMatches, "Couldn't reach Twitter.")
+	c.Assert(tf.sendTweet("into the void", &oauth1.Token{"token", "secret"}), gocheck.NotNil)
+}
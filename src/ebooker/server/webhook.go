@@ -0,0 +1,195 @@
+package main
+
+/*
+Webhook bots post by POSTing JSON to a URL: a Slack or Discord incoming
+webhook, or any HTTP endpoint that'll take it. The body comes from a
+text/template given the post's .Text and .Time, with a json function for
+quoting; "slack" and "discord" name the templates those two expect.
+
+Every body is signed with HMAC-SHA256 under the bot's secret, which is stored
+encrypted like any access token, so endpoints can check it came from us.
+Posts that fail in ways that might pass (not getting through to the endpoint,
+a 5xx, a 429) are tried again after a backoff, a few times. A connection that
+fails once we've sent the post isn't: webhooks have no way to tell a repeat
+from a new post, and it may well have got there.
+*/
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Webhooks take about anything, but nobody wants more than a toot's worth of
+// nonsense at a time.
+const WEBHOOK_CHAR_LIMIT = 500
+
+const DEFAULT_SIGNATURE_HEADER = "X-Ebooker-Signature"
+
+// How many times we try a post, waiting WEBHOOK_BACKOFF after the first
+// failure and twice as long after each one after.
+const (
+	WEBHOOK_ATTEMPTS = 3
+	WEBHOOK_BACKOFF  = time.Second
+)
+
+// Templates for the webhooks people use most, by name. The first is the
+// default.
+var WEBHOOK_TEMPLATES = map[string]string{
+	"":        `{"text": {{json .Text}}}`,
+	"slack":   `{"text": {{json .Text}}}`,
+	"discord": `{"content": {{json .Text}}}`,
+}
+
+var WEBHOOK_TEMPLATE_FUNCS = template.FuncMap{"json": func(v interface{}) (string, error) {
+	quoted, err := json.Marshal(v)
+	return string(quoted), err
+}}
+
+// What a webhook's template is given.
+type webhookPost struct {
+	Text string
+	Time time.Time
+}
+
+type webhookPublisher struct {
+	hook     defs.WebhookParams
+	url      string
+	template *template.Template
+	headers  http.Header
+	secret   []byte
+
+	client  *http.Client
+	logger  *logging.LogMaster
+	backoff time.Duration
+}
+
+func newWebhookPublisher(params *defs.PublisherParams, secret string, client *http.Client, logger *logging.LogMaster) (*webhookPublisher, error) {
+	hook := params.Webhook
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, errors.New("Webhook bots need the URL to post to.")
+	}
+	if secret == "" {
+		return nil, errors.New("Webhook bots need a secret to sign their posts with.")
+	}
+
+	source, named := WEBHOOK_TEMPLATES[hook.Template]
+	if !named {
+		source = hook.Template
+	}
+	tmpl, err := template.New("webhook").Funcs(WEBHOOK_TEMPLATE_FUNCS).Parse(source)
+	if err != nil {
+		return nil, errors.New("Couldn't read the webhook's template: " + err.Error())
+	}
+
+	headers := make(http.Header)
+	for _, header := range hook.Headers {
+		name, value, found := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, errors.New("Webhook headers look like \"Name: value\", not \"" + header + "\".")
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	if hook.SignatureHeader == "" {
+		hook.SignatureHeader = DEFAULT_SIGNATURE_HEADER
+	}
+
+	w := &webhookPublisher{hook, hook.URL, tmpl, headers, []byte(secret), client, logger, WEBHOOK_BACKOFF}
+	// Better to find out the template's no good now than when the bot posts.
+	if _, err := w.body("today is a great day"); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// The JSON to post for the status.
+func (w *webhookPublisher) body(status string) ([]byte, error) {
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, webhookPost{status, time.Now().UTC()}); err != nil {
+		return nil, errors.New("Couldn't fill in the webhook's template: " + err.Error())
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, errors.New("The webhook's template doesn't make JSON.")
+	}
+	return body.Bytes(), nil
+}
+
+// The body's HMAC-SHA256 under our secret, as its header's value.
+func (w *webhookPublisher) sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhookPublisher) publish(status string) error {
+	body, err := w.body(status)
+	if err != nil {
+		return err
+	}
+
+	wait := w.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.send(body)
+		if err == nil || !retry || attempt == WEBHOOK_ATTEMPTS {
+			return err
+		}
+		w.logger.Warn("Posting to the webhook failed; trying again.", logging.Field{"error", err}, logging.Field{"wait", wait})
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// POSTs the body once. Returns whether it's worth trying again if it failed.
+func (w *webhookPublisher) send(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for name, values := range w.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(w.hook.SignatureHeader, w.sign(body))
+
+	w.logger.DebugWrite("Sending webhook POST request to %s!\n", req.URL.Host)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// Only if we never connected can we be sure nothing was posted.
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial", err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	countRateLimit("webhook", resp)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("The webhook said %s", resp.Status)
+}
+
+func (w *webhookPublisher) charLimit() int {
+	return WEBHOOK_CHAR_LIMIT
+}
+
+func (w *webhookPublisher) params() defs.PublisherParams {
+	return defs.PublisherParams{PUBLISH_WEBHOOK, "", "", "", w.hook}
+}
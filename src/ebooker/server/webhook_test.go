@@ -0,0 +1,218 @@
+package main
+
+import (
+	"ebooker/defs"
+	"ebooker/logging"
+
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// hook up gocheck into the gotest runner.
+type WebhookSuite struct{}
+
+var _ = gocheck.Suite(&WebhookSuite{})
+
+// An endpoint that answers with each of statuses in turn (then 200s), and
+// hands what it's posted to the test.
+type fakeWebhook struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	status []int
+	posted chan *http.Request
+	bodies chan []byte
+}
+
+func newFakeWebhook(statuses ...int) *fakeWebhook {
+	fw := &fakeWebhook{status: statuses, posted: make(chan *http.Request, 10), bodies: make(chan []byte, 10)}
+	fw.server = httptest.NewServer(http.HandlerFunc(fw.serve))
+	return fw
+}
+
+func (fw *fakeWebhook) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	fw.posted <- r
+	fw.bodies <- body
+
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	if len(fw.status) > 0 {
+		w.WriteHeader(fw.status[0])
+		fw.status = fw.status[1:]
+	}
+}
+
+func makeTestWebhookParams(fw *fakeWebhook, template string) defs.PublisherParams {
+	return defs.PublisherParams{PUBLISH_WEBHOOK, "", "", "",
+		defs.WebhookParams{fw.server.URL + "/hook", template, []string{"X-Team: ebooks", "Authorization:Bearer abc"}, ""}}
+}
+
+func makeTestWebhook(c *gocheck.C, params defs.PublisherParams) *webhookPublisher {
+	logger := logging.GetLogMaster(true, false, false)
+	publisher, err := newWebhookPublisher(&params, "hooksecret", &http.Client{}, &logger)
+	c.Assert(err, gocheck.IsNil)
+	publisher.backoff = time.Millisecond
+	return publisher
+}
+
+func (s WebhookSuite) TestWebhookPublish(c *gocheck.C) {
+	fw := newFakeWebhook()
+	defer fw.server.Close()
+	publisher := makeTestWebhook(c, makeTestWebhookParams(fw, ""))
+	c.Assert(publisher.charLimit(), gocheck.Equals, WEBHOOK_CHAR_LIMIT)
+
+	c.Assert(publisher.publish(`today is a "great" day`), gocheck.IsNil)
+	req, body := <-fw.posted, <-fw.bodies
+	c.Assert(req.Method, gocheck.Equals, "POST")
+	c.Assert(req.URL.Path, gocheck.Equals, "/hook")
+	c.Assert(string(body), gocheck.Equals, `{"text": "today is a \"great\" day"}`)
+	c.Assert(req.Header.Get("Content-Type"), gocheck.Equals, "application/json")
+	c.Assert(req.Header.Get("X-Team"), gocheck.Equals, "ebooks")
+	c.Assert(req.Header.Get("Authorization"), gocheck.Equals, "Bearer abc")
+
+	// The endpoint can check the signature with the secret.
+	mac := hmac.New(sha256.New, []byte("hooksecret"))
+	mac.Write(body)
+	c.Assert(req.Header.Get(DEFAULT_SIGNATURE_HEADER), gocheck.Equals, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	publisher = makeTestWebhook(c, makeTestWebhookParams(fw, "discord"))
+	c.Assert(publisher.publish("today is a fine day"), gocheck.IsNil)
+	<-fw.posted
+	c.Assert(string(<-fw.bodies), gocheck.Equals, `{"content": "today is a fine day"}`)
+
+	params := makeTestWebhookParams(fw, `{"msg": {{json .Text}}, "at": {{json .Time}}, "via": "ebooker"}`)
+	params.Webhook.SignatureHeader = "X-Hub-Signature-256"
+	publisher = makeTestWebhook(c, params)
+	c.Assert(publisher.publish("today is a strange day"), gocheck.IsNil)
+	req = <-fw.posted
+	var posted struct {
+		Msg string
+		At  time.Time
+	}
+	c.Assert(json.Unmarshal(<-fw.bodies, &posted), gocheck.IsNil)
+	c.Assert(posted.Msg, gocheck.Equals, "today is a strange day")
+	c.Assert(time.Since(posted.At) < time.Minute, gocheck.Equals, true)
+	c.Assert(req.Header.Get("X-Hub-Signature-256"), gocheck.Matches, "sha256=[0-9a-f]{64}")
+	c.Assert(publisher.params(), gocheck.DeepEquals, params)
+}
+
+// Failures that might pass are tried again; others aren't.
+func (s WebhookSuite) TestWebhookRetry(c *gocheck.C) {
+	tests := []struct {
+		statuses []int
+		attempts int
+		fails    bool
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, 3, false},
+		{[]int{http.StatusBadRequest}, 1, true},
+		{[]int{500, 502, 503, 504}, WEBHOOK_ATTEMPTS, true},
+		{[]int{http.StatusNoContent}, 1, false},
+	}
+	for _, test := range tests {
+		fw := newFakeWebhook(test.statuses...)
+		publisher := makeTestWebhook(c, makeTestWebhookParams(fw, ""))
+		err := publisher.publish("today is a great day")
+		if test.fails {
+			c.Assert(err, gocheck.ErrorMatches, "The webhook said .*")
+		} else {
+			c.Assert(err, gocheck.IsNil)
+		}
+		c.Assert(len(fw.posted), gocheck.Equals, test.attempts)
+		fw.server.Close()
+	}
+
+	// Nobody home.
+	publisher := makeTestWebhook(c, defs.PublisherParams{PUBLISH_WEBHOOK, "", "", "",
+		defs.WebhookParams{"http://127.0.0.1:1/hook", "", nil, ""}})
+	c.Assert(publisher.publish("today is a great day"), gocheck.NotNil)
+
+	// Someone home, who hangs up once they've read the post. It may have got
+	// through, so we don't post it again.
+	var lock sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		attempts++
+		lock.Unlock()
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+	publisher = makeTestWebhook(c, defs.PublisherParams{PUBLISH_WEBHOOK, "", "", "",
+		defs.WebhookParams{server.URL + "/hook", "", nil, ""}})
+	c.Assert(publisher.publish("today is a great day"), gocheck.NotNil)
+	lock.Lock()
+	defer lock.Unlock()
+	c.Assert(attempts, gocheck.Equals, 1)
+}
+
+func (s WebhookSuite) TestNewWebhookPublisher(c *gocheck.C) {
+	logger := logging.GetLogMaster(true, false, false)
+	hook := func(url, template string, headers ...string) defs.PublisherParams {
+		return defs.PublisherParams{PUBLISH_WEBHOOK, "", "", "", defs.WebhookParams{url, template, headers, ""}}
+	}
+
+	params := hook("https://hooks.slack.com/services/T0/B0/x", "")
+	publisher, err := newWebhookPublisher(&params, "hooksecret", &http.Client{}, &logger)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(publisher.params().Webhook.SignatureHeader, gocheck.Equals, DEFAULT_SIGNATURE_HEADER)
+	_, err = newWebhookPublisher(&params, "", &http.Client{}, &logger)
+	c.Assert(err, gocheck.ErrorMatches, ".*secret.*")
+
+	bad := []defs.PublisherParams{hook("", ""),
+		hook("hooks.slack.com/services", ""),
+		hook("https://example.com/hook", `{"text": {{json .Text}`),
+		hook("https://example.com/hook", `{"text": {{.Text}}}`),
+		hook("https://example.com/hook", `{{.Nope}}`),
+		hook("https://example.com/hook", "", "X-Team ebooks"),
+		hook("https://example.com/hook", "", ": ebooks")}
+	for _, params := range bad {
+		_, err = newWebhookPublisher(&params, "hooksecret", &http.Client{}, &logger)
+		c.Assert(err, gocheck.NotNil)
+	}
+}
+
+// A webhook bot posts there, and keeps posting there after a restart.
+func (s WebhookSuite) TestWebhookBot(c *gocheck.C) {
+	fw := newFakeWebhook()
+	defer fw.server.Close()
+	ft := newFakeTwitter()
+	seedFakeTwitter(ft)
+	eb := makeTestEbooker(ft)
+
+	args := defs.NewBotParams{"hook_ebooks", makeTestGenParams("SrPablo"),
+		defs.AuthParams{"hook_ebooks", "hooksecret", ""}, defs.Schedule{""}, makeTestWebhookParams(fw, "discord")}
+	var msg string
+	c.Assert(eb.NewBot(&args, &msg), gocheck.IsNil)
+	bot, _ := eb.bots.get("hook_ebooks")
+	tickAndWait(bot)
+	<-fw.posted
+	c.Assert(string(<-fw.bodies), gocheck.Matches, `\{"content": "today is a (great|fine) day"\}`)
+	c.Assert(eb.shutdown(context.Background()), gocheck.Equals, true)
+
+	restored := newEbooker(eb.logger, eb.data, eb.oauth, ft, DEFAULT_REFRESH_INTERVAL, DEFAULT_MODEL_BUDGET)
+	restored.httpClient.Transport = http.DefaultTransport
+	restored.restoreBots()
+	defer restored.shutdown(context.Background())
+	bot, exists := restored.bots.get("hook_ebooks")
+	c.Assert(exists, gocheck.Equals, true)
+	c.Assert(bot.record().Publish.Webhook.Template, gocheck.Equals, "discord")
+
+	tickAndWait(bot)
+	select {
+	case <-fw.posted:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the restored bot didn't post to the webhook")
+	}
+	c.Assert(len(ft.posted), gocheck.Equals, 0)
+}